@@ -3,7 +3,45 @@ use netchat;
 CREATE TABLE `user` (
                         `id` int NOT NULL AUTO_INCREMENT,
                         `username` varchar(20) DEFAULT NULL,
-                        `password` varchar(20) DEFAULT NULL,
+                        `password` varchar(100) DEFAULT NULL,  -- bcrypt哈希，盐包含在哈希串中
+                        `created_at` datetime DEFAULT CURRENT_TIMESTAMP,  -- 注册时间，旧库迁移前注册的用户为空
                         PRIMARY KEY (`id`),
                         UNIQUE KEY `username` (`username`)
-) ENGINE=InnoDB AUTO_INCREMENT=17 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
\ No newline at end of file
+) ENGINE=InnoDB AUTO_INCREMENT=17 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- 角色：0普通成员 1管理员 2所有者，scope为global或room:房间名
+CREATE TABLE `role` (
+                        `scope` varchar(64) NOT NULL,
+                        `username` varchar(20) NOT NULL,
+                        `role` tinyint NOT NULL DEFAULT 0,
+                        PRIMARY KEY (`scope`,`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- 房间的权限标志
+CREATE TABLE `scope_flag` (
+                              `scope` varchar(64) NOT NULL,
+                              `invite_only` tinyint(1) NOT NULL DEFAULT 0,
+                              `read_only` tinyint(1) NOT NULL DEFAULT 0,
+                              `slow_mode` int NOT NULL DEFAULT 0,  -- 两次发言的最小间隔秒数
+                              PRIMARY KEY (`scope`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- 禁言和封禁，until为空表示永久
+CREATE TABLE `sanction` (
+                            `scope` varchar(64) NOT NULL,
+                            `username` varchar(20) NOT NULL,
+                            `kind` varchar(10) NOT NULL,
+                            `until` datetime DEFAULT NULL,
+                            `operator` varchar(20) DEFAULT NULL,
+                            PRIMARY KEY (`scope`,`username`,`kind`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- 仅限邀请房间的邀请名单
+CREATE TABLE `invite` (
+                          `scope` varchar(64) NOT NULL,
+                          `username` varchar(20) NOT NULL,
+                          PRIMARY KEY (`scope`,`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- 第一个全局所有者需要手动指定，之后可以用/role命令授予管理员
+-- INSERT INTO `role` VALUES ('global','admin',2);
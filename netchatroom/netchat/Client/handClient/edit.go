@@ -0,0 +1,66 @@
+package handClient
+
+import (
+	"fmt"
+	"log"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/message"
+	"strings"
+	"time"
+)
+
+// msgTime 消息时间的显示前缀，没有时间的消息返回空
+func msgTime(msg *common.Message) string {
+	if msg.Time == 0 {
+		return ""
+	}
+	return "[" + time.UnixMilli(msg.Time).Format("15:04:05") + "]"
+}
+
+// parseUpdate 解析/edit和/delete指令，第一个参数是消息ID时修改该消息，否则修改自己在当前房间的最后一条
+// /edit [消息ID] 新内容；/delete [消息ID]
+func parseUpdate(input string) (*common.Message, bool) {
+	cmd, rest, _ := strings.Cut(input, " ")
+	rest = strings.TrimSpace(rest)
+	msg := &common.Message{Type: message.EditMsg}
+	if cmd == "/delete" {
+		msg.Type = message.DeleteMsg
+		if rest != "" && !message.IsMsgID(rest) {
+			return nil, false
+		}
+		msg.ID = rest
+		return msg, true
+	}
+	first, content, _ := strings.Cut(rest, " ")
+	if message.IsMsgID(first) {
+		msg.ID, rest = first, strings.TrimSpace(content)
+	}
+	if rest == "" {
+		return nil, false
+	}
+	msg.Content = rest
+	return msg, true
+}
+
+// receiveUpdate 显示房间消息被编辑或删除的通知
+func receiveUpdate(msg *common.Message) {
+	update := &message.MsgUpdate{}
+	err := message.GetPayload(msg, update)
+	if err != nil {
+		log.Printf("receiveUpdate GetPayload failed,err:%v\n", err)
+		return
+	}
+	prefix := ""
+	if update.Room != common.DefaultRoom {
+		prefix = "[" + update.Room + "]"
+	}
+	by := ""
+	if update.Editor != update.Author {
+		by = "(由" + update.Editor + "操作)"
+	}
+	if update.Deleted {
+		fmt.Printf("[系统消息]%v%v删除了一条消息#%v%v\n", prefix, update.Author, update.ID, by)
+		return
+	}
+	fmt.Printf("->%v%v:%v%v #%v%v\n", prefix, update.Author, update.Content, message.EditedMark, update.ID, by)
+}
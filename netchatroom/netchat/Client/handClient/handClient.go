@@ -12,14 +12,23 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	reader   = bufio.NewReader(os.Stdin)
 	quitChan = make(chan struct{})
+	quitOnce sync.Once
 )
 
+// quit 通知所有协程退出，可以重复调用
+func quit() {
+	quitOnce.Do(func() {
+		close(quitChan)
+	})
+}
+
 // KeyboardInput 键盘输入函数
 func KeyboardInput() (string, error) {
 	msg, err := reader.ReadString('\n')
@@ -92,18 +101,28 @@ func Register(C *common.Client) {
 		if password == "/quit" {
 			break
 		}
-		err = message.SendMsg(C.Conn, &common.Message{
-			Sender:  C,
-			Content: username + "/" + password,
-			Type:    message.Register,
-		})
+		if err = message.ValidateUsername(username); err != nil {
+			fmt.Println(message.CodeText(message.CodeInvalidUsername))
+			continue
+		}
+		if err = message.ValidatePassword(password); err != nil {
+			fmt.Println(message.CodeText(message.CodeWeakPassword))
+			continue
+		}
+		req := &common.Message{Sender: C, Type: message.Register}
+		err = message.SetPayload(req, &message.RegisterRequest{Username: username, Password: password})
+		if err != nil {
+			log.Printf("Register SetPayload failed,err:%v\n", err)
+			continue
+		}
+		err = message.SendMsg(C.Conn, req)
 		if err != nil {
 			var opErr *net.OpError
 			if errors.As(err, &opErr) {
 				s := strings.ToLower(opErr.Err.Error())
 				if strings.Contains(s, "forcibly closed") {
 					fmt.Println("服务器已关闭...")
-					close(quitChan)
+					quit()
 					return
 				}
 			}
@@ -111,16 +130,16 @@ func Register(C *common.Client) {
 			continue
 		}
 
-		receiveMsg, err := message.ReciveMsg(C.Conn)
+		resp, err := ReceiveAuth(C)
 		if err != nil {
-			log.Printf("Register ReciveMsg failed ,err:%v\n", err)
+			log.Printf("Register ReceiveAuth failed ,err:%v\n", err)
 			continue
 		}
-		if receiveMsg.Content == "ok" {
+		if resp.OK() {
 			fmt.Println("注册成功!")
 			return
 		} else {
-			fmt.Println(receiveMsg.Content)
+			fmt.Println(message.CodeText(resp.Code))
 			return
 		}
 	}
@@ -155,74 +174,143 @@ func Login(C *common.Client) bool {
 		if password == "/quit" {
 			return false
 		}
-		err = message.SendMsg(C.Conn, &common.Message{
-			Sender:  C,
-			Content: username + "/" + password,
-			Type:    message.Login,
-		})
+		resp, err := SendLogin(C, username, password)
 		if err != nil {
 			var opErr *net.OpError
 			if errors.As(err, &opErr) {
 				s := strings.ToLower(opErr.Err.Error())
 				if strings.Contains(s, "forcibly closed") {
 					fmt.Println("服务器已关闭...")
-					close(quitChan)
+					quit()
 					return false
 				}
 			}
-			log.Printf("Login SendMsg failed,err:%v\n", err)
+			log.Printf("Login SendLogin failed,err:%v\n", err)
 			continue
 		}
-
-		receiveMsg, err := message.ReciveMsg(C.Conn)
-		if err != nil {
-			log.Printf("Login ReciveMsg failed ,err:%v\n", err)
-			continue
-		}
-		if receiveMsg.Content == "ok" {
+		if resp.OK() {
 			C.UserName = username
+			C.Token = resp.Token
 			fmt.Println("登录成功!")
+			printUnreadCounts(resp.Unread)
 			return true
 		} else {
-			fmt.Println(receiveMsg.Content)
+			fmt.Println(message.CodeText(resp.Code))
 			return false
 		}
 	}
 }
 
-// ClientReceiveMsg 用户循环接收服务端发送的信息
-func ClientReceiveMsg(C *common.Client) {
+// SendLogin 发送登录请求并等待回复
+func SendLogin(C *common.Client, username string, password string) (*message.AuthResponse, error) {
+	req := &common.Message{Sender: C, Type: message.Login}
+	err := message.SetPayload(req, &message.LoginRequest{Username: username, Password: password})
+	if err != nil {
+		return nil, fmt.Errorf("SendLogin SetPayload failed,err:%w", err)
+	}
+	err = message.SendMsg(C.Conn, req)
+	if err != nil {
+		return nil, fmt.Errorf("SendLogin SendMsg failed,err:%w", err)
+	}
+	return ReceiveAuth(C)
+}
+
+// Resume 断线重连后用会话令牌恢复登录，令牌失效或账号被封禁时返回false，
+// 服务端暂时出错等其他失败返回错误，调用方可以稍后重试
+func Resume(C *common.Client) (bool, error) {
+	req := &common.Message{Sender: C, Type: message.Resume}
+	err := message.SetPayload(req, &message.ResumeRequest{Token: C.Token})
+	if err != nil {
+		return false, fmt.Errorf("Resume SetPayload failed,err:%w", err)
+	}
+	err = message.SendMsg(C.Conn, req)
+	if err != nil {
+		return false, fmt.Errorf("Resume SendMsg failed,err:%w", err)
+	}
+	resp, err := ReceiveAuth(C)
+	if err != nil {
+		return false, fmt.Errorf("Resume ReceiveAuth failed,err:%w", err)
+	}
+	switch resp.Code {
+	case message.CodeOK:
+		C.Token = resp.Token
+		return true, nil
+	case message.CodeInvalidToken, message.CodeBanned:
+		C.Token = ""
+		return false, nil
+	}
+	return false, fmt.Errorf("Resume failed,err:%s", message.CodeText(resp.Code))
+}
+
+// ReceiveAuth 接收并解析服务端的登录注册回复
+func ReceiveAuth(C *common.Client) (*message.AuthResponse, error) {
+	receiveMsg, err := message.ReciveMsg(C.Conn)
+	if err != nil {
+		return nil, err
+	}
+	resp := &message.AuthResponse{}
+	err = message.GetPayload(receiveMsg, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// receive 循环接收服务端发送的信息，出错时交给重连流程
+func (m *Manager) receive(conn common.Conn) {
 	for {
-		msg, err := message.ReciveMsg(C.Conn)
+		msg, err := message.ReciveMsg(conn)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				fmt.Println("您已心跳超时，服务端强制踢出...")
-				close(quitChan)
-				return
-			}
-			if strings.Contains(err.Error(), "use of closed network connection") {
+			select {
+			case <-quitChan:
 				return
+			default:
 			}
-			var opErr *net.OpError
-			if errors.As(err, &opErr) {
-				s := strings.ToLower(opErr.Err.Error())
-				if strings.Contains(s, "forcibly closed") {
-					fmt.Println("服务器已关闭...")
-					close(quitChan)
-					return
-				}
+			if !errors.Is(err, io.EOF) && !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("receive ReciveMsg failed,err:%v\n", err)
 			}
-			log.Printf("ClientReceiveMsg ReciveMsg failed,err:%v\n", err)
-			continue
+			m.lost(conn)
+			return
 		}
 		switch msg.Type {
 		case message.HeartMsg:
 			continue
+		case message.CreateRoom, message.JoinRoom:
+			fmt.Println(msg.Content)
+			m.SetRoom(msg.Room)
+		case message.Kicked:
+			//被踢出后不再自动重连
+			fmt.Println(msg.Content)
+			quit()
+		case message.PublicMsg:
+			fmt.Println(msgTime(msg) + msg.Content)
+		case message.PrivateMsg:
+			m.receivePrivate(msg)
+		case message.EditMsg, message.DeleteMsg:
+			receiveUpdate(msg)
+		case message.FetchUnread:
+			m.receiveUnread(msg)
+		case message.ReadReceipt:
+			receiveReadNotice(msg)
+		case message.Typing:
+			m.receiveTyping(msg)
+		case message.Shutdown:
+			//服务端正在关闭，随后连接断开，按断线重连处理
+			fmt.Println(msg.Content)
+		case message.LeaveRoom:
+			fmt.Println(msg.Content)
+			if m.Room() == msg.Room {
+				m.SetRoom(common.DefaultRoom)
+			}
 		case message.CheckRankList:
 			fallthrough
+		case message.ListRooms:
+			fallthrough
 		case message.PublicHistory:
 			fallthrough
 		case message.PrivateHistory:
+			fallthrough
+		case message.Whois:
 			fmt.Print(msg.Content)
 		default:
 			fmt.Println(msg.Content)
@@ -230,24 +318,24 @@ func ClientReceiveMsg(C *common.Client) {
 	}
 }
 
-// SendHeartbeat 心跳检测
-func SendHeartbeat(C *common.Client) {
-	ticker := time.NewTicker(20 * time.Second) // 20秒发送一次
+// heartbeat 心跳检测，断线期间暂停发送
+func (m *Manager) heartbeat() {
+	ticker := time.NewTicker(m.Heartbeat) // 间隔必须小于服务端的心跳超时
 	defer ticker.Stop()
 	for {
 		select {
 		//ticker结构体中有一个C通道
 		case <-ticker.C:
-			// 重置超时
-			err := message.SendMsg(C.Conn, &common.Message{
-				Sender: C,
+			if status, _ := m.Status(); status != StatusConnected {
+				continue
+			}
+			// 重置超时，发送失败会触发重连
+			err := m.Send(&common.Message{
+				Sender: m.C,
 				Type:   message.HeartMsg,
 			})
-			//发送失败就退出心跳，退出客户端
 			if err != nil {
-				log.Printf("SendHeartbeat SendMsg failed,err:%v\n", err)
-				close(quitChan)
-				return
+				log.Printf("heartbeat Send failed,err:%v\n", err)
 			}
 		case <-quitChan:
 			return
@@ -256,10 +344,11 @@ func SendHeartbeat(C *common.Client) {
 }
 
 // HandleClient 登录后主进程
-func HandleClient(C *common.Client) {
+func HandleClient(m *Manager) {
+	C := m.C
 	fmt.Println("-------欢迎加入聊天室-------")
 	fmt.Println("-----输入/help查看所有指令-----")
-	go ClientReceiveMsg(C)
+	m.Start()
 
 	inputChan := make(chan string, 10)
 	go func() {
@@ -282,28 +371,103 @@ func HandleClient(C *common.Client) {
 			case input == "/help":
 				fmt.Println("/quit--退出聊天室")
 				fmt.Println("/checkUser--查看在线用户")
+				fmt.Println("/setStatus online|away|busy|invisible [说明]--设置在线状态")
+				fmt.Println("/whois 用户名--查看用户资料")
 				fmt.Println("/chat 用户名:消息--私聊用户")
-				fmt.Println("/history n--查看n条群聊历史消息")
+				fmt.Println("/history n--查看当前房间的n条历史消息")
 				fmt.Println("/history n 用户名--查看与该用户的n条私聊历史消息")
-				fmt.Println("/checkRankList--查看活跃度排行榜")
+				fmt.Println("/unread [用户名]--查看未读私聊，默认为全部会话")
+				fmt.Println("/edit [消息ID] 新内容--编辑当前房间的消息，默认为自己的最后一条")
+				fmt.Println("/delete [消息ID]--删除当前房间的消息，默认为自己的最后一条")
+				fmt.Println("/checkRankList--查看当前房间的活跃度排行榜")
+				fmt.Println("/rooms--查看所有房间")
+				fmt.Println("/create 房间名--创建房间")
+				fmt.Println("/join 房间名--加入房间")
+				fmt.Println("/leave [房间名]--离开房间，默认为当前房间")
+				fmt.Println("/switch 房间名--切换当前发言的房间")
+				fmt.Println("/status--查看连接状态")
+				fmt.Println("/reconnect--离线后手动重连")
+				fmt.Println("/login--会话过期后重新输入密码登录")
+				fmt.Println("以下管理指令作用于当前房间，需要管理员权限:")
+				fmt.Println("/kick 用户名--踢出用户")
+				fmt.Println("/mute 用户名 [分钟]--禁言用户，默认10分钟，0为永久")
+				fmt.Println("/unmute 用户名--解除禁言")
+				fmt.Println("/ban 用户名--封禁用户")
+				fmt.Println("/unban 用户名--解除封禁")
+				fmt.Println("/role 用户名 member|moderator--设置用户角色")
+				fmt.Println("/invite 用户名--邀请用户加入仅限邀请的房间")
+				fmt.Println("/flag invite|readonly true|false--设置仅限邀请或只读")
+				fmt.Println("/flag slow 秒数--设置慢速模式，0为关闭")
+			case input == "/status":
+				fmt.Println(m.StatusLine())
+			case input == "/reconnect":
+				m.Reconnect()
+			case input == "/login":
+				fmt.Println("请输入密码:")
+				password, err := KeyboardInput()
+				if err != nil {
+					log.Printf("HandleClient login KeyboardInput failed,err:%v\n", err)
+					continue
+				}
+				err = m.Login(password)
+				if err != nil {
+					fmt.Printf("重新登录失败:%v\n", err)
+					continue
+				}
+				fmt.Println("登录成功!")
 			case input == "/quit":
-				err := message.SendMsg(C.Conn, &common.Message{
+				m.flushReads()
+				err := m.Send(&common.Message{
 					Sender: C,
 					Type:   message.Quit,
 				})
 				if err != nil {
 					log.Printf("HandleClient sendMsg quit failed,err:%v\n", err)
 				}
-				close(quitChan)
+				quit()
 				return
 			case input == "/checkUser":
-				err := message.SendMsg(C.Conn, &common.Message{
+				err := m.Send(&common.Message{
 					Sender: C,
 					Type:   message.CheckUser,
 				})
 				if err != nil {
 					log.Printf("HandleClient sendMsg checkUser failed,err:%v\n", err)
 				}
+			case strings.HasPrefix(input, "/setStatus "):
+				status, text, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(input, "/setStatus ")), " ")
+				req := &message.StatusRequest{Status: status, Text: strings.TrimSpace(text)}
+				if !message.ValidateStatus(req) {
+					fmt.Printf("状态格式错误，说明不超过%d字，请重新输入...\n", message.StatusTextMaxLen)
+					continue
+				}
+				msg := &common.Message{
+					Sender: C,
+					Type:   message.SetStatus,
+				}
+				err := message.SetPayload(msg, req)
+				if err != nil {
+					log.Printf("HandleClient SetPayload status failed,err:%v\n", err)
+					continue
+				}
+				err = m.Send(msg)
+				if err != nil {
+					log.Printf("HandleClient sendMsg setStatus failed,err:%v\n", err)
+				}
+			case strings.HasPrefix(input, "/whois "):
+				username := strings.TrimSpace(strings.TrimPrefix(input, "/whois "))
+				if username == "" {
+					fmt.Println("查看用户资料格式错误，请重新输入...")
+					continue
+				}
+				err := m.Send(&common.Message{
+					Sender: C,
+					Type:   message.Whois,
+					To:     username,
+				})
+				if err != nil {
+					log.Printf("HandleClient sendMsg whois failed,err:%v\n", err)
+				}
 			case strings.HasPrefix(input, "/chat"):
 				result := strings.SplitN(input, " ", 2)
 				if len(result) != 2 {
@@ -320,7 +484,7 @@ func HandleClient(C *common.Client) {
 					continue
 				}
 				//发送给服务端
-				err := message.SendMsg(C.Conn, &common.Message{
+				err := m.Send(&common.Message{
 					Sender:  C,
 					Type:    message.PrivateMsg,
 					Content: result2[1],
@@ -332,10 +496,11 @@ func HandleClient(C *common.Client) {
 			case strings.HasPrefix(input, "/history"):
 				result := strings.SplitN(input, " ", 3)
 				if len(result) == 2 {
-					err := message.SendMsg(C.Conn, &common.Message{
+					err := m.Send(&common.Message{
 						Sender:  C,
 						Type:    message.PublicHistory,
 						Content: result[1],
+						Room:    m.Room(),
 					})
 					if err != nil {
 						log.Printf("HandleClient sendMsg PublicHistory failed,err:%v\n", err)
@@ -345,7 +510,7 @@ func HandleClient(C *common.Client) {
 						fmt.Println("查看历史信息格式有误，请重新输入...")
 						continue
 					}
-					err := message.SendMsg(C.Conn, &common.Message{
+					err := m.Send(&common.Message{
 						Sender:  C,
 						Type:    message.PrivateHistory,
 						Content: result[1],
@@ -357,23 +522,112 @@ func HandleClient(C *common.Client) {
 				} else {
 					fmt.Println("查看历史信息格式有误，请重新输入...")
 				}
+			case input == "/unread", strings.HasPrefix(input, "/unread "):
+				err := m.Send(&common.Message{
+					Sender: C,
+					Type:   message.FetchUnread,
+					To:     strings.TrimSpace(strings.TrimPrefix(input, "/unread")),
+				})
+				if err != nil {
+					log.Printf("HandleClient sendMsg unread failed,err:%v\n", err)
+				}
 			case input == "/checkRankList":
-				err := message.SendMsg(C.Conn, &common.Message{
+				err := m.Send(&common.Message{
 					Sender: C,
 					Type:   message.CheckRankList,
+					Room:   m.Room(),
 				})
 				if err != nil {
 					log.Printf("HandleClient sendMsg checkRankList failed,err:%v\n", err)
 				}
+			case input == "/rooms":
+				err := m.Send(&common.Message{
+					Sender: C,
+					Type:   message.ListRooms,
+				})
+				if err != nil {
+					log.Printf("HandleClient sendMsg rooms failed,err:%v\n", err)
+				}
+			case strings.HasPrefix(input, "/create "), strings.HasPrefix(input, "/join "):
+				cmd, room, _ := strings.Cut(input, " ")
+				room = strings.TrimSpace(room)
+				if err := message.ValidateRoomName(room); err != nil {
+					fmt.Println("房间名格式错误，请重新输入...")
+					continue
+				}
+				typ := message.JoinRoom
+				if cmd == "/create" {
+					typ = message.CreateRoom
+				}
+				err := m.Send(&common.Message{
+					Sender:  C,
+					Type:    typ,
+					Content: room,
+				})
+				if err != nil {
+					log.Printf("HandleClient sendMsg %v failed,err:%v\n", cmd, err)
+				}
+			case input == "/leave", strings.HasPrefix(input, "/leave "):
+				room := strings.TrimSpace(strings.TrimPrefix(input, "/leave"))
+				if room == "" {
+					room = m.Room()
+				}
+				err := m.Send(&common.Message{
+					Sender:  C,
+					Type:    message.LeaveRoom,
+					Content: room,
+				})
+				if err != nil {
+					log.Printf("HandleClient sendMsg leave failed,err:%v\n", err)
+				}
+			case strings.HasPrefix(input, "/switch "):
+				room := strings.TrimSpace(strings.TrimPrefix(input, "/switch "))
+				if err := message.ValidateRoomName(room); err != nil {
+					fmt.Println("房间名格式错误，请重新输入...")
+					continue
+				}
+				m.SetRoom(room)
+			case input == "/delete", strings.HasPrefix(input, "/delete "), strings.HasPrefix(input, "/edit "):
+				msg, ok := parseUpdate(input)
+				if !ok {
+					fmt.Println("编辑或删除指令格式错误，请重新输入...")
+					continue
+				}
+				msg.Sender, msg.Room = C, m.Room()
+				err := m.Send(msg)
+				if err != nil {
+					log.Printf("HandleClient sendMsg update failed,err:%v\n", err)
+				}
+			case isModerateCommand(input):
+				req := parseModerate(input)
+				if req == nil {
+					fmt.Println("管理指令格式错误，输入/help查看用法...")
+					continue
+				}
+				msg := &common.Message{
+					Sender: C,
+					Type:   message.Moderate,
+					Room:   m.Room(),
+				}
+				err := message.SetPayload(msg, req)
+				if err != nil {
+					log.Printf("HandleClient SetPayload moderate failed,err:%v\n", err)
+					continue
+				}
+				err = m.Send(msg)
+				if err != nil {
+					log.Printf("HandleClient sendMsg moderate failed,err:%v\n", err)
+				}
 			case strings.HasPrefix(input, "/"):
 				fmt.Println("指令输入错误，请检查输入...")
 			case input == "":
 				fmt.Println("输入内容不能为空...")
 			default:
-				err := message.SendMsg(C.Conn, &common.Message{
+				err := m.Send(&common.Message{
 					Sender:  C,
 					Type:    message.PublicMsg,
 					Content: input,
+					Room:    m.Room(),
 				})
 				if err != nil {
 					log.Printf("HandleClient SendMsg input failed,err:%v\n", err)
@@ -0,0 +1,119 @@
+package handClient
+
+import (
+	"fmt"
+	"log"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/message"
+	"strings"
+	"time"
+)
+
+// ReadReceiptDelay 收到私聊后等待这么久再发送已读回执，期间同一会话的多条私聊合并为一次回执
+const ReadReceiptDelay = 2 * time.Second
+
+// printUnreadCounts 登录后提示离线期间的未读私聊
+func printUnreadCounts(counts []message.UnreadCount) {
+	if len(counts) == 0 {
+		return
+	}
+	total := 0
+	parts := make([]string, 0, len(counts))
+	for _, c := range counts {
+		total += c.Count
+		parts = append(parts, fmt.Sprintf("%v(%d)", c.From, c.Count))
+	}
+	fmt.Printf("你有%d条未读私聊:%v，输入/unread查看\n", total, strings.Join(parts, " "))
+}
+
+// sendRead 发送已读回执，id为空时标记到最新一条
+func (m *Manager) sendRead(peer string, id string) {
+	msg := &common.Message{
+		Sender: m.C,
+		Type:   message.ReadReceipt,
+	}
+	err := message.SetPayload(msg, &message.ReadRequest{Peer: peer, ID: id})
+	if err != nil {
+		log.Printf("sendRead SetPayload failed,err:%v\n", err)
+		return
+	}
+	err = m.Send(msg)
+	if err != nil {
+		log.Printf("sendRead Send failed,err:%v\n", err)
+	}
+}
+
+// markRead 记录与peer的会话已读到id，ReadReceiptDelay后与其他会话一起发送
+func (m *Manager) markRead(peer string, id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads[peer] = id
+	if m.readTimer == nil {
+		m.readTimer = time.AfterFunc(ReadReceiptDelay, m.flushReads)
+	}
+}
+
+// flushReads 立即发送所有还没发送的已读回执，每个会话一次
+func (m *Manager) flushReads() {
+	m.mu.Lock()
+	reads := m.reads
+	m.reads = make(map[string]string)
+	if m.readTimer != nil {
+		m.readTimer.Stop()
+		m.readTimer = nil
+	}
+	m.mu.Unlock()
+	for peer, id := range reads {
+		m.sendRead(peer, id)
+	}
+}
+
+// receivePrivate 显示收到的私聊，显示后即视为已读到这一条，连续收到的私聊合并发送一次回执
+func (m *Manager) receivePrivate(msg *common.Message) {
+	fmt.Println(msgTime(msg) + msg.Content)
+	if msg.Sender != nil && msg.Sender.UserName != "" {
+		m.markRead(msg.Sender.UserName, msg.ID)
+	}
+}
+
+// receiveUnread 显示拉取到的未读私聊，并把每个会话标记为已读到显示的最后一条
+func (m *Manager) receiveUnread(msg *common.Message) {
+	resp := &message.UnreadResponse{}
+	err := message.GetPayload(msg, resp)
+	if err != nil {
+		log.Printf("receiveUnread GetPayload failed,err:%v\n", err)
+		return
+	}
+	if len(resp.Messages) == 0 {
+		fmt.Println("没有未读私聊")
+		return
+	}
+	fmt.Println("-------未读私聊-------")
+	last := make(map[string]string)
+	var peers []string
+	for _, u := range resp.Messages {
+		fmt.Printf("->%v私聊你:%v\n", u.From, u.Content)
+		if _, ok := last[u.From]; !ok {
+			peers = append(peers, u.From)
+		}
+		last[u.From] = u.ID
+	}
+	if resp.More {
+		fmt.Println("还有更多未读私聊，请再次输入/unread查看")
+	}
+	fmt.Println("----------------------")
+	for _, peer := range peers {
+		m.sendRead(peer, last[peer])
+	}
+}
+
+// receiveReadNotice 显示对方已读的提示
+func receiveReadNotice(msg *common.Message) {
+	notice := &message.ReadNotice{}
+	err := message.GetPayload(msg, notice)
+	if err != nil {
+		log.Printf("receiveReadNotice GetPayload failed,err:%v\n", err)
+		return
+	}
+	fmt.Printf("[已读]%v已读你的%d条私聊\n", notice.Reader, notice.Count)
+}
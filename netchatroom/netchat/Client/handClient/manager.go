@@ -0,0 +1,421 @@
+package handClient
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/message"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 连接状态
+const (
+	StatusConnected = iota
+	StatusReconnecting
+	StatusOffline
+)
+
+var statusTexts = map[int]string{
+	StatusConnected:    "已连接",
+	StatusReconnecting: "重连中",
+	StatusOffline:      "离线",
+}
+
+const (
+	MaxQueueLen       = 100                    // 离线发送队列的最大长度
+	MaxReconnectTimes = 10                     // 连续重连失败多少次后进入离线状态
+	BackoffBase       = 500 * time.Millisecond // 第一次重连前的等待时间
+	BackoffMax        = 30 * time.Second       // 重连等待时间上限
+	DialTimeout       = 3 * time.Second
+)
+
+// ErrSessionExpired 会话令牌已失效或账号被封禁，不能自动恢复登录，需要用/login重新输入密码登录
+var ErrSessionExpired = errors.New("session expired")
+
+// Manager 管理与服务端的连接，断线后按指数退避自动重连，
+// 断线期间的公聊和私聊消息缓存在有界队列中，重新登录后补发
+type Manager struct {
+	Addr      string
+	Heartbeat time.Duration // 心跳发送间隔
+	TLS       *tls.Config   // 非空时使用TLS连接服务端
+	C         *common.Client
+
+	mu      sync.Mutex
+	status  int
+	room    string // 当前所在房间，公聊消息发往该房间
+	queue   []*common.Message
+	typing  map[string]time.Time // 正在输入的用户，显示文本 -> 过期时间
+	wake    chan struct{}        // 离线状态下手动触发重连
+	expired bool                 // 会话已过期，等待用/login重新登录
+
+	reads     map[string]string // 还没有发送已读回执的会话，对方用户名 -> 已读到的消息ID
+	readTimer *time.Timer       // 到期后合并发送reads中的已读回执
+}
+
+// NewManager 按配置创建连接管理器
+func NewManager(cfg *config.ClientConfig) *Manager {
+	return &Manager{
+		Addr:      cfg.Server,
+		Heartbeat: cfg.Heartbeat,
+		C:         &common.Client{},
+		room:      common.DefaultRoom,
+		typing:    make(map[string]time.Time),
+		reads:     make(map[string]string),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Dial 连接服务端并完成握手
+func (m *Manager) Dial() (common.Conn, error) {
+	var conn net.Conn
+	var err error
+	if m.TLS != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: DialTimeout}, "tcp", m.Addr, m.TLS)
+	} else {
+		conn, err = net.DialTimeout("tcp", m.Addr, DialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	//握手协商协议版本和编解码器
+	codecConn, err := message.ClientHandshake(conn, message.CodecNames)
+	if err != nil {
+		closeErr := conn.Close()
+		if closeErr != nil {
+			log.Printf("Dial conn.Close failed,err:%v\n", closeErr)
+		}
+		return nil, fmt.Errorf("ClientHandshake failed,err:%w", err)
+	}
+	return codecConn, nil
+}
+
+// Connect 首次连接服务端
+func (m *Manager) Connect() error {
+	conn, err := m.Dial()
+	if err != nil {
+		return err
+	}
+	m.C.Conn = conn
+	return nil
+}
+
+// Start 登录成功后启动接收和心跳协程
+func (m *Manager) Start() {
+	m.setStatus(StatusConnected)
+	go m.receive(m.C.Conn)
+	go m.heartbeat()
+}
+
+// Status 返回当前连接状态和离线队列长度
+func (m *Manager) Status() (int, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status, len(m.queue)
+}
+
+// Room 返回当前房间
+func (m *Manager) Room() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.room
+}
+
+// SetRoom 切换当前房间
+func (m *Manager) SetRoom(room string) {
+	m.mu.Lock()
+	m.room = room
+	m.mu.Unlock()
+	fmt.Println(m.StatusLine())
+}
+
+// StatusLine 状态栏文本
+func (m *Manager) StatusLine() string {
+	status, queued := m.Status()
+	line := "[状态]" + statusTexts[status] + " 房间:" + m.Room()
+	if queued > 0 {
+		line += fmt.Sprintf("，%d条消息待发送", queued)
+	}
+	if typing := m.Typing(); len(typing) > 0 {
+		line += " " + strings.Join(typing, "、") + "正在输入..."
+	}
+	return line
+}
+
+// Typing 返回正在输入的用户，过期的不再显示
+func (m *Manager) Typing() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var res []string
+	for who, expire := range m.typing {
+		if now.After(expire) {
+			delete(m.typing, who)
+			continue
+		}
+		res = append(res, who)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// receiveTyping 记录正在输入的用户，新出现的用户刷新状态栏，持续输入的只延长显示时间。
+// 终端按行读取输入，看不到按键，只显示WebSocket等其他客户端发来的输入事件
+func (m *Manager) receiveTyping(msg *common.Message) {
+	if msg.Sender == nil {
+		return
+	}
+	who := msg.Sender.UserName
+	if msg.To != "" {
+		who += "(私聊)"
+	} else if msg.Room != m.Room() {
+		who += "(" + msg.Room + ")"
+	}
+	m.mu.Lock()
+	expire, ok := m.typing[who]
+	shown := ok && time.Now().Before(expire)
+	m.typing[who] = time.Now().Add(message.TypingTTL)
+	m.mu.Unlock()
+	if !shown {
+		fmt.Println(m.StatusLine())
+	}
+}
+
+func (m *Manager) setStatus(status int) {
+	m.mu.Lock()
+	changed := m.status != status
+	m.status = status
+	m.mu.Unlock()
+	if changed {
+		fmt.Println(m.StatusLine())
+	}
+}
+
+// Send 发送消息，断线时公聊和私聊消息进入离线队列；
+// 发送失败时公聊和私聊消息同样进入离线队列，并返回发送的错误
+func (m *Manager) Send(msg *common.Message) error {
+	m.mu.Lock()
+	if m.status != StatusConnected {
+		defer m.mu.Unlock()
+		if msg.Type != message.PublicMsg && msg.Type != message.PrivateMsg {
+			return fmt.Errorf("当前%s，指令未发送", statusTexts[m.status])
+		}
+		m.enqueue(msg)
+		return nil
+	}
+	conn := m.C.Conn
+	m.mu.Unlock()
+
+	err := message.SendMsg(conn, msg)
+	if err != nil {
+		m.mu.Lock()
+		if msg.Type == message.PublicMsg || msg.Type == message.PrivateMsg {
+			m.enqueue(msg)
+		}
+		m.mu.Unlock()
+		m.lost(conn)
+		return fmt.Errorf("Send SendMsg failed,err:%w", err)
+	}
+	return nil
+}
+
+// enqueue 加入离线队列，队列满时丢弃最早的消息，调用方需持有锁
+func (m *Manager) enqueue(msg *common.Message) {
+	if len(m.queue) >= MaxQueueLen {
+		fmt.Println("离线队列已满，最早的一条消息被丢弃")
+		m.queue = m.queue[1:]
+	}
+	m.queue = append(m.queue, msg)
+}
+
+// Reconnect 离线状态下手动重试，会话过期时只能用/login重新登录
+func (m *Manager) Reconnect() {
+	m.mu.Lock()
+	expired := m.expired
+	m.mu.Unlock()
+	if expired {
+		fmt.Println("会话已过期，请输入/login重新登录")
+		return
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// lost 连接断开，只有当前连接断开才触发重连，避免重复
+func (m *Manager) lost(conn common.Conn) {
+	m.mu.Lock()
+	if m.C.Conn != conn || m.status != StatusConnected {
+		m.mu.Unlock()
+		return
+	}
+	m.status = StatusReconnecting
+	m.mu.Unlock()
+	fmt.Println(m.StatusLine())
+	err := conn.Close()
+	if err != nil {
+		log.Printf("lost conn.Close failed,err:%v\n", err)
+	}
+	go m.reconnect()
+}
+
+// reconnect 按指数退避加随机抖动重连，成功后恢复会话并补发离线队列
+func (m *Manager) reconnect() {
+	for {
+		for attempt := 0; attempt < MaxReconnectTimes; attempt++ {
+			select {
+			case <-quitChan:
+				return
+			case <-time.After(backoff(attempt)):
+			}
+			conn, err := m.Dial()
+			if err != nil {
+				log.Printf("reconnect Dial failed,err:%v\n", err)
+				continue
+			}
+			err = m.relogin(conn)
+			if err != nil {
+				log.Printf("reconnect relogin failed,err:%v\n", err)
+				closeErr := conn.Close()
+				if closeErr != nil {
+					log.Printf("reconnect conn.Close failed,err:%v\n", closeErr)
+				}
+				//令牌失效后再重连也无法恢复，等待用户输入密码重新登录，离线队列保留到登录成功后补发
+				if errors.Is(err, ErrSessionExpired) {
+					m.mu.Lock()
+					m.expired = true
+					m.mu.Unlock()
+					m.setStatus(StatusOffline)
+					fmt.Println("会话已过期，请输入/login重新登录，离线消息会在登录后补发")
+					return
+				}
+				continue
+			}
+			err = m.resumed(conn)
+			if err != nil {
+				log.Printf("reconnect resumed failed,err:%v\n", err)
+				continue
+			}
+			return
+		}
+		m.setStatus(StatusOffline)
+		fmt.Println("重连失败，输入/reconnect重试")
+		select {
+		case <-quitChan:
+			return
+		case <-m.wake:
+			m.setStatus(StatusReconnecting)
+		}
+	}
+}
+
+// relogin 在新连接上用会话令牌恢复登录，客户端不保存密码，令牌失效时返回ErrSessionExpired
+func (m *Manager) relogin(conn common.Conn) error {
+	C := &common.Client{UserName: m.C.UserName, Conn: conn, Token: m.C.Token}
+	if C.Token == "" {
+		return ErrSessionExpired
+	}
+	ok, err := Resume(C)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrSessionExpired
+	}
+	m.C.Token = C.Token
+	return nil
+}
+
+// Login 会话过期后在新连接上用密码重新登录，成功后补发离线队列
+func (m *Manager) Login(password string) error {
+	m.mu.Lock()
+	expired := m.expired
+	m.mu.Unlock()
+	if !expired {
+		return errors.New("会话未过期，不需要重新登录")
+	}
+	conn, err := m.Dial()
+	if err != nil {
+		return fmt.Errorf("Dial failed,err:%w", err)
+	}
+	C := &common.Client{UserName: m.C.UserName, Conn: conn}
+	resp, err := SendLogin(C, C.UserName, password)
+	if err == nil && !resp.OK() {
+		err = fmt.Errorf("%s", message.CodeText(resp.Code))
+	}
+	if err != nil {
+		closeErr := conn.Close()
+		if closeErr != nil {
+			log.Printf("Login conn.Close failed,err:%v\n", closeErr)
+		}
+		return err
+	}
+	m.mu.Lock()
+	m.C.Token = resp.Token
+	m.expired = false
+	m.mu.Unlock()
+	printUnreadCounts(resp.Unread)
+	err = m.resumed(conn)
+	if err != nil {
+		//补发时又断线，按普通断线重连
+		m.setStatus(StatusReconnecting)
+		go m.reconnect()
+	}
+	return nil
+}
+
+// resumed 新连接登录成功后先按顺序补发离线队列，队列清空后才切换为已连接，
+// 补发期间输入的消息继续排在队尾，不会先于更早的离线消息发出
+func (m *Manager) resumed(conn common.Conn) error {
+	m.mu.Lock()
+	m.C.Conn = conn
+	queued := len(m.queue)
+	m.mu.Unlock()
+	//状态还不是已连接，这期间连接断开不会触发新的重连，由调用方继续重连
+	go m.receive(conn)
+	if queued > 0 {
+		fmt.Printf("正在补发%d条离线消息...\n", queued)
+	}
+	for {
+		m.mu.Lock()
+		//检查队列和切换状态在同一次加锁中完成，之后的消息直接发送
+		if len(m.queue) == 0 {
+			m.status = StatusConnected
+			m.mu.Unlock()
+			break
+		}
+		msg := m.queue[0]
+		m.queue = m.queue[1:]
+		m.mu.Unlock()
+		err := message.SendMsg(conn, msg)
+		if err != nil {
+			m.mu.Lock()
+			m.queue = append([]*common.Message{msg}, m.queue...)
+			m.mu.Unlock()
+			closeErr := conn.Close()
+			if closeErr != nil {
+				log.Printf("resumed conn.Close failed,err:%v\n", closeErr)
+			}
+			return fmt.Errorf("SendMsg failed,err:%w", err)
+		}
+	}
+	fmt.Println(m.StatusLine())
+	return nil
+}
+
+// backoff 第attempt次重连前的等待时间，在[d/2,d)之间随机抖动
+func backoff(attempt int) time.Duration {
+	d := BackoffBase << attempt
+	if d > BackoffMax || d <= 0 {
+		d = BackoffMax
+	}
+	return d/2 + rand.N(d/2)
+}
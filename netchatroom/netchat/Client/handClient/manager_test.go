@@ -0,0 +1,185 @@
+package handClient
+
+import (
+	"errors"
+	"net"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/message"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn 记录写出的消息，onWrite在每次写之前调用，返回错误时写失败
+type fakeConn struct {
+	mu      sync.Mutex
+	written []string
+	onWrite func(n int) error
+}
+
+// ReadMsg 一直阻塞，接收协程不会因为读失败而触发重连
+func (c *fakeConn) ReadMsg() (*common.Message, error) { select {} }
+
+func (c *fakeConn) WriteMsg(msg *common.Message) error {
+	c.mu.Lock()
+	n := len(c.written)
+	c.mu.Unlock()
+	if c.onWrite != nil {
+		if err := c.onWrite(n); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written = append(c.written, msg.Content)
+	return nil
+}
+
+func (c *fakeConn) Written() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.written...)
+}
+
+func (c *fakeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *fakeConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *fakeConn) Close() error                     { return nil }
+
+// newTestManager 创建处于给定状态的连接管理器
+func newTestManager(status int) *Manager {
+	m := NewManager(&config.ClientConfig{Heartbeat: time.Hour})
+	m.status = status
+	return m
+}
+
+func say(content string) *common.Message {
+	return &common.Message{Type: message.PublicMsg, Content: content}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := range 70 {
+		d := BackoffBase << attempt
+		if d > BackoffMax || d <= 0 {
+			d = BackoffMax
+		}
+		for range 20 {
+			got := backoff(attempt)
+			if got < d/2 || got >= d {
+				t.Fatalf("backoff(%d) = %v, want [%v,%v)", attempt, got, d/2, d)
+			}
+		}
+	}
+}
+
+func TestQueueDropsOldest(t *testing.T) {
+	m := newTestManager(StatusReconnecting)
+	for i := range MaxQueueLen + 5 {
+		if err := m.Send(say(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, queued := m.Status(); queued != MaxQueueLen {
+		t.Fatalf("queued = %d, want %d", queued, MaxQueueLen)
+	}
+	if m.queue[0].Content != "5" || m.queue[MaxQueueLen-1].Content != strconv.Itoa(MaxQueueLen+4) {
+		t.Fatalf("queue = %v ... %v", m.queue[0].Content, m.queue[MaxQueueLen-1].Content)
+	}
+	//断线时指令不进队列，直接返回错误
+	if err := m.Send(&common.Message{Type: message.CheckUser}); err == nil {
+		t.Fatal("command sent while reconnecting")
+	}
+}
+
+func TestResumedReplaysInOrder(t *testing.T) {
+	m := newTestManager(StatusReconnecting)
+	for i := range 3 {
+		if err := m.Send(say(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn := &fakeConn{}
+	conn.onWrite = func(n int) error {
+		//补发过程中用户输入的消息排在更早的离线消息之后
+		if n == 0 {
+			if err := m.Send(say("late")); err != nil {
+				t.Error(err)
+			}
+		}
+		return nil
+	}
+	if err := m.resumed(conn); err != nil {
+		t.Fatal(err)
+	}
+	if status, queued := m.Status(); status != StatusConnected || queued != 0 {
+		t.Fatalf("status = %d, queued = %d", status, queued)
+	}
+	if err := m.Send(say("after")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"0", "1", "2", "late", "after"}
+	got := conn.Written()
+	if len(got) != len(want) {
+		t.Fatalf("written = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("written = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestResumedKeepsQueueOnFailure(t *testing.T) {
+	m := newTestManager(StatusReconnecting)
+	for i := range 3 {
+		if err := m.Send(say(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn := &fakeConn{onWrite: func(n int) error {
+		if n == 1 {
+			return errors.New("broken pipe")
+		}
+		return nil
+	}}
+	if err := m.resumed(conn); err == nil {
+		t.Fatal("resumed succeeded on a broken connection")
+	}
+	//没发出去的消息留在队列开头，下次连接成功后按原顺序补发
+	if status, queued := m.Status(); status != StatusReconnecting || queued != 2 || m.queue[0].Content != "1" {
+		t.Fatalf("status = %d, queued = %d, head = %v", status, queued, m.queue[0].Content)
+	}
+}
+
+func TestReadReceiptsBatched(t *testing.T) {
+	m := newTestManager(StatusConnected)
+	conn := &fakeConn{}
+	m.C.Conn = conn
+	for i := range 5 {
+		m.receivePrivate(&common.Message{Sender: &common.Client{UserName: "alice"}, ID: strconv.Itoa(i+1) + "-0"})
+	}
+	m.receivePrivate(&common.Message{Sender: &common.Client{UserName: "bob"}, ID: "9-0"})
+	if got := conn.Written(); len(got) != 0 {
+		t.Fatalf("receipts sent before the delay: %q", got)
+	}
+	m.flushReads()
+	//每个会话只发一次，标记到最后一条
+	got := map[string]string{}
+	for _, content := range conn.Written() {
+		req := &message.ReadRequest{}
+		if err := message.GetPayload(&common.Message{Content: content}, req); err != nil {
+			t.Fatal(err)
+		}
+		got[req.Peer] = req.ID
+	}
+	if len(conn.Written()) != 2 || got["alice"] != "5-0" || got["bob"] != "9-0" {
+		t.Fatalf("receipts = %q", conn.Written())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readTimer != nil || len(m.reads) != 0 {
+		t.Fatalf("pending receipts after flush: %v", m.reads)
+	}
+}
@@ -0,0 +1,51 @@
+package handClient
+
+import (
+	"netchatroom/netchat/message"
+	"strings"
+)
+
+// moderateCommands 管理指令对应的操作，以及除目标用户外最多还能带几个参数
+var moderateCommands = map[string]struct {
+	action string
+	args   int
+}{
+	"/kick":   {message.ActionKick, 0},
+	"/mute":   {message.ActionMute, 1},
+	"/unmute": {message.ActionUnmute, 0},
+	"/ban":    {message.ActionBan, 0},
+	"/unban":  {message.ActionUnban, 0},
+	"/role":   {message.ActionRole, 1},
+	"/invite": {message.ActionInvite, 0},
+}
+
+// isModerateCommand 判断输入是否为管理指令
+func isModerateCommand(input string) bool {
+	cmd, _, _ := strings.Cut(input, " ")
+	_, ok := moderateCommands[cmd]
+	return ok || cmd == "/flag"
+}
+
+// parseModerate 解析管理指令，格式错误时返回nil
+// /flag 标志名 值；其余为 /指令 用户名 [参数]
+func parseModerate(input string) *message.ModerateRequest {
+	fields := strings.Fields(input)
+	if fields[0] == "/flag" {
+		if len(fields) != 3 {
+			return nil
+		}
+		return &message.ModerateRequest{Action: message.ActionFlag, Arg: fields[1] + " " + fields[2]}
+	}
+	cmd := moderateCommands[fields[0]]
+	if len(fields) < 2 || len(fields) > 2+cmd.args {
+		return nil
+	}
+	req := &message.ModerateRequest{Action: cmd.action, Target: fields[1]}
+	if len(fields) == 3 {
+		req.Arg = fields[2]
+	}
+	if req.Action == message.ActionRole && req.Arg == "" {
+		return nil
+	}
+	return req
+}
@@ -5,15 +5,29 @@ import (
 	"log"
 	"net"
 	"netchatroom/netchat/Client/handClient"
-	"netchatroom/netchat/common"
-	"time"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/utils"
+	"os"
+	"strings"
 )
 
 func main() {
-	//go项目登入服务器
-	conn, err := net.DialTimeout("tcp", "0.0.0.0:8888", 3*time.Second)
-	////部署docker后项目登入服务器
-	//conn, err := net.DialTimeout("tcp", "netchat-server:8888", 3*time.Second)
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Printf("config.Load failed,err:%v\n", err)
+		return
+	}
+	utils.SetMaxFrameSize(uint32(cfg.Client.MaxFrameSize))
+	m := handClient.NewManager(&cfg.Client)
+	if cfg.Client.TLS.Enable {
+		t := cfg.Client.TLS
+		m.TLS, err = utils.ClientTLS(t.CA, t.Cert, t.Key, t.ServerName)
+		if err != nil {
+			log.Printf("ClientTLS failed,err:%v\n", err)
+			return
+		}
+	}
+	err = m.Connect()
 	if err != nil {
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 			fmt.Println("连接超时...")
@@ -23,15 +37,13 @@ func main() {
 		return
 	}
 	defer func() {
-		err = conn.Close()
-		if err != nil {
+		err = m.C.Conn.Close()
+		if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
 			log.Printf("C.Conn.Close failed,err:%v\n", err)
 		}
 	}()
 
-	C := &common.Client{Conn: conn}
-	if handClient.LoginAndRegister(C) {
-		go handClient.SendHeartbeat(C)
-		handClient.HandleClient(C)
+	if handClient.LoginAndRegister(m.C) {
+		handClient.HandleClient(m)
 	}
 }
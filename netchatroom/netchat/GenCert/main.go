@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"netchatroom/netchat/utils"
+	"strings"
+	"time"
+)
+
+// 生成开发用的自签名CA、服务端证书和客户端证书，不要在生产环境使用
+func main() {
+	out := flag.String("out", "certs", "证书输出目录")
+	hosts := flag.String("hosts", "localhost,127.0.0.1,netchat-server", "服务端证书包含的域名或IP，逗号分隔")
+	validFor := flag.Duration("valid-for", 365*24*time.Hour, "证书有效期")
+	flag.Parse()
+
+	var names []string
+	for _, h := range strings.Split(*hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			names = append(names, h)
+		}
+	}
+	err := utils.GenerateDevCerts(*out, names, *validFor)
+	if err != nil {
+		log.Printf("GenerateDevCerts failed,err:%v\n", err)
+		return
+	}
+	fmt.Printf("证书已生成到%s目录\n", *out)
+	fmt.Printf("服务端: -tls-cert %s/%s -tls-key %s/%s [-tls-client-ca %s/%s]\n",
+		*out, utils.ServerCertFile, *out, utils.ServerKeyFile, *out, utils.CACertFile)
+	fmt.Printf("客户端: -tls -tls-ca %s/%s [-tls-client-cert %s/%s -tls-client-key %s/%s]\n",
+		*out, utils.CACertFile, *out, utils.ClientCertFile, *out, utils.ClientKeyFile)
+}
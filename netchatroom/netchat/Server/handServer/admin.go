@@ -0,0 +1,247 @@
+package handServer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/db"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminOperator 管理控制台执行处罚时记录的操作者
+const AdminOperator = "[管理员]"
+
+// adminHelp 管理控制台的指令说明
+const adminHelp = `list--列出在线用户的地址和空闲时间
+kick 用户名 [原因]--强制用户下线
+announce 内容--发送系统公告
+ban 用户名 [分钟]--封禁账号，不填为永久
+unban 用户名--解除封禁
+resetrank [房间名]--重置房间的活跃度排行榜，默认为公聊
+help--查看指令
+quit--退出控制台
+`
+
+// ServeAdmin 在配置的本机地址或Unix套接字上启动管理控制台，可以用nc或telnet连接，
+// 每个连接按行读取指令，所有操作写入审计日志。控制台没有认证，Unix套接字只允许运行服务端的用户访问
+func (S *Server) ServeAdmin() error {
+	network, addr := S.cfg.AdminListen()
+	file, err := os.OpenFile(S.cfg.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("OpenFile failed,err:%w", err)
+	}
+	audit := log.New(file, "", log.LstdFlags)
+	listen, err := listenAdmin(network, addr)
+	if err != nil {
+		closeErr := file.Close()
+		if closeErr != nil {
+			log.Printf("ServeAdmin file.Close failed,err:%v\n", closeErr)
+		}
+		return err
+	}
+	S.trackListener(listen)
+	fmt.Printf("管理控制台已启动 %v\n", addr)
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			//服务端关闭
+			if errors.Is(err, net.ErrClosed) {
+				closeErr := file.Close()
+				if closeErr != nil {
+					log.Printf("ServeAdmin file.Close failed,err:%v\n", closeErr)
+				}
+				return err
+			}
+			log.Printf("ServeAdmin Accept failed,err:%v\n", err)
+			continue
+		}
+		go S.handleAdminConn(conn, audit)
+	}
+}
+
+// listenAdmin 监听管理控制台，Unix套接字先删除上次异常退出留下的文件，监听后权限设为0600
+func listenAdmin(network string, addr string) (net.Listener, error) {
+	if network == "unix" {
+		err := os.Remove(addr)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("Remove failed,err:%w", err)
+		}
+	}
+	listen, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("Listen failed,err:%w", err)
+	}
+	if network == "unix" {
+		err = os.Chmod(addr, 0600)
+		if err != nil {
+			closeErr := listen.Close()
+			if closeErr != nil {
+				log.Printf("listenAdmin listen.Close failed,err:%v\n", closeErr)
+			}
+			return nil, fmt.Errorf("Chmod failed,err:%w", err)
+		}
+	}
+	return listen, nil
+}
+
+// handleAdminConn 处理一个管理连接
+func (S *Server) handleAdminConn(conn net.Conn, audit *log.Logger) {
+	defer func() {
+		err := conn.Close()
+		if err != nil {
+			log.Printf("handleAdminConn conn.Close failed,err:%v\n", err)
+		}
+	}()
+	//Unix套接字的客户端没有地址
+	operator := "unix"
+	if addr := conn.RemoteAddr(); addr != nil && addr.Network() != "unix" {
+		operator = addr.String()
+	}
+	audit.Printf("%v 连接管理控制台\n", operator)
+	_, err := io.WriteString(conn, "netchat管理控制台，输入help查看指令\n> ")
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "quit" {
+			break
+		}
+		if line == "" {
+			_, err = io.WriteString(conn, "> ")
+			if err != nil {
+				return
+			}
+			continue
+		}
+		result := S.AdminCommand(line)
+		audit.Printf("%v %q -> %v\n", operator, line, strings.TrimSpace(result))
+		_, err = io.WriteString(conn, result+"> ")
+		if err != nil {
+			return
+		}
+	}
+	audit.Printf("%v 断开管理控制台\n", operator)
+}
+
+// AdminCommand 执行一条管理指令，返回要显示给管理员的结果
+func (S *Server) AdminCommand(line string) string {
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch cmd {
+	case "help":
+		return adminHelp
+	case "list":
+		return S.adminList()
+	case "kick":
+		username, reason, _ := strings.Cut(arg, " ")
+		if username == "" {
+			return "用法:kick 用户名 [原因]\n"
+		}
+		content := "[系统消息]你已被管理员强制下线"
+		if reason = strings.TrimSpace(reason); reason != "" {
+			content += "，原因:" + reason
+		}
+		if !S.Kick(username, content) {
+			return username + "不在线\n"
+		}
+		return "已强制" + username + "下线\n"
+	case "announce":
+		if arg == "" {
+			return "用法:announce 内容\n"
+		}
+		S.Broadcast("", &common.Message{Content: "[系统公告]" + arg})
+		fmt.Printf("[系统公告]%v\n", arg)
+		return "公告已发送\n"
+	case "ban":
+		return S.adminBan(arg)
+	case "unban":
+		if arg == "" {
+			return "用法:unban 用户名\n"
+		}
+		ok, err := S.Users.DelSanction(S.ctx, db.GlobalScope, arg, db.SanctionBan)
+		if err != nil {
+			return fmt.Sprintf("解除封禁失败:%v\n", err)
+		}
+		if !ok {
+			return arg + "没有被封禁\n"
+		}
+		return "已解除" + arg + "的封禁\n"
+	case "resetrank":
+		room := arg
+		if room == "" {
+			room = db.DefaultRoom
+		}
+		err := S.Ranks.DelKey(S.ctx, db.RoomZSetName(room))
+		if err != nil {
+			return fmt.Sprintf("重置排行榜失败:%v\n", err)
+		}
+		return "已重置房间" + room + "的活跃度排行榜\n"
+	default:
+		return "未知指令，输入help查看指令\n"
+	}
+}
+
+// adminList 列出本实例上在线用户的远端地址和空闲时间
+func (S *Server) adminList() string {
+	var lines []string
+	now := time.Now()
+	S.Clients.Range(func(key, value interface{}) bool {
+		C := value.(*common.Client)
+		idle := "-"
+		if last, ok := S.active.Load(key); ok {
+			idle = now.Sub(last.(time.Time)).Truncate(time.Second).String()
+		}
+		state := "在线"
+		if _, ok := S.detached.Load(key); ok {
+			state = "等待重连"
+		}
+		lines = append(lines, fmt.Sprintf("%-20s %-22s %-10s %s", C.UserName, C.Conn.RemoteAddr(), idle, state))
+		return true
+	})
+	sort.Strings(lines)
+	return fmt.Sprintf("%-20s %-22s %-10s %s\n", "用户名", "地址", "空闲", "状态") +
+		strings.Join(append(lines, fmt.Sprintf("本实例%v共%d人在线\n", S.instance, len(lines))), "\n")
+}
+
+// adminBan 封禁账号并强制下线，分钟数为0或不填为永久
+func (S *Server) adminBan(arg string) string {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "用法:ban 用户名 [分钟]\n"
+	}
+	minutes := 0
+	if len(fields) == 2 {
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 0 {
+			return "封禁时长必须是非负整数分钟\n"
+		}
+		minutes = n
+	}
+	username := fields[0]
+	exists, err := S.userExists(username)
+	if err != nil {
+		return fmt.Sprintf("查询用户失败:%v\n", err)
+	}
+	if !exists {
+		return username + "不存在\n"
+	}
+	err = S.Users.AddSanction(S.ctx, db.GlobalScope, username, db.SanctionBan, minutes*60, AdminOperator)
+	if err != nil {
+		return fmt.Sprintf("封禁失败:%v\n", err)
+	}
+	S.Kick(username, "[系统消息]你的账号已被管理员封禁")
+	if minutes == 0 {
+		return "已永久封禁" + username + "\n"
+	}
+	return fmt.Sprintf("已封禁%v %d分钟\n", username, minutes)
+}
@@ -0,0 +1,71 @@
+package handServer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeAdminUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+	//上次异常退出留下的套接字文件
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default().Server
+	cfg.AdminAddr = config.AdminUnixPrefix + path
+	cfg.AuditLog = filepath.Join(dir, "audit.log")
+	S := NewServer(&cfg, db.NewMemStore().Stores())
+	go S.HandleMsgChan()
+	errc := make(chan error, 1)
+	go func() { errc <- S.ServeAdmin() }()
+
+	var conn net.Conn
+	var err error
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("unix", path); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 || info.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("socket mode = %v", info.Mode())
+	}
+
+	r := bufio.NewReader(conn)
+	if line, err := r.ReadString('\n'); err != nil || !strings.Contains(line, "管理控制台") {
+		t.Fatalf("banner = %q, %v", line, err)
+	}
+	if _, err = conn.Write([]byte("quit\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = S.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errc; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("ServeAdmin err = %v", err)
+	}
+	audit, err := os.ReadFile(cfg.AuditLog)
+	if err != nil || !strings.Contains(string(audit), "unix 连接管理控制台") {
+		t.Fatalf("audit = %q, %v", audit, err)
+	}
+}
@@ -0,0 +1,357 @@
+package handServer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	APIDefaultHistory = 20               // 不指定n时返回的历史消息条数
+	APIMaxBody        = 64 << 10         // 请求体的最大字节数
+	APIPostTimeout    = 5 * time.Second  // 发送消息时等待消息管道处理完成的最长时间
+	APIHeaderTimeout  = 10 * time.Second // 读取请求头的超时时间
+)
+
+// ServeAPI 在listen上提供HTTP接口，listen关闭后返回。
+// 除登录外的接口都需要在Authorization头中携带登录返回的令牌：Bearer <token>
+//
+//	POST /api/login           登录，请求体为LoginRequest，返回AuthResponse
+//	GET  /api/history         房间历史消息，参数room（默认房间）和n
+//	GET  /api/private/{peer}  与某个用户的私聊历史，参数n
+//	GET  /api/rank            房间活跃度排行榜，参数room
+//	GET  /api/users           在线用户
+//	POST /api/messages        发送公聊或私聊消息，请求体为PostRequest
+func (S *Server) ServeAPI(listen net.Listener) error {
+	srv := &http.Server{
+		Handler:           S.APIHandler(),
+		ReadHeaderTimeout: APIHeaderTimeout,
+	}
+	S.trackHTTP(srv)
+	return srv.Serve(listen)
+}
+
+// APIHandler 返回HTTP接口的路由
+func (S *Server) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", S.apiLogin)
+	mux.HandleFunc("GET /api/history", S.withUser(S.apiHistory))
+	mux.HandleFunc("GET /api/private/{peer}", S.withUser(S.apiPrivateHistory))
+	mux.HandleFunc("GET /api/rank", S.withUser(S.apiRank))
+	mux.HandleFunc("GET /api/users", S.withUser(S.apiUsers))
+	mux.HandleFunc("POST /api/messages", S.withUser(S.apiPost))
+	return mux
+}
+
+// apiStatus 错误码对应的HTTP状态码
+var apiStatus = map[string]int{
+	message.CodeOK:            http.StatusOK,
+	message.CodeBadRequest:    http.StatusBadRequest,
+	message.CodeUserNotFound:  http.StatusNotFound,
+	message.CodeWrongPassword: http.StatusUnauthorized,
+	message.CodeInvalidToken:  http.StatusUnauthorized,
+	message.CodeBanned:        http.StatusForbidden,
+	message.CodeForbidden:     http.StatusForbidden,
+	message.CodeInternal:      http.StatusInternalServerError,
+}
+
+// writeJSON 以JSON格式回复
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("writeJSON Encode failed,err:%v\n", err)
+	}
+}
+
+// writeError 按错误码回复错误，text为空时使用错误码对应的提示
+func writeError(w http.ResponseWriter, code string, text string) {
+	status, ok := apiStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, message.NewAPIResponse(code, text))
+}
+
+// readJSON 解析请求体
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, APIMaxBody))
+	err := dec.Decode(v)
+	if err != nil {
+		writeError(w, message.CodeBadRequest, "")
+		return false
+	}
+	return true
+}
+
+// queryCount 读取条数参数n，不指定时使用默认值
+func queryCount(r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("n")
+	if v == "" {
+		return APIDefaultHistory, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// withUser 校验Bearer令牌，把令牌对应的用户名交给下一个处理函数
+func (S *Server) withUser(next func(w http.ResponseWriter, r *http.Request, username string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, message.CodeInvalidToken, "")
+			return
+		}
+		username, err := S.Cache.GetSession(r.Context(), token)
+		if err != nil {
+			if errors.Is(err, db.ErrNil) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, message.CodeInvalidToken, "")
+			} else {
+				log.Printf("withUser GetSession failed,err:%v\n", err)
+				writeError(w, message.CodeInternal, "")
+			}
+			return
+		}
+		if S.isBanned(username) {
+			writeError(w, message.CodeBanned, "")
+			return
+		}
+		next(w, r, username)
+	}
+}
+
+// apiLogin 校验用户名密码并签发会话令牌，不占用聊天室的在线状态
+func (S *Server) apiLogin(w http.ResponseWriter, r *http.Request) {
+	req := &message.LoginRequest{}
+	if !readJSON(w, r, req) {
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		writeError(w, message.CodeBadRequest, "")
+		return
+	}
+	if code := S.authenticate(req.Username, req.Password); code != message.CodeOK {
+		writeError(w, code, "")
+		return
+	}
+	token, err := S.NewSession(req.Username)
+	if err != nil {
+		log.Printf("apiLogin NewSession failed,err:%v\n", err)
+		writeError(w, message.CodeInternal, "")
+		return
+	}
+	writeJSON(w, http.StatusOK, &message.AuthResponse{
+		Code:    message.CodeOK,
+		Message: message.CodeText(message.CodeOK),
+		Token:   token,
+		Unread:  S.unreadCounts(req.Username),
+	})
+}
+
+// apiHistory 房间最近n条历史消息
+func (S *Server) apiHistory(w http.ResponseWriter, r *http.Request, username string) {
+	n, ok := queryCount(r)
+	if !ok {
+		writeError(w, message.CodeBadRequest, "")
+		return
+	}
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		room = db.DefaultRoom
+	}
+	if !S.apiRoomMember(w, room, username) {
+		return
+	}
+	items, err := S.roomHistory(r.Context(), room, n)
+	if err != nil {
+		log.Printf("apiHistory roomHistory failed,err:%v\n", err)
+		writeError(w, message.CodeInternal, "")
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// apiPrivateHistory 与某个用户最近n条私聊历史
+func (S *Server) apiPrivateHistory(w http.ResponseWriter, r *http.Request, username string) {
+	n, ok := queryCount(r)
+	if !ok {
+		writeError(w, message.CodeBadRequest, "")
+		return
+	}
+	peer := r.PathValue("peer")
+	exists, err := S.userExists(peer)
+	if err != nil {
+		log.Printf("apiPrivateHistory userExists failed,err:%v\n", err)
+		writeError(w, message.CodeInternal, "")
+		return
+	}
+	if !exists {
+		writeError(w, message.CodeUserNotFound, "该用户名不存在，请检查输入")
+		return
+	}
+	items, err := S.privateHistory(r.Context(), username, peer, n)
+	if err != nil {
+		log.Printf("apiPrivateHistory privateHistory failed,err:%v\n", err)
+		writeError(w, message.CodeInternal, "")
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// apiRank 房间活跃度排行榜
+func (S *Server) apiRank(w http.ResponseWriter, r *http.Request, username string) {
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		room = db.DefaultRoom
+	}
+	if !S.apiRoomMember(w, room, username) {
+		return
+	}
+	lists, err := S.Ranks.ZRevRangeMsg(r.Context(), db.RoomZSetName(room))
+	if err != nil {
+		log.Printf("apiRank ZRevRangeMsg failed,err:%v\n", err)
+		writeError(w, message.CodeInternal, "")
+		return
+	}
+	items := make([]message.RankItem, 0, len(lists))
+	for i, list := range lists {
+		items = append(items, message.RankItem{Rank: i + 1, Username: list.Member, Score: list.Score})
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// apiUsers 集群中的在线用户，按用户名排序，不包括隐身的其他用户
+func (S *Server) apiUsers(w http.ResponseWriter, r *http.Request, username string) {
+	writeJSON(w, http.StatusOK, S.onlineUsers(username))
+}
+
+// apiPost 把消息放入与TCP客户端相同的消息管道，等待处理完成后回复，
+// 处理过程中回复给发送者的提示（例如被禁言）作为错误返回
+func (S *Server) apiPost(w http.ResponseWriter, r *http.Request, username string) {
+	req := &message.PostRequest{}
+	if !readJSON(w, r, req) {
+		return
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		writeError(w, message.CodeBadRequest, "消息内容不能为空")
+		return
+	}
+	conn := newAPIConn(r.RemoteAddr)
+	msg := &common.Message{
+		Sender:  &common.Client{UserName: username, Conn: conn},
+		Content: req.Content,
+		Type:    message.PublicMsg,
+		Room:    req.Room,
+	}
+	if req.To != "" {
+		if req.To == username {
+			writeError(w, message.CodeBadRequest, "不能给自己发送私聊")
+			return
+		}
+		msg.Type, msg.To, msg.Room = message.PrivateMsg, req.To, ""
+	}
+	select {
+	case S.shardOf(username) <- msg:
+	case <-S.stopDispatch:
+		writeJSON(w, http.StatusServiceUnavailable, message.NewAPIResponse(message.CodeInternal, "服务器正在关闭"))
+		return
+	case <-r.Context().Done():
+		return
+	}
+	select {
+	case <-conn.done:
+	case <-time.After(APIPostTimeout):
+		//已经进入管道，稍后仍会被处理
+		writeJSON(w, http.StatusAccepted, message.NewAPIResponse(message.CodeOK, "消息已排队"))
+		return
+	}
+	if replies := conn.Replies(); len(replies) > 0 {
+		writeError(w, message.CodeForbidden, strings.Join(replies, "\n"))
+		return
+	}
+	writeJSON(w, http.StatusOK, message.NewAPIResponse(message.CodeOK, ""))
+}
+
+// apiRoomMember 检查用户是否在房间中，不在时回复403
+func (S *Server) apiRoomMember(w http.ResponseWriter, room string, username string) bool {
+	ok, err := S.isRoomMember(room, username)
+	if err != nil {
+		log.Printf("apiRoomMember isRoomMember failed,err:%v\n", err)
+		writeError(w, message.CodeInternal, "")
+		return false
+	}
+	if !ok {
+		writeError(w, message.CodeForbidden, "你不在房间"+room+"中")
+	}
+	return ok
+}
+
+// apiConn HTTP请求在消息管道中使用的连接，收集处理过程中回复给发送者的提示，
+// 管道处理完这条消息后关闭done
+type apiConn struct {
+	remote  apiAddr
+	done    chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	replies []string
+}
+
+func newAPIConn(remote string) *apiConn {
+	return &apiConn{remote: apiAddr(remote), done: make(chan struct{})}
+}
+
+// finish 通知等待的HTTP请求消息已处理完
+func (c *apiConn) finish() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// Replies 处理过程中收到的提示
+func (c *apiConn) Replies() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.replies...)
+}
+
+func (c *apiConn) ReadMsg() (*common.Message, error) {
+	return nil, io.EOF
+}
+
+func (c *apiConn) WriteMsg(msg *common.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replies = append(c.replies, msg.Content)
+	return nil
+}
+
+func (c *apiConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *apiConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *apiConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *apiConn) Close() error { return nil }
+
+// apiAddr HTTP请求的来源地址
+type apiAddr string
+
+func (a apiAddr) Network() string { return "http" }
+
+func (a apiAddr) String() string { return string(a) }
@@ -0,0 +1,299 @@
+package handServer
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"os"
+	"time"
+)
+
+// 多个实例共用redis时，每个实例用自己的消费者组按顺序读取房间流中的全部消息，发给自己持有连接的用户。
+// 私聊收件箱的消费协程跟随用户的连接，总在持有连接的实例上运行。
+// 系统消息、已读通知、踢人等不进流的消息通过集群频道发给其他实例
+
+// 集群事件的类型
+const (
+	eventBroadcast = "broadcast" // 发给各实例上的在线用户
+	eventUser      = "user"      // 发给某个用户
+	eventKick      = "kick"      // 把用户踢下线
+	eventTakeover  = "takeover"  // 用户在其他实例上登录，本实例上的旧会话直接关闭
+)
+
+// clusterEvent 通过db.ClusterChannel在实例之间传递的事件
+type clusterEvent struct {
+	Kind   string
+	Origin string          // 发布事件的实例，自己发布的事件在本地已经处理过
+	Msg    *common.Message `json:",omitempty"`
+	To     string          `json:",omitempty"` // eventUser、eventKick和eventTakeover的目标用户
+	Room   string          `json:",omitempty"` // eventBroadcast只发给该房间的成员，为空时发给所有人
+	Except string          `json:",omitempty"` // eventBroadcast不发给该用户
+}
+
+// newInstanceID 由主机名、进程号和随机数生成实例标识，同一进程内的多个实例也不会重复
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	var b [4]byte
+	for i := range b {
+		b[i] = byte(rand.IntN(256))
+	}
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b[:]))
+}
+
+// Instance 返回本实例在集群中的标识
+func (S *Server) Instance() string {
+	return S.instance
+}
+
+// JoinCluster 登记本实例并订阅集群频道，启动心跳和待确认消息的认领协程，
+// 必须在开始接受连接前调用，之后由Shutdown退出集群
+func (S *Server) JoinCluster() error {
+	err := S.Cluster.HeartbeatInstance(S.ctx, S.instance, time.Now())
+	if err != nil {
+		return fmt.Errorf("HeartbeatInstance failed,err:%w", err)
+	}
+	events, err := S.Cluster.SubscribeMsg(S.consume, db.ClusterChannel)
+	if err != nil {
+		return fmt.Errorf("SubscribeMsg failed,err:%w", err)
+	}
+	S.consumers.Add(3)
+	go S.HandleCluster(events)
+	go S.HeartbeatCluster()
+	go S.ReclaimInboxes()
+	fmt.Printf("[系统消息]实例%v已加入集群\n", S.instance)
+	return nil
+}
+
+// leaveCluster 删除本实例上用户的在线记录并记下最后在线时间，删除本实例的消费者组和心跳记录，Shutdown关闭连接前调用
+func (S *Server) leaveCluster() {
+	S.Clients.Range(func(key, _ interface{}) bool {
+		err := S.Cluster.DelPresence(S.ctx, key.(string), S.instance)
+		if err != nil {
+			log.Printf("leaveCluster DelPresence failed,err:%v\n", err)
+		}
+		S.recordLastSeen(key.(string))
+		return true
+	})
+	S.removeInstance(S.instance)
+}
+
+// publish 把事件发给其他实例
+func (S *Server) publish(ev *clusterEvent) {
+	ev.Origin = S.instance
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("publish Marshal failed,err:%v\n", err)
+		return
+	}
+	err = S.Cluster.PublishMsg(S.ctx, db.ClusterChannel, string(data))
+	if err != nil {
+		log.Printf("publish PublishMsg failed,err:%v\n", err)
+	}
+}
+
+// HandleCluster 处理其他实例发来的事件，服务端关闭时返回
+func (S *Server) HandleCluster(events <-chan string) {
+	defer S.consumers.Done()
+	for data := range events {
+		ev := &clusterEvent{}
+		err := json.Unmarshal([]byte(data), ev)
+		if err != nil {
+			log.Printf("HandleCluster Unmarshal failed,err:%v\n", err)
+			continue
+		}
+		if ev.Origin == S.instance {
+			continue
+		}
+		switch ev.Kind {
+		case eventBroadcast:
+			if ev.Room == "" {
+				S.broadcastLocal(ev.Except, ev.Msg)
+			} else {
+				S.broadcastRoomLocal(ev.Room, ev.Except, ev.Msg)
+			}
+		case eventUser:
+			S.sendLocal(ev.To, ev.Msg)
+		case eventKick:
+			S.kickLocal(ev.To, ev.Msg.Content)
+		case eventTakeover:
+			S.dropLocal(ev.To)
+		}
+	}
+}
+
+// HeartbeatCluster 定期刷新本实例的心跳，清理失联实例留下的记录，把空闲的用户标记为离开，
+// 并启动其他实例创建的房间的消费协程，服务端关闭时返回
+func (S *Server) HeartbeatCluster() {
+	defer S.consumers.Done()
+	ticker := time.NewTicker(S.cfg.InstanceTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-S.consume.Done():
+			return
+		case <-ticker.C:
+		}
+		err := S.Cluster.HeartbeatInstance(S.ctx, S.instance, time.Now())
+		if err != nil {
+			log.Printf("HeartbeatCluster HeartbeatInstance failed,err:%v\n", err)
+			continue
+		}
+		S.sweepCluster()
+		S.sweepAway()
+		S.HandleMsgStream()
+	}
+}
+
+// sweepCluster 删除失联实例的心跳记录、消费者组和它们上面用户的在线记录，多个实例同时清理不会冲突
+func (S *Server) sweepCluster() {
+	instances, err := S.Cluster.ListInstances(S.ctx)
+	if err != nil {
+		log.Printf("sweepCluster ListInstances failed,err:%v\n", err)
+		return
+	}
+	live := S.liveInstances(instances)
+	for instance := range instances {
+		if live[instance] {
+			continue
+		}
+		S.removeInstance(instance)
+		fmt.Printf("[系统消息]实例%v已失联\n", instance)
+	}
+	presence, err := S.Cluster.ListPresence(S.ctx)
+	if err != nil {
+		log.Printf("sweepCluster ListPresence failed,err:%v\n", err)
+		return
+	}
+	for username, p := range presence {
+		if live[p.Instance] {
+			continue
+		}
+		err = S.Cluster.DelPresence(S.ctx, username, p.Instance)
+		if err != nil {
+			log.Printf("sweepCluster DelPresence failed,err:%v\n", err)
+		}
+	}
+}
+
+// removeInstance 删除实例在各房间流上的消费者组和心跳记录
+func (S *Server) removeInstance(instance string) {
+	rooms, err := S.Cache.SMembersMsg(S.ctx, db.RoomSetName)
+	if err != nil {
+		log.Printf("removeInstance SMembersMsg failed,err:%v\n", err)
+		return
+	}
+	//一个房间删除失败不影响其他房间，也不影响删除实例记录
+	for _, room := range rooms {
+		err = S.Streams.XGroupDestroyMsg(S.ctx, db.RoomStreamName(room), db.InstanceGroupName(instance))
+		if err != nil {
+			log.Printf("removeInstance XGroupDestroyMsg %v failed,err:%v\n", room, err)
+		}
+	}
+	err = S.Cluster.RemoveInstance(S.ctx, instance)
+	if err != nil {
+		log.Printf("removeInstance RemoveInstance failed,err:%v\n", err)
+	}
+}
+
+// liveInstances 返回InstanceTTL内有过心跳的实例，本实例总是算在内
+func (S *Server) liveInstances(instances map[string]time.Time) map[string]bool {
+	live := map[string]bool{S.instance: true}
+	now := time.Now()
+	for instance, last := range instances {
+		if now.Sub(last) < S.cfg.InstanceTTL {
+			live[instance] = true
+		}
+	}
+	return live
+}
+
+// remotePresence 返回用户在其他存活实例上的在线记录
+func (S *Server) remotePresence(username string) (db.Presence, bool) {
+	p, err := S.Cluster.GetPresence(S.ctx, username)
+	if err != nil {
+		if !errors.Is(err, db.ErrNil) {
+			log.Printf("remotePresence GetPresence failed,err:%v\n", err)
+		}
+		return db.Presence{}, false
+	}
+	if p.Instance == S.instance {
+		return db.Presence{}, false
+	}
+	instances, err := S.Cluster.ListInstances(S.ctx)
+	if err != nil {
+		log.Printf("remotePresence ListInstances failed,err:%v\n", err)
+		return db.Presence{}, false
+	}
+	return p, S.liveInstances(instances)[p.Instance]
+}
+
+// broadcastLocal 发给本实例上除except外的所有在线用户
+func (S *Server) broadcastLocal(except string, msg *common.Message) {
+	S.Clients.Range(func(_, value interface{}) bool {
+		C := value.(*common.Client)
+		if C.UserName != except {
+			err := message.SendMsg(C.Conn, msg)
+			if err != nil {
+				log.Printf("broadcastLocal SendMsg failed,err:%v\n", err)
+			}
+		}
+		return true
+	})
+}
+
+// sendLocal 发给本实例上的用户，用户不在本实例时返回false
+func (S *Server) sendLocal(username string, msg *common.Message) bool {
+	val, ok := S.Clients.Load(username)
+	if !ok {
+		return false
+	}
+	err := message.SendMsg(val.(*common.Client).Conn, msg)
+	if err != nil {
+		log.Printf("sendLocal SendMsg failed,err:%v\n", err)
+	}
+	return true
+}
+
+// sendUser 发给集群中的在线用户，用户在其他实例上时由该实例转发，用户不在线时返回false
+func (S *Server) sendUser(username string, msg *common.Message) bool {
+	if S.sendLocal(username, msg) {
+		return true
+	}
+	if _, ok := S.remotePresence(username); !ok {
+		return false
+	}
+	S.publish(&clusterEvent{Kind: eventUser, To: username, Msg: msg})
+	return true
+}
+
+// dropLocal 用户已经在其他实例上登录，关闭本实例上的旧会话，不广播离开，也不删除在线记录
+func (S *Server) dropLocal(username string) {
+	val, ok := S.Clients.LoadAndDelete(username)
+	if !ok {
+		return
+	}
+	if timer, ok := S.detached.LoadAndDelete(username); ok {
+		timer.(*time.Timer).Stop()
+	}
+	S.active.Delete(username)
+	S.stopTyping(username)
+	S.resetPresence(username)
+	if cancel, ok := S.inboxes.LoadAndDelete(username); ok {
+		cancel.(context.CancelFunc)()
+	}
+	err := val.(*common.Client).Conn.Close()
+	if err != nil {
+		log.Printf("dropLocal Conn.Close failed,err:%v\n", err)
+	}
+	fmt.Printf("[系统消息]%v已在其他实例登录\n", username)
+}
@@ -0,0 +1,49 @@
+package handServer
+
+import (
+	"context"
+	"errors"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/db"
+	"testing"
+	"time"
+)
+
+// failDestroyStreams 删除指定流上的消费者组时失败
+type failDestroyStreams struct {
+	db.StreamStore
+	stream string
+}
+
+func (s failDestroyStreams) XGroupDestroyMsg(ctx context.Context, stream string, group string) error {
+	if stream == s.stream {
+		return errors.New("connection reset")
+	}
+	return s.StreamStore.XGroupDestroyMsg(ctx, stream, group)
+}
+
+func TestRemoveInstanceContinuesOnError(t *testing.T) {
+	ctx := context.Background()
+	stores := db.NewMemStore().Stores()
+	stores.Streams = failDestroyStreams{StreamStore: stores.Streams, stream: db.RoomStreamName("a")}
+	cfg := config.Default().Server
+	S := NewServer(&cfg, stores)
+	if err := S.Cluster.HeartbeatInstance(ctx, "dead", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for _, room := range []string{"a", "b"} {
+		if _, err := S.Cache.SAddMsg(ctx, room, db.RoomSetName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	S.removeInstance("dead")
+	instances, err := S.Cluster.ListInstances(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a房间删除消费者组失败，实例记录仍然要删除
+	if _, ok := instances["dead"]; ok {
+		t.Fatalf("instance record kept: %v", instances)
+	}
+}
@@ -0,0 +1,72 @@
+package handServer
+
+import (
+	"hash/fnv"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/message"
+	"sync"
+)
+
+// Dispatch 把客户端消息交给发送者所在的分片处理。同一发送者的消息总是进入同一个分片，
+// 按发送顺序处理；不同发送者的消息在各自的分片中并发处理。
+// 只能在连接的读协程、计时器或HTTP请求中调用，处理消息的过程中不能再调用，否则分片满时会死锁
+func (S *Server) Dispatch(msg *common.Message) {
+	//服务端关闭后丢弃
+	select {
+	case S.shardOf(msg.Sender.UserName) <- msg:
+	case <-S.stopDispatch:
+	}
+}
+
+// shardOf 用户名对应的分片
+func (S *Server) shardOf(username string) chan *common.Message {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(username))
+	return S.shards[h.Sum32()%uint32(len(S.shards))]
+}
+
+// HandleMsgChan 为每个分片启动一个处理协程，Shutdown停止分发且各分片处理完剩余消息后返回
+func (S *Server) HandleMsgChan() {
+	defer close(S.dispatchDone)
+	var wg sync.WaitGroup
+	for _, shard := range S.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			S.handleShard(shard)
+		}()
+	}
+	wg.Wait()
+}
+
+// handleShard 按顺序处理一个分片中的消息，停止分发后处理完已入队的消息再返回
+func (S *Server) handleShard(shard chan *common.Message) {
+	for {
+		select {
+		case msg := <-shard:
+			S.handleDispatched(msg)
+		case <-S.stopDispatch:
+			for {
+				select {
+				case msg := <-shard:
+					S.handleDispatched(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// handleDispatched 处理一条分发来的消息，临时事件直接转发，其余消息交给HandleMsg
+func (S *Server) handleDispatched(msg *common.Message) {
+	if message.IsEphemeral(msg.Type) {
+		S.HandleEphemeral(msg)
+	} else {
+		S.HandleMsg(msg)
+	}
+	//HTTP接口发来的消息处理完后通知等待的请求
+	if conn, ok := msg.Sender.Conn.(*apiConn); ok {
+		conn.finish()
+	}
+}
@@ -0,0 +1,198 @@
+package handServer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// discardConn 丢弃所有回复的连接
+type discardConn struct{}
+
+func (discardConn) ReadMsg() (*common.Message, error) { return nil, io.EOF }
+func (discardConn) WriteMsg(*common.Message) error    { return nil }
+func (discardConn) SetReadDeadline(time.Time) error   { return nil }
+func (discardConn) SetWriteDeadline(time.Time) error  { return nil }
+func (discardConn) RemoteAddr() net.Addr              { return apiAddr("discard") }
+func (discardConn) Close() error                      { return nil }
+
+// 给私聊路径上用到的存储操作加上延迟，模拟redis和MySQL的网络往返
+type (
+	slowUsers struct {
+		db.UserStore
+		latency time.Duration
+	}
+	slowCache struct {
+		db.CacheStore
+		latency time.Duration
+	}
+	slowStreams struct {
+		db.StreamStore
+		latency time.Duration
+	}
+	slowRanks struct {
+		db.RankStore
+		latency time.Duration
+		done    atomic.Int64 // 私聊处理的最后一步是加活跃度，用来统计处理完的消息数
+	}
+)
+
+func sleep(d time.Duration) {
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (s slowUsers) QuerySanction(ctx context.Context, scope string, username string, kind string) (bool, error) {
+	sleep(s.latency)
+	return s.UserStore.QuerySanction(ctx, scope, username, kind)
+}
+
+func (s slowCache) GetUser(ctx context.Context, username string) (string, error) {
+	sleep(s.latency)
+	return s.CacheStore.GetUser(ctx, username)
+}
+
+func (s slowStreams) XAddMsg(ctx context.Context, msg string, codec string, stream string) (string, error) {
+	sleep(s.latency)
+	return s.StreamStore.XAddMsg(ctx, msg, codec, stream)
+}
+
+func (s *slowRanks) ZIncrMsg(ctx context.Context, member string, key string) error {
+	sleep(s.latency)
+	defer s.done.Add(1)
+	return s.RankStore.ZIncrMsg(ctx, member, key)
+}
+
+// newDispatchServer 启动只有消息分发的服务端，clients个用户已注册
+func newDispatchServer(tb testing.TB, shards int, clients int, latency time.Duration) (*Server, *db.MemStore, *slowRanks) {
+	tb.Helper()
+	store := db.NewMemStore()
+	ranks := &slowRanks{RankStore: store, latency: latency}
+	cfg := config.Default().Server
+	cfg.DispatchShards = shards
+	S := NewServer(&cfg, db.Stores{
+		Users:   slowUsers{UserStore: store, latency: latency},
+		Cache:   slowCache{CacheStore: store, latency: latency},
+		Streams: slowStreams{StreamStore: store, latency: latency},
+		Ranks:   ranks,
+		Cluster: store,
+	})
+	for i := range clients {
+		name := "user" + strconv.Itoa(i)
+		if err := store.AddUser(context.Background(), name, "hash"); err != nil {
+			tb.Fatal(err)
+		}
+		if err := store.SetUser(context.Background(), name, "1"); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	go S.HandleMsgChan()
+	return S, store, ranks
+}
+
+// waitDone 等待处理完n条私聊
+func waitDone(tb testing.TB, ranks *slowRanks, n int64) {
+	tb.Helper()
+	deadline := time.Now().Add(time.Minute)
+	for ranks.done.Load() < n {
+		if time.Now().After(deadline) {
+			tb.Fatalf("processed %d of %d messages", ranks.done.Load(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDispatchPreservesSenderOrder(t *testing.T) {
+	const senders, perSender = 50, 20
+	S, store, ranks := newDispatchServer(t, 8, senders+1, 0)
+	sink := "user" + strconv.Itoa(senders)
+	//各发送者的消息交错进入，每条处理的耗时随机
+	for i := range perSender {
+		for s := range senders {
+			S.Dispatch(&common.Message{
+				Sender:  &common.Client{UserName: "user" + strconv.Itoa(s), Conn: discardConn{}},
+				Type:    message.PrivateMsg,
+				To:      sink,
+				Content: strconv.Itoa(i),
+			})
+			if rand.IntN(10) == 0 {
+				time.Sleep(time.Microsecond)
+			}
+		}
+	}
+	waitDone(t, ranks, senders*perSender)
+	for s := range senders {
+		sender := "user" + strconv.Itoa(s)
+		entries, err := store.XRangeMsg(context.Background(), privateStreamName(sender, sink), perSender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			msg, err := message.DecodeStored(e.Codec, e.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, msg.Content)
+		}
+		for i, content := range got {
+			if content != strconv.Itoa(i) {
+				t.Fatalf("%s order = %v", sender, got)
+			}
+		}
+		if len(got) != perSender {
+			t.Fatalf("%s got %d messages, want %d", sender, len(got), perSender)
+		}
+	}
+}
+
+// BenchmarkDispatch 数千个模拟客户端互发私聊，每次存储操作有固定延迟，比较不同分片数的吞吐量
+func BenchmarkDispatch(b *testing.B) {
+	const latency = 100 * time.Microsecond
+	//服务端会把每条私聊打印到标准输出，压测时丢弃
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = stdout
+		_ = devNull.Close()
+	}()
+	for _, clients := range []int{1000, 5000} {
+		for _, shards := range []int{1, 4, 16, 64} {
+			b.Run(fmt.Sprintf("clients=%d/shards=%d", clients, shards), func(b *testing.B) {
+				S, _, ranks := newDispatchServer(b, shards, clients, latency)
+				senders := make([]*common.Client, clients)
+				for i := range senders {
+					senders[i] = &common.Client{UserName: "user" + strconv.Itoa(i), Conn: discardConn{}}
+				}
+				b.ResetTimer()
+				start := time.Now()
+				for i := range b.N {
+					S.Dispatch(&common.Message{
+						Sender:  senders[i%clients],
+						Type:    message.PrivateMsg,
+						To:      senders[(i+1)%clients].UserName,
+						Content: "hello",
+					})
+				}
+				waitDone(b, ranks, int64(b.N))
+				b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msgs/s")
+			})
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package handServer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"strings"
+	"time"
+)
+
+// 房间消息流只能追加，被编辑或删除的消息把最新版本保存在房间的编辑记录中，读取历史时覆盖流中的原文。
+// 消息按发送者分片处理，管理员的删除和作者的编辑可能同时进行，删除另外记在删除集合中，读取时优先于编辑记录
+
+// HandleEditMsg 编辑房间中的消息，ID为空时编辑自己在该房间的最后一条，Content为新内容
+func (S *Server) HandleEditMsg(msg *common.Message) {
+	content := strings.TrimSpace(msg.Content)
+	if content == "" {
+		S.reply(msg.Sender, "编辑后的内容不能为空")
+		return
+	}
+	S.updateMsg(msg, &message.MsgUpdate{Content: content})
+}
+
+// HandleDeleteMsg 删除房间中的消息，ID为空时删除自己在该房间的最后一条
+func (S *Server) HandleDeleteMsg(msg *common.Message) {
+	S.updateMsg(msg, &message.MsgUpdate{Deleted: true})
+}
+
+// updateMsg 检查权限后保存消息的最新版本，并向房间广播更新事件
+func (S *Server) updateMsg(msg *common.Message, update *message.MsgUpdate) {
+	C := msg.Sender
+	room := roomOf(msg)
+	if !S.checkRoomMember(C, room) {
+		return
+	}
+	id := msg.ID
+	if id != "" && !message.IsMsgID(id) {
+		S.reply(C, "消息ID格式错误")
+		return
+	}
+	if id == "" {
+		last, err := S.Cache.HGetMsg(S.ctx, db.RoomLastMsgName(room), C.UserName)
+		if err != nil {
+			if !errors.Is(err, db.ErrNil) {
+				log.Printf("updateMsg HGetMsg last failed,err:%v\n", err)
+			}
+			S.reply(C, fmt.Sprintf("你在房间%v中还没有发过消息", room))
+			return
+		}
+		id = last
+	}
+	author, ok := S.msgAuthor(C, room, id)
+	if !ok || !S.checkUpdate(C, room, author, update.Deleted) {
+		return
+	}
+	prev, err := S.msgEdit(room, id)
+	if err != nil {
+		log.Printf("updateMsg msgEdit failed,err:%v\n", err)
+		return
+	}
+	if prev != nil && prev.Deleted {
+		S.reply(C, "该消息已被删除")
+		return
+	}
+
+	update.ID, update.Room, update.Author, update.Editor = id, room, author, C.UserName
+	update.Time = time.Now().UnixMilli()
+	event := &common.Message{
+		Sender: &common.Client{UserName: C.UserName},
+		Type:   message.EditMsg,
+		Room:   room,
+		ID:     id,
+		Time:   update.Time,
+	}
+	if update.Deleted {
+		event.Type = message.DeleteMsg
+	}
+	err = message.SetPayload(event, update)
+	if err != nil {
+		log.Printf("updateMsg SetPayload failed,err:%v\n", err)
+		return
+	}
+	if update.Deleted {
+		_, err = S.Cache.SAddMsg(S.ctx, id, db.RoomDeletedName(room))
+		if err != nil {
+			log.Printf("updateMsg SAddMsg deleted failed,err:%v\n", err)
+			S.reply(C, "修改消息失败，请稍后再试")
+			return
+		}
+	}
+	err = S.Cache.HSetMsg(S.ctx, db.RoomEditsName(room), id, event.Content)
+	if err != nil {
+		log.Printf("updateMsg HSetMsg failed,err:%v\n", err)
+		S.reply(C, "修改消息失败，请稍后再试")
+		return
+	}
+	if !update.Deleted {
+		//写入期间消息可能被同时删除，此时编辑不再生效，也不广播
+		deleted, err := S.isDeleted(room, id)
+		if err != nil {
+			log.Printf("updateMsg isDeleted failed,err:%v\n", err)
+		} else if deleted {
+			S.reply(C, "该消息已被删除")
+			return
+		}
+	}
+	err = S.pruneEdits(room)
+	if err != nil {
+		log.Printf("updateMsg pruneEdits failed,err:%v\n", err)
+	}
+	//发送者也会收到，作为操作成功的确认
+	S.BroadcastRoom(room, "", event)
+	if update.Deleted {
+		fmt.Printf("[系统消息]%v删除了房间%v中%v的消息%v\n", C.UserName, room, author, id)
+	} else {
+		fmt.Printf("[系统消息]%v编辑了房间%v中%v的消息%v:%v\n", C.UserName, room, author, id, update.Content)
+	}
+}
+
+// msgAuthor 返回房间消息的作者，消息不存在时回复提示
+func (S *Server) msgAuthor(C *common.Client, room string, id string) (string, bool) {
+	entry, err := S.Streams.XGetMsg(S.ctx, db.RoomStreamName(room), id)
+	if err != nil {
+		if errors.Is(err, db.ErrNil) {
+			S.reply(C, fmt.Sprintf("消息%v不存在或已过期", id))
+		} else {
+			log.Printf("msgAuthor XGetMsg failed,err:%v\n", err)
+		}
+		return "", false
+	}
+	orig, err := message.DecodeStored(entry.Codec, entry.Data)
+	if err != nil || orig.Sender == nil || orig.Type != message.PublicMsg {
+		S.reply(C, fmt.Sprintf("消息%v不存在或已过期", id))
+		return "", false
+	}
+	return orig.Sender.UserName, true
+}
+
+// checkUpdate 作者可以编辑和删除自己的消息，被禁言时只能删除；
+// 管理员可以编辑和删除角色比自己低的用户的消息
+func (S *Server) checkUpdate(C *common.Client, room string, author string, deleting bool) bool {
+	if author == C.UserName {
+		if deleting {
+			return true
+		}
+		muted, err := S.hasSanction(room, C.UserName, db.SanctionMute)
+		if err != nil {
+			log.Printf("checkUpdate hasSanction failed,err:%v\n", err)
+			return false
+		}
+		if muted {
+			S.reply(C, "你已被禁言，消息未修改")
+			return false
+		}
+		return true
+	}
+	role, err := S.effectiveRole(room, C.UserName)
+	if err != nil {
+		log.Printf("checkUpdate effectiveRole failed,err:%v\n", err)
+		return false
+	}
+	if role < db.RoleModerator {
+		S.reply(C, "只能修改自己的消息")
+		return false
+	}
+	authorRole, err := S.effectiveRole(room, author)
+	if err != nil {
+		log.Printf("checkUpdate effectiveRole author failed,err:%v\n", err)
+		return false
+	}
+	if authorRole >= role {
+		S.reply(C, fmt.Sprintf("不能修改%v的消息，对方的角色不低于你", author))
+		return false
+	}
+	return true
+}
+
+// isDeleted 判断消息是否已被删除
+func (S *Server) isDeleted(room string, id string) (bool, error) {
+	deleted, err := S.Cache.SIsMemberMsg(S.ctx, id, db.RoomDeletedName(room))
+	if err != nil {
+		return false, fmt.Errorf("SIsMemberMsg failed,err:%w", err)
+	}
+	return deleted, nil
+}
+
+// msgEdit 返回消息保存的最新版本，没有被编辑或删除过时返回nil
+func (S *Server) msgEdit(room string, id string) (*message.MsgUpdate, error) {
+	deleted, err := S.isDeleted(room, id)
+	if err != nil {
+		return nil, err
+	}
+	if deleted {
+		return &message.MsgUpdate{ID: id, Room: room, Deleted: true}, nil
+	}
+	data, err := S.Cache.HGetMsg(S.ctx, db.RoomEditsName(room), id)
+	if err != nil {
+		if errors.Is(err, db.ErrNil) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("HGetMsg failed,err:%w", err)
+	}
+	update := &message.MsgUpdate{}
+	err = message.GetPayload(&common.Message{Content: data}, update)
+	if err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// pruneEdits 删除已经被裁剪出房间消息流的消息的编辑记录和删除标记，使它们不会比流中的消息多
+func (S *Server) pruneEdits(room string) error {
+	oldest, err := S.Streams.XRangeAfterMsg(S.ctx, db.RoomStreamName(room), "0", 1)
+	if err != nil {
+		return fmt.Errorf("XRangeAfterMsg failed,err:%w", err)
+	}
+	edits, err := S.Cache.HGetAllMsg(S.ctx, db.RoomEditsName(room))
+	if err != nil {
+		return fmt.Errorf("HGetAllMsg failed,err:%w", err)
+	}
+	var expired []string
+	for id := range edits {
+		if len(oldest) == 0 || db.CompareStreamID(id, oldest[0].ID) < 0 {
+			expired = append(expired, id)
+		}
+	}
+	_, err = S.Cache.HDelMsg(S.ctx, db.RoomEditsName(room), expired...)
+	if err != nil {
+		return fmt.Errorf("HDelMsg failed,err:%w", err)
+	}
+	deleted, err := S.Cache.SMembersMsg(S.ctx, db.RoomDeletedName(room))
+	if err != nil {
+		return fmt.Errorf("SMembersMsg failed,err:%w", err)
+	}
+	for _, id := range deleted {
+		if len(oldest) == 0 || db.CompareStreamID(id, oldest[0].ID) < 0 {
+			_, err = S.Cache.SRemMsg(S.ctx, id, db.RoomDeletedName(room))
+			if err != nil {
+				return fmt.Errorf("SRemMsg failed,err:%w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// roomHistory 返回房间最近n条消息，被编辑或删除过的消息替换为最新版本
+func (S *Server) roomHistory(ctx context.Context, room string, n int) ([]message.HistoryItem, error) {
+	res, err := S.Streams.XRangeMsg(ctx, db.RoomStreamName(room), n)
+	if err != nil {
+		return nil, fmt.Errorf("XRangeMsg failed,err:%w", err)
+	}
+	edits, err := S.Cache.HGetAllMsg(ctx, db.RoomEditsName(room))
+	if err != nil {
+		return nil, fmt.Errorf("HGetAllMsg failed,err:%w", err)
+	}
+	members, err := S.Cache.SMembersMsg(ctx, db.RoomDeletedName(room))
+	if err != nil {
+		return nil, fmt.Errorf("SMembersMsg failed,err:%w", err)
+	}
+	deleted := make(map[string]bool, len(members))
+	for _, id := range members {
+		deleted[id] = true
+	}
+	items := make([]message.HistoryItem, 0, len(res))
+	for _, v := range res {
+		his, err := message.DecodeStored(v.Codec, v.Data)
+		if err != nil {
+			log.Printf("roomHistory DecodeStored failed,err:%v\n", err)
+			continue
+		}
+		item := message.HistoryItem{
+			ID:      v.ID,
+			Time:    db.StreamIDTime(v.ID).UnixMilli(),
+			Content: his.Content,
+		}
+		if his.Sender != nil {
+			item.Sender = his.Sender.UserName
+		}
+		if deleted[v.ID] {
+			item.Content, item.Deleted = message.DeletedText, true
+		} else if data, ok := edits[v.ID]; ok {
+			update := &message.MsgUpdate{}
+			err = message.GetPayload(&common.Message{Content: data}, update)
+			if err != nil {
+				log.Printf("roomHistory GetPayload failed,err:%v\n", err)
+			} else if update.Deleted {
+				item.Content, item.Deleted = message.DeletedText, true
+			} else {
+				item.Content, item.Edited = update.Content, true
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// historyLine 历史消息的一行，例如"[2006-01-02 15:04:05 #1700000000000-0]->alice:你好(已编辑)"
+func historyLine(room string, item message.HistoryItem) string {
+	line := fmt.Sprintf("[%v #%v]->%v%v:%v", formatTime(time.UnixMilli(item.Time)), item.ID, roomPrefix(room), item.Sender, item.Content)
+	if item.Edited {
+		line += message.EditedMark
+	}
+	return line
+}
@@ -0,0 +1,130 @@
+package handServer
+
+import (
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/message"
+	"sync"
+	"time"
+)
+
+// HandleEphemeral 处理临时事件，不进消息流，直接转发给本实例和其他实例上的在线用户
+func (S *Server) HandleEphemeral(msg *common.Message) {
+	switch msg.Type {
+	case message.Typing:
+		S.HandleTyping(msg)
+	}
+}
+
+// HandleTyping 转发正在输入事件，To非空时发给私聊对象，否则发给房间中的其他成员。
+// 同一用户在同一位置TypingInterval内的多次输入合并为间隔结束时的一次补发，隐身的用户不转发
+func (S *Server) HandleTyping(msg *common.Message) {
+	C := msg.Sender
+	//隐身的用户在其他人看来不在线，转发输入事件会暴露其在线
+	if S.invisible(C.UserName) {
+		return
+	}
+	event := &common.Message{
+		Sender: &common.Client{UserName: C.UserName},
+		Type:   message.Typing,
+	}
+	if msg.To != "" {
+		if msg.To == C.UserName {
+			return
+		}
+		event.To = msg.To
+		send := func() { S.sendUser(msg.To, event) }
+		if S.allowTyping(C.UserName, "@"+msg.To, send) {
+			send()
+		}
+		return
+	}
+	room := roomOf(msg)
+	//不在房间中的不回复提示，直接丢弃
+	if ok, err := S.isRoomMember(room, C.UserName); err != nil || !ok {
+		return
+	}
+	event.Room = room
+	send := func() { S.BroadcastRoom(room, C.UserName, event) }
+	trailing := func() {
+		//补发时用户可能已经离开了房间
+		if ok, err := S.isRoomMember(room, C.UserName); err == nil && ok {
+			send()
+		}
+	}
+	if S.allowTyping(C.UserName, room, trailing) {
+		send()
+	}
+}
+
+// invisible 判断用户是否设置了隐身
+func (S *Server) invisible(username string) bool {
+	return S.localPresence(username).Status == message.StatusInvisible
+}
+
+// typingTarget 用户在一个位置（房间名或@私聊对象）的输入事件状态
+type typingTarget struct {
+	last    time.Time   // 最后一次转发的时间
+	pending *time.Timer // 间隔内又有输入时安排的补发，为nil表示没有
+}
+
+// typingState 用户在各位置的输入事件状态，补发在定时器协程中进行，需要加锁
+type typingState struct {
+	mu      sync.Mutex
+	targets map[string]*typingTarget
+}
+
+// allowTyping 判断用户在target的输入事件是否立即转发。距上次转发不到TypingInterval时不立即转发，
+// 而是安排在间隔结束时调用trailing补发一次，间隔内再多的输入也只补发一次
+func (S *Server) allowTyping(username string, target string, trailing func()) bool {
+	val, _ := S.typing.LoadOrStore(username, &typingState{targets: make(map[string]*typingTarget)})
+	state := val.(*typingState)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	now := time.Now()
+	//顺便清掉过期的记录，避免切换过很多房间的用户记录不断变多
+	for k, t := range state.targets {
+		if t.pending == nil && now.Sub(t.last) >= S.cfg.TypingInterval {
+			delete(state.targets, k)
+		}
+	}
+	t, ok := state.targets[target]
+	if !ok {
+		state.targets[target] = &typingTarget{last: now}
+		return true
+	}
+	if t.pending != nil {
+		return false
+	}
+	t.pending = time.AfterFunc(t.last.Add(S.cfg.TypingInterval).Sub(now), func() {
+		state.mu.Lock()
+		//用户已经离开，补发被取消
+		if t.pending == nil {
+			state.mu.Unlock()
+			return
+		}
+		t.pending = nil
+		t.last = time.Now()
+		state.mu.Unlock()
+		if !S.invisible(username) {
+			trailing()
+		}
+	})
+	return false
+}
+
+// stopTyping 用户离开时清除输入事件状态，取消还没有补发的事件
+func (S *Server) stopTyping(username string) {
+	val, ok := S.typing.LoadAndDelete(username)
+	if !ok {
+		return
+	}
+	state := val.(*typingState)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, t := range state.targets {
+		if t.pending != nil {
+			t.pending.Stop()
+			t.pending = nil
+		}
+	}
+}
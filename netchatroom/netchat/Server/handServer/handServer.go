@@ -1,221 +1,248 @@
 package handServer
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"github.com/go-sql-driver/mysql"
-	"github.com/redis/go-redis/v9"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
 	"netchatroom/netchat/db"
 	"netchatroom/netchat/message"
+	"netchatroom/netchat/utils"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
-	Clients sync.Map             // 用来存储在线客户端
-	MsgChan chan *common.Message // 消息通道
+	db.Stores                        // 账号、缓存、消息流和排行榜的存储
+	cfg       config.ServerConfig    // 服务端配置
+	instance  string                 // 集群中本实例的标识
+	Clients   sync.Map               // 用来存储在线客户端
+	shards    []chan *common.Message // 按发送者分片的消息通道，见Dispatch
+	detached  sync.Map               // 断线等待重连的用户，username -> *time.Timer
+	rooms     sync.Map               // 已启动消费协程的房间
+	lastSend  sync.Map               // 慢速模式下用户在各房间最后一次发言的时间，room|username -> time.Time
+	active    sync.Map               // 用户最后一次发送消息的时间，心跳不算，username -> time.Time
+	statuses  sync.Map               // 用户设置的在线状态，username -> message.StatusRequest
+	away      sync.Map               // 空闲超过AwayAfter自动显示为离开的用户，username -> struct{}
+	typing    sync.Map               // 用户在各位置的输入事件状态，username -> *typingState
+
+	ctx          context.Context    // 服务端的生命周期，处理消息时的存储操作使用，Shutdown最后取消
+	cancel       context.CancelFunc // 取消ctx
+	consume      context.Context    // 取消后消息流的消费协程处理完当前消息就退出
+	stopConsume  context.CancelFunc // 取消consume
+	closing      atomic.Bool        // 正在关闭，读协程不再把断线当作异常
+	stopDispatch chan struct{}      // 关闭后Dispatch不再接收消息，分片处理完剩余消息后退出
+	dispatchDone chan struct{}      // 所有分片处理协程退出后关闭
+	readers      sync.WaitGroup     // 连接的读协程
+	readerConns  sync.Map           // 读协程正在读取的连接，不论用户是否已经加入S.Clients，common.Conn -> struct{}
+	consumers    sync.WaitGroup     // 房间流和私聊收件箱的消费协程
+	inboxes      sync.Map           // 私聊收件箱协程，username -> context.CancelFunc
+	servingMu    sync.Mutex         // 保护listeners和httpServers
+	listeners    []net.Listener     // Serve正在接受连接的监听
+	httpServers  []*http.Server     // WebSocket接入和HTTP接口
+}
+
+// NewServer 按配置创建服务端，生产环境使用db.NewStores，测试使用db.NewMemStore
+func NewServer(cfg *config.ServerConfig, stores db.Stores) *Server {
+	S := &Server{
+		Stores:   stores,
+		cfg:      *cfg,
+		instance: cfg.InstanceID,
+		shards:   make([]chan *common.Message, cfg.DispatchShards),
+
+		stopDispatch: make(chan struct{}),
+		dispatchDone: make(chan struct{}),
+	}
+	if S.instance == "" {
+		S.instance = newInstanceID()
+	}
+	S.ctx, S.cancel = context.WithCancel(context.Background())
+	S.consume, S.stopConsume = context.WithCancel(S.ctx)
+	for i := range S.shards {
+		S.shards[i] = make(chan *common.Message, cfg.MsgChanSize)
+	}
+	return S
 }
 
-// Broadcast 服务器广播
+// Broadcast 服务器广播，对集群中除了发送者的所有在线用户发送
 func (S *Server) Broadcast(username string, msg *common.Message) {
-	//对除了发送者的所有在线用户发送
-	S.Clients.Range(func(_, value interface{}) bool {
-		val, _ := value.(*common.Client)
-		if val.UserName != username {
-			err := message.SendMsg(val.Conn, msg)
-			if err != nil {
-				log.Printf("Broadcast SendMsg failed,err:%v\n", err)
-			}
-		}
-		return true
-	})
+	S.broadcastLocal(username, msg)
+	S.publish(&clusterEvent{Kind: eventBroadcast, Msg: msg, Except: username})
 }
 
 // ReceiveToChan 接收消息
 func (S *Server) ReceiveToChan(C *common.Client) {
+	S.active.Store(C.UserName, time.Now())
 	for {
 		msg, err := message.ReciveMsg(C.Conn)
 		if err != nil {
-			//客户端主动退出
-			if errors.Is(err, io.EOF) || strings.Contains(err.Error(), "use of closed network connection") {
+			//服务端正在关闭，连接由Shutdown统一关闭
+			if S.closing.Load() {
 				return
 			}
-
-			//客户端异常退出
-			var opErr *net.OpError
-			if errors.As(err, &opErr) {
-				s := strings.ToLower(opErr.Err.Error())
-				if strings.Contains(s, "forcibly closed") {
-					S.MsgChan <- &common.Message{
-						Sender: C,
-						Type:   message.Quit,
-					}
-					return
-				}
+			//跟不上或写失败被服务端断开的，与客户端异常断开一样等待重连
+			if errors.Is(err, ErrSlowConsumer) || errors.Is(err, ErrWriteFailed) {
+				log.Printf("ReceiveToChan %v disconnected,err:%v\n", C.UserName, err)
+				S.Detach(C)
+				return
+			}
+			//服务端自己关闭的连接（离开或被新连接接管）
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
 			}
 			//net.Timeout()返回一个bool值，其判断该错误是否为超时错误
 			//将错误类型断言为net.Error调用其下的net.Timeout函数
 			var netErr net.Error
-			if errors.As(err, &netErr) {
-				if netErr.Timeout() {
-					S.MsgChan <- &common.Message{
-						Content: fmt.Sprintf("%v心跳超时，强行踢出!", C.UserName),
-					}
-					S.MsgChan <- &common.Message{
-						Sender: C,
-						Type:   message.Quit,
-					}
-					return
-				}
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				fmt.Printf("[系统消息]%v心跳超时!\n", C.UserName)
+			} else if !errors.Is(err, io.EOF) {
+				log.Printf("ReceiveToChan ReciveMsg failed,err:%v\n", err)
 			}
-			log.Printf("ReceiveToChan ReciveMsg failed,err:%v\n", err)
+			//客户端异常断开，保留在线状态等待重连
+			S.Detach(C)
 			return
 		}
-		msg.Sender.Conn = C.Conn
-		S.MsgChan <- msg
-	}
-}
-
-// HandleUsernameStreamMsg 处理私聊流中的消息
-func (S *Server) HandleUsernameStreamMsg(C *common.Client) {
-	for {
-		msgID, msgStr, err := db.XReadGroupMsg(C.UserName+"_stream", C.UserName+"_group", C.UserName+"_consumer")
-		if err != nil {
-			log.Printf("HandleUsernameStreamMsg db.XReadGroupMsg failed,err:%v\n", err)
-			continue
-		}
-		msg, err := message.JsonToMsg(msgStr)
-		if err != nil {
-			log.Printf("HandleUsernameStreamMsg JsonToMsg failed,err:%v\n", err)
-			continue
+		//发送者以服务端记录的登录用户为准，防止客户端伪造用户名
+		msg.Sender = C
+		if msg.Type != message.HeartMsg {
+			S.markActive(C.UserName)
 		}
-		if msg.Sender.UserName == "[退出信号]" {
-			//直接确认
-			err = db.XAckMsg(msgID, C.UserName+"_stream", C.UserName+"_group")
+		S.Dispatch(msg)
+		//客户端主动退出，注销会话令牌后不再读取
+		if msg.Type == message.Quit {
+			err = S.Cache.DelSession(S.ctx, C.Token)
 			if err != nil {
-				log.Printf("HandleUsernameStreamMsg db.XAckMsg failed,err:%v\n", err)
+				log.Printf("ReceiveToChan DelSession failed,err:%v\n", err)
 			}
 			return
 		}
-		receiveC, _ := S.Clients.Load(C.UserName)
-		err = message.SendMsg(receiveC.(*common.Client).Conn, &common.Message{
-			Content: fmt.Sprintf("->%v私聊你:%v", msg.Sender.UserName, msg.Content),
-		})
-		if err != nil {
-			log.Printf("HandleUsernameStreamMsg SendMsg failed,err:%v\n", err)
-			return
-		}
-
-		//发送完确认
-		err = db.XAckMsg(msgID, C.UserName+"_stream", C.UserName+"_group")
-		if err != nil {
-			log.Printf("HandleUsernameStreamMsg db.XAckMsg failed,err:%v\n", err)
-			continue
-		}
 	}
 }
 
-// HandleMsgStream 处理群聊流中的消息
-func (S *Server) HandleMsgStream() {
+// HandleUsernameStreamMsg 处理私聊流中的消息，先补发上次没确认的，用户离开或服务端关闭时ctx被取消后返回
+func (S *Server) HandleUsernameStreamMsg(ctx context.Context, C *common.Client) {
+	defer S.consumers.Done()
+	S.ReplayPending(C)
 	for {
-		msgID, msgStr, err := db.XReadGroupMsg(db.ReceiveStreamName, db.GroupName, db.ConsumerName)
-		if err != nil {
-			log.Printf("HandleMsgStream db.XReadGroupMsg failed,err:%v\n", err)
-			continue
-		}
-		msg, err := message.JsonToMsg(msgStr)
+		entry, err := S.Streams.XReadGroupMsg(ctx, db.InboxStreamName(C.UserName), db.InboxGroupName(C.UserName), db.InboxConsumerName(C.UserName))
 		if err != nil {
-			log.Printf("HandleMsgStream JsonToMsg failed,err:%v\n", err)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("HandleUsernameStreamMsg db.XReadGroupMsg failed,err:%v\n", err)
+			time.Sleep(time.Second)
 			continue
 		}
-		switch msg.Type {
-		case message.PublicMsg:
-			S.HandlePublicMsg(msg, msgID)
-		default:
-			continue
-			//err = db.XAckMsg(msgID, db.ReceiveStreamName, db.GroupName)
-			//if err != nil {
-			//	log.Printf("HandleMsgStream db.XAckMsg failed,err%v", err)
-			//}
+		//没有送达的不确认，由ReclaimInboxes重新投递
+		err = S.deliverInbox(C.UserName, entry)
+		if err != nil && !errors.Is(err, errInboxOffline) {
+			log.Printf("HandleUsernameStreamMsg deliverInbox failed,err:%v\n", err)
 		}
 	}
 }
 
-// HandleMsgChan 处理管道中的消息进行相应操作，进不进流
-func (S *Server) HandleMsgChan() {
-	for {
-		msg := <-S.MsgChan
-		switch msg.Type {
-		case message.Join:
-			S.HandleJoin(msg.Sender)
-		case message.Quit:
-			S.HandleLeave(msg.Sender)
-		case message.PublicMsg:
-			rdbMsg, err := message.MsgToJson(msg)
-			if err != nil {
-				log.Printf("HandleMsgChan message.MsgToJson1 failed,err:%v\n", err)
-			}
-			//加到接收消息
-			err = db.XAddMsg(rdbMsg, db.ReceiveStreamName)
-			if err != nil {
-				log.Printf("HandleMsgChan db.XAddMsg1 failed,err:%v\n", err)
-			}
-		case message.PrivateMsg:
-			S.HandlePrivateMsg(msg)
-		case message.HeartMsg:
-			err := msg.Sender.Conn.SetReadDeadline(time.Now().Add(50 * time.Second))
-			if err != nil {
-				log.Printf("HandleMsgChan SetReadDeadline failed,err:%v\n", err)
-			}
-		case message.CheckUser:
-			S.HandleCheckUser(msg.Sender)
-		case message.CheckRankList:
-			S.HandleCheckRankList(msg.Sender)
-		case message.PublicHistory:
-			S.HandlePublicHistory(msg)
-		case message.PrivateHistory:
-			S.HandlePrivateHistory(msg)
-		default:
-			fmt.Printf("[系统消息]%v\n", msg.Content)
+// HandleMsg 处理一条客户端消息进行相应操作，进不进流
+func (S *Server) HandleMsg(msg *common.Message) {
+	switch msg.Type {
+	case message.Join:
+		S.HandleJoin(msg.Sender)
+	case message.Quit:
+		S.HandleLeave(msg.Sender)
+	case message.PublicMsg:
+		S.HandleRoomMsg(msg)
+	case message.PrivateMsg:
+		S.HandlePrivateMsg(msg)
+	case message.HeartMsg:
+		//正在关闭时读超时已经由Shutdown设置，不再推后
+		if S.closing.Load() {
+			return
 		}
+		err := msg.Sender.Conn.SetReadDeadline(time.Now().Add(S.cfg.HeartbeatTimeout))
+		if err != nil {
+			log.Printf("HandleMsg SetReadDeadline failed,err:%v\n", err)
+		}
+	case message.CheckUser:
+		S.HandleCheckUser(msg.Sender)
+	case message.CheckRankList:
+		S.HandleCheckRankList(msg)
+	case message.PublicHistory:
+		S.HandlePublicHistory(msg)
+	case message.PrivateHistory:
+		S.HandlePrivateHistory(msg)
+	case message.CreateRoom:
+		S.HandleCreateRoom(msg)
+	case message.JoinRoom:
+		S.HandleJoinRoom(msg)
+	case message.LeaveRoom:
+		S.HandleLeaveRoom(msg)
+	case message.ListRooms:
+		S.HandleListRooms(msg)
+	case message.Moderate:
+		S.HandleModerate(msg)
+	case message.FetchUnread:
+		S.HandleFetchUnread(msg)
+	case message.ReadReceipt:
+		S.HandleReadReceipt(msg)
+	case message.SetStatus:
+		S.HandleSetStatus(msg)
+	case message.Whois:
+		S.HandleWhois(msg)
+	case message.EditMsg:
+		S.HandleEditMsg(msg)
+	case message.DeleteMsg:
+		S.HandleDeleteMsg(msg)
+	default:
+		fmt.Printf("[系统消息]%v\n", msg.Content)
 	}
-
 }
 
-// HandlePublicHistory 处理群聊历史消息
+// HandlePublicHistory 处理房间历史消息
 func (S *Server) HandlePublicHistory(msg *common.Message) {
 	n, err := strconv.Atoi(msg.Content)
 	if err != nil {
 		log.Printf("HandlePublicHistory strconv.Atoi failed,err:%v\n", err)
 		return
 	}
-	res, err := db.XRangeMsg(db.ReceiveStreamName, n)
+	room := roomOf(msg)
+	if !S.checkRoomMember(msg.Sender, room) {
+		return
+	}
+	items, err := S.roomHistory(S.ctx, room, n)
 	if err != nil {
-		log.Printf("HandlePublicHistory XRangeMsg failed,err:%v", err)
+		log.Printf("HandlePublicHistory roomHistory failed,err:%v", err)
 		return
 	}
 
 	list := ""
-	for _, v := range res {
-		his, err := message.JsonToMsg(v)
-		if err != nil {
-			log.Printf("HandlePublicHistory JsonToMsg failed,err:%v", err)
-			return
-		}
-		list = list + "->" + his.Sender.UserName + ":" + his.Content + "\n"
+	for _, item := range items {
+		list = list + historyLine(room, item) + "\n"
 	}
 	err = message.SendMsg(msg.Sender.Conn, &common.Message{
 		Type:    message.PublicHistory,
+		Room:    room,
 		Content: list,
 	})
-	fmt.Printf("[系统消息]%s请求查看了群聊历史消息\n", msg.Sender.UserName)
+	if err != nil {
+		log.Printf("HandlePublicHistory SendMsg failed,err:%v\n", err)
+	}
+	fmt.Printf("[系统消息]%s请求查看了房间%s的历史消息\n", msg.Sender.UserName, room)
+}
+
+// privateStreamName 两个用户之间的私聊历史流，运用比较来统一key值，确保同一个流
+func privateStreamName(a string, b string) string {
+	if a > b {
+		return a + "And" + b
+	}
+	return b + "And" + a
 }
 
 // HandlePrivateHistory 处理私聊历史消息
@@ -226,31 +253,27 @@ func (S *Server) HandlePrivateHistory(msg *common.Message) {
 		return
 	}
 	//判断该用户是否存在
-	_, err = db.QueryUsername(msg.To)
+	exists, err := S.userExists(msg.To)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			er := message.SendMsg(msg.Sender.Conn, &common.Message{
-				Content: "该用户名不存在，请检查输入",
-			})
-			if er != nil {
-				log.Printf("HandlePrivateHistory QueryUsername SendMsg failed,err:%v\n", er)
-			}
-		}
+		log.Printf("HandlePrivateHistory userExists failed,err:%v\n", err)
 		return
 	}
-	var streamName string
-	if msg.Sender.UserName > msg.To {
-		streamName = msg.Sender.UserName + "And" + msg.To
-	} else {
-		streamName = msg.To + "And" + msg.Sender.UserName
+	if !exists {
+		er := message.SendMsg(msg.Sender.Conn, &common.Message{
+			Content: "该用户名不存在，请检查输入",
+		})
+		if er != nil {
+			log.Printf("HandlePrivateHistory userExists SendMsg failed,err:%v\n", er)
+		}
+		return
 	}
-	res, err := db.XRangeMsg(streamName, n)
+	items, err := S.privateHistory(S.ctx, msg.Sender.UserName, msg.To, n)
 	if err != nil {
-		log.Printf("HandlePrivateHistory db.XRangeMsg failed,err:%v\n", err)
+		log.Printf("HandlePrivateHistory privateHistory failed,err:%v\n", err)
 	}
 	list := ""
-	for _, v := range res {
-		list = list + v + "\n"
+	for _, item := range items {
+		list = list + fmt.Sprintf("[私聊]%v:%v", item.Sender, item.Content) + "\n"
 	}
 	err = message.SendMsg(msg.Sender.Conn, &common.Message{
 		Type:    message.PrivateHistory,
@@ -259,69 +282,96 @@ func (S *Server) HandlePrivateHistory(msg *common.Message) {
 	fmt.Printf("[系统消息]%s请求查看了与%s的私聊历史消息\n", msg.Sender.UserName, msg.To)
 }
 
-// HandlePublicMsg 处理流中公聊的消息
-func (S *Server) HandlePublicMsg(msg *common.Message, msgID string) {
-	defer func() {
-		err := db.XAckMsg(msgID, db.ReceiveStreamName, db.GroupName)
-		if err != nil {
-			log.Printf("HandlePublicMsg db.XAckMsg failed,err:%v", err)
-			return
-		}
-	}()
-	S.Broadcast(msg.Sender.UserName, &common.Message{
-		Content: fmt.Sprintf("->%v:%v", msg.Sender.UserName, msg.Content),
-	})
-	fmt.Printf("->%v:%v\n", msg.Sender.UserName, msg.Content)
-	//用户公聊消息触发添加活跃度
-	err := db.ZIncrMsg(msg.Sender.UserName, db.ZSetName)
+// privateHistory 返回两个用户之间最近n条私聊。私聊历史流中的条目用发送者协商出的编解码器存储，
+// 没有codec标记的旧条目是"[私聊]发送者:内容"格式的文本
+func (S *Server) privateHistory(ctx context.Context, a string, b string, n int) ([]message.HistoryItem, error) {
+	res, err := S.Streams.XRangeMsg(ctx, privateStreamName(a, b), n)
 	if err != nil {
-		log.Printf("ReceiveToChan ReceiveMsg failed,err:%v\n", err)
+		return nil, fmt.Errorf("XRangeMsg failed,err:%w", err)
 	}
+	items := make([]message.HistoryItem, 0, len(res))
+	for _, v := range res {
+		item := message.HistoryItem{
+			ID:   v.ID,
+			Time: db.StreamIDTime(v.ID).UnixMilli(),
+		}
+		if v.Codec == "" {
+			item.Sender, item.Content, _ = strings.Cut(strings.TrimPrefix(v.Data, "[私聊]"), ":")
+		} else {
+			his, err := message.DecodeStored(v.Codec, v.Data)
+			if err != nil {
+				log.Printf("privateHistory DecodeStored failed,err:%v\n", err)
+				continue
+			}
+			item.Content = his.Content
+			if his.Sender != nil {
+				item.Sender = his.Sender.UserName
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// HandlePublicMsg 处理房间流中的消息，每个实例都会读到，只发给本实例上的房间成员，由HandleRoomStream确认
+func (S *Server) HandlePublicMsg(msg *common.Message, msgID string) {
+	room := roomOf(msg)
+	if msg.Sender == nil {
+		log.Printf("HandlePublicMsg %v has no sender\n", msgID)
+		return
+	}
+	S.broadcastRoomLocal(room, msg.Sender.UserName, &common.Message{
+		Type:    message.PublicMsg,
+		Sender:  &common.Client{UserName: msg.Sender.UserName},
+		Room:    room,
+		ID:      msgID,
+		Time:    db.StreamIDTime(msgID).UnixMilli(),
+		Content: fmt.Sprintf("->%v%v:%v", roomPrefix(room), msg.Sender.UserName, msg.Content),
+	})
+	fmt.Printf("->%v%v:%v\n", roomPrefix(room), msg.Sender.UserName, msg.Content)
 }
 
 // HandlePrivateMsg 处理私聊的消息
 func (S *Server) HandlePrivateMsg(msg *common.Message) {
 	//判断该用户是否存在
-	_, err := db.QueryUsername(msg.To)
+	exists, err := S.userExists(msg.To)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			er := message.SendMsg(msg.Sender.Conn, &common.Message{
-				Content: "该用户名不存在，请检查输入",
-			})
-			if er != nil {
-				log.Printf("HandlePrivateMsg QueryUsername SendMsg failed,err:%v\n", er)
-			}
+		log.Printf("HandlePrivateMsg userExists failed,err:%v\n", err)
+		return
+	}
+	if !exists {
+		er := message.SendMsg(msg.Sender.Conn, &common.Message{
+			Content: "该用户名不存在，请检查输入",
+		})
+		if er != nil {
+			log.Printf("HandlePrivateMsg userExists SendMsg failed,err:%v\n", er)
 		}
 		return
 	}
+	if !S.checkPrivateSend(msg.Sender) {
+		return
+	}
 	//直接发送到To用户的私聊收件箱中
-	rdbMsg, err := message.MsgToJson(msg)
+	rdbMsg, codec, err := message.EncodeStored(msg.Sender.Conn, msg)
 	if err != nil {
-		log.Printf("HanlePrivateMsg message.MsgToJson failed,err:%v\n", err)
+		log.Printf("HanlePrivateMsg message.EncodeStored failed,err:%v\n", err)
 		return
 	}
 	//加到接收消息
-	err = db.XAddMsg(rdbMsg, msg.To+"_stream")
+	_, err = S.Streams.XAddMsg(S.ctx, rdbMsg, codec, db.InboxStreamName(msg.To))
 	if err != nil {
 		log.Printf("HanlePrivateMsg db.XAddMsg failed,err:%v\n", err)
 		return
 	}
 	fmt.Printf("[系统消息]%v私聊%v:%v\n", msg.Sender.UserName, msg.To, msg.Content)
-	//运用比较来统一key值，确保同一个流
-	var streamName string
-	if msg.Sender.UserName > msg.To {
-		streamName = msg.Sender.UserName + "And" + msg.To
-	} else {
-		streamName = msg.To + "And" + msg.Sender.UserName
-	}
-	rdbMMsg := fmt.Sprintf("[私聊]%v:%v", msg.Sender.UserName, msg.Content)
-	//加入特定的私聊历史消息流
-	err = db.XAddMsg(rdbMMsg, streamName)
+	streamName := privateStreamName(msg.Sender.UserName, msg.To)
+	//加入特定的私聊历史消息流，与收件箱使用同样的编码
+	_, err = S.Streams.XAddMsg(S.ctx, rdbMsg, codec, streamName)
 	if err != nil {
 		log.Printf("HandleMsgChan db.XAddMsg4 failed,err:%v\n", err)
 	}
 	//用户私聊消息触发添加活跃度
-	err = db.ZIncrMsg(msg.Sender.UserName, db.ZSetName)
+	err = S.Ranks.ZIncrMsg(S.ctx, msg.Sender.UserName, db.ZSetName)
 	if err != nil {
 		log.Printf("ReceiveToChan ReceiveMsg failed,err:%v\n", err)
 	}
@@ -330,9 +380,18 @@ func (S *Server) HandlePrivateMsg(msg *common.Message) {
 // HandleJoin 处理用户的加入消息
 func (S *Server) HandleJoin(C *common.Client) {
 	S.Clients.Store(C.UserName, C)
-	S.MsgChan <- &common.Message{
-		Content: fmt.Sprintf("%v加入聊天室!", C.UserName),
-	}
+	//记录在线位置，用户在其他实例上断线等待重连的旧会话由该实例关闭
+	S.resetPresence(C.UserName)
+	S.setPresence(C.UserName)
+	S.publish(&clusterEvent{Kind: eventTakeover, To: C.UserName})
+	//私聊收件箱协程跟随登录会话，断线重连时不需要重新启动
+	ctx, cancel := context.WithCancel(S.consume)
+	if old, loaded := S.inboxes.Swap(C.UserName, cancel); loaded {
+		old.(context.CancelFunc)()
+	}
+	S.consumers.Add(1)
+	go S.HandleUsernameStreamMsg(ctx, C)
+	fmt.Printf("[系统消息]%v加入聊天室!\n", C.UserName)
 	S.Broadcast(C.UserName, &common.Message{
 		Content: fmt.Sprintf("[系统消息]%v加入聊天室", C.UserName),
 	})
@@ -340,34 +399,57 @@ func (S *Server) HandleJoin(C *common.Client) {
 
 // HandleLeave 处理用户的离开消息
 func (S *Server) HandleLeave(C *common.Client) {
-	S.Clients.Delete(C.UserName)
-	S.MsgChan <- &common.Message{
-		Content: fmt.Sprintf("%v离开了聊天室!", C.UserName),
+	//已经被重连的新连接接管，只关闭旧连接
+	if !S.Clients.CompareAndDelete(C.UserName, C) {
+		err := C.Conn.Close()
+		if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			log.Printf("C.Conn.Close failed,err:%v\n", err)
+		}
+		return
 	}
-	S.Broadcast(C.UserName, &common.Message{
-		Content: fmt.Sprintf("[系统消息]%v离开了聊天室!", C.UserName),
-	})
-	//做完退出操作后关闭Conn
-	err := C.Conn.Close()
+	if timer, ok := S.detached.LoadAndDelete(C.UserName); ok {
+		timer.(*time.Timer).Stop()
+	}
+	S.active.Delete(C.UserName)
+	S.stopTyping(C.UserName)
+	//隐身的用户在其他人看来早已离线，不广播离开
+	invisible := S.localPresence(C.UserName).Status == message.StatusInvisible
+	S.resetPresence(C.UserName)
+	err := S.Cluster.DelPresence(S.ctx, C.UserName, S.instance)
 	if err != nil {
+		log.Printf("HandleLeave DelPresence failed,err:%v\n", err)
+	}
+	S.recordLastSeen(C.UserName)
+	fmt.Printf("[系统消息]%v离开了聊天室!\n", C.UserName)
+	if !invisible {
+		S.Broadcast(C.UserName, &common.Message{
+			Content: fmt.Sprintf("[系统消息]%v离开了聊天室!", C.UserName),
+		})
+	}
+	//做完退出操作后关闭Conn
+	err = C.Conn.Close()
+	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
 		log.Printf("C.Conn.Close failed,err:%v\n", err)
 	}
-	//写一个退出信号关闭单独的私聊协程
-	err = db.XAddMsg("{\"Sender\":{\"UserName\":\"[退出信号]\"},\"Type\":5,\"To\":\"wuhan\"}", C.UserName+"_stream")
-	if err != nil {
-		log.Printf("HandleLeave XAddMsg [退出信号] failed,err:%v\n", err)
-		return
+	//停止单独的私聊协程
+	if cancel, ok := S.inboxes.LoadAndDelete(C.UserName); ok {
+		cancel.(context.CancelFunc)()
 	}
 }
 
-// HandleCheckRankList 处理用户查看活跃度排行榜功能
-func (S *Server) HandleCheckRankList(C *common.Client) {
-	lists, err := db.ZRevRangeMsg(db.ZSetName)
+// HandleCheckRankList 处理用户查看房间活跃度排行榜功能
+func (S *Server) HandleCheckRankList(msg *common.Message) {
+	C := msg.Sender
+	room := roomOf(msg)
+	if !S.checkRoomMember(C, room) {
+		return
+	}
+	lists, err := S.Ranks.ZRevRangeMsg(S.ctx, db.RoomZSetName(room))
 	if err != nil {
 		log.Printf("HandleCheckRankList failed,err:%v\n", err)
 		return
 	}
-	res := "-------" + "活跃度排行榜" + "-------\n"
+	res := "-------" + roomPrefix(room) + "活跃度排行榜" + "-------\n"
 	res = res + fmt.Sprintf("%-6s%-7s%-6s\n", "排名", "用户名", "活跃度")
 	for i, list := range lists {
 		res = res + fmt.Sprintf("%-7d%-10s%-6.0f\n", i+1, list.Member, list.Score)
@@ -380,31 +462,11 @@ func (S *Server) HandleCheckRankList(C *common.Client) {
 	if err != nil {
 		log.Printf("HandleCheckRankList SendMsg res failed,err:%v\n", err)
 	}
-	fmt.Printf("[系统消息]%s请求查看了活跃度排行榜\n", C.UserName)
-}
-
-// HandleCheckUser 处理查看在线用户功能
-func (S *Server) HandleCheckUser(C *common.Client) {
-	list := ""
-	num := 0
-	S.Clients.Range(func(_, value interface{}) bool {
-		num++
-		userName := value.(*common.Client).UserName
-		list += userName + "   "
-		return true // 继续遍历所有用户
-	})
-	endList := "当前在线用户(" + strconv.Itoa(num) + "人):" + list
-	err := message.SendMsg(C.Conn, &common.Message{
-		Content: endList,
-	})
-	if err != nil {
-		log.Printf("HandleCheckUser SendMsg endList failed,err:%v\n", err)
-	}
-	fmt.Printf("[系统消息]%s请求查看了在线用户\n", C.UserName)
+	fmt.Printf("[系统消息]%s请求查看了房间%s的活跃度排行榜\n", C.UserName, room)
 }
 
 // LoginAndRegister 对登录注册消息进行区别和处理
-func (S *Server) LoginAndRegister(conn net.Conn) *common.Client {
+func (S *Server) LoginAndRegister(conn common.Conn) *common.Client {
 	for {
 		msg, err := message.ReciveMsg(conn)
 		if err != nil {
@@ -421,7 +483,8 @@ func (S *Server) LoginAndRegister(conn net.Conn) *common.Client {
 			log.Printf("LoginAndRegister ReciveMsg failed,err:%v\n", err)
 			return nil
 		}
-		msg.Sender.Conn = conn
+		//登录前的发送者只认连接本身，不信任客户端填写的信息
+		msg.Sender = &common.Client{Conn: conn}
 		switch msg.Type {
 		case message.Register:
 			S.ReplyRegister(msg)
@@ -432,141 +495,229 @@ func (S *Server) LoginAndRegister(conn net.Conn) *common.Client {
 			} else {
 				continue
 			}
+		case message.Resume:
+			if C := S.ReplyResume(msg); C != nil {
+				return C
+			} else {
+				continue
+			}
 		}
 	}
 }
 
+// ReplyAuth 回复登录注册结果
+func (S *Server) ReplyAuth(conn common.Conn, typ int, code string) {
+	S.SendAuth(conn, typ, &message.AuthResponse{Code: code})
+}
+
+// SendAuth 发送完整的登录注册回复
+func (S *Server) SendAuth(conn common.Conn, typ int, resp *message.AuthResponse) {
+	resp.Message = message.CodeText(resp.Code)
+	reply := &common.Message{Type: typ}
+	err := message.SetPayload(reply, resp)
+	if err != nil {
+		log.Printf("SendAuth SetPayload failed,err:%v\n", err)
+		return
+	}
+	err = message.SendMsg(conn, reply)
+	if err != nil {
+		log.Printf("SendAuth SendMsg %v failed,err:%v\n", resp.Code, err)
+	}
+}
+
 // ReplyRegister 用户注册消息回复
 func (S *Server) ReplyRegister(msg *common.Message) {
-	user := strings.Split(msg.Content, "/")
+	req := &message.RegisterRequest{}
+	err := message.GetPayload(msg, req)
+	if err != nil {
+		S.ReplyAuth(msg.Sender.Conn, message.Register, message.CodeBadRequest)
+		return
+	}
+	if err = message.ValidateUsername(req.Username); err != nil {
+		S.ReplyAuth(msg.Sender.Conn, message.Register, message.CodeInvalidUsername)
+		return
+	}
+	if err = message.ValidatePassword(req.Password); err != nil {
+		S.ReplyAuth(msg.Sender.Conn, message.Register, message.CodeWeakPassword)
+		return
+	}
+	//只保存加盐哈希后的密码
+	hash, err := utils.HashPassword(req.Password)
+	if err != nil {
+		log.Printf("ReplyRegister HashPassword failed,err:%v\n", err)
+		S.ReplyAuth(msg.Sender.Conn, message.Register, message.CodeInternal)
+		return
+	}
 	//加入数据库中
-	err := db.AddUser(user[0], user[1])
+	err = S.Users.AddUser(S.ctx, req.Username, hash)
 	if err != nil {
 		//判断用户名是否存在，这里有唯一约束会添加失败
-		var mysqlErr *mysql.MySQLError
-		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
-			er := message.SendMsg(msg.Sender.Conn, &common.Message{
-				Content: "该用户名已存在，请登录",
-			})
-			if er != nil {
-				log.Printf("ReplyRegister AddUser SendMsg2 failed,err:%v\n", er)
-			}
+		if errors.Is(err, db.ErrUserExists) {
+			S.ReplyAuth(msg.Sender.Conn, message.Register, message.CodeUserExists)
 		} else {
 			log.Printf("ReplyRegister AddUser failed,err:%v\n", err)
-			er := message.SendMsg(msg.Sender.Conn, &common.Message{
-				Content: "注册失败，请稍后再试",
-			})
-			if er != nil {
-				log.Printf("ReplyRegister AddUser SendMsg3 failed,err:%v\n", er)
-			}
+			S.ReplyAuth(msg.Sender.Conn, message.Register, message.CodeInternal)
 		}
 		return
 	}
+	//注册时就创建私聊收件箱，首次登录前收到的私聊同样能送达；失败时首次登录会再创建
+	err = S.createInbox(req.Username)
+	if err != nil {
+		log.Printf("ReplyRegister createInbox failed,err:%v\n", err)
+	}
 	//注册成功
-	err = message.SendMsg(msg.Sender.Conn, &common.Message{
-		Content: "ok",
-	})
+	S.ReplyAuth(msg.Sender.Conn, message.Register, message.CodeOK)
+	fmt.Printf("[系统消息]%v注册成功!\n", req.Username)
+}
+
+// rehashPassword 旧的明文密码登录成功后替换为哈希，并清掉旧版本缓存的明文
+func (S *Server) rehashPassword(username string, password string) {
+	hash, err := utils.HashPassword(password)
 	if err != nil {
-		log.Printf("ReplyRegister AddUser SendMsg4 failed,err:%v\n", err)
+		log.Printf("rehashPassword HashPassword failed,err:%v\n", err)
+		return
 	}
-	S.MsgChan <- &common.Message{
-		Content: fmt.Sprintf("%v注册成功!", user[0]),
+	err = S.Users.UpdatePassword(S.ctx, username, hash)
+	if err != nil {
+		log.Printf("rehashPassword UpdatePassword failed,err:%v\n", err)
+		return
+	}
+	err = S.Cache.DelLegacyUser(S.ctx, username)
+	if err != nil {
+		log.Printf("rehashPassword DelLegacyUser failed,err:%v\n", err)
 	}
+	fmt.Printf("[系统消息]%v的旧密码已迁移为哈希存储\n", username)
 }
 
-// ReplyLogin 用户登录消息回复
-func (S *Server) ReplyLogin(msg *common.Message) *common.Client {
-	user := strings.Split(msg.Content, "/")
-	password, err := db.GetUser(user[0])
+// userExists 判断用户是否存在，先查redis缓存再查数据库
+func (S *Server) userExists(username string) (bool, error) {
+	_, err := S.Cache.GetUser(S.ctx, username)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, db.ErrNil) {
+		log.Printf("userExists GetUser failed,err:%v\n", err)
+	}
+	_, err = S.Users.QueryUsername(S.ctx, username)
 	if err != nil {
-		if !errors.Is(err, redis.Nil) {
-			log.Printf("ReplyLogin GetUser failed,err:%v\n", err)
-		}
-		//报错后继续查数据库，如果都查不到就返回
-		password, err = db.QueryUsername(user[0])
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				er := message.SendMsg(msg.Sender.Conn, &common.Message{
-					Content: "该用户名不存在，请注册",
-				})
-				if er != nil {
-					log.Printf("ReplyLogin QueryUsername SendMsg2 failed,err:%v\n", er)
-				}
-			} else {
-				log.Printf("ReplyLogin QueryUsername failed,err:%v\n", err)
-				er := message.SendMsg(msg.Sender.Conn, &common.Message{
-					Content: "登录失败，请稍后再试",
-				})
-				if er != nil {
-					log.Printf("ReplyLogin QueryUsername SendMsg3 failed,err:%v\n", er)
-				}
-			}
-			return nil
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
 		}
-		err = db.SetUser(user[0], password)
-		if err != nil {
-			log.Printf("ReplyLogin SetUser failed,err:%v", err)
+		return false, err
+	}
+	err = S.Cache.SetUser(S.ctx, username, "1")
+	if err != nil {
+		log.Printf("userExists SetUser failed,err:%v\n", err)
+	}
+	return true, nil
+}
+
+// authenticate 校验用户名和密码以及是否被封禁，返回登录错误码，TCP登录和HTTP接口共用
+func (S *Server) authenticate(username string, password string) string {
+	//密码哈希只存在数据库中，redis不缓存任何密码
+	hash, err := S.Users.QueryUsername(S.ctx, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return message.CodeUserNotFound
 		}
+		log.Printf("authenticate QueryUsername failed,err:%v\n", err)
+		return message.CodeInternal
 	}
-	if user[1] == password {
-		if _, ok := S.Clients.Load(user[0]); ok {
-			err = message.SendMsg(msg.Sender.Conn, &common.Message{
-				Content: "该用户名已登录...",
-			})
-			if err != nil {
-				log.Printf("ReplyLogin QueryUsername SendMsg6 failed,err:%v\n", err)
-			}
+	ok, legacy := utils.CheckPassword(hash, password)
+	if !ok {
+		return message.CodeWrongPassword
+	}
+	if legacy {
+		S.rehashPassword(username, password)
+	}
+	if S.isBanned(username) {
+		return message.CodeBanned
+	}
+	//只缓存用户存在这一非敏感信息
+	err = S.Cache.SetUser(S.ctx, username, "1")
+	if err != nil {
+		log.Printf("authenticate SetUser failed,err:%v", err)
+	}
+	return message.CodeOK
+}
+
+// ReplyLogin 用户登录消息回复
+func (S *Server) ReplyLogin(msg *common.Message) *common.Client {
+	req := &message.LoginRequest{}
+	err := message.GetPayload(msg, req)
+	if err != nil || req.Username == "" || req.Password == "" {
+		S.ReplyAuth(msg.Sender.Conn, message.Login, message.CodeBadRequest)
+		return nil
+	}
+	if code := S.authenticate(req.Username, req.Password); code != message.CodeOK {
+		S.ReplyAuth(msg.Sender.Conn, message.Login, code)
+		return nil
+	}
+	_, online := S.Clients.Load(req.Username)
+	_, detached := S.detached.Load(req.Username)
+	if online && !detached {
+		S.ReplyAuth(msg.Sender.Conn, message.Login, message.CodeAlreadyLoggedIn)
+		return nil
+	}
+	//在其他实例上在线的同样不能重复登录，断线等待重连的由本实例接管
+	if !online {
+		if p, ok := S.remotePresence(req.Username); ok && !p.Detached {
+			S.ReplyAuth(msg.Sender.Conn, message.Login, message.CodeAlreadyLoggedIn)
 			return nil
-		} else {
-			//登录成功
-			err = message.SendMsg(msg.Sender.Conn, &common.Message{
-				Content: "ok",
-			})
-			if err != nil {
-				log.Printf("ReplyLogin QueryUsername SendMsg4 failed,err:%v\n", err)
-			}
-			client := &common.Client{UserName: user[0], Conn: msg.Sender.Conn}
-			//加入到map中用于后续的查看
-			S.MsgChan <- &common.Message{
-				Sender:  client,
-				Content: fmt.Sprintf("%v加入聊天室!\n", user[0]),
-				Type:    message.Join,
-			}
-			//从登录成功起开始接收心跳，设置心跳超时时间
-			err = msg.Sender.Conn.SetReadDeadline(time.Now().Add(50 * time.Second))
-			if err != nil {
-				log.Printf("ReplyLogin SetReadDeadline failed,err:%v\n", err)
-				return nil
-			}
-			//为首次登录的用户创建用户组和流作为私聊收件箱
-			err = db.XGroupCreateMkStreamMsg(user[0]+"_stream", user[0]+"_group")
-			if err != nil {
-				log.Printf("ReplyLogin XGroupCreateMkStreamMsg failed,err:%v", err)
-				return nil
-			}
-			//为登录的用户创建或添加活跃度
-			flag, err := db.ZAddNXMsg(user[0], db.ZSetName)
-			if err != nil {
-				log.Printf("ReplyLogin ZAddNXMsg failed,err:%v", err)
-				return nil
-			}
-			//如果已经有了直接添加活跃度
-			if flag == 0 {
-				err = db.ZIncrMsg(user[0], db.ZSetName)
-				if err != nil {
-					log.Printf("ReplyLogin ZIncrMsg failed,err:%v", err)
-					return nil
-				}
-			}
-			return client
 		}
-	} else {
-		err = message.SendMsg(msg.Sender.Conn, &common.Message{
-			Content: "密码错误，请重新输入",
-		})
-		if err != nil {
-			log.Printf("ReplyLogin QueryUsername SendMsg5 failed,err:%v\n", err)
+	}
+	token, err := S.NewSession(req.Username)
+	if err != nil {
+		log.Printf("ReplyLogin NewSession failed,err:%v\n", err)
+		S.ReplyAuth(msg.Sender.Conn, message.Login, message.CodeInternal)
+		return nil
+	}
+	//断线等待重连期间用密码重新登录，同样直接接管
+	if detached {
+		if C := S.Reattach(msg.Sender.Conn, message.Login, req.Username, token); C != nil {
+			return C
 		}
+	}
+	return S.LoginSuccess(msg.Sender.Conn, message.Login, req.Username, token)
+}
+
+// LoginSuccess 登录或令牌恢复成功后加入聊天室
+func (S *Server) LoginSuccess(conn common.Conn, typ int, username string, token string) *common.Client {
+	//旧版本注册的用户没有私聊收件箱，必须在收件箱协程启动前创建
+	err := S.Streams.XGroupCreateMkStreamMsg(S.ctx, db.InboxStreamName(username), db.InboxGroupName(username))
+	if err != nil {
+		log.Printf("LoginSuccess XGroupCreateMkStreamMsg failed,err:%v", err)
+		S.ReplyAuth(conn, typ, message.CodeInternal)
+		return nil
+	}
+	//登录成功，带上离线期间的未读私聊数
+	S.SendAuth(conn, typ, &message.AuthResponse{Code: message.CodeOK, Token: token, Unread: S.unreadCounts(username)})
+	client := &common.Client{UserName: username, Conn: conn, Token: token}
+	//加入到map中用于后续的查看
+	S.Dispatch(&common.Message{
+		Sender:  client,
+		Content: fmt.Sprintf("%v加入聊天室!\n", username),
+		Type:    message.Join,
+	})
+	//从登录成功起开始接收心跳，设置心跳超时时间
+	err = conn.SetReadDeadline(time.Now().Add(S.cfg.HeartbeatTimeout))
+	if err != nil {
+		log.Printf("LoginSuccess SetReadDeadline failed,err:%v\n", err)
 		return nil
 	}
+	//为登录的用户创建或添加活跃度
+	flag, err := S.Ranks.ZAddNXMsg(S.ctx, username, db.ZSetName)
+	if err != nil {
+		log.Printf("LoginSuccess ZAddNXMsg failed,err:%v", err)
+		return nil
+	}
+	//如果已经有了直接添加活跃度
+	if flag == 0 {
+		err = S.Ranks.ZIncrMsg(S.ctx, username, db.ZSetName)
+		if err != nil {
+			log.Printf("LoginSuccess ZIncrMsg failed,err:%v", err)
+			return nil
+		}
+	}
+	return client
 }
@@ -0,0 +1,374 @@
+package handServer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"sort"
+	"time"
+)
+
+const (
+	UnreadScanLimit  = 1000 // 统计未读时最多扫描的收件箱消息数，与流的默认长度一致
+	UnreadFetchLimit = 100  // 一次最多拉取的未读私聊数
+	PendingBatch     = 100  // 补发和认领待确认私聊时每批的条数
+)
+
+// errInboxOffline 收件人不在线，私聊留在待确认列表中等登录后补发
+var errInboxOffline = errors.New("inbox owner offline")
+
+// createInbox 创建用户的私聊收件箱和已读位置，注册时调用，保证之后发来的私聊都能送达并计入未读
+func (S *Server) createInbox(username string) error {
+	err := S.Streams.XGroupCreateMkStreamMsg(S.ctx, db.InboxStreamName(username), db.InboxGroupName(username))
+	if err != nil {
+		return fmt.Errorf("XGroupCreateMkStreamMsg failed,err:%w", err)
+	}
+	err = S.Cache.HSetMsg(S.ctx, db.ReadCursorName(username), db.ReadCursorFloor, "0")
+	if err != nil {
+		return fmt.Errorf("HSetMsg failed,err:%w", err)
+	}
+	return nil
+}
+
+// readCursors 返回用户在各会话中的已读位置和共同的已读下限。
+// 旧版本注册的用户还没有已读位置，首次调用时把下限设为收件箱的最新消息，之前的私聊不算未读
+func (S *Server) readCursors(username string) (map[string]string, string, error) {
+	cursors, err := S.Cache.HGetAllMsg(S.ctx, db.ReadCursorName(username))
+	if err != nil {
+		return nil, "", fmt.Errorf("HGetAllMsg failed,err:%w", err)
+	}
+	floor, ok := cursors[db.ReadCursorFloor]
+	if ok {
+		return cursors, floor, nil
+	}
+	floor = "0"
+	last, err := S.Streams.XRangeMsg(S.ctx, db.InboxStreamName(username), 1)
+	if err != nil {
+		return nil, "", fmt.Errorf("XRangeMsg failed,err:%w", err)
+	}
+	if len(last) > 0 {
+		floor = last[0].ID
+	}
+	err = S.Cache.HSetMsg(S.ctx, db.ReadCursorName(username), db.ReadCursorFloor, floor)
+	if err != nil {
+		return nil, "", fmt.Errorf("HSetMsg failed,err:%w", err)
+	}
+	return cursors, floor, nil
+}
+
+// inboxEntry 已读下限之后的一条收件箱私聊，From为空表示不需要阅读的条目
+type inboxEntry struct {
+	ID      string
+	From    string
+	Content string
+}
+
+// inboxState 用户的已读位置、已读下限和下限之后的收件箱私聊
+type inboxState struct {
+	cursors map[string]string
+	floor   string
+	entries []inboxEntry
+}
+
+// inboxAfterFloor 读取用户已读下限之后的收件箱私聊，已读下限随已读回执前移，每次只扫描还可能未读的部分
+func (S *Server) inboxAfterFloor(username string) (*inboxState, error) {
+	cursors, floor, err := S.readCursors(username)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := S.Streams.XRangeAfterMsg(S.ctx, db.InboxStreamName(username), floor, UnreadScanLimit)
+	if err != nil {
+		return nil, fmt.Errorf("XRangeAfterMsg failed,err:%w", err)
+	}
+	state := &inboxState{cursors: cursors, floor: floor}
+	for _, entry := range entries {
+		msg, err := message.DecodeStored(entry.Codec, entry.Data)
+		if err != nil {
+			log.Printf("inboxAfterFloor DecodeStored failed,err:%v\n", err)
+			state.entries = append(state.entries, inboxEntry{ID: entry.ID})
+			continue
+		}
+		from := msg.Sender.UserName
+		//旧版本写入的退出信号
+		if from == "[退出信号]" {
+			from = ""
+		}
+		state.entries = append(state.entries, inboxEntry{ID: entry.ID, From: from, Content: msg.Content})
+	}
+	return state, nil
+}
+
+// unread 返回还没有标记为已读的私聊，按时间正序，peer非空时只返回来自peer的
+func (st *inboxState) unread(peer string) []message.UnreadMessage {
+	res := make([]message.UnreadMessage, 0)
+	for _, e := range st.entries {
+		if e.From == "" || (peer != "" && e.From != peer) {
+			continue
+		}
+		if cursor, ok := st.cursors[e.From]; ok && db.CompareStreamID(e.ID, cursor) <= 0 {
+			continue
+		}
+		res = append(res, message.UnreadMessage{ID: e.ID, From: e.From, Content: e.Content})
+	}
+	return res
+}
+
+// unreadMessages 返回收件箱中还没有标记为已读的私聊，按时间正序，peer非空时只返回来自peer的
+func (S *Server) unreadMessages(username string, peer string) ([]message.UnreadMessage, error) {
+	state, err := S.inboxAfterFloor(username)
+	if err != nil {
+		return nil, err
+	}
+	return state.unread(peer), nil
+}
+
+// advanceFloor 把已读下限移到最后一条之前全部已读的私聊，并删除不超过新下限的会话已读位置
+func (S *Server) advanceFloor(username string, state *inboxState) error {
+	floor := state.floor
+	for _, e := range state.entries {
+		if e.From != "" {
+			cursor, ok := state.cursors[e.From]
+			if !ok || db.CompareStreamID(e.ID, cursor) > 0 {
+				break
+			}
+		}
+		floor = e.ID
+	}
+	if floor == state.floor {
+		return nil
+	}
+	err := S.Cache.HSetMsg(S.ctx, db.ReadCursorName(username), db.ReadCursorFloor, floor)
+	if err != nil {
+		return fmt.Errorf("HSetMsg failed,err:%w", err)
+	}
+	//下限之前的私聊不再扫描，不超过下限的会话已读位置已经没有作用
+	var stale []string
+	for peer, cursor := range state.cursors {
+		if peer != db.ReadCursorFloor && db.CompareStreamID(cursor, floor) <= 0 {
+			stale = append(stale, peer)
+		}
+	}
+	_, err = S.Cache.HDelMsg(S.ctx, db.ReadCursorName(username), stale...)
+	if err != nil {
+		return fmt.Errorf("HDelMsg failed,err:%w", err)
+	}
+	return nil
+}
+
+// unreadCounts 按发送者统计未读私聊数，出错时记录日志并返回空，不影响登录
+func (S *Server) unreadCounts(username string) []message.UnreadCount {
+	unread, err := S.unreadMessages(username, "")
+	if err != nil {
+		log.Printf("unreadCounts unreadMessages failed,err:%v\n", err)
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, m := range unread {
+		counts[m.From]++
+	}
+	res := make([]message.UnreadCount, 0, len(counts))
+	for from, n := range counts {
+		res = append(res, message.UnreadCount{From: from, Count: n})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].From < res[j].From })
+	return res
+}
+
+// HandleFetchUnread 处理拉取未读私聊，To非空时只拉取与该用户的会话，拉取不改变已读位置
+func (S *Server) HandleFetchUnread(msg *common.Message) {
+	C := msg.Sender
+	unread, err := S.unreadMessages(C.UserName, msg.To)
+	if err != nil {
+		log.Printf("HandleFetchUnread unreadMessages failed,err:%v\n", err)
+		S.reply(C, "查询未读私聊失败，请稍后再试")
+		return
+	}
+	resp := &message.UnreadResponse{Messages: unread}
+	if len(unread) > UnreadFetchLimit {
+		resp.Messages, resp.More = unread[:UnreadFetchLimit], true
+	}
+	reply := &common.Message{Type: message.FetchUnread}
+	err = message.SetPayload(reply, resp)
+	if err != nil {
+		log.Printf("HandleFetchUnread SetPayload failed,err:%v\n", err)
+		return
+	}
+	err = message.SendMsg(C.Conn, reply)
+	if err != nil {
+		log.Printf("HandleFetchUnread SendMsg failed,err:%v\n", err)
+	}
+}
+
+// HandleReadReceipt 处理已读回执，把与对方会话的已读位置向后移动，所有会话都读过的部分计入已读下限，
+// 并通知在线的对方
+func (S *Server) HandleReadReceipt(msg *common.Message) {
+	C := msg.Sender
+	req := &message.ReadRequest{}
+	err := message.GetPayload(msg, req)
+	if err != nil || req.Peer == "" {
+		S.reply(C, "已读回执格式错误")
+		return
+	}
+	state, err := S.inboxAfterFloor(C.UserName)
+	if err != nil {
+		log.Printf("HandleReadReceipt inboxAfterFloor failed,err:%v\n", err)
+		return
+	}
+	unread := state.unread(req.Peer)
+	//只能标记到已经收到的消息，不会越过之后才到的私聊
+	cursor, n := "", 0
+	for _, m := range unread {
+		if req.ID != "" && db.CompareStreamID(m.ID, req.ID) > 0 {
+			break
+		}
+		cursor, n = m.ID, n+1
+	}
+	if n == 0 {
+		return
+	}
+	err = S.Cache.HSetMsg(S.ctx, db.ReadCursorName(C.UserName), req.Peer, cursor)
+	if err != nil {
+		log.Printf("HandleReadReceipt HSetMsg failed,err:%v\n", err)
+		return
+	}
+	state.cursors[req.Peer] = cursor
+	err = S.advanceFloor(C.UserName, state)
+	if err != nil {
+		log.Printf("HandleReadReceipt advanceFloor failed,err:%v\n", err)
+	}
+	notice := &common.Message{Type: message.ReadReceipt}
+	err = message.SetPayload(notice, &message.ReadNotice{Reader: C.UserName, Count: n})
+	if err != nil {
+		log.Printf("HandleReadReceipt SetPayload failed,err:%v\n", err)
+		return
+	}
+	S.sendUser(req.Peer, notice)
+}
+
+// deliverInbox 把收件箱中的一条私聊发给在线的收件人，写入连接后才确认。
+// 收件人不在线、消息在发送队列中被丢弃或写入失败时不确认，留在待确认列表中，登录时补发或由ReclaimInboxes重新投递
+func (S *Server) deliverInbox(username string, entry *db.StreamEntry) error {
+	//已被裁剪的消息只剩ID，没有可以投递的内容
+	if entry.Data == "" {
+		return S.ackInbox(username, entry.ID)
+	}
+	msg, err := message.DecodeStored(entry.Codec, entry.Data)
+	if err != nil {
+		return fmt.Errorf("DecodeStored failed,err:%w", err)
+	}
+	//旧版本写入的退出信号，直接确认
+	if msg.Sender.UserName == "[退出信号]" {
+		return S.ackInbox(username, entry.ID)
+	}
+	receiveC, ok := S.Clients.Load(username)
+	if !ok {
+		return errInboxOffline
+	}
+	err = writeConfirmed(receiveC.(*common.Client).Conn, privateDelivery(msg, entry.ID))
+	if err != nil {
+		return fmt.Errorf("writeConfirmed failed,err:%w", err)
+	}
+	return S.ackInbox(username, entry.ID)
+}
+
+// ackInbox 确认收件箱中的一条私聊
+func (S *Server) ackInbox(username string, msgID string) error {
+	err := S.Streams.XAckMsg(S.ctx, msgID, db.InboxStreamName(username), db.InboxGroupName(username))
+	if err != nil {
+		return fmt.Errorf("XAckMsg failed,err:%w", err)
+	}
+	return nil
+}
+
+// ReplayPending 补发私聊收件箱中已投递但未确认的消息，登录和断线重连时调用
+func (S *Server) ReplayPending(C *common.Client) {
+	stream, group, consumer := db.InboxStreamName(C.UserName), db.InboxGroupName(C.UserName), db.InboxConsumerName(C.UserName)
+	for {
+		entries, err := S.Streams.XReadGroupPendingMsg(S.ctx, stream, group, consumer, PendingBatch)
+		if err != nil {
+			log.Printf("ReplayPending XReadGroupPendingMsg failed,err:%v\n", err)
+			return
+		}
+		failed := false
+		for _, entry := range entries {
+			err = S.deliverInbox(C.UserName, entry)
+			if err != nil {
+				if !errors.Is(err, errInboxOffline) {
+					log.Printf("ReplayPending deliverInbox failed,err:%v\n", err)
+				}
+				failed = true
+			}
+		}
+		//待确认列表总是从头读取，有没确认的消息时再读会读到同一批，留给ReclaimInboxes处理
+		if failed || len(entries) < PendingBatch {
+			return
+		}
+	}
+}
+
+// ReclaimInboxes 定期认领在线用户收件箱中空闲超过PendingClaimIdle仍未确认的私聊并重新投递，
+// 投递次数超过MaxDeliveries的移入死信流，服务端关闭时返回
+func (S *Server) ReclaimInboxes() {
+	defer S.consumers.Done()
+	ticker := time.NewTicker(S.cfg.PendingClaimIdle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-S.consume.Done():
+			return
+		case <-ticker.C:
+		}
+		S.inboxes.Range(func(key, _ interface{}) bool {
+			username := key.(string)
+			//等待重连的用户连接已经断开，重连后会补发
+			if _, ok := S.detached.Load(username); !ok {
+				S.reclaimInbox(username)
+			}
+			return S.consume.Err() == nil
+		})
+	}
+}
+
+// reclaimInbox 认领一个用户收件箱中空闲过久的私聊
+func (S *Server) reclaimInbox(username string) {
+	stream, group, consumer := db.InboxStreamName(username), db.InboxGroupName(username), db.InboxConsumerName(username)
+	entries, err := S.Streams.XAutoClaimMsg(S.ctx, stream, group, consumer, S.cfg.PendingClaimIdle, PendingBatch)
+	if err != nil {
+		log.Printf("reclaimInbox XAutoClaimMsg failed,err:%v\n", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.Deliveries > int64(S.cfg.MaxDeliveries) {
+			err = S.deadLetter(username, entry)
+		} else {
+			err = S.deliverInbox(username, entry)
+		}
+		if err != nil && !errors.Is(err, errInboxOffline) {
+			log.Printf("reclaimInbox %v failed,err:%v\n", entry.ID, err)
+		}
+	}
+}
+
+// deadLetter 把多次投递仍未确认的私聊原样写入死信流后确认，写入失败时留在待确认列表中下次再试
+func (S *Server) deadLetter(username string, entry *db.StreamEntry) error {
+	_, err := S.Streams.XAddMsg(S.ctx, entry.Data, entry.Codec, db.DeadLetterName)
+	if err != nil {
+		return fmt.Errorf("XAddMsg failed,err:%w", err)
+	}
+	log.Printf("deadLetter %v的私聊%v投递%d次仍未确认，已移入死信流\n", username, entry.ID, entry.Deliveries-1)
+	return S.ackInbox(username, entry.ID)
+}
+
+// privateDelivery 投递给收件人的私聊，带上发送者用户名和收件箱中的消息ID，客户端据此发送已读回执
+func privateDelivery(msg *common.Message, id string) *common.Message {
+	return &common.Message{
+		Sender:  &common.Client{UserName: msg.Sender.UserName},
+		Type:    message.PrivateMsg,
+		ID:      id,
+		Time:    db.StreamIDTime(id).UnixMilli(),
+		Content: fmt.Sprintf("->%v私聊你:%v", msg.Sender.UserName, msg.Content),
+	}
+}
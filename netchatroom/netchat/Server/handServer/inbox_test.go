@@ -0,0 +1,252 @@
+package handServer
+
+import (
+	"context"
+	"errors"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyConn 在fail为true时写失败，模拟写到一半断开的连接
+type flakyConn struct {
+	discardConn
+	mu      sync.Mutex
+	fail    bool
+	written []string
+}
+
+func (c *flakyConn) WriteMsg(msg *common.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fail {
+		return errors.New("broken pipe")
+	}
+	c.written = append(c.written, msg.Content)
+	return nil
+}
+
+func (c *flakyConn) setFail(fail bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail = fail
+}
+
+func (c *flakyConn) Written() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.written...)
+}
+
+// newInboxServer 创建只有存储的服务端，bob已登录且收件箱中有一条没送达的私聊
+func newInboxServer(t *testing.T) (*Server, *db.MemStore, *flakyConn) {
+	t.Helper()
+	ctx := context.Background()
+	store := db.NewMemStore()
+	cfg := config.Default().Server
+	cfg.PendingClaimIdle = time.Millisecond
+	cfg.MaxDeliveries = 3
+	S := NewServer(&cfg, store.Stores())
+	if err := S.createInbox("bob"); err != nil {
+		t.Fatal(err)
+	}
+	conn := &flakyConn{fail: true}
+	S.Clients.Store("bob", &common.Client{UserName: "bob", Conn: conn})
+	S.inboxes.Store("bob", context.CancelFunc(func() {}))
+
+	data, codec, err := message.EncodeStored(conn, &common.Message{
+		Sender:  &common.Client{UserName: "alice"},
+		Type:    message.PrivateMsg,
+		To:      "bob",
+		Content: "hi",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.XAddMsg(ctx, data, codec, db.InboxStreamName("bob")); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := store.XReadGroupMsg(ctx, db.InboxStreamName("bob"), db.InboxGroupName("bob"), db.InboxConsumerName("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = S.deliverInbox("bob", entry); err == nil {
+		t.Fatal("deliverInbox on broken conn succeeded")
+	}
+	return S, store, conn
+}
+
+// pendingCount 返回bob收件箱中待确认的私聊数，读取待确认列表也算一次投递
+func pendingCount(t *testing.T, store *db.MemStore) int {
+	t.Helper()
+	pending, err := store.XReadGroupPendingMsg(context.Background(), db.InboxStreamName("bob"), db.InboxGroupName("bob"), db.InboxConsumerName("bob"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(pending)
+}
+
+func TestReclaimRedeliversPending(t *testing.T) {
+	S, store, conn := newInboxServer(t)
+	time.Sleep(5 * time.Millisecond)
+
+	conn.setFail(false)
+	S.reclaimInbox("bob")
+	if got := conn.Written(); len(got) != 1 || got[0] != "->alice私聊你:hi" {
+		t.Fatalf("written = %q", got)
+	}
+	if n := pendingCount(t, store); n != 0 {
+		t.Fatalf("pending after reclaim = %d", n)
+	}
+}
+
+func TestReplayPendingOnLogin(t *testing.T) {
+	S, store, conn := newInboxServer(t)
+
+	conn.setFail(false)
+	S.ReplayPending(&common.Client{UserName: "bob", Conn: conn})
+	if got := conn.Written(); len(got) != 1 {
+		t.Fatalf("written = %q", got)
+	}
+	if n := pendingCount(t, store); n != 0 {
+		t.Fatalf("pending after replay = %d", n)
+	}
+}
+
+func TestReclaimDeadLetters(t *testing.T) {
+	S, store, conn := newInboxServer(t)
+	//第一次投递失败后还能再投递MaxDeliveries-1次
+	for range S.cfg.MaxDeliveries - 1 {
+		time.Sleep(5 * time.Millisecond)
+		S.reclaimInbox("bob")
+	}
+	dead, err := store.XRangeMsg(context.Background(), db.DeadLetterName, 10)
+	if err != nil || len(dead) != 0 {
+		t.Fatalf("dead letters too early = %v, %v", dead, err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	S.reclaimInbox("bob")
+	if n := pendingCount(t, store); n != 0 {
+		t.Fatalf("pending after dead letter = %d", n)
+	}
+	dead, err = store.XRangeMsg(context.Background(), db.DeadLetterName, 10)
+	if err != nil || len(dead) != 1 {
+		t.Fatalf("dead letters = %v, %v", dead, err)
+	}
+	msg, err := message.DecodeStored(dead[0].Codec, dead[0].Data)
+	if err != nil || msg.To != "bob" || msg.Content != "hi" {
+		t.Fatalf("dead letter = %+v, %v", msg, err)
+	}
+	if got := conn.Written(); len(got) != 0 {
+		t.Fatalf("written = %q", got)
+	}
+}
+
+func TestDeliverInboxDroppedStaysPending(t *testing.T) {
+	S, store, _ := newInboxServer(t)
+	S.cfg.MaxDeliveries = 10
+	S.cfg.SendQueueSize = 1
+	S.cfg.SendOverflow = config.OverflowDropOldest
+	inner := newStuckConn()
+	conn := S.newOutConn(inner)
+	S.Clients.Store("bob", &common.Client{UserName: "bob", Conn: conn})
+	//写协程阻塞在第一条上
+	if err := conn.WriteMsg(&common.Message{Content: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	for len(conn.queue) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	//私聊进入发送队列后被广播挤掉，不能确认
+	time.Sleep(5 * time.Millisecond)
+	errc := make(chan error, 1)
+	go func() {
+		S.reclaimInbox("bob")
+		errc <- nil
+	}()
+	for len(conn.queue) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := conn.WriteMsg(&common.Message{Content: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	<-errc
+	if n := pendingCount(t, store); n != 1 {
+		t.Fatalf("pending after dropped delivery = %d, want 1", n)
+	}
+
+	//之后重新投递成功才确认
+	close(inner.release)
+	time.Sleep(5 * time.Millisecond)
+	S.reclaimInbox("bob")
+	if n := pendingCount(t, store); n != 0 {
+		t.Fatalf("pending after redelivery = %d", n)
+	}
+	if got := inner.Written(); got[len(got)-1] != "->alice私聊你:hi" {
+		t.Fatalf("written = %q", got)
+	}
+}
+
+func TestReadReceiptAdvancesFloor(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemStore()
+	cfg := config.Default().Server
+	S := NewServer(&cfg, store.Stores())
+	if err := S.createInbox("bob"); err != nil {
+		t.Fatal(err)
+	}
+	bob := &common.Client{UserName: "bob", Conn: discardConn{}}
+	add := func(from string) string {
+		t.Helper()
+		data, codec, err := message.EncodeStored(discardConn{}, &common.Message{Sender: &common.Client{UserName: from}, Type: message.PrivateMsg, To: "bob"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := store.XAddMsg(ctx, data, codec, db.InboxStreamName("bob"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	read := func(peer string) {
+		t.Helper()
+		msg := &common.Message{Sender: bob, Type: message.ReadReceipt}
+		if err := message.SetPayload(msg, &message.ReadRequest{Peer: peer}); err != nil {
+			t.Fatal(err)
+		}
+		S.HandleReadReceipt(msg)
+	}
+	cursors := func() map[string]string {
+		t.Helper()
+		fields, err := store.HGetAllMsg(ctx, db.ReadCursorName("bob"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fields
+	}
+
+	a1 := add("alice")
+	add("carol")
+	a2 := add("alice")
+	//carol的私聊还没读，下限只能移到它之前
+	read("alice")
+	if got := cursors(); got[db.ReadCursorFloor] != a1 || got["alice"] != a2 {
+		t.Fatalf("cursors after alice = %v", got)
+	}
+	//全部读过后下限移到最后一条，不再需要各会话的已读位置
+	read("carol")
+	if got := cursors(); len(got) != 1 || got[db.ReadCursorFloor] != a2 {
+		t.Fatalf("cursors after carol = %v", got)
+	}
+	a3 := add("alice")
+	unread, err := S.unreadMessages("bob", "")
+	if err != nil || len(unread) != 1 || unread[0].ID != a3 {
+		t.Fatalf("unread = %+v, %v", unread, err)
+	}
+}
@@ -0,0 +1,239 @@
+package handServer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/message"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrSlowConsumer = errors.New("slow consumer disconnected")
+	ErrWriteFailed  = errors.New("write failed")
+	ErrConnClosed   = errors.New("connection closed")
+	ErrMsgDropped   = errors.New("message dropped")
+)
+
+// outMsg 发送队列中的一条消息，done非空时写协程把写入的结果发给它
+type outMsg struct {
+	msg  *common.Message
+	done chan error
+}
+
+// finish 通知等待确认的发送者，done有一个缓冲，不会阻塞写协程
+func (m *outMsg) finish(err error) {
+	if m.done != nil {
+		m.done <- err
+	}
+}
+
+// confirmedWriter 能确认消息已经写入连接的连接，需要送达保证的发送者据此决定是否确认消息
+type confirmedWriter interface {
+	WriteMsgConfirmed(msg *common.Message) error
+}
+
+// writeConfirmed 发送消息并等待写入连接，连接不支持确认时退化为SendMsg
+func writeConfirmed(conn common.Conn, msg *common.Message) error {
+	if c, ok := conn.(confirmedWriter); ok {
+		return c.WriteMsgConfirmed(msg)
+	}
+	return message.SendMsg(conn, msg)
+}
+
+// outConn 给连接加上有界的发送队列，所有写操作只入队，由一个写协程按顺序写入连接，
+// 多个协程同时发送时帧不会交错，慢客户端也不会阻塞广播。队列满时按配置的方式处理，
+// 需要送达保证的发送者用WriteMsgConfirmed等待写入的结果，被丢弃时会收到ErrMsgDropped
+type outConn struct {
+	common.Conn
+	cfg     *config.ServerConfig
+	queue   chan *outMsg
+	quit    chan struct{} // 关闭后写协程发完队列中剩余的消息再关闭连接
+	stopped chan struct{} // 写协程退出后关闭
+	once    sync.Once
+	broken  atomic.Pointer[error] // 服务端因为跟不上或写失败断开连接的原因
+	dropped atomic.Int64          // drop-oldest方式下丢弃的消息数
+}
+
+// newOutConn 包装连接并启动写协程
+func (S *Server) newOutConn(conn common.Conn) *outConn {
+	c := &outConn{
+		Conn:    conn,
+		cfg:     &S.cfg,
+		queue:   make(chan *outMsg, S.cfg.SendQueueSize),
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+// Unwrap 返回被包装的连接，用于查询协商出的编解码器
+func (c *outConn) Unwrap() common.Conn {
+	return c.Conn
+}
+
+// WriteMsg 把消息放入发送队列，入队后即返回，之后可能因为队列满被丢弃
+func (c *outConn) WriteMsg(msg *common.Message) error {
+	return c.enqueue(&outMsg{msg: msg})
+}
+
+// WriteMsgConfirmed 把消息放入发送队列并等待写协程写入连接，
+// 消息被丢弃、写入失败或连接在写入前关闭时返回错误
+func (c *outConn) WriteMsgConfirmed(msg *common.Message) error {
+	m := &outMsg{msg: msg, done: make(chan error, 1)}
+	err := c.enqueue(m)
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-m.done:
+		return err
+	case <-c.stopped:
+	}
+	//写协程退出前可能刚好写完这条
+	select {
+	case err = <-m.done:
+		return err
+	default:
+		return ErrConnClosed
+	}
+}
+
+// enqueue 把消息放入发送队列，队列满时按配置的方式处理
+func (c *outConn) enqueue(m *outMsg) error {
+	select {
+	case <-c.quit:
+		return ErrConnClosed
+	default:
+	}
+	select {
+	case c.queue <- m:
+		return nil
+	default:
+	}
+	switch c.cfg.SendOverflow {
+	case config.OverflowDropOldest:
+		for {
+			select {
+			case old := <-c.queue:
+				old.finish(ErrMsgDropped)
+				if n := c.dropped.Add(1); n == 1 || n%100 == 0 {
+					log.Printf("outConn %v send queue full, dropped %d messages\n", c.RemoteAddr(), n)
+				}
+			default:
+			}
+			select {
+			case c.queue <- m:
+				return nil
+			default:
+			}
+		}
+	case config.OverflowBlock:
+		timer := time.NewTimer(c.cfg.SendBlockTimeout)
+		defer timer.Stop()
+		select {
+		case c.queue <- m:
+			return nil
+		case <-c.quit:
+			return ErrConnClosed
+		case <-timer.C:
+		}
+	}
+	c.disconnectSlow()
+	return ErrSlowConsumer
+}
+
+// ReadMsg 读取消息，服务端因为跟不上或写失败断开连接时返回的错误包含ErrSlowConsumer或ErrWriteFailed，
+// 读协程据此按异常断线处理，而不是当作服务端主动关闭
+func (c *outConn) ReadMsg() (*common.Message, error) {
+	msg, err := c.Conn.ReadMsg()
+	if err != nil {
+		if reason := c.broken.Load(); reason != nil {
+			return nil, fmt.Errorf("%w: %v", *reason, err)
+		}
+	}
+	return msg, err
+}
+
+// Close 停止接收新消息，写协程发完已入队的消息后关闭连接
+func (c *outConn) Close() error {
+	c.once.Do(func() {
+		close(c.quit)
+	})
+	return nil
+}
+
+// abort 记录断开原因并立即关闭连接，队列中的消息被丢弃
+func (c *outConn) abort(reason error) {
+	if !c.broken.CompareAndSwap(nil, &reason) {
+		return
+	}
+	_ = c.Close()
+	//写协程可能正阻塞在写操作上，直接关闭连接让它返回
+	_ = c.Conn.Close()
+}
+
+// disconnectSlow 断开跟不上的客户端
+func (c *outConn) disconnectSlow() {
+	log.Printf("outConn %v send queue full, disconnecting\n", c.RemoteAddr())
+	c.abort(ErrSlowConsumer)
+}
+
+// writeLoop 写协程，每次写入前设置写超时，写失败时关闭连接让读协程感知断线
+func (c *outConn) writeLoop() {
+	defer close(c.stopped)
+	for {
+		select {
+		case m := <-c.queue:
+			if !c.write(m, time.Now().Add(c.cfg.WriteTimeout)) {
+				return
+			}
+		case <-c.quit:
+			c.flush()
+			return
+		}
+	}
+}
+
+// flush 连接关闭前在一个写超时内发完队列中剩余的消息
+func (c *outConn) flush() {
+	deadline := time.Now().Add(c.cfg.WriteTimeout)
+	for c.broken.Load() == nil {
+		select {
+		case m := <-c.queue:
+			if !c.write(m, deadline) {
+				return
+			}
+			continue
+		default:
+		}
+		break
+	}
+	_ = c.Conn.Close()
+}
+
+// write 写入一条消息并通知等待确认的发送者，失败时关闭连接并返回false
+func (c *outConn) write(m *outMsg, deadline time.Time) bool {
+	err := c.Conn.SetWriteDeadline(deadline)
+	if err == nil {
+		err = c.Conn.WriteMsg(m.msg)
+	}
+	m.finish(err)
+	if err != nil {
+		select {
+		case <-c.quit:
+			//已经在关闭，不需要再通知读协程
+			_ = c.Conn.Close()
+		default:
+			log.Printf("outConn %v WriteMsg failed,err:%v\n", c.RemoteAddr(), err)
+			c.abort(ErrWriteFailed)
+		}
+		return false
+	}
+	return true
+}
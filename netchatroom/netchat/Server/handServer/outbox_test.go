@@ -0,0 +1,174 @@
+package handServer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stuckConn 写操作阻塞直到release被关闭，模拟跟不上的客户端
+type stuckConn struct {
+	release chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	written []string
+}
+
+func newStuckConn() *stuckConn {
+	return &stuckConn{release: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (c *stuckConn) ReadMsg() (*common.Message, error) {
+	<-c.closed
+	return nil, io.EOF
+}
+
+func (c *stuckConn) WriteMsg(msg *common.Message) error {
+	select {
+	case <-c.release:
+	case <-c.closed:
+		return net.ErrClosed
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written = append(c.written, msg.Content)
+	return nil
+}
+
+func (c *stuckConn) Written() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.written...)
+}
+
+func (c *stuckConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *stuckConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *stuckConn) RemoteAddr() net.Addr             { return apiAddr("stuck") }
+func (c *stuckConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func newTestOutConn(policy string) (*outConn, *stuckConn) {
+	cfg := config.Default().Server
+	cfg.SendQueueSize = 2
+	cfg.SendOverflow = policy
+	cfg.SendBlockTimeout = 50 * time.Millisecond
+	S := &Server{cfg: cfg}
+	inner := newStuckConn()
+	return S.newOutConn(inner), inner
+}
+
+// fill 写入第一条消息并等待写协程取走它阻塞在写操作上，然后写满队列
+func fill(t *testing.T, c *outConn) {
+	t.Helper()
+	if err := c.WriteMsg(&common.Message{Content: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	for len(c.queue) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, content := range []string{"2", "3"} {
+		if err := c.WriteMsg(&common.Message{Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOutConnDropOldest(t *testing.T) {
+	c, inner := newTestOutConn(config.OverflowDropOldest)
+	fill(t, c)
+	for _, content := range []string{"4", "5"} {
+		if err := c.WriteMsg(&common.Message{Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(inner.release)
+	_ = c.Close()
+	<-c.stopped
+	if got := inner.Written(); len(got) != 3 || got[0] != "1" || got[1] != "4" || got[2] != "5" {
+		t.Fatalf("written = %v, want [1 4 5]", got)
+	}
+}
+
+func TestOutConnDisconnect(t *testing.T) {
+	c, _ := newTestOutConn(config.OverflowDisconnect)
+	fill(t, c)
+	if err := c.WriteMsg(&common.Message{Content: "4"}); !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("overflow err = %v, want ErrSlowConsumer", err)
+	}
+	//读协程能区分被断开和服务端主动关闭
+	if _, err := c.ReadMsg(); !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("ReadMsg err = %v, want ErrSlowConsumer", err)
+	}
+	if err := c.WriteMsg(&common.Message{Content: "5"}); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("write after disconnect err = %v, want ErrConnClosed", err)
+	}
+}
+
+func TestOutConnBlock(t *testing.T) {
+	c, inner := newTestOutConn(config.OverflowBlock)
+	fill(t, c)
+	//超时前队列空出位置时正常入队
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(inner.release)
+	}()
+	if err := c.WriteMsg(&common.Message{Content: "4"}); err != nil {
+		t.Fatalf("blocked write err = %v", err)
+	}
+	_ = c.Close()
+	<-c.stopped
+	if got := inner.Written(); len(got) != 4 {
+		t.Fatalf("written = %v, want 4 messages", got)
+	}
+
+	c, _ = newTestOutConn(config.OverflowBlock)
+	fill(t, c)
+	if err := c.WriteMsg(&common.Message{Content: "4"}); !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("timed out write err = %v, want ErrSlowConsumer", err)
+	}
+}
+
+func TestOutConnConfirmed(t *testing.T) {
+	c, inner := newTestOutConn(config.OverflowDropOldest)
+	fill(t, c)
+	//需要确认的消息被挤出队列时发送者能知道没有送达
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.WriteMsgConfirmed(&common.Message{Content: "durable"})
+	}()
+	for len(c.queue) != 2 || c.dropped.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, content := range []string{"4", "5"} {
+		if err := c.WriteMsg(&common.Message{Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errc; !errors.Is(err, ErrMsgDropped) {
+		t.Fatalf("dropped confirmed write err = %v, want ErrMsgDropped", err)
+	}
+
+	//写入连接后才返回
+	close(inner.release)
+	if err := c.WriteMsgConfirmed(&common.Message{Content: "6"}); err != nil {
+		t.Fatalf("confirmed write err = %v", err)
+	}
+	if got := inner.Written(); len(got) == 0 || got[len(got)-1] != "6" {
+		t.Fatalf("written = %v, want 6 last", got)
+	}
+
+	//连接断开后不会一直等待
+	c.abort(ErrWriteFailed)
+	<-c.stopped
+	if err := c.WriteMsgConfirmed(&common.Message{Content: "7"}); err == nil {
+		t.Fatal("confirmed write after abort succeeded")
+	}
+}
@@ -0,0 +1,427 @@
+package handServer
+
+import (
+	"fmt"
+	"log"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMuteMinutes 未指定时长时的禁言分钟数
+const DefaultMuteMinutes = 10
+
+var roleNames = map[int]string{
+	db.RoleMember:    "成员",
+	db.RoleModerator: "管理员",
+	db.RoleOwner:     "所有者",
+}
+
+var roleByName = map[string]int{
+	"member":    db.RoleMember,
+	"moderator": db.RoleModerator,
+	"owner":     db.RoleOwner,
+}
+
+// sanctionScope 处罚的作用范围，默认房间就是整个聊天室，在其中的处罚作用于全局
+func sanctionScope(room string) string {
+	if room == db.DefaultRoom {
+		return db.GlobalScope
+	}
+	return db.RoomScope(room)
+}
+
+// effectiveRole 用户在房间中的实际角色，取全局角色和房间角色中较高的一个
+func (S *Server) effectiveRole(room string, username string) (int, error) {
+	global, err := S.Users.QueryRole(S.ctx, db.GlobalScope, username)
+	if err != nil {
+		return db.RoleMember, fmt.Errorf("QueryRole global failed,err:%w", err)
+	}
+	local, err := S.Users.QueryRole(S.ctx, db.RoomScope(room), username)
+	if err != nil {
+		return db.RoleMember, fmt.Errorf("QueryRole room failed,err:%w", err)
+	}
+	return max(global, local), nil
+}
+
+// hasSanction 判断用户在房间中是否处于某种处罚，全局处罚对所有房间生效
+func (S *Server) hasSanction(room string, username string, kind string) (bool, error) {
+	ok, err := S.Users.QuerySanction(S.ctx, db.GlobalScope, username, kind)
+	if err != nil || ok || room == db.DefaultRoom {
+		return ok, err
+	}
+	return S.Users.QuerySanction(S.ctx, db.RoomScope(room), username, kind)
+}
+
+// checkSend 消息进入房间流之前检查禁言、只读和慢速模式，不允许时回复原因
+func (S *Server) checkSend(C *common.Client, room string) bool {
+	muted, err := S.hasSanction(room, C.UserName, db.SanctionMute)
+	if err != nil {
+		log.Printf("checkSend hasSanction failed,err:%v\n", err)
+		return false
+	}
+	if muted {
+		S.reply(C, "你已被禁言，消息未发送")
+		return false
+	}
+	role, err := S.effectiveRole(room, C.UserName)
+	if err != nil {
+		log.Printf("checkSend effectiveRole failed,err:%v\n", err)
+		return false
+	}
+	//管理员不受只读和慢速模式限制
+	if role >= db.RoleModerator {
+		return true
+	}
+	flags, err := S.Users.QueryFlags(S.ctx, db.RoomScope(room))
+	if err != nil {
+		log.Printf("checkSend QueryFlags failed,err:%v\n", err)
+		return false
+	}
+	if flags.ReadOnly {
+		S.reply(C, fmt.Sprintf("房间%v是只读公告频道，只有管理员可以发言", room))
+		return false
+	}
+	if flags.SlowMode > 0 {
+		key := room + "|" + C.UserName
+		now := time.Now()
+		if last, ok := S.lastSend.Load(key); ok {
+			wait := time.Duration(flags.SlowMode)*time.Second - now.Sub(last.(time.Time))
+			if wait > 0 {
+				S.reply(C, fmt.Sprintf("房间%v处于慢速模式，请%d秒后再发言", room, int(wait.Seconds())+1))
+				return false
+			}
+		}
+		S.lastSend.Store(key, now)
+	}
+	return true
+}
+
+// checkPrivateSend 私聊进入收件箱之前检查全局禁言
+func (S *Server) checkPrivateSend(C *common.Client) bool {
+	muted, err := S.Users.QuerySanction(S.ctx, db.GlobalScope, C.UserName, db.SanctionMute)
+	if err != nil {
+		log.Printf("checkPrivateSend QuerySanction failed,err:%v\n", err)
+		return false
+	}
+	if muted {
+		S.reply(C, "你已被禁言，消息未发送")
+		return false
+	}
+	return true
+}
+
+// checkJoin 加入房间前检查封禁和仅限邀请
+func (S *Server) checkJoin(C *common.Client, room string) bool {
+	banned, err := S.hasSanction(room, C.UserName, db.SanctionBan)
+	if err != nil {
+		log.Printf("checkJoin hasSanction failed,err:%v\n", err)
+		return false
+	}
+	if banned {
+		S.reply(C, fmt.Sprintf("你已被房间%v封禁", room))
+		return false
+	}
+	flags, err := S.Users.QueryFlags(S.ctx, db.RoomScope(room))
+	if err != nil {
+		log.Printf("checkJoin QueryFlags failed,err:%v\n", err)
+		return false
+	}
+	if !flags.InviteOnly {
+		return true
+	}
+	role, err := S.effectiveRole(room, C.UserName)
+	if err != nil {
+		log.Printf("checkJoin effectiveRole failed,err:%v\n", err)
+		return false
+	}
+	if role >= db.RoleModerator {
+		return true
+	}
+	invited, err := S.Users.QueryInvite(S.ctx, db.RoomScope(room), C.UserName)
+	if err != nil {
+		log.Printf("checkJoin QueryInvite failed,err:%v\n", err)
+		return false
+	}
+	if !invited {
+		S.reply(C, fmt.Sprintf("房间%v仅限邀请加入", room))
+	}
+	return invited
+}
+
+// isBanned 判断用户是否被全局封禁，被封禁的用户不能登录
+func (S *Server) isBanned(username string) bool {
+	banned, err := S.Users.QuerySanction(S.ctx, db.GlobalScope, username, db.SanctionBan)
+	if err != nil {
+		log.Printf("isBanned QuerySanction failed,err:%v\n", err)
+		return false
+	}
+	return banned
+}
+
+// Kick 把集群中的在线用户踢出聊天室并注销会话令牌，用户在其他实例上时由该实例处理，用户不在线时返回false
+func (S *Server) Kick(username string, reason string) bool {
+	if S.kickLocal(username, reason) {
+		return true
+	}
+	if _, ok := S.remotePresence(username); !ok {
+		return false
+	}
+	S.publish(&clusterEvent{Kind: eventKick, To: username, Msg: &common.Message{Type: message.Kicked, Content: reason}})
+	return true
+}
+
+// kickLocal 把本实例上的用户踢出聊天室，用户不在本实例时返回false
+func (S *Server) kickLocal(username string, reason string) bool {
+	val, ok := S.Clients.Load(username)
+	if !ok {
+		return false
+	}
+	C := val.(*common.Client)
+	err := message.SendMsg(C.Conn, &common.Message{
+		Type:    message.Kicked,
+		Content: reason,
+	})
+	if err != nil {
+		log.Printf("Kick SendMsg failed,err:%v\n", err)
+	}
+	err = S.Cache.DelSession(S.ctx, C.Token)
+	if err != nil {
+		log.Printf("Kick DelSession failed,err:%v\n", err)
+	}
+	S.HandleLeave(C)
+	return true
+}
+
+// removeFromRoom 把用户移出非默认房间，在线时通知其切回默认房间
+func (S *Server) removeFromRoom(room string, username string, reason string) {
+	_, err := S.Cache.SRemMsg(S.ctx, username, db.RoomMembersName(room))
+	if err != nil {
+		log.Printf("removeFromRoom SRemMsg failed,err:%v\n", err)
+		return
+	}
+	S.sendUser(username, &common.Message{
+		Type:    message.LeaveRoom,
+		Room:    room,
+		Content: reason,
+	})
+}
+
+// notify 给集群中的在线用户发送一条提示
+func (S *Server) notify(username string, content string) {
+	S.sendUser(username, &common.Message{Content: content})
+}
+
+// HandleModerate 处理管理指令，只有管理员及以上可以使用，且只能管理角色比自己低的用户
+func (S *Server) HandleModerate(msg *common.Message) {
+	C := msg.Sender
+	req := &message.ModerateRequest{}
+	err := message.GetPayload(msg, req)
+	if err != nil {
+		S.reply(C, "管理指令格式错误")
+		return
+	}
+	room := roomOf(msg)
+	role, err := S.effectiveRole(room, C.UserName)
+	if err != nil {
+		log.Printf("HandleModerate effectiveRole failed,err:%v\n", err)
+		return
+	}
+	if role < db.RoleModerator {
+		S.reply(C, fmt.Sprintf("你不是房间%v的管理员", room))
+		return
+	}
+	if req.Action == message.ActionFlag {
+		S.moderateFlag(C, room, req.Arg)
+		return
+	}
+
+	//以下操作都针对某个用户
+	if req.Target == "" || req.Target == C.UserName {
+		S.reply(C, "请指定其他用户")
+		return
+	}
+	exists, err := S.userExists(req.Target)
+	if err != nil {
+		log.Printf("HandleModerate userExists failed,err:%v\n", err)
+		return
+	}
+	if !exists {
+		S.reply(C, "该用户名不存在，请检查输入")
+		return
+	}
+	targetRole, err := S.effectiveRole(room, req.Target)
+	if err != nil {
+		log.Printf("HandleModerate effectiveRole target failed,err:%v\n", err)
+		return
+	}
+	if targetRole >= role {
+		S.reply(C, fmt.Sprintf("不能管理%v，对方的角色不低于你", req.Target))
+		return
+	}
+
+	var result string
+	switch req.Action {
+	case message.ActionKick:
+		result = S.moderateKick(room, req.Target, C.UserName)
+	case message.ActionMute:
+		result = S.moderateMute(room, req.Target, C.UserName, req.Arg)
+	case message.ActionUnmute:
+		result = S.moderateUnsanction(room, req.Target, db.SanctionMute, "禁言")
+	case message.ActionBan:
+		result = S.moderateBan(room, req.Target, C.UserName)
+	case message.ActionUnban:
+		result = S.moderateUnsanction(room, req.Target, db.SanctionBan, "封禁")
+	case message.ActionRole:
+		result = S.moderateRole(room, req.Target, role, req.Arg)
+	case message.ActionInvite:
+		result = S.moderateInvite(room, req.Target)
+	default:
+		result = "未知的管理指令"
+	}
+	if result == "" {
+		return
+	}
+	S.reply(C, "[系统消息]"+result)
+	fmt.Printf("[系统消息]%v在房间%v执行了%v %v:%v\n", C.UserName, room, req.Action, req.Target, result)
+}
+
+// moderateKick 默认房间中踢出聊天室，其他房间中移出房间
+func (S *Server) moderateKick(room string, target string, operator string) string {
+	if room == db.DefaultRoom {
+		if !S.Kick(target, fmt.Sprintf("[系统消息]你已被%v踢出聊天室", operator)) {
+			return fmt.Sprintf("%v不在线", target)
+		}
+		return fmt.Sprintf("已将%v踢出聊天室", target)
+	}
+	S.removeFromRoom(room, target, fmt.Sprintf("[系统消息]你已被%v移出房间%v", operator, room))
+	return fmt.Sprintf("已将%v移出房间%v", target, room)
+}
+
+// moderateMute 禁言，arg为分钟数，0表示永久
+func (S *Server) moderateMute(room string, target string, operator string, arg string) string {
+	minutes := DefaultMuteMinutes
+	if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return "禁言时长必须是非负整数分钟"
+		}
+		minutes = n
+	}
+	err := S.Users.AddSanction(S.ctx, sanctionScope(room), target, db.SanctionMute, minutes*60, operator)
+	if err != nil {
+		log.Printf("moderateMute AddSanction failed,err:%v\n", err)
+		return "服务器繁忙，请稍后再试"
+	}
+	duration := "永久"
+	if minutes > 0 {
+		duration = fmt.Sprintf("%d分钟", minutes)
+	}
+	S.notify(target, fmt.Sprintf("[系统消息]你已被%v禁言%v", operator, duration))
+	return fmt.Sprintf("已将%v禁言%v", target, duration)
+}
+
+// moderateBan 封禁，默认房间中封禁整个聊天室并踢下线，其他房间中移出并禁止再次加入
+func (S *Server) moderateBan(room string, target string, operator string) string {
+	err := S.Users.AddSanction(S.ctx, sanctionScope(room), target, db.SanctionBan, 0, operator)
+	if err != nil {
+		log.Printf("moderateBan AddSanction failed,err:%v\n", err)
+		return "服务器繁忙，请稍后再试"
+	}
+	if room == db.DefaultRoom {
+		S.Kick(target, fmt.Sprintf("[系统消息]你已被%v封禁", operator))
+		return fmt.Sprintf("已封禁%v", target)
+	}
+	S.removeFromRoom(room, target, fmt.Sprintf("[系统消息]你已被%v封禁，不能再加入房间%v", operator, room))
+	return fmt.Sprintf("已在房间%v封禁%v", room, target)
+}
+
+// moderateUnsanction 解除禁言或封禁
+func (S *Server) moderateUnsanction(room string, target string, kind string, name string) string {
+	ok, err := S.Users.DelSanction(S.ctx, sanctionScope(room), target, kind)
+	if err != nil {
+		log.Printf("moderateUnsanction DelSanction failed,err:%v\n", err)
+		return "服务器繁忙，请稍后再试"
+	}
+	if !ok {
+		return fmt.Sprintf("%v没有被%v", target, name)
+	}
+	S.notify(target, fmt.Sprintf("[系统消息]你的%v已被解除", name))
+	return fmt.Sprintf("已解除%v的%v", target, name)
+}
+
+// moderateRole 设置用户在房间中的角色，只能授予比自己低的角色
+func (S *Server) moderateRole(room string, target string, role int, arg string) string {
+	newRole, ok := roleByName[arg]
+	if !ok {
+		return "角色只能是member、moderator或owner"
+	}
+	if newRole >= role {
+		return "只能授予比自己低的角色"
+	}
+	err := S.Users.SetRole(S.ctx, db.RoomScope(room), target, newRole)
+	if err != nil {
+		log.Printf("moderateRole SetRole failed,err:%v\n", err)
+		return "服务器繁忙，请稍后再试"
+	}
+	S.notify(target, fmt.Sprintf("[系统消息]你在房间%v的角色变为%v", room, roleNames[newRole]))
+	return fmt.Sprintf("%v在房间%v的角色变为%v", target, room, roleNames[newRole])
+}
+
+// moderateInvite 邀请用户加入仅限邀请的房间
+func (S *Server) moderateInvite(room string, target string) string {
+	if room == db.DefaultRoom {
+		return "默认房间不需要邀请"
+	}
+	err := S.Users.AddInvite(S.ctx, db.RoomScope(room), target)
+	if err != nil {
+		log.Printf("moderateInvite AddInvite failed,err:%v\n", err)
+		return "服务器繁忙，请稍后再试"
+	}
+	S.notify(target, fmt.Sprintf("[系统消息]你被邀请加入房间%v，输入/join %v加入", room, room))
+	return fmt.Sprintf("已邀请%v加入房间%v", target, room)
+}
+
+// moderateFlag 修改房间的权限标志，arg格式为"标志名 值"
+func (S *Server) moderateFlag(C *common.Client, room string, arg string) {
+	name, value, _ := strings.Cut(strings.TrimSpace(arg), " ")
+	value = strings.TrimSpace(value)
+	flags, err := S.Users.QueryFlags(S.ctx, db.RoomScope(room))
+	if err != nil {
+		log.Printf("moderateFlag QueryFlags failed,err:%v\n", err)
+		return
+	}
+	switch name {
+	case message.FlagInviteOnly:
+		if room == db.DefaultRoom {
+			S.reply(C, "默认房间不能设为仅限邀请")
+			return
+		}
+		flags.InviteOnly, err = strconv.ParseBool(value)
+	case message.FlagReadOnly:
+		flags.ReadOnly, err = strconv.ParseBool(value)
+	case message.FlagSlowMode:
+		flags.SlowMode, err = strconv.Atoi(value)
+		if err == nil && flags.SlowMode < 0 {
+			err = strconv.ErrRange
+		}
+	default:
+		S.reply(C, "标志只能是invite、readonly或slow")
+		return
+	}
+	if err != nil {
+		S.reply(C, "标志的值格式错误，invite和readonly为true/false，slow为秒数")
+		return
+	}
+	err = S.Users.SetFlags(S.ctx, flags)
+	if err != nil {
+		log.Printf("moderateFlag SetFlags failed,err:%v\n", err)
+		return
+	}
+	S.reply(C, fmt.Sprintf("[系统消息]房间%v 仅限邀请:%v 只读:%v 慢速模式:%d秒",
+		room, flags.InviteOnly, flags.ReadOnly, flags.SlowMode))
+	fmt.Printf("[系统消息]%v修改了房间%v的权限标志\n", C.UserName, room)
+}
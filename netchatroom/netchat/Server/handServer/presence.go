@@ -0,0 +1,246 @@
+package handServer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 用户设置的状态只保存在持有连接的实例上，重新登录后恢复为在线；
+// 对外显示的状态写在集群共享的在线记录中，空闲超过AwayAfter的在线用户自动显示为离开
+
+// timeLayout whois中时间的显示格式
+const timeLayout = "2006-01-02 15:04:05"
+
+// localPresence 按用户设置的状态和空闲时间生成本实例上用户的在线记录
+func (S *Server) localPresence(username string) db.Presence {
+	p := db.Presence{Instance: S.instance}
+	if _, ok := S.detached.Load(username); ok {
+		p.Detached = true
+	}
+	if val, ok := S.statuses.Load(username); ok {
+		req := val.(message.StatusRequest)
+		p.Status, p.Text = req.Status, req.Text
+	}
+	//自己设置为忙碌或隐身的不自动改为离开
+	if _, ok := S.away.Load(username); ok && (p.Status == "" || p.Status == message.StatusOnline) {
+		p.Status = message.StatusAway
+	}
+	if p.Status == message.StatusOnline {
+		p.Status = ""
+	}
+	return p
+}
+
+// setPresence 把本实例上用户当前的在线记录写入集群
+func (S *Server) setPresence(username string) {
+	err := S.Cluster.SetPresence(S.ctx, username, S.localPresence(username))
+	if err != nil {
+		log.Printf("setPresence SetPresence failed,err:%v\n", err)
+	}
+}
+
+// resetPresence 清除用户设置的状态，登录和离开时调用
+func (S *Server) resetPresence(username string) {
+	S.statuses.Delete(username)
+	S.away.Delete(username)
+}
+
+// recordLastSeen 记录用户最后一次下线的时间
+func (S *Server) recordLastSeen(username string) {
+	err := S.Cluster.SetLastSeen(S.ctx, username, time.Now())
+	if err != nil {
+		log.Printf("recordLastSeen SetLastSeen failed,err:%v\n", err)
+	}
+}
+
+// markActive 记录用户发送了消息，自动显示为离开的用户恢复在线
+func (S *Server) markActive(username string) {
+	S.active.Store(username, time.Now())
+	if _, ok := S.away.LoadAndDelete(username); ok {
+		S.setPresence(username)
+	}
+}
+
+// sweepAway 把只有心跳、超过AwayAfter没有发消息的用户标记为离开
+func (S *Server) sweepAway() {
+	now := time.Now()
+	S.active.Range(func(key, value interface{}) bool {
+		username := key.(string)
+		if now.Sub(value.(time.Time)) < S.cfg.AwayAfter {
+			return true
+		}
+		if _, loaded := S.away.LoadOrStore(username, struct{}{}); !loaded {
+			S.setPresence(username)
+		}
+		return true
+	})
+}
+
+// presences 返回集群中所有在线用户的在线记录，包括等待重连的
+func (S *Server) presences() map[string]db.Presence {
+	res := make(map[string]db.Presence)
+	presence, err := S.Cluster.ListPresence(S.ctx)
+	if err != nil {
+		log.Printf("presences ListPresence failed,err:%v\n", err)
+	}
+	instances, err := S.Cluster.ListInstances(S.ctx)
+	if err != nil {
+		log.Printf("presences ListInstances failed,err:%v\n", err)
+	}
+	live := S.liveInstances(instances)
+	for username, p := range presence {
+		if live[p.Instance] && p.Instance != S.instance {
+			res[username] = p
+		}
+	}
+	//本实例上的用户以本地状态为准
+	S.Clients.Range(func(key, _ interface{}) bool {
+		res[key.(string)] = S.localPresence(key.(string))
+		return true
+	})
+	return res
+}
+
+// presenceOf 返回用户在集群中的在线记录，用户不在线时返回false
+func (S *Server) presenceOf(username string) (db.Presence, bool) {
+	if _, ok := S.Clients.Load(username); ok {
+		return S.localPresence(username), true
+	}
+	return S.remotePresence(username)
+}
+
+// visibleTo 隐身的用户只对自己显示为在线
+func visibleTo(viewer string, username string, p db.Presence) bool {
+	return p.Status != message.StatusInvisible || viewer == username
+}
+
+// onlineUsers 返回viewer能看到的集群中所有在线用户，按用户名排序
+func (S *Server) onlineUsers(viewer string) []string {
+	var users []string
+	for username, p := range S.presences() {
+		if visibleTo(viewer, username, p) {
+			users = append(users, username)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// statusLabel 在线状态和状态说明的显示文本，例如"忙碌:开会中"
+func statusLabel(p db.Presence) string {
+	status := p.Status
+	if status == "" {
+		status = message.StatusOnline
+	}
+	if p.Text == "" {
+		return message.StatusText(status)
+	}
+	return message.StatusText(status) + ":" + p.Text
+}
+
+// HandleCheckUser 处理查看在线用户功能，列出集群中所有实例上的在线用户和他们的状态
+func (S *Server) HandleCheckUser(C *common.Client) {
+	presence := S.presences()
+	var users []string
+	for userName, p := range presence {
+		if visibleTo(C.UserName, userName, p) {
+			users = append(users, userName)
+		}
+	}
+	sort.Strings(users)
+	list := ""
+	for _, userName := range users {
+		p := presence[userName]
+		if p.Status == "" && p.Text == "" {
+			list += userName + "   "
+		} else {
+			list += userName + "(" + statusLabel(p) + ")   "
+		}
+	}
+	endList := "当前在线用户(" + strconv.Itoa(len(users)) + "人):" + list
+	err := message.SendMsg(C.Conn, &common.Message{
+		Content: endList,
+	})
+	if err != nil {
+		log.Printf("HandleCheckUser SendMsg endList failed,err:%v\n", err)
+	}
+	fmt.Printf("[系统消息]%s请求查看了在线用户\n", C.UserName)
+}
+
+// HandleSetStatus 处理用户设置在线状态
+func (S *Server) HandleSetStatus(msg *common.Message) {
+	C := msg.Sender
+	req := message.StatusRequest{}
+	err := message.GetPayload(msg, &req)
+	req.Text = strings.TrimSpace(req.Text)
+	if err != nil || !message.ValidateStatus(&req) {
+		S.reply(C, fmt.Sprintf("状态只能是online、away、busy或invisible，说明不超过%d字", message.StatusTextMaxLen))
+		return
+	}
+	S.statuses.Store(C.UserName, req)
+	S.setPresence(C.UserName)
+	S.reply(C, "状态已设置为"+statusLabel(db.Presence{Status: req.Status, Text: req.Text}))
+	fmt.Printf("[系统消息]%v设置状态为%v\n", C.UserName, req.Status)
+}
+
+// HandleWhois 处理查看用户资料，包括在线状态、最后在线时间、注册时间和活跃度
+func (S *Server) HandleWhois(msg *common.Message) {
+	C := msg.Sender
+	username := strings.TrimSpace(msg.To)
+	registered, err := S.Users.QueryRegistered(S.ctx, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			S.reply(C, "该用户名不存在，请检查输入")
+			return
+		}
+		log.Printf("HandleWhois QueryRegistered failed,err:%v\n", err)
+		S.reply(C, "查询用户资料失败，请稍后再试")
+		return
+	}
+	var b strings.Builder
+	b.WriteString("-------" + username + "-------\n")
+	p, online := S.presenceOf(username)
+	if online && visibleTo(C.UserName, username, p) {
+		b.WriteString("状态:" + statusLabel(p) + "\n")
+	} else {
+		b.WriteString("状态:离线\n")
+		last, err := S.Cluster.GetLastSeen(S.ctx, username)
+		if err != nil && !errors.Is(err, db.ErrNil) {
+			log.Printf("HandleWhois GetLastSeen failed,err:%v\n", err)
+		}
+		b.WriteString("最后在线:" + formatTime(last) + "\n")
+	}
+	b.WriteString("注册时间:" + formatTime(registered) + "\n")
+	score, err := S.Ranks.ZScoreMsg(S.ctx, username, db.ZSetName)
+	if err != nil && !errors.Is(err, db.ErrNil) {
+		log.Printf("HandleWhois ZScoreMsg failed,err:%v\n", err)
+	}
+	b.WriteString(fmt.Sprintf("活跃度:%.0f\n", score))
+	b.WriteString("------------------------\n")
+	err = message.SendMsg(C.Conn, &common.Message{
+		Type:    message.Whois,
+		To:      username,
+		Content: b.String(),
+	})
+	if err != nil {
+		log.Printf("HandleWhois SendMsg failed,err:%v\n", err)
+	}
+	fmt.Printf("[系统消息]%s查看了%s的资料\n", C.UserName, username)
+}
+
+// formatTime 按timeLayout显示时间，零值显示为未知
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "未知"
+	}
+	return t.Format(timeLayout)
+}
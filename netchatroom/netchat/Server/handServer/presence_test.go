@@ -0,0 +1,52 @@
+package handServer
+
+import (
+	"context"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"testing"
+	"time"
+)
+
+func TestSweepAway(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemStore()
+	cfg := config.Default().Server
+	cfg.AwayAfter = time.Minute
+	S := NewServer(&cfg, store.Stores())
+	for _, username := range []string{"alice", "bob", "carol"} {
+		S.Clients.Store(username, &common.Client{UserName: username, Conn: discardConn{}})
+		S.active.Store(username, time.Now().Add(-time.Hour))
+		S.setPresence(username)
+	}
+	S.markActive("carol")
+	S.statuses.Store("bob", message.StatusRequest{Status: message.StatusBusy, Text: "开会中"})
+
+	status := func(username string) string {
+		t.Helper()
+		p, err := store.GetPresence(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Status
+	}
+	//只有心跳的在线用户自动显示为离开，自己设置了忙碌的不变，刚发过消息的仍在线
+	S.sweepAway()
+	if got := status("alice"); got != message.StatusAway {
+		t.Fatalf("alice status = %q, want away", got)
+	}
+	if got := status("bob"); got != message.StatusBusy {
+		t.Fatalf("bob status = %q, want busy", got)
+	}
+	if got := status("carol"); got != "" {
+		t.Fatalf("carol status = %q, want online", got)
+	}
+
+	//发消息后恢复在线
+	S.markActive("alice")
+	if got := status("alice"); got != "" {
+		t.Fatalf("alice status after message = %q, want online", got)
+	}
+}
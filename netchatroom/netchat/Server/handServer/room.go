@@ -0,0 +1,330 @@
+package handServer
+
+import (
+	"fmt"
+	"log"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"sort"
+	"strings"
+	"time"
+)
+
+// roomOf 返回消息所在的房间，未指定时为默认房间
+func roomOf(msg *common.Message) string {
+	if msg.Room == "" {
+		return db.DefaultRoom
+	}
+	return msg.Room
+}
+
+// roomPrefix 非默认房间的消息前加上房间名
+func roomPrefix(room string) string {
+	if room == db.DefaultRoom {
+		return ""
+	}
+	return "[" + room + "]"
+}
+
+// HandleMsgStream 为每个房间启动一个协程处理房间流中的消息，已经启动的房间不会重复启动
+func (S *Server) HandleMsgStream() {
+	rooms, err := S.Cache.SMembersMsg(S.ctx, db.RoomSetName)
+	if err != nil {
+		log.Printf("HandleMsgStream SMembersMsg failed,err:%v\n", err)
+		rooms = []string{db.DefaultRoom}
+	}
+	for _, room := range rooms {
+		S.startRoom(room)
+	}
+}
+
+// startRoom 创建本实例的消费者组并启动房间流的消费协程，每个房间只启动一次。
+// 消费者组从最新的消息开始读，实例启动前的消息已经没有在线的接收者
+func (S *Server) startRoom(room string) {
+	if _, loaded := S.rooms.LoadOrStore(room, struct{}{}); loaded {
+		return
+	}
+	err := S.Streams.XGroupCreateLatestMsg(S.ctx, db.RoomStreamName(room), db.InstanceGroupName(S.instance))
+	if err != nil {
+		log.Printf("startRoom XGroupCreateLatestMsg failed,err:%v\n", err)
+		S.rooms.Delete(room)
+		return
+	}
+	S.consumers.Add(1)
+	go S.HandleRoomStream(room)
+}
+
+// HandleRoomStream 处理某个房间流中的消息，每条读到的消息处理后都确认，
+// 无法解码或不是公聊的消息也确认，不会一直留在待确认列表中，服务端关闭时处理完当前消息后返回
+func (S *Server) HandleRoomStream(room string) {
+	defer S.consumers.Done()
+	stream := db.RoomStreamName(room)
+	for {
+		entry, err := S.Streams.XReadGroupMsg(S.consume, stream, db.InstanceGroupName(S.instance), db.InstanceConsumerName(S.instance))
+		if err != nil {
+			if S.consume.Err() != nil {
+				return
+			}
+			log.Printf("HandleRoomStream db.XReadGroupMsg failed,err:%v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		msg, err := message.DecodeStored(entry.Codec, entry.Data)
+		if err != nil {
+			log.Printf("HandleRoomStream DecodeStored %v failed,err:%v\n", entry.ID, err)
+		} else if msg.Type == message.PublicMsg {
+			msg.Room = room
+			S.HandlePublicMsg(msg, entry.ID)
+		}
+		err = S.Streams.XAckMsg(S.ctx, entry.ID, stream, db.InstanceGroupName(S.instance))
+		if err != nil {
+			log.Printf("HandleRoomStream db.XAckMsg failed,err:%v\n", err)
+		}
+	}
+}
+
+// isRoomMember 判断用户是否在房间中，所有人默认都在默认房间
+func (S *Server) isRoomMember(room string, username string) (bool, error) {
+	if room == db.DefaultRoom {
+		return true, nil
+	}
+	return S.Cache.SIsMemberMsg(S.ctx, username, db.RoomMembersName(room))
+}
+
+// checkRoomMember 检查发送者是否在房间中，不在时回复提示
+func (S *Server) checkRoomMember(C *common.Client, room string) bool {
+	ok, err := S.isRoomMember(room, C.UserName)
+	if err != nil {
+		log.Printf("checkRoomMember isRoomMember failed,err:%v\n", err)
+		return false
+	}
+	if !ok {
+		S.reply(C, fmt.Sprintf("你不在房间%v中，请先/join %v", room, room))
+	}
+	return ok
+}
+
+// BroadcastRoom 向房间中除发送者外的在线成员广播，其他实例上的成员由该实例转发
+func (S *Server) BroadcastRoom(room string, username string, msg *common.Message) {
+	if room == db.DefaultRoom {
+		S.Broadcast(username, msg)
+		return
+	}
+	S.broadcastRoomLocal(room, username, msg)
+	S.publish(&clusterEvent{Kind: eventBroadcast, Msg: msg, Room: room, Except: username})
+}
+
+// broadcastRoomLocal 向本实例上房间中除username外的在线成员发送
+func (S *Server) broadcastRoomLocal(room string, username string, msg *common.Message) {
+	if room == db.DefaultRoom {
+		S.broadcastLocal(username, msg)
+		return
+	}
+	members, err := S.Cache.SMembersMsg(S.ctx, db.RoomMembersName(room))
+	if err != nil {
+		log.Printf("broadcastRoomLocal SMembersMsg failed,err:%v\n", err)
+		return
+	}
+	for _, member := range members {
+		if member != username {
+			S.sendLocal(member, msg)
+		}
+	}
+}
+
+// HandleRoomMsg 房间消息进入对应房间的流
+func (S *Server) HandleRoomMsg(msg *common.Message) {
+	room := roomOf(msg)
+	if !S.checkRoomMember(msg.Sender, room) || !S.checkSend(msg.Sender, room) {
+		return
+	}
+	//消息ID和时间由服务端分配，不信任客户端填写的
+	msg.ID, msg.Time = "", 0
+	rdbMsg, codec, err := message.EncodeStored(msg.Sender.Conn, msg)
+	if err != nil {
+		log.Printf("HandleRoomMsg message.EncodeStored failed,err:%v\n", err)
+		return
+	}
+	//加到房间的接收流，流中的ID就是消息ID
+	id, err := S.Streams.XAddMsg(S.ctx, rdbMsg, codec, db.RoomStreamName(room))
+	if err != nil {
+		log.Printf("HandleRoomMsg db.XAddMsg failed,err:%v\n", err)
+		return
+	}
+	//记下用户在房间中的最后一条消息，编辑和删除不指定ID时使用
+	err = S.Cache.HSetMsg(S.ctx, db.RoomLastMsgName(room), msg.Sender.UserName, id)
+	if err != nil {
+		log.Printf("HandleRoomMsg HSetMsg failed,err:%v\n", err)
+	}
+	//每个实例都会读到房间消息，活跃度在写入时增加一次
+	err = S.Ranks.ZIncrMsg(S.ctx, msg.Sender.UserName, db.RoomZSetName(room))
+	if err != nil {
+		log.Printf("HandleRoomMsg ZIncrMsg failed,err:%v\n", err)
+	}
+}
+
+// HandleCreateRoom 创建房间，创建者自动加入
+func (S *Server) HandleCreateRoom(msg *common.Message) {
+	room := msg.Content
+	if err := message.ValidateRoomName(room); err != nil {
+		S.reply(msg.Sender, "房间名只能包含字母、数字、下划线，长度3-20位")
+		return
+	}
+	n, err := S.Cache.SAddMsg(S.ctx, room, db.RoomSetName)
+	if err != nil {
+		log.Printf("HandleCreateRoom SAddMsg failed,err:%v\n", err)
+		return
+	}
+	if n == 0 {
+		S.reply(msg.Sender, fmt.Sprintf("房间%v已存在，请直接/join", room))
+		return
+	}
+	S.startRoom(room)
+	//创建者成为房间的所有者
+	err = S.Users.SetRole(S.ctx, db.RoomScope(room), msg.Sender.UserName, db.RoleOwner)
+	if err != nil {
+		log.Printf("HandleCreateRoom SetRole failed,err:%v\n", err)
+	}
+	_, err = S.Cache.SAddMsg(S.ctx, msg.Sender.UserName, db.RoomMembersName(room))
+	if err != nil {
+		log.Printf("HandleCreateRoom SAddMsg member failed,err:%v\n", err)
+		return
+	}
+	err = message.SendMsg(msg.Sender.Conn, &common.Message{
+		Type:    message.CreateRoom,
+		Room:    room,
+		Content: fmt.Sprintf("[系统消息]房间%v创建成功，已切换到该房间", room),
+	})
+	if err != nil {
+		log.Printf("HandleCreateRoom SendMsg failed,err:%v\n", err)
+	}
+	fmt.Printf("[系统消息]%v创建了房间%v\n", msg.Sender.UserName, room)
+}
+
+// HandleJoinRoom 加入已有的房间
+func (S *Server) HandleJoinRoom(msg *common.Message) {
+	room := msg.Content
+	exists, err := S.Cache.SIsMemberMsg(S.ctx, room, db.RoomSetName)
+	if err != nil {
+		log.Printf("HandleJoinRoom SIsMemberMsg failed,err:%v\n", err)
+		return
+	}
+	if !exists {
+		S.reply(msg.Sender, fmt.Sprintf("房间%v不存在，可以用/create创建", room))
+		return
+	}
+	if !S.checkJoin(msg.Sender, room) {
+		return
+	}
+	//房间可能是其他实例刚创建的，本实例还没开始读取
+	S.startRoom(room)
+	if room != db.DefaultRoom {
+		_, err = S.Cache.SAddMsg(S.ctx, msg.Sender.UserName, db.RoomMembersName(room))
+		if err != nil {
+			log.Printf("HandleJoinRoom SAddMsg failed,err:%v\n", err)
+			return
+		}
+	}
+	err = message.SendMsg(msg.Sender.Conn, &common.Message{
+		Type:    message.JoinRoom,
+		Room:    room,
+		Content: fmt.Sprintf("[系统消息]已加入房间%v并切换到该房间", room),
+	})
+	if err != nil {
+		log.Printf("HandleJoinRoom SendMsg failed,err:%v\n", err)
+	}
+	S.BroadcastRoom(room, msg.Sender.UserName, &common.Message{
+		Room:    room,
+		Content: fmt.Sprintf("[系统消息]%v加入了房间%v", msg.Sender.UserName, room),
+	})
+}
+
+// HandleLeaveRoom 离开房间，默认房间不能离开
+func (S *Server) HandleLeaveRoom(msg *common.Message) {
+	room := msg.Content
+	if room == db.DefaultRoom {
+		S.reply(msg.Sender, "不能离开默认房间")
+		return
+	}
+	n, err := S.Cache.SRemMsg(S.ctx, msg.Sender.UserName, db.RoomMembersName(room))
+	if err != nil {
+		log.Printf("HandleLeaveRoom SRemMsg failed,err:%v\n", err)
+		return
+	}
+	if n == 0 {
+		S.reply(msg.Sender, fmt.Sprintf("你不在房间%v中", room))
+		return
+	}
+	err = message.SendMsg(msg.Sender.Conn, &common.Message{
+		Type:    message.LeaveRoom,
+		Room:    room,
+		Content: fmt.Sprintf("[系统消息]已离开房间%v", room),
+	})
+	if err != nil {
+		log.Printf("HandleLeaveRoom SendMsg failed,err:%v\n", err)
+	}
+	S.BroadcastRoom(room, msg.Sender.UserName, &common.Message{
+		Room:    room,
+		Content: fmt.Sprintf("[系统消息]%v离开了房间%v", msg.Sender.UserName, room),
+	})
+}
+
+// HandleListRooms 列出所有房间及成员数，标出已加入的房间
+func (S *Server) HandleListRooms(msg *common.Message) {
+	rooms, err := S.Cache.SMembersMsg(S.ctx, db.RoomSetName)
+	if err != nil {
+		log.Printf("HandleListRooms SMembersMsg failed,err:%v\n", err)
+		return
+	}
+	sort.Strings(rooms)
+	users := S.onlineUsers(msg.Sender.UserName)
+	online := make(map[string]bool, len(users))
+	for _, username := range users {
+		online[username] = true
+	}
+	var b strings.Builder
+	b.WriteString("-------房间列表-------\n")
+	for _, room := range rooms {
+		var members []string
+		if room == db.DefaultRoom {
+			members = users
+		} else {
+			members, err = S.Cache.SMembersMsg(S.ctx, db.RoomMembersName(room))
+			if err != nil {
+				log.Printf("HandleListRooms SMembersMsg members failed,err:%v\n", err)
+				continue
+			}
+		}
+		count, joined := 0, room == db.DefaultRoom
+		for _, member := range members {
+			if online[member] {
+				count++
+			}
+			if member == msg.Sender.UserName {
+				joined = true
+			}
+		}
+		mark := " "
+		if joined {
+			mark = "*"
+		}
+		fmt.Fprintf(&b, "%s%-20s 成员%d人 在线%d人\n", mark, room, len(members), count)
+	}
+	b.WriteString("(*表示已加入)\n")
+	err = message.SendMsg(msg.Sender.Conn, &common.Message{
+		Type:    message.ListRooms,
+		Content: b.String(),
+	})
+	if err != nil {
+		log.Printf("HandleListRooms SendMsg failed,err:%v\n", err)
+	}
+}
+
+// reply 给用户回复一条提示
+func (S *Server) reply(C *common.Client, content string) {
+	err := message.SendMsg(C.Conn, &common.Message{Content: content})
+	if err != nil {
+		log.Printf("reply SendMsg failed,err:%v\n", err)
+	}
+}
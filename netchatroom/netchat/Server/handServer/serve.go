@@ -0,0 +1,73 @@
+package handServer
+
+import (
+	"errors"
+	"log"
+	"net"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/message"
+)
+
+// Serve 在listen上接受客户端连接，listen关闭后返回
+func (S *Server) Serve(listen net.Listener) error {
+	S.trackListener(listen)
+	for {
+		//等待客户端链接
+		conn, err := listen.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Println("listen.Accept failed,err:", err)
+			continue
+		}
+		//链接成功
+		go S.HandleConn(conn)
+	}
+}
+
+// HandleConn 处理一个客户端连接，握手后进入登录注册，登录成功后开始接收消息
+func (S *Server) HandleConn(conn net.Conn) {
+	//先握手协商协议版本和编解码器，不支持的客户端直接断开
+	codecConn, err := message.ServerHandshake(conn)
+	if err != nil {
+		log.Printf("ServerHandshake failed,err:%v\n", err)
+		err = conn.Close()
+		if err != nil {
+			log.Printf("conn.Close failed,err:%v\n", err)
+		}
+		return
+	}
+	//之后所有写操作都经过连接自己的发送队列
+	S.serveClient(S.newOutConn(codecConn))
+}
+
+// serveClient 登录注册成功后开始接收消息，未登录就断开的连接直接关闭
+func (S *Server) serveClient(conn common.Conn) {
+	C := S.LoginAndRegister(conn)
+	if C == nil {
+		_ = conn.Close()
+		return
+	}
+	//正在关闭时不再接收新登录的用户
+	S.servingMu.Lock()
+	if S.closing.Load() {
+		S.servingMu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	S.startReader(C)
+	S.servingMu.Unlock()
+}
+
+// startReader 登记连接并启动读协程，Shutdown据此让所有读协程返回，
+// 包括加入消息还在分片中排队、尚未加入S.Clients的用户
+func (S *Server) startReader(C *common.Client) {
+	S.readers.Add(1)
+	S.readerConns.Store(C.Conn, struct{}{})
+	go func() {
+		defer S.readers.Done()
+		defer S.readerConns.Delete(C.Conn)
+		S.ReceiveToChan(C)
+	}()
+}
@@ -0,0 +1,121 @@
+package handServer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"netchatroom/netchat/utils"
+	"time"
+)
+
+// NewSession 为登录成功的用户签发会话令牌
+func (S *Server) NewSession(username string) (string, error) {
+	token, err := utils.NewToken()
+	if err != nil {
+		return "", fmt.Errorf("NewToken failed,err:%w", err)
+	}
+	err = S.Cache.SetSession(S.ctx, token, username, S.cfg.SessionTTL)
+	if err != nil {
+		return "", fmt.Errorf("SetSession failed,err:%w", err)
+	}
+	return token, nil
+}
+
+// Detach 连接异常断开时先保留用户的在线状态，宽限期内可以用令牌恢复，
+// 超过宽限期仍未恢复再按离开处理
+func (S *Server) Detach(C *common.Client) {
+	//已经被新连接接管或已经离开的不需要处理
+	if cur, ok := S.Clients.Load(C.UserName); !ok || cur != C {
+		return
+	}
+	err := C.Conn.Close()
+	if err != nil {
+		log.Printf("Detach C.Conn.Close failed,err:%v\n", err)
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(S.cfg.ResumeGrace, func() {
+		//宽限期内已经恢复的会删掉这个计时器
+		if !S.detached.CompareAndDelete(C.UserName, timer) {
+			return
+		}
+		S.Dispatch(&common.Message{
+			Sender: C,
+			Type:   message.Quit,
+		})
+	})
+	S.detached.Store(C.UserName, timer)
+	S.setPresence(C.UserName)
+	fmt.Printf("[系统消息]%v连接断开，等待重连...\n", C.UserName)
+}
+
+// ReplyResume 处理断线重连的会话恢复请求
+func (S *Server) ReplyResume(msg *common.Message) *common.Client {
+	req := &message.ResumeRequest{}
+	err := message.GetPayload(msg, req)
+	if err != nil || req.Token == "" {
+		S.ReplyAuth(msg.Sender.Conn, message.Resume, message.CodeBadRequest)
+		return nil
+	}
+	username, err := S.Cache.GetSession(S.ctx, req.Token)
+	if err != nil {
+		if errors.Is(err, db.ErrNil) {
+			S.ReplyAuth(msg.Sender.Conn, message.Resume, message.CodeInvalidToken)
+		} else {
+			log.Printf("ReplyResume GetSession failed,err:%v\n", err)
+			S.ReplyAuth(msg.Sender.Conn, message.Resume, message.CodeInternal)
+		}
+		return nil
+	}
+	if S.isBanned(username) {
+		err = S.Cache.DelSession(S.ctx, req.Token)
+		if err != nil {
+			log.Printf("ReplyResume DelSession failed,err:%v\n", err)
+		}
+		S.ReplyAuth(msg.Sender.Conn, message.Resume, message.CodeBanned)
+		return nil
+	}
+	//续期令牌
+	err = S.Cache.SetSession(S.ctx, req.Token, username, S.cfg.SessionTTL)
+	if err != nil {
+		log.Printf("ReplyResume SetSession failed,err:%v\n", err)
+	}
+
+	if C := S.Reattach(msg.Sender.Conn, message.Resume, username, req.Token); C != nil {
+		return C
+	}
+	//宽限期已过，按正常登录重新加入聊天室
+	return S.LoginSuccess(msg.Sender.Conn, message.Resume, username, req.Token)
+}
+
+// Reattach 用新连接接管仍在线或断线等待重连的用户，不广播加入和离开，用户不在线时返回nil
+func (S *Server) Reattach(conn common.Conn, typ int, username string, token string) *common.Client {
+	old, online := S.Clients.Load(username)
+	if !online {
+		return nil
+	}
+	if timer, ok := S.detached.LoadAndDelete(username); ok {
+		timer.(*time.Timer).Stop()
+	} else {
+		//服务端还没发现旧连接断开，由新连接接管
+		err := old.(*common.Client).Conn.Close()
+		if err != nil {
+			log.Printf("Reattach old Conn.Close failed,err:%v\n", err)
+		}
+	}
+	client := &common.Client{UserName: username, Conn: conn, Token: token}
+	S.Clients.Store(username, client)
+	S.setPresence(username)
+	err := conn.SetReadDeadline(time.Now().Add(S.cfg.HeartbeatTimeout))
+	if err != nil {
+		log.Printf("Reattach SetReadDeadline failed,err:%v\n", err)
+		return nil
+	}
+	S.SendAuth(conn, typ, &message.AuthResponse{Code: message.CodeOK, Token: token, Unread: S.unreadCounts(username)})
+	fmt.Printf("[系统消息]%v重新连接成功\n", username)
+	//补发断线期间没能送达的私聊
+	go S.ReplayPending(client)
+	return client
+}
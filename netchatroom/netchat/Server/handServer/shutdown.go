@@ -0,0 +1,164 @@
+package handServer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/message"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed 重复调用Shutdown时返回
+var ErrServerClosed = errors.New("server closed")
+
+// drainInterval Shutdown等待读协程退出时重新设置读超时的间隔
+const drainInterval = 50 * time.Millisecond
+
+// trackListener 记录正在接受连接的监听，Shutdown时关闭
+func (S *Server) trackListener(listen net.Listener) {
+	S.servingMu.Lock()
+	defer S.servingMu.Unlock()
+	S.listeners = append(S.listeners, listen)
+}
+
+// trackHTTP 记录WebSocket接入和HTTP接口的http.Server，Shutdown时关闭
+func (S *Server) trackHTTP(srv *http.Server) {
+	S.servingMu.Lock()
+	defer S.servingMu.Unlock()
+	S.httpServers = append(S.httpServers, srv)
+}
+
+// Shutdown 优雅关闭服务端：停止接受新连接，通知所有客户端服务器正在关闭，
+// 停止读取客户端消息，等已经收到的消息处理完、消息流中正在处理的消息确认后关闭所有连接。
+// ctx到期时不再等待，直接关闭剩余的连接并返回ctx.Err()，之后由调用者关闭MySQL和redis
+func (S *Server) Shutdown(ctx context.Context) error {
+	S.servingMu.Lock()
+	if !S.closing.CompareAndSwap(false, true) {
+		S.servingMu.Unlock()
+		return ErrServerClosed
+	}
+	listeners, servers := S.listeners, S.httpServers
+	S.servingMu.Unlock()
+
+	//停止接受新连接，HTTP接口等正在处理的请求返回
+	for _, listen := range listeners {
+		err := listen.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Shutdown listen.Close failed,err:%v\n", err)
+		}
+	}
+	for _, srv := range servers {
+		err := srv.Shutdown(ctx)
+		if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("Shutdown http.Server.Shutdown failed,err:%v\n", err)
+		}
+	}
+
+	//通知客户端，写入各自的发送队列，关闭连接前发出
+	S.Clients.Range(func(_, value interface{}) bool {
+		err := message.SendMsg(value.(*common.Client).Conn, &common.Message{
+			Type:    message.Shutdown,
+			Content: "[系统消息]服务器正在关闭，稍后将自动重连",
+		})
+		if err != nil {
+			log.Printf("Shutdown SendMsg failed,err:%v\n", err)
+		}
+		return true
+	})
+
+	err := S.drain(ctx)
+	S.leaveCluster()
+	S.closeClients(ctx)
+	//drain超时返回时消费协程可能还没停止，这里一并取消
+	S.cancel()
+	if err != nil {
+		return fmt.Errorf("Shutdown drain failed,err:%w", err)
+	}
+	fmt.Println("[系统消息]服务器已关闭")
+	return nil
+}
+
+// drain 停止读取客户端消息，依次等待读协程退出、分片处理完已收到的消息、消息流的消费协程确认完正在处理的消息
+func (S *Server) drain(ctx context.Context) error {
+	//让阻塞在读上的读协程立即返回，closing已设置，不会按断线处理。
+	//加入还在分片中排队的用户不在S.Clients中，按读协程自己登记的连接设置；
+	//分片中正在处理的心跳可能刚把超时时间推后，等待期间定期重新设置
+	readers := waitGroupDone(&S.readers)
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		now := time.Now()
+		S.readerConns.Range(func(key, _ interface{}) bool {
+			_ = key.(common.Conn).SetReadDeadline(now)
+			return true
+		})
+		select {
+		case <-readers:
+			waiting = false
+		case <-ctx.Done():
+			return fmt.Errorf("wait readers failed,err:%w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	close(S.stopDispatch)
+	err := waitCtx(ctx, S.dispatchDone)
+	if err != nil {
+		return fmt.Errorf("wait dispatch failed,err:%w", err)
+	}
+	//分片处理完后不会再有新的消费协程启动，正在处理的消息仍用S.ctx完成确认
+	S.stopConsume()
+	err = waitCtx(ctx, waitGroupDone(&S.consumers))
+	if err != nil {
+		return fmt.Errorf("wait consumers failed,err:%w", err)
+	}
+	return nil
+}
+
+// closeClients 停止所有等待重连的计时器，关闭所有客户端连接，等发送队列写完，ctx到期时直接关闭
+func (S *Server) closeClients(ctx context.Context) {
+	S.detached.Range(func(key, value interface{}) bool {
+		value.(*time.Timer).Stop()
+		S.detached.Delete(key)
+		return true
+	})
+	var conns []*outConn
+	S.Clients.Range(func(key, value interface{}) bool {
+		conn := value.(*common.Client).Conn
+		_ = conn.Close()
+		if c, ok := conn.(*outConn); ok {
+			conns = append(conns, c)
+		}
+		S.Clients.Delete(key)
+		return true
+	})
+	for _, c := range conns {
+		if waitCtx(ctx, c.stopped) != nil {
+			_ = c.Conn.Close()
+		}
+	}
+}
+
+// waitCtx 等待done关闭或ctx到期
+func waitCtx(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitGroupDone 返回一个在wg计数归零后关闭的通道
+func waitGroupDone(wg *sync.WaitGroup) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
@@ -0,0 +1,48 @@
+package handServer
+
+import (
+	"context"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/db"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deadlineConn 读操作阻塞到读超时被设置为已经过去的时间
+type deadlineConn struct {
+	discardConn
+	once    sync.Once
+	expired chan struct{}
+}
+
+func (c *deadlineConn) ReadMsg() (*common.Message, error) {
+	<-c.expired
+	return nil, os.ErrDeadlineExceeded
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	if !t.After(time.Now()) {
+		c.once.Do(func() { close(c.expired) })
+	}
+	return nil
+}
+
+func TestDrainWakesReadersNotInClients(t *testing.T) {
+	cfg := config.Default().Server
+	S := NewServer(&cfg, db.NewMemStore().Stores())
+	go S.HandleMsgChan()
+	//登录成功但加入消息还在分片中排队，用户不在S.Clients中
+	conn := &deadlineConn{expired: make(chan struct{})}
+	S.startReader(&common.Client{UserName: "alice", Conn: conn})
+
+	S.closing.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := S.drain(ctx); err != nil {
+		t.Fatalf("drain err = %v", err)
+	}
+	S.cancel()
+}
@@ -0,0 +1,76 @@
+package handServer
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"netchatroom/netchat/message"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSPath WebSocket接入的路径
+const WSPath = "/ws"
+
+// ServeWS 在listen上提供WebSocket接入，listen关闭后返回。
+// 浏览器通过Sec-WebSocket-Protocol选择编解码器（json、msgpack、protobuf），不指定时使用JSON，
+// 之后每个帧是一条消息，登录注册和聊天的流程与TCP客户端完全相同
+func (S *Server) ServeWS(listen net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(WSPath, S.HandleWS)
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	S.trackHTTP(srv)
+	return srv.Serve(listen)
+}
+
+// HandleWS 把HTTP请求升级为WebSocket连接，之后按普通客户端处理
+func (S *Server) HandleWS(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		Subprotocols: message.CodecNames,
+		CheckOrigin:  S.checkOrigin,
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		//Upgrade失败时已经回复了HTTP错误
+		log.Printf("HandleWS Upgrade failed,err:%v\n", err)
+		return
+	}
+	//与TCP帧使用同样的长度上限
+	ws.SetReadLimit(int64(S.cfg.MaxFrameSize))
+	var codec message.Codec
+	if name := ws.Subprotocol(); name != "" {
+		codec, err = message.CodecByName(name)
+		if err != nil {
+			log.Printf("HandleWS CodecByName failed,err:%v\n", err)
+			_ = ws.Close()
+			return
+		}
+	}
+	S.serveClient(S.newOutConn(message.NewWSConn(ws, codec)))
+}
+
+// checkOrigin 校验浏览器来源，没有Origin头的非浏览器客户端总是允许
+func (S *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(S.cfg.WSOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || (allowed != "" && strings.EqualFold(allowed, origin)) {
+			return true
+		}
+	}
+	//默认只允许同源
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
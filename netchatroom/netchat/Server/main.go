@@ -1,62 +1,133 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"netchatroom/netchat/Server/handServer"
-	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
 	"netchatroom/netchat/db"
-	"sync"
+	"netchatroom/netchat/utils"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Printf("config.Load failed,err:%v\n", err)
+		return
+	}
+	utils.SetMaxFrameSize(uint32(cfg.Server.MaxFrameSize))
+	var tlsCfg *tls.Config
+	if cfg.Server.TLS.Enabled() {
+		tlsCfg, err = utils.ServerTLS(cfg.Server.TLS.Cert, cfg.Server.TLS.Key, cfg.Server.TLS.ClientCA)
+		if err != nil {
+			log.Printf("ServerTLS failed,err:%v\n", err)
+			return
+		}
+	}
 	fmt.Println("服务器启动...")
-	listen, err := net.Listen("tcp", "0.0.0.0:8888")
+	listen, err := listenTCP(cfg.Server.Addr, tlsCfg)
 	if err != nil {
 		log.Println("服务器启动失败...,err:", err)
 		return
 	}
 	fmt.Println("服务器启动成功...")
-	//延时关闭listen
+	//启动失败时关闭listen，正常运行时由Shutdown关闭
 	defer func() {
 		listenErr := listen.Close()
-		if listenErr != nil {
+		if listenErr != nil && !errors.Is(listenErr, net.ErrClosed) {
 			log.Printf("listen.Close failed,err:%v\n", listenErr)
 		}
-		db.CloseDB()
 	}()
-	err = db.InitDB()
+	err = db.InitDB(&cfg.MySQL)
 	if err != nil {
 		log.Printf("InitDB failed,err:%v\n", err)
 		return
 	}
-	err = db.InitRDB()
+	defer db.CloseDB()
+	err = db.InitRDB(&cfg.Redis)
 	if err != nil {
 		log.Printf("InitRDB failed,err:%v\n", err)
 		return
 	}
+	defer db.CloseRDB()
 
-	netChat := handServer.Server{
-		Clients: sync.Map{},
-		MsgChan: make(chan *common.Message, 100),
+	netChat := handServer.NewServer(&cfg.Server, db.NewStores())
+	err = netChat.JoinCluster()
+	if err != nil {
+		log.Printf("JoinCluster failed,err:%v\n", err)
+		return
 	}
 
 	go netChat.HandleMsgChan()
 	go netChat.HandleMsgStream()
-	for {
-		//等待客户端链接
-		conn, err := listen.Accept()
-		if err != nil {
-			log.Println("listen.Accept failed,err:", err)
+	//管理控制台只监听本机
+	go func() {
+		err := netChat.ServeAdmin()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("ServeAdmin failed,err:%v\n", err)
+		}
+	}()
+	//WebSocket接入和HTTP接口与TCP共用TLS配置
+	for _, extra := range []struct {
+		name  string
+		addr  string
+		serve func(net.Listener) error
+	}{
+		{"ServeWS", cfg.Server.WSAddr, netChat.ServeWS},
+		{"ServeAPI", cfg.Server.APIAddr, netChat.ServeAPI},
+	} {
+		if extra.addr == "" {
 			continue
 		}
-		//链接成功
+		extraListen, err := listenTCP(extra.addr, tlsCfg)
+		if err != nil {
+			log.Printf("%s listen failed,err:%v\n", extra.name, err)
+			return
+		}
 		go func() {
-			if C := netChat.LoginAndRegister(conn); C != nil {
-				go netChat.ReceiveToChan(C)
-				go netChat.HandleUsernameStreamMsg(C)
+			err := extra.serve(extraListen)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("%s failed,err:%v\n", extra.name, err)
 			}
 		}()
 	}
+	go func() {
+		err := netChat.Serve(listen)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Serve failed,err:%v\n", err)
+		}
+	}()
+
+	//收到SIGINT或SIGTERM后优雅关闭，超时后强制关闭连接，再关闭MySQL和redis
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop()
+	fmt.Println("服务器正在关闭...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	err = netChat.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Shutdown failed,err:%v\n", err)
+	}
+}
+
+// listenTCP 监听地址，tlsCfg非空时在其上启用TLS
+func listenTCP(addr string, tlsCfg *tls.Config) (net.Listener, error) {
+	listen, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		return tls.NewListener(listen, tlsCfg), nil
+	}
+	return listen, nil
 }
@@ -0,0 +1,499 @@
+// Package chattest 在测试进程内启动使用内存存储的服务端，并提供按脚本收发消息的客户端，
+// 用于端到端地检查每个客户端收到了什么、按什么顺序收到
+package chattest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"netchatroom/netchat/Server/handServer"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	Password = "password123"   // 脚本客户端默认使用的密码
+	Timeout  = 2 * time.Second // 等待一条消息的最长时间
+)
+
+// Server 进程内的服务端
+type Server struct {
+	*handServer.Server
+	Store   *db.MemStore
+	Addr    string
+	WSAddr  string // WebSocket接入地址
+	APIAddr string // HTTP接口地址
+	t       testing.TB
+}
+
+// StartServer 用默认配置在随机端口启动服务端，测试结束时关闭服务端
+func StartServer(t testing.TB) *Server {
+	cfg := config.Default().Server
+	return StartServerConfig(t, &cfg)
+}
+
+// StartServerConfig 用指定配置启动服务端，监听地址总是随机端口
+func StartServerConfig(t testing.TB, cfg *config.ServerConfig) *Server {
+	t.Helper()
+	return StartServerStore(t, cfg, db.NewMemStore())
+}
+
+// StartCluster 启动n个共用同一个内存存储的服务端实例，模拟共用redis的集群
+func StartCluster(t testing.TB, n int) []*Server {
+	t.Helper()
+	cfg := config.Default().Server
+	return StartClusterConfig(t, n, &cfg)
+}
+
+// StartClusterConfig 用指定配置启动n个实例的集群，各实例的InstanceID由序号生成
+func StartClusterConfig(t testing.TB, n int, cfg *config.ServerConfig) []*Server {
+	t.Helper()
+	store := db.NewMemStore()
+	servers := make([]*Server, n)
+	for i := range servers {
+		node := *cfg
+		node.InstanceID = "node" + strconv.Itoa(i+1)
+		servers[i] = StartServerStore(t, &node, store)
+	}
+	return servers
+}
+
+// StartServerStore 用指定配置和存储启动服务端，监听地址总是随机端口
+func StartServerStore(t testing.TB, cfg *config.ServerConfig, store *db.MemStore) *Server {
+	t.Helper()
+	s := &Server{
+		Server: handServer.NewServer(cfg, store.Stores()),
+		Store:  store,
+		t:      t,
+	}
+	//最先注册，在关闭监听和客户端连接之后执行
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := s.Shutdown(ctx)
+		if err != nil && !errors.Is(err, handServer.ErrServerClosed) {
+			t.Errorf("Shutdown failed,err:%v", err)
+		}
+	})
+	if err := s.JoinCluster(); err != nil {
+		t.Fatalf("JoinCluster failed,err:%v", err)
+	}
+	go s.HandleMsgChan()
+	go s.HandleMsgStream()
+	s.Addr = s.listen("Serve", s.Serve)
+	s.WSAddr = s.listen("ServeWS", s.ServeWS)
+	s.APIAddr = s.listen("ServeAPI", s.ServeAPI)
+	return s
+}
+
+// listen 在随机端口上启动serve，测试结束时关闭监听，返回监听地址
+func (s *Server) listen(name string, serve func(net.Listener) error) string {
+	s.t.Helper()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Fatalf("Listen failed,err:%v", err)
+	}
+	go func() {
+		err := serve(listen)
+		if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+			s.t.Errorf("%s failed,err:%v", name, err)
+		}
+	}()
+	s.t.Cleanup(func() {
+		_ = listen.Close()
+	})
+	return listen.Addr().String()
+}
+
+// API 调用HTTP接口，token非空时带上Bearer令牌，body非空时编码为JSON请求体，
+// 回复解码到out中，返回HTTP状态码
+func (s *Server) API(method string, path string, token string, body any, out any) int {
+	s.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://"+s.APIAddr+path, reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		s.t.Fatalf("%s %s failed,err:%v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			s.t.Fatalf("%s %s Decode failed,err:%v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// Dial 连接服务端并完成握手，按客户端默认的顺序协商编解码器
+func (s *Server) Dial() *Client {
+	return s.DialCodec(message.CodecNames...)
+}
+
+// DialCodec 连接服务端并只提供指定的编解码器
+func (s *Server) DialCodec(codecs ...string) *Client {
+	s.t.Helper()
+	conn, err := net.DialTimeout("tcp", s.Addr, Timeout)
+	if err != nil {
+		s.t.Fatalf("Dial failed,err:%v", err)
+	}
+	codecConn, err := message.ClientHandshake(conn, codecs)
+	if err != nil {
+		_ = conn.Close()
+		s.t.Fatalf("ClientHandshake failed,err:%v", err)
+	}
+	return s.newClient(codecConn)
+}
+
+// DialWS 通过WebSocket接入，codec为空时不指定子协议，使用JSON文本帧
+func (s *Server) DialWS(codec string) *Client {
+	s.t.Helper()
+	dialer := websocket.Dialer{HandshakeTimeout: Timeout}
+	if codec != "" {
+		dialer.Subprotocols = []string{codec}
+	}
+	ws, _, err := dialer.Dial("ws://"+s.WSAddr+handServer.WSPath, nil)
+	if err != nil {
+		s.t.Fatalf("websocket Dial failed,err:%v", err)
+	}
+	var c message.Codec
+	if name := ws.Subprotocol(); name != "" {
+		c, err = message.CodecByName(name)
+		if err != nil {
+			_ = ws.Close()
+			s.t.Fatal(err)
+		}
+	}
+	return s.newClient(message.NewWSConn(ws, c))
+}
+
+// newClient 开始接收conn上的消息，测试结束时关闭连接
+func (s *Server) newClient(conn common.Conn) *Client {
+	c := &Client{
+		t:    s.t,
+		Conn: conn,
+		msgs: make(chan *common.Message, 100),
+	}
+	go c.receive()
+	s.t.Cleanup(func() {
+		_ = c.Conn.Close()
+	})
+	return c
+}
+
+// Join 注册并登录一个新用户，返回已登录的客户端
+func (s *Server) Join(username string) *Client {
+	s.t.Helper()
+	return s.Login(s.Dial(), username)
+}
+
+// Login 用已建立的连接注册并登录一个新用户
+func (s *Server) Login(c *Client, username string) *Client {
+	s.t.Helper()
+	if resp := c.Register(username, Password); !resp.OK() {
+		s.t.Fatalf("%v Register = %v", username, resp.Code)
+	}
+	if resp := c.Login(username, Password); !resp.OK() {
+		s.t.Fatalf("%v Login = %v", username, resp.Code)
+	}
+	return c
+}
+
+// Client 按脚本收发消息的客户端，收到的消息按顺序缓存，由Next和Expect系列方法逐条检查
+type Client struct {
+	Name  string
+	Token string
+	Conn  common.Conn
+
+	t    testing.TB
+	msgs chan *common.Message
+	err  error // 接收协程退出的原因，msgs关闭后可读
+}
+
+// receive 持续接收消息，连接断开时关闭msgs
+func (c *Client) receive() {
+	defer close(c.msgs)
+	for {
+		msg, err := message.ReciveMsg(c.Conn)
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.msgs <- msg
+	}
+}
+
+// Send 发送任意消息
+func (c *Client) Send(msg *common.Message) {
+	c.t.Helper()
+	if msg.Sender == nil {
+		msg.Sender = &common.Client{UserName: c.Name}
+	}
+	err := message.SendMsg(c.Conn, msg)
+	if err != nil {
+		c.t.Fatalf("%v SendMsg failed,err:%v", c.Name, err)
+	}
+}
+
+// auth 发送登录注册类请求并等待对应类型的回复
+func (c *Client) auth(typ int, payload any) *message.AuthResponse {
+	c.t.Helper()
+	msg := &common.Message{Type: typ}
+	err := message.SetPayload(msg, payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.Send(msg)
+	reply := c.ExpectType(typ)
+	resp := &message.AuthResponse{}
+	err = message.GetPayload(reply, resp)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+// Register 注册
+func (c *Client) Register(username string, password string) *message.AuthResponse {
+	c.t.Helper()
+	return c.auth(message.Register, &message.RegisterRequest{Username: username, Password: password})
+}
+
+// Login 登录，成功后记录用户名和会话令牌
+func (c *Client) Login(username string, password string) *message.AuthResponse {
+	c.t.Helper()
+	resp := c.auth(message.Login, &message.LoginRequest{Username: username, Password: password})
+	if resp.OK() {
+		c.Name, c.Token = username, resp.Token
+	}
+	return resp
+}
+
+// Resume 用会话令牌恢复登录
+func (c *Client) Resume(token string) *message.AuthResponse {
+	c.t.Helper()
+	return c.auth(message.Resume, &message.ResumeRequest{Token: token})
+}
+
+// Say 在默认房间公聊
+func (c *Client) Say(content string) {
+	c.t.Helper()
+	c.SayIn("", content)
+}
+
+// SayIn 在指定房间发言
+func (c *Client) SayIn(room string, content string) {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.PublicMsg, Content: content, Room: room})
+}
+
+// Chat 私聊
+func (c *Client) Chat(to string, content string) {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.PrivateMsg, Content: content, To: to})
+}
+
+// History 请求默认房间最近n条历史消息
+func (c *Client) History(n int) {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.PublicHistory, Content: strconv.Itoa(n)})
+}
+
+// PrivateHistory 请求与某个用户最近n条私聊历史
+func (c *Client) PrivateHistory(n int, with string) {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.PrivateHistory, Content: strconv.Itoa(n), To: with})
+}
+
+// FetchUnread 拉取未读私聊，peer非空时只拉取与该用户的会话
+func (c *Client) FetchUnread(peer string) *message.UnreadResponse {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.FetchUnread, To: peer})
+	resp := &message.UnreadResponse{}
+	err := message.GetPayload(c.ExpectType(message.FetchUnread), resp)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+// Read 发送已读回执，id为空时标记到最新一条
+func (c *Client) Read(peer string, id string) {
+	c.t.Helper()
+	msg := &common.Message{Type: message.ReadReceipt}
+	err := message.SetPayload(msg, &message.ReadRequest{Peer: peer, ID: id})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.Send(msg)
+}
+
+// Rank 请求默认房间的活跃度排行榜
+func (c *Client) Rank() {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.CheckRankList})
+}
+
+// CheckUser 请求在线用户列表
+func (c *Client) CheckUser() {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.CheckUser})
+}
+
+// SetStatus 设置在线状态
+func (c *Client) SetStatus(status string, text string) {
+	c.t.Helper()
+	msg := &common.Message{Type: message.SetStatus}
+	err := message.SetPayload(msg, &message.StatusRequest{Status: status, Text: text})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.Send(msg)
+}
+
+// Typing 发送正在输入事件，to非空时为私聊，否则为room，room为空表示默认房间
+func (c *Client) Typing(room string, to string) {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.Typing, Room: room, To: to})
+}
+
+// Edit 编辑房间中的消息，id为空时编辑自己在该房间的最后一条，room为空表示默认房间
+func (c *Client) Edit(room string, id string, content string) {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.EditMsg, Room: room, ID: id, Content: content})
+}
+
+// Delete 删除房间中的消息，id为空时删除自己在该房间的最后一条，room为空表示默认房间
+func (c *Client) Delete(room string, id string) {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.DeleteMsg, Room: room, ID: id})
+}
+
+// Whois 请求用户资料
+func (c *Client) Whois(username string) {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.Whois, To: username})
+}
+
+// Moderate 在房间中执行管理指令，room为空时为默认房间
+func (c *Client) Moderate(room string, req *message.ModerateRequest) {
+	c.t.Helper()
+	msg := &common.Message{Type: message.Moderate, Room: room}
+	err := message.SetPayload(msg, req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.Send(msg)
+}
+
+// Heartbeat 发送心跳
+func (c *Client) Heartbeat() {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.HeartMsg})
+}
+
+// Quit 主动退出
+func (c *Client) Quit() {
+	c.t.Helper()
+	c.Send(&common.Message{Type: message.Quit})
+}
+
+// Next 返回下一条收到的消息，超时或连接断开时测试失败
+func (c *Client) Next() *common.Message {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatalf("%v connection closed while waiting for a message,err:%v", c.Name, c.err)
+		}
+		return msg
+	case <-time.After(Timeout):
+		c.t.Fatalf("%v timed out waiting for a message", c.Name)
+	}
+	return nil
+}
+
+// Expect 下一条消息必须包含substr
+func (c *Client) Expect(substr string) *common.Message {
+	c.t.Helper()
+	msg := c.Next()
+	if !strings.Contains(msg.Content, substr) {
+		c.t.Fatalf("%v got %q (type %d), want it to contain %q", c.Name, msg.Content, msg.Type, substr)
+	}
+	return msg
+}
+
+// ExpectType 下一条消息必须是指定类型
+func (c *Client) ExpectType(typ int) *common.Message {
+	c.t.Helper()
+	msg := c.Next()
+	if msg.Type != typ {
+		c.t.Fatalf("%v got type %d %q, want type %d", c.Name, msg.Type, msg.Content, typ)
+	}
+	return msg
+}
+
+// SkipUntil 丢弃消息直到某条包含substr，用于跳过与当前检查无关的系统消息
+func (c *Client) SkipUntil(substr string) *common.Message {
+	c.t.Helper()
+	for {
+		msg := c.Next()
+		if strings.Contains(msg.Content, substr) {
+			return msg
+		}
+	}
+}
+
+// ExpectNothing 在d时间内不能收到任何消息
+func (c *Client) ExpectNothing(d time.Duration) {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.msgs:
+		if ok {
+			c.t.Fatalf("%v got unexpected %q (type %d)", c.Name, msg.Content, msg.Type)
+		}
+	case <-time.After(d):
+	}
+}
+
+// ExpectClosed 连接必须在超时前被服务端关闭，之前收到的消息被丢弃
+func (c *Client) ExpectClosed(timeout time.Duration) {
+	c.t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-c.msgs:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			c.t.Fatalf("%v connection still open after %v", c.Name, timeout)
+		}
+	}
+}
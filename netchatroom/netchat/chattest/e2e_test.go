@@ -0,0 +1,779 @@
+package chattest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"netchatroom/netchat/Server/handServer"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/db"
+	"netchatroom/netchat/message"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterAndLogin(t *testing.T) {
+	s := StartServer(t)
+	c := s.Dial()
+
+	if resp := c.Register("ab", Password); resp.Code != message.CodeInvalidUsername {
+		t.Fatalf("short username = %v", resp.Code)
+	}
+	//系统key的前缀不能用作用户名，否则收件箱会与默认房间的流重名
+	if resp := c.Register("chat_receive", Password); resp.Code != message.CodeInvalidUsername {
+		t.Fatalf("reserved username = %v", resp.Code)
+	}
+	if resp := c.Register("alice", "short"); resp.Code != message.CodeWeakPassword {
+		t.Fatalf("weak password = %v", resp.Code)
+	}
+	if resp := c.Register("alice", Password); !resp.OK() {
+		t.Fatalf("register = %v", resp.Code)
+	}
+	if resp := c.Register("alice", Password); resp.Code != message.CodeUserExists {
+		t.Fatalf("duplicate register = %v", resp.Code)
+	}
+	if resp := c.Login("bob", Password); resp.Code != message.CodeUserNotFound {
+		t.Fatalf("unknown user = %v", resp.Code)
+	}
+	if resp := c.Login("alice", "wrong12345"); resp.Code != message.CodeWrongPassword {
+		t.Fatalf("wrong password = %v", resp.Code)
+	}
+	if resp := c.Login("alice", Password); !resp.OK() || resp.Token == "" {
+		t.Fatalf("login = %+v", resp)
+	}
+
+	if resp := s.Dial().Login("alice", Password); resp.Code != message.CodeAlreadyLoggedIn {
+		t.Fatalf("second login = %v", resp.Code)
+	}
+}
+
+func TestPublicChatOrder(t *testing.T) {
+	s := StartServer(t)
+	alice := s.Join("alice")
+	bob := s.Join("bob")
+	alice.Expect("bob加入聊天室")
+
+	for i := range 5 {
+		alice.Say(fmt.Sprintf("msg%d", i))
+	}
+	for i := range 5 {
+		bob.Expect(fmt.Sprintf("->alice:msg%d", i))
+	}
+	//发送者自己不会收到
+	alice.ExpectNothing(100 * time.Millisecond)
+
+	bob.History(3)
+	history := bob.ExpectType(message.PublicHistory)
+	if want := "->alice:msg2\n->alice:msg3\n->alice:msg4\n"; stripHistoryTime(history.Content) != want {
+		t.Fatalf("history = %q, want %q", history.Content, want)
+	}
+
+	bob.Rank()
+	rank := bob.ExpectType(message.CheckRankList)
+	lines := strings.Split(rank.Content, "\n")
+	if len(lines) < 4 || !strings.Contains(lines[2], "alice") || !strings.Contains(lines[3], "bob") {
+		t.Fatalf("rank = %q, want alice before bob", rank.Content)
+	}
+}
+
+func TestRoomStreamAcksBadEntries(t *testing.T) {
+	s := StartServer(t)
+	alice := s.Join("alice")
+	bob := s.Join("bob")
+	alice.Expect("bob加入聊天室")
+
+	//无法解码、不是公聊和没有发送者的消息都跳过，但不能一直留在实例的待确认列表中
+	ctx := context.Background()
+	stream := db.RoomStreamName(db.DefaultRoom)
+	for _, data := range []string{
+		"not a message",
+		fmt.Sprintf(`{"Type":%d,"Content":"x"}`, message.CheckUser),
+		fmt.Sprintf(`{"Type":%d,"Content":"no sender"}`, message.PublicMsg),
+	} {
+		if _, err := s.Store.XAddMsg(ctx, data, "", stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice.Say("after")
+	bob.Expect("->alice:after")
+	bob.ExpectNothing(50 * time.Millisecond)
+
+	group, consumer := db.InstanceGroupName(s.Instance()), db.InstanceConsumerName(s.Instance())
+	pending, err := s.Store.XReadGroupPendingMsg(ctx, stream, group, consumer, 10)
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("pending = %+v, %v", pending, err)
+	}
+}
+
+func TestPrivateChat(t *testing.T) {
+	s := StartServer(t)
+	alice := s.Join("alice")
+	bob := s.Join("bob")
+	alice.Expect("bob加入聊天室")
+	//旧版本写入私聊历史流的文本条目，没有codec标记
+	ctx := context.Background()
+	if _, err := s.Store.XAddMsg(ctx, "[私聊]bob:legacy", "", "bobAndalice"); err != nil {
+		t.Fatal(err)
+	}
+
+	alice.Chat("bob", "hi")
+	alice.Chat("bob", "there: 1:2")
+	bob.Expect("->alice私聊你:hi")
+	bob.Expect("->alice私聊你:there: 1:2")
+
+	alice.Chat("nobody", "hi")
+	alice.Expect("该用户名不存在")
+
+	bob.PrivateHistory(10, "alice")
+	history := bob.ExpectType(message.PrivateHistory)
+	if want := "[私聊]bob:legacy\n[私聊]alice:hi\n[私聊]alice:there: 1:2\n"; history.Content != want {
+		t.Fatalf("private history = %q, want %q", history.Content, want)
+	}
+	//新条目用发送者协商出的编解码器存储
+	entries, err := s.Store.XRangeMsg(ctx, "bobAndalice", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries[1:] {
+		if _, err := message.DecodeStored(e.Codec, e.Data); e.Codec == "" || err != nil {
+			t.Fatalf("entry = %+v, err = %v", e, err)
+		}
+	}
+}
+
+func TestCheckUserAndQuit(t *testing.T) {
+	s := StartServer(t)
+	alice := s.Join("alice")
+	bob := s.Join("bob")
+	alice.Expect("bob加入聊天室")
+
+	alice.CheckUser()
+	alice.Expect("当前在线用户(2人)")
+
+	bob.Quit()
+	alice.Expect("bob离开了聊天室")
+	bob.ExpectClosed(Timeout)
+
+	alice.CheckUser()
+	alice.Expect("当前在线用户(1人)")
+}
+
+func TestHeartbeat(t *testing.T) {
+	cfg := config.Default().Server
+	cfg.HeartbeatTimeout = time.Second
+	s := StartServerConfig(t, &cfg)
+	silent := s.Join("silent")
+	alive := s.Join("alive")
+
+	//心跳间隔小于超时时间的客户端一直在线
+	for range 6 {
+		time.Sleep(250 * time.Millisecond)
+		alive.Heartbeat()
+	}
+	silent.ExpectClosed(Timeout)
+	alive.ExpectNothing(100 * time.Millisecond)
+
+	//断线的用户在宽限期内仍显示在线，可以用令牌恢复
+	again := s.Dial()
+	if resp := again.Resume(silent.Token); !resp.OK() {
+		t.Fatalf("resume = %v", resp.Code)
+	}
+	alive.ExpectNothing(100 * time.Millisecond)
+}
+
+func TestResumeGraceExpires(t *testing.T) {
+	cfg := config.Default().Server
+	cfg.ResumeGrace = 500 * time.Millisecond
+	s := StartServerConfig(t, &cfg)
+	alice := s.Join("alice")
+	bob := s.Join("bob")
+	alice.Expect("bob加入聊天室")
+
+	//连接异常断开，宽限期内不广播离开，超过宽限期仍未恢复按离开处理
+	if err := bob.Conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	alice.ExpectNothing(200 * time.Millisecond)
+	alice.Expect("bob离开了聊天室")
+}
+
+func TestModeratorMute(t *testing.T) {
+	s := StartServer(t)
+	mod := s.Join("mod")
+	user := s.Join("user")
+	mod.Expect("user加入聊天室")
+	if err := s.Store.SetRole(context.Background(), db.RoomScope(db.DefaultRoom), "mod", db.RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+
+	mod.Moderate("", &message.ModerateRequest{Action: message.ActionMute, Target: "user"})
+	mod.Expect("已将user禁言10分钟")
+	user.Expect("你已被mod禁言10分钟")
+
+	user.Say("hello")
+	user.Expect("你已被禁言")
+	mod.ExpectNothing(100 * time.Millisecond)
+}
+
+func TestWebSocketClients(t *testing.T) {
+	s := StartServer(t)
+	tcp := s.Join("tcpuser")
+	web := s.Login(s.DialWS(""), "webuser")
+	tcp.Expect("webuser加入聊天室")
+	bin := s.Login(s.DialWS(message.CodecMsgPack), "binuser")
+	tcp.Expect("binuser加入聊天室")
+	web.Expect("binuser加入聊天室")
+
+	web.Say("hello from browser")
+	tcp.Expect("->webuser:hello from browser")
+	bin.Expect("->webuser:hello from browser")
+
+	tcp.Chat("webuser", "hi web")
+	web.Expect("->tcpuser私聊你:hi web")
+
+	bin.History(1)
+	if history := bin.ExpectType(message.PublicHistory); stripHistoryTime(history.Content) != "->webuser:hello from browser\n" {
+		t.Fatalf("history = %q", history.Content)
+	}
+
+	web.CheckUser()
+	web.Expect("当前在线用户(3人)")
+
+	web.Quit()
+	tcp.Expect("webuser离开了聊天室")
+	web.ExpectClosed(Timeout)
+}
+
+func TestHTTPAPI(t *testing.T) {
+	s := StartServer(t)
+	alice := s.Join("alice")
+	bob := s.Join("bob")
+	alice.Expect("bob加入聊天室")
+
+	var login message.AuthResponse
+	if code := s.API("POST", "/api/login", "", &message.LoginRequest{Username: "bob", Password: "wrong12345"}, &login); code != http.StatusUnauthorized || login.Code != message.CodeWrongPassword {
+		t.Fatalf("wrong password = %d %+v", code, login)
+	}
+	if code := s.API("POST", "/api/login", "", &message.LoginRequest{Username: "bob", Password: Password}, &login); code != http.StatusOK || login.Token == "" {
+		t.Fatalf("login = %d %+v", code, login)
+	}
+	if code := s.API("GET", "/api/users", "bad-token", nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("bad token = %d", code)
+	}
+
+	//通过接口发送的消息和TCP客户端走同一条管道
+	var resp message.APIResponse
+	if code := s.API("POST", "/api/messages", login.Token, &message.PostRequest{Content: "from api"}, &resp); code != http.StatusOK {
+		t.Fatalf("post = %d %+v", code, resp)
+	}
+	alice.Expect("->bob:from api")
+	if code := s.API("POST", "/api/messages", login.Token, &message.PostRequest{Content: "secret", To: "alice"}, &resp); code != http.StatusOK {
+		t.Fatalf("private post = %d %+v", code, resp)
+	}
+	alice.Expect("->bob私聊你:secret")
+
+	var history []message.HistoryItem
+	if code := s.API("GET", "/api/history?n=5", login.Token, nil, &history); code != http.StatusOK ||
+		len(history) != 1 || history[0].Sender != "bob" || history[0].Content != "from api" {
+		t.Fatalf("history = %d %+v", code, history)
+	}
+	if code := s.API("GET", "/api/private/alice", login.Token, nil, &history); code != http.StatusOK ||
+		len(history) != 1 || history[0].Sender != "bob" || history[0].Content != "secret" {
+		t.Fatalf("private history = %d %+v", code, history)
+	}
+	if code := s.API("GET", "/api/private/nobody", login.Token, nil, nil); code != http.StatusNotFound {
+		t.Fatalf("unknown peer = %d", code)
+	}
+
+	var rank []message.RankItem
+	if code := s.API("GET", "/api/rank", login.Token, nil, &rank); code != http.StatusOK ||
+		len(rank) != 2 || rank[0].Username != "bob" {
+		t.Fatalf("rank = %d %+v", code, rank)
+	}
+	var users []string
+	if code := s.API("GET", "/api/users", login.Token, nil, &users); code != http.StatusOK ||
+		strings.Join(users, ",") != "alice,bob" {
+		t.Fatalf("users = %d %v", code, users)
+	}
+
+	//被禁言时管道中的提示作为错误返回
+	if err := s.Store.AddSanction(context.Background(), db.GlobalScope, "bob", db.SanctionMute, 0, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if code := s.API("POST", "/api/messages", login.Token, &message.PostRequest{Content: "muted"}, &resp); code != http.StatusForbidden ||
+		!strings.Contains(resp.Message, "禁言") {
+		t.Fatalf("muted post = %d %+v", code, resp)
+	}
+	alice.ExpectNothing(100 * time.Millisecond)
+	bob.ExpectNothing(100 * time.Millisecond)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	s := StartServer(t)
+	alice := s.Join("alice")
+	bob := s.Join("bob")
+	ws := s.Login(s.DialWS(message.CodecJSON), "carol")
+	alice.SkipUntil("bob加入聊天室")
+	alice.SkipUntil("carol加入聊天室")
+	bob.SkipUntil("carol加入聊天室")
+
+	//关闭前发出的消息都已送达
+	alice.Say("最后一条公聊")
+	bob.Expect("最后一条公聊")
+	ws.Expect("最后一条公聊")
+	alice.Chat("bob", "最后一条私聊")
+	bob.Expect("最后一条私聊")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed,err:%v", err)
+	}
+	//每个客户端先收到关闭通知，随后连接被关闭，不广播离开
+	for _, c := range []*Client{alice, bob, ws} {
+		msg := c.Next()
+		for msg.Type != message.Shutdown {
+			if strings.Contains(msg.Content, "离开") {
+				t.Fatalf("%v got %q before shutdown notice", c.Name, msg.Content)
+			}
+			msg = c.Next()
+		}
+		if !strings.Contains(msg.Content, "服务器正在关闭") {
+			t.Fatalf("%v got %q", c.Name, msg.Content)
+		}
+		c.ExpectClosed(Timeout)
+	}
+	//不再接受新连接
+	if conn, err := net.DialTimeout("tcp", s.Addr, time.Second); err == nil {
+		_ = conn.Close()
+		t.Fatal("listener still accepting after Shutdown")
+	}
+	if err := s.Shutdown(ctx); !errors.Is(err, handServer.ErrServerClosed) {
+		t.Fatalf("second Shutdown err = %v, want ErrServerClosed", err)
+	}
+}
+
+func TestOfflinePrivateUnread(t *testing.T) {
+	s := StartServer(t)
+	alice := s.Join("alice")
+	carol := s.Join("carol")
+	//bob注册后还没有登录过
+	bob := s.Dial()
+	if resp := bob.Register("bob", Password); !resp.OK() {
+		t.Fatalf("Register = %v", resp.Code)
+	}
+	alice.Chat("bob", "hi1")
+	alice.Chat("bob", "hi2")
+	carol.Chat("bob", "hey")
+	alice.Chat("bob", "hi3")
+	//私聊经过各自的分片，等都写入收件箱后再登录
+	deadline := time.Now().Add(Timeout)
+	for {
+		entries, err := s.Store.XRangeMsg(context.Background(), db.InboxStreamName("bob"), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("inbox has %d messages, want 4", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp := bob.Login("bob", Password)
+	if !resp.OK() {
+		t.Fatalf("Login = %v", resp.Code)
+	}
+	want := []message.UnreadCount{{From: "alice", Count: 3}, {From: "carol", Count: 1}}
+	if fmt.Sprint(resp.Unread) != fmt.Sprint(want) {
+		t.Fatalf("unread = %v, want %v", resp.Unread, want)
+	}
+	//离线期间的私聊在登录后送达，按发送者保持顺序
+	msg := bob.SkipUntil("->alice私聊你:hi1")
+	if msg.Type != message.PrivateMsg || msg.Sender.UserName != "alice" {
+		t.Fatalf("delivery = %+v", msg)
+	}
+	bob.SkipUntil("->alice私聊你:hi2")
+	bob.SkipUntil("->alice私聊你:hi3")
+
+	//送达不等于已读，拉取也不改变已读位置
+	unread := bob.FetchUnread("alice")
+	if len(unread.Messages) != 3 || unread.Messages[0].Content != "hi1" || unread.Messages[2].Content != "hi3" {
+		t.Fatalf("unread from alice = %+v", unread.Messages)
+	}
+	if again := bob.FetchUnread(""); len(again.Messages) != 4 {
+		t.Fatalf("all unread = %+v", again.Messages)
+	}
+
+	//已读到第二条，在线的发送者收到回执
+	bob.Read("alice", unread.Messages[1].ID)
+	notice := &message.ReadNotice{}
+	if err := message.GetPayload(alice.SkipUntil(`"Reader":"bob"`), notice); err != nil || notice.Count != 2 {
+		t.Fatalf("notice = %+v, err = %v", notice, err)
+	}
+	if rest := bob.FetchUnread("alice"); len(rest.Messages) != 1 || rest.Messages[0].Content != "hi3" {
+		t.Fatalf("unread after receipt = %+v", rest.Messages)
+	}
+	//不带ID的回执标记到最新一条
+	bob.Read("carol", "")
+	carol.SkipUntil(`"Reader":"bob"`)
+
+	//重新登录后未读数来自已读位置
+	bob.Quit()
+	bob.ExpectClosed(Timeout)
+	again := s.Dial()
+	resp = again.Login("bob", Password)
+	want = []message.UnreadCount{{From: "alice", Count: 1}}
+	if !resp.OK() || fmt.Sprint(resp.Unread) != fmt.Sprint(want) {
+		t.Fatalf("relogin = %v unread %v, want %v", resp.Code, resp.Unread, want)
+	}
+}
+
+func TestClusterFanOut(t *testing.T) {
+	nodes := StartCluster(t, 2)
+	alice := nodes[0].Join("alice")
+	bob := nodes[1].Join("bob")
+	alice.Expect("bob加入聊天室")
+
+	//另一个实例上的用户收到全部公聊，且顺序不变
+	for i := range 5 {
+		alice.Say(fmt.Sprintf("msg%d", i))
+	}
+	for i := range 5 {
+		bob.Expect(fmt.Sprintf("->alice:msg%d", i))
+	}
+	bob.Say("hey")
+	alice.Expect("->bob:hey")
+	alice.ExpectNothing(100 * time.Millisecond)
+
+	bob.CheckUser()
+	bob.Expect("当前在线用户(2人):alice   bob")
+
+	//私聊和已读通知送到持有连接的实例
+	alice.Chat("bob", "hi")
+	msg := bob.Expect("->alice私聊你:hi")
+	if msg.Sender == nil || msg.Sender.UserName != "alice" {
+		t.Fatalf("private sender = %+v", msg.Sender)
+	}
+	bob.Read("alice", "")
+	alice.ExpectType(message.ReadReceipt)
+
+	//在一个实例上在线时不能在另一个实例上重复登录
+	if resp := nodes[1].Dial().Login("alice", Password); resp.Code != message.CodeAlreadyLoggedIn {
+		t.Fatalf("login on other node = %v", resp.Code)
+	}
+
+	//另一个实例上的管理操作同样生效
+	if !nodes[1].Kick("alice", "[系统消息]你已被踢出") {
+		t.Fatal("Kick remote user = false")
+	}
+	alice.ExpectType(message.Kicked)
+	alice.ExpectClosed(Timeout)
+	bob.Expect("alice离开了聊天室")
+	bob.CheckUser()
+	bob.Expect("当前在线用户(1人):bob")
+}
+
+func TestClusterResumeOnOtherNode(t *testing.T) {
+	nodes := StartCluster(t, 2)
+	alice := nodes[0].Join("alice")
+	bob := nodes[1].Join("bob")
+	alice.Expect("bob加入聊天室")
+
+	//实例关闭后客户端用令牌在另一个实例上恢复
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := nodes[0].Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	alice.SkipUntil("服务器正在关闭")
+	alice.ExpectClosed(Timeout)
+	bob.CheckUser()
+	bob.Expect("当前在线用户(1人)")
+
+	again := nodes[1].Dial()
+	if resp := again.Resume(alice.Token); !resp.OK() {
+		t.Fatalf("resume on other node = %v", resp.Code)
+	}
+	bob.Expect("alice加入聊天室")
+	bob.Say("welcome back")
+	again.SkipUntil("->bob:welcome back")
+}
+
+func TestPresenceStatus(t *testing.T) {
+	nodes := StartCluster(t, 2)
+	alice := nodes[0].Join("alice")
+	bob := nodes[1].Join("bob")
+	alice.Expect("bob加入聊天室")
+
+	//其他实例上的用户也能看到设置的状态
+	bob.SetStatus(message.StatusBusy, "开会中")
+	bob.Expect("状态已设置为忙碌:开会中")
+	alice.CheckUser()
+	alice.Expect("当前在线用户(2人):alice   bob(忙碌:开会中)")
+
+	bob.SetStatus("sleeping", "")
+	bob.Expect("状态只能是")
+
+	//隐身的用户只有自己能看到
+	alice.SetStatus(message.StatusInvisible, "")
+	alice.Expect("状态已设置为隐身")
+	bob.CheckUser()
+	bob.Expect("当前在线用户(1人):bob(忙碌:开会中)")
+	alice.CheckUser()
+	alice.Expect("当前在线用户(2人):alice(隐身)   bob(忙碌:开会中)")
+	bob.Whois("alice")
+	msg := bob.ExpectType(message.Whois)
+	for _, want := range []string{"状态:离线", "最后在线:未知", "活跃度:1"} {
+		if !strings.Contains(msg.Content, want) {
+			t.Fatalf("whois = %q, want %q", msg.Content, want)
+		}
+	}
+
+	//隐身的用户离开时不广播，但记录最后在线时间
+	alice.Quit()
+	alice.ExpectClosed(Timeout)
+	bob.ExpectNothing(100 * time.Millisecond)
+	bob.Whois("alice")
+	msg = bob.ExpectType(message.Whois)
+	if strings.Contains(msg.Content, "最后在线:未知") || !strings.Contains(msg.Content, "注册时间:") {
+		t.Fatalf("whois after quit = %q", msg.Content)
+	}
+
+	bob.Whois("nobody")
+	bob.Expect("该用户名不存在")
+}
+
+func TestAutoAway(t *testing.T) {
+	cfg := config.Default().Server
+	cfg.InstanceTTL = 150 * time.Millisecond
+	cfg.AwayAfter = 300 * time.Millisecond
+	s := StartServerConfig(t, &cfg)
+	alice := s.Join("alice")
+	bob := s.Join("bob")
+	carol := s.Join("carol")
+	alice.Expect("bob加入聊天室")
+	alice.Expect("carol加入聊天室")
+	bob.Expect("carol加入聊天室")
+	carol.SetStatus(message.StatusBusy, "开会中")
+	carol.Expect("状态已设置为忙碌:开会中")
+
+	//只有心跳的用户由服务端的心跳协程自动标记为离开，自己设置了忙碌的不变；
+	//查看在线用户本身也是一次操作，查看的人仍在线
+	time.Sleep(2 * cfg.AwayAfter)
+	alice.CheckUser()
+	alice.Expect("当前在线用户(3人):alice   bob(离开)   carol(忙碌:开会中)")
+
+	//发消息后恢复在线
+	bob.Say("back")
+	alice.Expect("->bob:back")
+	carol.Expect("->bob:back")
+	alice.CheckUser()
+	alice.Expect("当前在线用户(3人):alice   bob   carol(忙碌:开会中)")
+}
+
+func TestTypingEphemeral(t *testing.T) {
+	cfg := config.Default().Server
+	cfg.TypingInterval = 300 * time.Millisecond
+	nodes := StartClusterConfig(t, 2, &cfg)
+	alice := nodes[0].Join("alice")
+	bob := nodes[1].Join("bob")
+	alice.Expect("bob加入聊天室")
+
+	//房间中的输入事件直接发到其他实例
+	alice.Typing("", "")
+	msg := bob.ExpectType(message.Typing)
+	if msg.Sender == nil || msg.Sender.UserName != "alice" || msg.Room != db.DefaultRoom {
+		t.Fatalf("typing = %+v", msg)
+	}
+	//间隔内重复的合并为间隔结束时的一次补发
+	alice.Typing("", "")
+	alice.Typing("", "")
+	alice.Typing("", "")
+	bob.ExpectNothing(cfg.TypingInterval / 3)
+	msg = bob.ExpectType(message.Typing)
+	if msg.Sender == nil || msg.Sender.UserName != "alice" || msg.Room != db.DefaultRoom {
+		t.Fatalf("trailing typing = %+v", msg)
+	}
+	bob.ExpectNothing(2 * cfg.TypingInterval)
+
+	//隐身的用户不转发输入事件
+	alice.SetStatus(message.StatusInvisible, "")
+	alice.Expect("状态已设置为隐身")
+	alice.Typing("", "")
+	alice.Typing("", "bob")
+	bob.ExpectNothing(2 * cfg.TypingInterval)
+	alice.SetStatus(message.StatusOnline, "")
+	alice.Expect("状态已设置为在线")
+
+	//私聊的输入事件只发给对方
+	bob.Typing("", "alice")
+	msg = alice.ExpectType(message.Typing)
+	if msg.Sender == nil || msg.Sender.UserName != "bob" || msg.To != "alice" {
+		t.Fatalf("private typing = %+v", msg)
+	}
+
+	//不在房间中的输入事件直接丢弃，也不进历史消息
+	bob.Typing("lobby", "")
+	alice.ExpectNothing(100 * time.Millisecond)
+	bob.ExpectNothing(50 * time.Millisecond)
+	bob.History(10)
+	if msg = bob.ExpectType(message.PublicHistory); msg.Content != "" {
+		t.Fatalf("history = %q", msg.Content)
+	}
+}
+
+// stripHistoryTime 去掉历史消息每行开头的时间和消息ID
+func stripHistoryTime(content string) string {
+	lines := strings.SplitAfter(content, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "[") {
+			if _, rest, ok := strings.Cut(line, "]"); ok {
+				lines[i] = rest
+			}
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// expectUpdate 等待消息的编辑或删除事件并解析
+func expectUpdate(t *testing.T, c *Client, typ int) *message.MsgUpdate {
+	t.Helper()
+	update := &message.MsgUpdate{}
+	if err := message.GetPayload(c.ExpectType(typ), update); err != nil {
+		t.Fatal(err)
+	}
+	return update
+}
+
+func TestEditDeleteMessage(t *testing.T) {
+	s := StartServer(t)
+	alice := s.Join("alice")
+	bob := s.Join("bob")
+	alice.Expect("bob加入聊天室")
+	mod := s.Join("mod")
+	alice.Expect("mod加入聊天室")
+	bob.Expect("mod加入聊天室")
+	if err := s.Store.SetRole(context.Background(), db.RoomScope(db.DefaultRoom), "mod", db.RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+
+	//消息带有服务端分配的ID和时间
+	alice.Say("helo")
+	msg := bob.ExpectType(message.PublicMsg)
+	mod.Expect("->alice:helo")
+	if msg.Content != "->alice:helo" || !message.IsMsgID(msg.ID) || msg.Time == 0 {
+		t.Fatalf("public msg = %+v", msg)
+	}
+	id := msg.ID
+
+	//不指定ID时编辑自己的最后一条，所有人包括自己都收到更新
+	alice.Edit("", "", "hello")
+	for _, c := range []*Client{alice, bob, mod} {
+		update := expectUpdate(t, c, message.EditMsg)
+		if update.ID != id || update.Author != "alice" || update.Editor != "alice" || update.Content != "hello" {
+			t.Fatalf("%v edit = %+v", c.Name, update)
+		}
+	}
+
+	bob.Edit("", id, "hacked")
+	bob.Expect("只能修改自己的消息")
+	bob.Delete("", "")
+	bob.Expect("你在房间public中还没有发过消息")
+	bob.Edit("", "bad-id", "x")
+	bob.Expect("消息ID格式错误")
+
+	bob.History(5)
+	history := bob.ExpectType(message.PublicHistory).Content
+	if !strings.Contains(history, "#"+id+"]->alice:hello"+message.EditedMark+"\n") {
+		t.Fatalf("history after edit = %q", history)
+	}
+
+	//管理员可以删除普通成员的消息
+	mod.Delete("", id)
+	for _, c := range []*Client{alice, bob, mod} {
+		update := expectUpdate(t, c, message.DeleteMsg)
+		if update.ID != id || !update.Deleted || update.Author != "alice" || update.Editor != "mod" {
+			t.Fatalf("%v delete = %+v", c.Name, update)
+		}
+	}
+	alice.Edit("", "", "again")
+	alice.Expect("该消息已被删除")
+
+	bob.History(5)
+	history = bob.ExpectType(message.PublicHistory).Content
+	if stripHistoryTime(history) != "->alice:"+message.DeletedText+"\n" {
+		t.Fatalf("history after delete = %q", history)
+	}
+	bob.ExpectNothing(100 * time.Millisecond)
+}
+
+func TestDeleteWinsOverConcurrentEdit(t *testing.T) {
+	s := StartServer(t)
+	alice := s.Join("alice")
+	bob := s.Join("bob")
+	alice.Expect("bob加入聊天室")
+	alice.Say("oops")
+	id := bob.ExpectType(message.PublicMsg).ID
+	alice.Delete("", id)
+	expectUpdate(t, alice, message.DeleteMsg)
+	expectUpdate(t, bob, message.DeleteMsg)
+
+	//模拟在另一个分片中同时进行的编辑，在删除之后覆盖了编辑记录
+	edit := &common.Message{}
+	if err := message.SetPayload(edit, &message.MsgUpdate{ID: id, Room: db.DefaultRoom, Author: "alice", Editor: "alice", Content: "revived"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store.HSetMsg(context.Background(), db.RoomEditsName(db.DefaultRoom), id, edit.Content); err != nil {
+		t.Fatal(err)
+	}
+
+	bob.History(5)
+	history := stripHistoryTime(bob.ExpectType(message.PublicHistory).Content)
+	if history != "->alice:"+message.DeletedText+"\n" {
+		t.Fatalf("history = %q", history)
+	}
+	alice.Edit("", id, "again")
+	alice.Expect("该消息已被删除")
+	bob.ExpectNothing(100 * time.Millisecond)
+}
+
+func TestEditsPrunedWithStream(t *testing.T) {
+	cfg := config.Default().Server
+	store := db.NewMemStore()
+	store.MaxLen = 2
+	s := StartServerStore(t, &cfg, store)
+	alice := s.Join("alice")
+	bob := s.Join("bob")
+	alice.Expect("bob加入聊天室")
+
+	var ids []string
+	for _, content := range []string{"a", "b", "c"} {
+		alice.Say(content)
+		ids = append(ids, bob.ExpectType(message.PublicMsg).ID)
+		//每条都编辑一次，第一条的编辑发生在它被裁剪出流之前
+		alice.Edit("", "", content+"!")
+		expectUpdate(t, alice, message.EditMsg)
+		expectUpdate(t, bob, message.EditMsg)
+	}
+
+	//第一条已经被裁剪出流，它的编辑记录随之删除
+	edits, err := store.HGetAllMsg(context.Background(), db.RoomEditsName(db.DefaultRoom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := edits[ids[0]]; ok || len(edits) != 2 {
+		t.Fatalf("edits = %v, ids = %v", edits, ids)
+	}
+	bob.History(5)
+	history := stripHistoryTime(bob.ExpectType(message.PublicHistory).Content)
+	if history != "->alice:b!"+message.EditedMark+"\n->alice:c!"+message.EditedMark+"\n" {
+		t.Fatalf("history = %q", history)
+	}
+}
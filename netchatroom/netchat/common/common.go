@@ -1,10 +1,27 @@
 package common
 
-import "net"
+import (
+	"net"
+	"time"
+)
+
+// DefaultRoom 默认的公共聊天室，所有用户都在其中
+const DefaultRoom = "public"
+
+// Conn 客户端连接，每次读写一条完整的消息，TCP连接和WebSocket连接都实现该接口
+type Conn interface {
+	ReadMsg() (*Message, error)
+	WriteMsg(msg *Message) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
 
 type Client struct {
 	UserName string
-	Conn     net.Conn `json:"-"`
+	Conn     Conn   `json:"-" msgpack:"-"`
+	Token    string `json:"-" msgpack:"-"` // 会话令牌，断线重连时用于恢复登录
 }
 
 type Message struct {
@@ -12,4 +29,7 @@ type Message struct {
 	Content string  // 消息内容
 	Type    int     // 消息类型
 	To      string  // 对象
+	Room    string  // 所在房间，为空表示默认房间
+	ID      string  `json:",omitempty" msgpack:",omitempty"` // 服务端分配的消息ID，即消息流中的ID
+	Time    int64   `json:",omitempty" msgpack:",omitempty"` // 服务端时间，毫秒时间戳
 }
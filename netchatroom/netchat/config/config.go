@@ -0,0 +1,436 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 单帧长度的默认值和上限，默认值与utils.DefaultMaxFrameSize一致
+const (
+	DefaultMaxFrameSize = 1 << 20
+	MaxFrameSizeLimit   = 1 << 30
+)
+
+// DefaultPath 默认配置文件，不存在时只使用默认值、环境变量和命令行参数
+const DefaultPath = "config.yaml"
+
+// EnvPrefix 环境变量前缀，例如NETCHAT_MYSQL_DSN
+const EnvPrefix = "NETCHAT_"
+
+// Config 服务端和客户端共用的配置，优先级：命令行参数 > 环境变量 > 配置文件 > 默认值
+type Config struct {
+	Server ServerConfig `yaml:"server"`
+	MySQL  MySQLConfig  `yaml:"mysql"`
+	Redis  RedisConfig  `yaml:"redis"`
+	Client ClientConfig `yaml:"client"`
+}
+
+// ServerConfig 服务端配置
+type ServerConfig struct {
+	Addr             string        `yaml:"addr"`               // 聊天服务监听地址
+	AdminAddr        string        `yaml:"admin_addr"`         // 管理控制台监听地址，只能是本机回环地址或unix:套接字路径
+	WSAddr           string        `yaml:"ws_addr"`            // WebSocket接入监听地址，为空时不启用
+	WSOrigins        string        `yaml:"ws_origins"`         // 允许的浏览器来源，逗号分隔，*表示任意来源，为空时只允许同源
+	APIAddr          string        `yaml:"api_addr"`           // HTTP接口监听地址，为空时不启用
+	AuditLog         string        `yaml:"audit_log"`          // 管理操作审计日志文件
+	HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout"`  // 多久收不到客户端消息算心跳超时
+	SessionTTL       time.Duration `yaml:"session_ttl"`        // 会话令牌在redis中的有效期
+	ResumeGrace      time.Duration `yaml:"resume_grace"`       // 断线后保留在线状态等待用令牌重连的宽限期
+	MsgChanSize      int           `yaml:"msg_chan_size"`      // 每个分片消息通道的缓冲大小
+	DispatchShards   int           `yaml:"dispatch_shards"`    // 并发处理消息的分片数，同一用户的消息总在同一分片中按顺序处理
+	SendQueueSize    int           `yaml:"send_queue_size"`    // 每个连接待发送消息队列的长度
+	SendOverflow     string        `yaml:"send_overflow"`      // 发送队列满时的处理方式，见Overflow常量
+	SendBlockTimeout time.Duration `yaml:"send_block_timeout"` // block方式下等待队列空出位置的最长时间
+	WriteTimeout     time.Duration `yaml:"write_timeout"`      // 每次写连接的超时时间
+	ShutdownTimeout  time.Duration `yaml:"shutdown_timeout"`   // 收到退出信号后等待处理完消息、关闭连接的最长时间
+	PendingClaimIdle time.Duration `yaml:"pending_claim_idle"` // 私聊投递后多久未确认就重新投递
+	MaxDeliveries    int           `yaml:"max_deliveries"`     // 私聊最多投递的次数，超过后移入死信流
+	InstanceID       string        `yaml:"instance_id"`        // 集群中本实例的唯一标识，为空时由主机名和进程号生成
+	InstanceTTL      time.Duration `yaml:"instance_ttl"`       // 多久没有心跳的实例视为失联，它上面的用户不再算在线
+	AwayAfter        time.Duration `yaml:"away_after"`         // 用户多久只有心跳没有发消息就自动显示为离开
+	TypingInterval   time.Duration `yaml:"typing_interval"`    // 同一用户在同一位置的输入事件，这个间隔内最多转发一次，多余的合并到间隔结束时补发
+	MaxFrameSize     int           `yaml:"max_frame_size"`     // 接收的单帧最大字节数，超过时断开连接
+	TLS              ServerTLS     `yaml:"tls"`
+}
+
+// 发送队列满时的处理方式
+const (
+	OverflowDropOldest = "drop-oldest" // 丢弃最早的一条待发送消息
+	OverflowDisconnect = "disconnect"  // 断开跟不上的客户端，客户端可以用令牌恢复
+	OverflowBlock      = "block"       // 等待队列空出位置，超过send_block_timeout仍然满时断开
+)
+
+// ServerTLS 服务端TLS配置，Cert为空时不启用TLS
+type ServerTLS struct {
+	Cert     string `yaml:"cert"`      // 服务端证书
+	Key      string `yaml:"key"`       // 服务端私钥
+	ClientCA string `yaml:"client_ca"` // 非空时要求客户端出示由该CA签发的证书（mTLS）
+}
+
+// Enabled 是否启用TLS
+func (t *ServerTLS) Enabled() bool {
+	return t.Cert != ""
+}
+
+// MySQLConfig 数据库配置
+type MySQLConfig struct {
+	DSN          string        `yaml:"dsn"`
+	QueryTimeout time.Duration `yaml:"query_timeout"` // 每次查询的超时时间
+}
+
+// RedisConfig redis配置
+type RedisConfig struct {
+	Addr         string        `yaml:"addr"`
+	Password     string        `yaml:"password"`
+	DB           int           `yaml:"db"`
+	StreamMaxLen int64         `yaml:"stream_max_len"` // 每个流保留的最大消息数
+	OpTimeout    time.Duration `yaml:"op_timeout"`     // 每次操作的超时时间，阻塞读取消息流不受限制
+}
+
+// ClientConfig 客户端配置
+type ClientConfig struct {
+	Server       string        `yaml:"server"`         // 服务端地址
+	Heartbeat    time.Duration `yaml:"heartbeat"`      // 心跳发送间隔，必须小于服务端的心跳超时
+	MaxFrameSize int           `yaml:"max_frame_size"` // 接收的单帧最大字节数，超过时断开连接
+	TLS          ClientTLS     `yaml:"tls"`
+}
+
+// ClientTLS 客户端TLS配置
+type ClientTLS struct {
+	Enable     bool   `yaml:"enable"`      // 是否使用TLS连接服务端
+	CA         string `yaml:"ca"`          // 校验服务端证书的CA，为空时使用系统根证书
+	Cert       string `yaml:"cert"`        // 客户端证书，服务端开启mTLS时需要
+	Key        string `yaml:"key"`         // 客户端私钥
+	ServerName string `yaml:"server_name"` // 校验服务端证书时使用的域名，为空时取服务端地址中的主机名
+}
+
+// Default 返回默认配置，对应本机直接运行的环境
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:             "0.0.0.0:8888",
+			AdminAddr:        "127.0.0.1:8889",
+			WSAddr:           "0.0.0.0:8890",
+			APIAddr:          "0.0.0.0:8891",
+			AuditLog:         "admin_audit.log",
+			HeartbeatTimeout: 50 * time.Second,
+			SessionTTL:       24 * time.Hour,
+			ResumeGrace:      60 * time.Second,
+			MsgChanSize:      100,
+			DispatchShards:   16,
+			SendQueueSize:    256,
+			SendOverflow:     OverflowDropOldest,
+			SendBlockTimeout: time.Second,
+			WriteTimeout:     10 * time.Second,
+			ShutdownTimeout:  10 * time.Second,
+			PendingClaimIdle: 30 * time.Second,
+			MaxDeliveries:    5,
+			InstanceTTL:      15 * time.Second,
+			AwayAfter:        5 * time.Minute,
+			TypingInterval:   3 * time.Second,
+			MaxFrameSize:     DefaultMaxFrameSize,
+		},
+		MySQL: MySQLConfig{
+			DSN:          "root:1458963@tcp(127.0.0.1:3306)/netchat",
+			QueryTimeout: 5 * time.Second,
+		},
+		Redis: RedisConfig{
+			Addr:         "localhost:6379",
+			StreamMaxLen: 1000,
+			OpTimeout:    3 * time.Second,
+		},
+		Client: ClientConfig{
+			Server:       "127.0.0.1:8888",
+			Heartbeat:    20 * time.Second,
+			MaxFrameSize: DefaultMaxFrameSize,
+		},
+	}
+}
+
+// Load 依次读取配置文件、环境变量和命令行参数并校验，args不含程序名
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	path, explicit := configPath(args)
+	err := cfg.loadFile(path, explicit)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := flag.NewFlagSet("netchat", flag.ContinueOnError)
+	fs.String("config", path, "配置文件路径，环境变量"+EnvPrefix+"CONFIG")
+	cfg.bind(fs)
+	//环境变量和命令行参数共用flag的解析逻辑
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || f.Name == "config" || envErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("env %s=%q invalid,err:%w", envName(f.Name), value, err)
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+	err = fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// bind 把配置项注册为命令行参数，参数名对应的环境变量为前缀加大写的参数名
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.Server.Addr, "addr", c.Server.Addr, "聊天服务监听地址")
+	fs.StringVar(&c.Server.AdminAddr, "admin-addr", c.Server.AdminAddr, "管理控制台监听地址，本机回环地址或unix:套接字路径")
+	fs.StringVar(&c.Server.WSAddr, "ws-addr", c.Server.WSAddr, "WebSocket接入监听地址，为空时不启用")
+	fs.StringVar(&c.Server.WSOrigins, "ws-origins", c.Server.WSOrigins, "允许的浏览器来源，逗号分隔，*表示任意来源")
+	fs.StringVar(&c.Server.APIAddr, "api-addr", c.Server.APIAddr, "HTTP接口监听地址，为空时不启用")
+	fs.StringVar(&c.Server.AuditLog, "audit-log", c.Server.AuditLog, "管理操作审计日志文件")
+	fs.DurationVar(&c.Server.HeartbeatTimeout, "heartbeat-timeout", c.Server.HeartbeatTimeout, "服务端心跳超时时间")
+	fs.DurationVar(&c.Server.SessionTTL, "session-ttl", c.Server.SessionTTL, "会话令牌的有效期")
+	fs.DurationVar(&c.Server.ResumeGrace, "resume-grace", c.Server.ResumeGrace, "断线后等待用令牌重连的宽限期")
+	fs.IntVar(&c.Server.MsgChanSize, "msg-chan-size", c.Server.MsgChanSize, "每个分片消息通道的缓冲大小")
+	fs.IntVar(&c.Server.DispatchShards, "dispatch-shards", c.Server.DispatchShards, "并发处理消息的分片数")
+	fs.IntVar(&c.Server.SendQueueSize, "send-queue-size", c.Server.SendQueueSize, "每个连接待发送消息队列的长度")
+	fs.StringVar(&c.Server.SendOverflow, "send-overflow", c.Server.SendOverflow, "发送队列满时的处理方式：drop-oldest、disconnect、block")
+	fs.DurationVar(&c.Server.SendBlockTimeout, "send-block-timeout", c.Server.SendBlockTimeout, "block方式下等待发送队列的最长时间")
+	fs.DurationVar(&c.Server.WriteTimeout, "write-timeout", c.Server.WriteTimeout, "每次写连接的超时时间")
+	fs.DurationVar(&c.Server.ShutdownTimeout, "shutdown-timeout", c.Server.ShutdownTimeout, "优雅关闭的最长等待时间")
+	fs.DurationVar(&c.Server.PendingClaimIdle, "pending-claim-idle", c.Server.PendingClaimIdle, "私聊投递后多久未确认就重新投递")
+	fs.IntVar(&c.Server.MaxDeliveries, "max-deliveries", c.Server.MaxDeliveries, "私聊最多投递的次数，超过后移入死信流")
+	fs.StringVar(&c.Server.InstanceID, "instance-id", c.Server.InstanceID, "集群中本实例的唯一标识，为空时自动生成")
+	fs.DurationVar(&c.Server.InstanceTTL, "instance-ttl", c.Server.InstanceTTL, "多久没有心跳的实例视为失联")
+	fs.DurationVar(&c.Server.AwayAfter, "away-after", c.Server.AwayAfter, "多久没有发消息自动显示为离开")
+	fs.DurationVar(&c.Server.TypingInterval, "typing-interval", c.Server.TypingInterval, "同一位置的输入事件最多转发一次的间隔")
+	fs.IntVar(&c.Server.MaxFrameSize, "max-frame-size", c.Server.MaxFrameSize, "服务端接收的单帧最大字节数")
+	fs.StringVar(&c.Server.TLS.Cert, "tls-cert", c.Server.TLS.Cert, "服务端TLS证书，为空时不启用TLS")
+	fs.StringVar(&c.Server.TLS.Key, "tls-key", c.Server.TLS.Key, "服务端TLS私钥")
+	fs.StringVar(&c.Server.TLS.ClientCA, "tls-client-ca", c.Server.TLS.ClientCA, "校验客户端证书的CA，非空时启用mTLS")
+	fs.StringVar(&c.MySQL.DSN, "mysql-dsn", c.MySQL.DSN, "MySQL连接串")
+	fs.DurationVar(&c.MySQL.QueryTimeout, "mysql-query-timeout", c.MySQL.QueryTimeout, "MySQL每次查询的超时时间")
+	fs.StringVar(&c.Redis.Addr, "redis-addr", c.Redis.Addr, "redis地址")
+	fs.StringVar(&c.Redis.Password, "redis-password", c.Redis.Password, "redis密码")
+	fs.IntVar(&c.Redis.DB, "redis-db", c.Redis.DB, "redis数据库编号")
+	fs.Int64Var(&c.Redis.StreamMaxLen, "stream-max-len", c.Redis.StreamMaxLen, "每个流保留的最大消息数")
+	fs.DurationVar(&c.Redis.OpTimeout, "redis-op-timeout", c.Redis.OpTimeout, "redis每次操作的超时时间")
+	fs.StringVar(&c.Client.Server, "server", c.Client.Server, "客户端连接的服务端地址")
+	fs.DurationVar(&c.Client.Heartbeat, "heartbeat", c.Client.Heartbeat, "客户端心跳间隔")
+	fs.IntVar(&c.Client.MaxFrameSize, "client-max-frame-size", c.Client.MaxFrameSize, "客户端接收的单帧最大字节数")
+	fs.BoolVar(&c.Client.TLS.Enable, "tls", c.Client.TLS.Enable, "客户端使用TLS连接服务端")
+	fs.StringVar(&c.Client.TLS.CA, "tls-ca", c.Client.TLS.CA, "校验服务端证书的CA")
+	fs.StringVar(&c.Client.TLS.Cert, "tls-client-cert", c.Client.TLS.Cert, "客户端证书")
+	fs.StringVar(&c.Client.TLS.Key, "tls-client-key", c.Client.TLS.Key, "客户端私钥")
+	fs.StringVar(&c.Client.TLS.ServerName, "tls-server-name", c.Client.TLS.ServerName, "校验服务端证书时使用的域名")
+}
+
+// AdminUnixPrefix admin_addr以此开头时管理控制台监听Unix套接字，例如unix:/run/netchat/admin.sock
+const AdminUnixPrefix = "unix:"
+
+// AdminListen 返回管理控制台监听的网络类型和地址
+func (s *ServerConfig) AdminListen() (string, string) {
+	if path, ok := strings.CutPrefix(s.AdminAddr, AdminUnixPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", s.AdminAddr
+}
+
+// isLoopback 判断监听的主机是否只在本机可达，空主机表示所有网卡
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Validate 校验配置
+func (c *Config) Validate() error {
+	var errs []error
+	for name, addr := range map[string]string{
+		"addr":       c.Server.Addr,
+		"redis-addr": c.Redis.Addr,
+		"server":     c.Client.Server,
+	} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("%s %q invalid: %w", name, addr, err))
+		}
+	}
+	//管理控制台没有认证，只允许监听本机回环地址或Unix套接字
+	if network, addr := c.Server.AdminListen(); network == "unix" {
+		if addr == "" {
+			errs = append(errs, errors.New("admin-addr unix socket path is empty"))
+		}
+	} else if host, _, err := net.SplitHostPort(addr); err != nil {
+		errs = append(errs, fmt.Errorf("admin-addr %q invalid: %w", addr, err))
+	} else if !isLoopback(host) {
+		errs = append(errs, fmt.Errorf("admin-addr %q must be a loopback address or %spath", addr, AdminUnixPrefix))
+	}
+	//可选的监听地址为空时不启用
+	for name, addr := range map[string]string{
+		"ws-addr":  c.Server.WSAddr,
+		"api-addr": c.Server.APIAddr,
+	} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("%s %q invalid: %w", name, addr, err))
+		}
+	}
+	if c.Server.AuditLog == "" {
+		errs = append(errs, errors.New("audit-log is empty"))
+	}
+	if c.Server.HeartbeatTimeout <= 0 {
+		errs = append(errs, errors.New("heartbeat-timeout must be positive"))
+	}
+	if c.Server.SessionTTL <= 0 {
+		errs = append(errs, errors.New("session-ttl must be positive"))
+	}
+	if c.Server.ResumeGrace <= 0 {
+		errs = append(errs, errors.New("resume-grace must be positive"))
+	} else if c.Server.ResumeGrace >= c.Server.SessionTTL {
+		//宽限期内令牌必须仍然有效
+		errs = append(errs, fmt.Errorf("resume-grace %v must be less than session-ttl %v",
+			c.Server.ResumeGrace, c.Server.SessionTTL))
+	}
+	if c.Server.MsgChanSize <= 0 {
+		errs = append(errs, errors.New("msg-chan-size must be positive"))
+	}
+	if c.Server.DispatchShards <= 0 {
+		errs = append(errs, errors.New("dispatch-shards must be positive"))
+	}
+	if c.Server.SendQueueSize <= 0 {
+		errs = append(errs, errors.New("send-queue-size must be positive"))
+	}
+	switch c.Server.SendOverflow {
+	case OverflowDropOldest, OverflowDisconnect:
+	case OverflowBlock:
+		if c.Server.SendBlockTimeout <= 0 {
+			errs = append(errs, errors.New("send-block-timeout must be positive"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("send-overflow %q invalid, want %s, %s or %s",
+			c.Server.SendOverflow, OverflowDropOldest, OverflowDisconnect, OverflowBlock))
+	}
+	if c.Server.WriteTimeout <= 0 {
+		errs = append(errs, errors.New("write-timeout must be positive"))
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown-timeout must be positive"))
+	}
+	if c.Server.PendingClaimIdle <= 0 {
+		errs = append(errs, errors.New("pending-claim-idle must be positive"))
+	}
+	if c.Server.MaxDeliveries <= 0 {
+		errs = append(errs, errors.New("max-deliveries must be positive"))
+	}
+	if c.Server.InstanceTTL <= 0 {
+		errs = append(errs, errors.New("instance-ttl must be positive"))
+	}
+	if c.Server.AwayAfter <= 0 {
+		errs = append(errs, errors.New("away-after must be positive"))
+	}
+	if c.Server.TypingInterval <= 0 {
+		errs = append(errs, errors.New("typing-interval must be positive"))
+	}
+	for name, n := range map[string]int{
+		"max-frame-size":        c.Server.MaxFrameSize,
+		"client-max-frame-size": c.Client.MaxFrameSize,
+	} {
+		if n <= 0 || n > MaxFrameSizeLimit {
+			errs = append(errs, fmt.Errorf("%s must be between 1 and %d", name, MaxFrameSizeLimit))
+		}
+	}
+	if (c.Server.TLS.Cert == "") != (c.Server.TLS.Key == "") {
+		errs = append(errs, errors.New("tls-cert and tls-key must be set together"))
+	}
+	if c.Server.TLS.ClientCA != "" && !c.Server.TLS.Enabled() {
+		errs = append(errs, errors.New("tls-client-ca requires tls-cert"))
+	}
+	if c.MySQL.DSN == "" {
+		errs = append(errs, errors.New("mysql-dsn is empty"))
+	}
+	if c.MySQL.QueryTimeout <= 0 {
+		errs = append(errs, errors.New("mysql-query-timeout must be positive"))
+	}
+	if c.Redis.DB < 0 {
+		errs = append(errs, errors.New("redis-db must not be negative"))
+	}
+	if c.Redis.StreamMaxLen <= 0 {
+		errs = append(errs, errors.New("stream-max-len must be positive"))
+	}
+	if c.Redis.OpTimeout <= 0 {
+		errs = append(errs, errors.New("redis-op-timeout must be positive"))
+	}
+	if c.Client.Heartbeat <= 0 {
+		errs = append(errs, errors.New("heartbeat must be positive"))
+	} else if c.Client.Heartbeat >= c.Server.HeartbeatTimeout {
+		errs = append(errs, fmt.Errorf("heartbeat %v must be less than heartbeat-timeout %v",
+			c.Client.Heartbeat, c.Server.HeartbeatTimeout))
+	}
+	if (c.Client.TLS.Cert == "") != (c.Client.TLS.Key == "") {
+		errs = append(errs, errors.New("tls-client-cert and tls-client-key must be set together"))
+	}
+	return errors.Join(errs...)
+}
+
+// loadFile 读取yaml配置文件，未显式指定的默认文件不存在时忽略
+func (c *Config) loadFile(path string, explicit bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			return nil
+		}
+		return fmt.Errorf("ReadFile failed,err:%w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s Decode failed,err:%w", path, err)
+	}
+	return nil
+}
+
+// configPath 在解析其他参数之前找出配置文件路径，返回是否显式指定
+func configPath(args []string) (string, bool) {
+	path, explicit := DefaultPath, false
+	if v, ok := os.LookupEnv(EnvPrefix + "CONFIG"); ok {
+		path, explicit = v, true
+	}
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if v, ok := strings.CutPrefix(name, "config="); ok {
+			path, explicit = v, true
+		} else if name == "config" && i+1 < len(args) {
+			path, explicit = args[i+1], true
+		}
+	}
+	return path, explicit
+}
+
+// envName 命令行参数对应的环境变量名
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
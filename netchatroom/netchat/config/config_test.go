@@ -0,0 +1,221 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig 在临时目录写入配置文件，返回路径
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+server:
+  addr: 0.0.0.0:1001
+  heartbeat_timeout: 40s
+  session_ttl: 2h
+redis:
+  addr: file:6379
+`)
+	t.Setenv("NETCHAT_HEARTBEAT_TIMEOUT", "30s")
+	t.Setenv("NETCHAT_REDIS_ADDR", "env:6379")
+	t.Setenv("NETCHAT_MAX_DELIVERIES", "7")
+	cfg, err := Load([]string{"-config", path, "-redis-addr=flag:6379", "-session-ttl", "3h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//配置文件覆盖默认值，环境变量覆盖配置文件，命令行参数覆盖环境变量
+	for name, got := range map[string][2]any{
+		"addr":              {cfg.Server.Addr, "0.0.0.0:1001"},
+		"heartbeat-timeout": {cfg.Server.HeartbeatTimeout, 30 * time.Second},
+		"redis-addr":        {cfg.Redis.Addr, "flag:6379"},
+		"session-ttl":       {cfg.Server.SessionTTL, 3 * time.Hour},
+		"max-deliveries":    {cfg.Server.MaxDeliveries, 7},
+		"mysql-dsn":         {cfg.MySQL.DSN, Default().MySQL.DSN},
+	} {
+		if got[0] != got[1] {
+			t.Errorf("%s = %v, want %v", name, got[0], got[1])
+		}
+	}
+}
+
+func TestLoadConfigPath(t *testing.T) {
+	t.Chdir(t.TempDir())
+	//默认的配置文件不存在时只用默认值
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Fatalf("Load without config file = %+v", cfg)
+	}
+	//显式指定的配置文件必须存在
+	if _, err = Load([]string{"-config=missing.yaml"}); err == nil {
+		t.Fatal("Load of missing explicit config succeeded")
+	}
+
+	path := writeConfig(t, "server:\n  addr: 0.0.0.0:1002\n")
+	t.Setenv("NETCHAT_CONFIG", path)
+	if cfg, err = Load(nil); err != nil || cfg.Server.Addr != "0.0.0.0:1002" {
+		t.Fatalf("NETCHAT_CONFIG: addr = %v, err = %v", cfg, err)
+	}
+	//命令行参数指定的配置文件优先于环境变量
+	other := writeConfig(t, "server:\n  addr: 0.0.0.0:1003\n")
+	if cfg, err = Load([]string{"--config", other}); err != nil || cfg.Server.Addr != "0.0.0.0:1003" {
+		t.Fatalf("-config: addr = %v, err = %v", cfg, err)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for name, tc := range map[string]struct {
+		yaml string
+		env  [2]string
+		args []string
+		want string
+	}{
+		"unknown field":  {yaml: "server:\n  adr: 0.0.0.0:1\n", want: "adr"},
+		"bad yaml":       {yaml: "server: [\n", want: "Decode failed"},
+		"bad env":        {env: [2]string{"NETCHAT_WRITE_TIMEOUT", "soon"}, want: "NETCHAT_WRITE_TIMEOUT"},
+		"bad flag":       {args: []string{"-write-timeout", "10"}, want: "write-timeout"},
+		"unknown flag":   {args: []string{"-nope"}, want: "nope"},
+		"invalid config": {args: []string{"-addr", "8888"}, want: "addr"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			args := tc.args
+			if tc.yaml != "" {
+				args = append([]string{"-config", writeConfig(t, tc.yaml)}, args...)
+			}
+			if tc.env[0] != "" {
+				t.Setenv(tc.env[0], tc.env[1])
+			}
+			_, err := Load(args)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("err = %v, want containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for flagName, want := range map[string]string{
+		"addr":          "NETCHAT_ADDR",
+		"mysql-dsn":     "NETCHAT_MYSQL_DSN",
+		"tls-client-ca": "NETCHAT_TLS_CLIENT_CA",
+	} {
+		if got := envName(flagName); got != want {
+			t.Errorf("envName(%q) = %q, want %q", flagName, got, want)
+		}
+	}
+}
+
+func TestBindFlags(t *testing.T) {
+	cfg := Default()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.bind(fs)
+	//每个参数对应不同的环境变量，默认值与Default一致
+	envs := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		env := envName(f.Name)
+		if other, ok := envs[env]; ok {
+			t.Errorf("flags %q and %q share env %s", f.Name, other, env)
+		}
+		envs[env] = f.Name
+	})
+	for name, want := range map[string]string{
+		"heartbeat-timeout": "50s",
+		"session-ttl":       "24h0m0s",
+		"resume-grace":      "1m0s",
+		"send-overflow":     OverflowDropOldest,
+		"stream-max-len":    "1000",
+		"tls":               "false",
+	} {
+		f := fs.Lookup(name)
+		if f == nil {
+			t.Errorf("flag %q not registered", name)
+		} else if f.DefValue != want {
+			t.Errorf("flag %q default = %q, want %q", name, f.DefValue, want)
+		}
+	}
+	//参数直接写入配置
+	if err := fs.Parse([]string{"-resume-grace", "5s", "-tls"}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.ResumeGrace != 5*time.Second || !cfg.Client.TLS.Enable {
+		t.Fatalf("parsed config = %+v", cfg)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("default config invalid: %v", err)
+	}
+	for want, modify := range map[string]func(c *Config){
+		`addr "8888" invalid`:           func(c *Config) { c.Server.Addr = "8888" },
+		`redis-addr "" invalid`:         func(c *Config) { c.Redis.Addr = "" },
+		`server "host" invalid`:         func(c *Config) { c.Client.Server = "host" },
+		`ws-addr "ws" invalid`:          func(c *Config) { c.Server.WSAddr = "ws" },
+		`api-addr ":x:y" invalid`:       func(c *Config) { c.Server.APIAddr = ":x:y" },
+		"heartbeat-timeout":             func(c *Config) { c.Server.HeartbeatTimeout = 0 },
+		"write-timeout":                 func(c *Config) { c.Server.WriteTimeout = -time.Second },
+		"session-ttl":                   func(c *Config) { c.Server.SessionTTL = 0 },
+		"must be less than session-ttl": func(c *Config) { c.Server.ResumeGrace = c.Server.SessionTTL },
+		"heartbeat 50s must be less":    func(c *Config) { c.Client.Heartbeat = c.Server.HeartbeatTimeout },
+		"send-block-timeout": func(c *Config) {
+			c.Server.SendOverflow, c.Server.SendBlockTimeout = OverflowBlock, 0
+		},
+		`send-overflow "drop"`:            func(c *Config) { c.Server.SendOverflow = "drop" },
+		"max-frame-size must be between":  func(c *Config) { c.Server.MaxFrameSize = MaxFrameSizeLimit + 1 },
+		"tls-cert and tls-key":            func(c *Config) { c.Server.TLS.Cert = "server.pem" },
+		"tls-client-ca requires tls-cert": func(c *Config) { c.Server.TLS.ClientCA = "ca.pem" },
+	} {
+		c := Default()
+		modify(c)
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want containing %q", err, want)
+		}
+	}
+	//多个错误一起报告
+	c := Default()
+	c.Server.Addr, c.Redis.OpTimeout = "", 0
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "addr") || !strings.Contains(err.Error(), "redis-op-timeout") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestValidateAdminAddr(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:8889":               true,
+		"[::1]:8889":                   true,
+		"localhost:8889":               true,
+		"unix:/run/netchat/admin.sock": true,
+		"0.0.0.0:8889":                 false,
+		":8889":                        false,
+		"192.168.1.10:8889":            false,
+		"unix:":                        false,
+		"127.0.0.1":                    false,
+	} {
+		c := Default()
+		c.Server.AdminAddr = addr
+		err := c.Validate()
+		if ok != (err == nil) {
+			t.Errorf("admin-addr %q: err = %v", addr, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "admin-addr") {
+			t.Errorf("admin-addr %q: err = %v", addr, err)
+		}
+	}
+}
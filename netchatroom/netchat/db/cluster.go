@@ -0,0 +1,231 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ClusterChannel   = "chat_cluster"   // 实例之间广播事件的频道
+	InstanceHashName = "chat_instances" // 实例ID -> 最后一次心跳的毫秒时间戳
+	PresenceHashName = "chat_presence"  // 用户名 -> Presence的JSON
+	LastSeenHashName = "chat_last_seen" // 用户名 -> 最后一次下线的毫秒时间戳
+)
+
+// Presence 用户在集群中的在线记录
+type Presence struct {
+	Instance string // 持有用户连接的实例
+	Detached bool   `json:",omitempty"` // 连接断开，等待重连
+	Status   string `json:",omitempty"` // 对外显示的在线状态，为空表示在线
+	Text     string `json:",omitempty"` // 状态说明
+}
+
+// InstanceGroupName 实例读取房间流的消费者组，每个实例一个组，房间的每条消息所有实例都能按顺序读到
+func InstanceGroupName(instance string) string {
+	return GroupName + "_" + instance
+}
+
+// InstanceConsumerName 实例在自己的消费者组中的消费者名
+func InstanceConsumerName(instance string) string {
+	return "chat_consumer_" + instance
+}
+
+// delPresenceScript 只删除仍属于该实例的在线记录，避免删掉用户在其他实例上新建的记录
+var delPresenceScript = redis.NewScript(`
+local v = redis.call('HGET', KEYS[1], ARGV[1])
+if v and cjson.decode(v).Instance == ARGV[2] then
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// PublishMsg 向频道发布一条消息
+func PublishMsg(ctx context.Context, channel string, payload string) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := rdb.Publish(ctx, channel, payload).Err()
+	if err != nil {
+		return fmt.Errorf("rdb.Publish failed,err:%w", err)
+	}
+	return nil
+}
+
+// SubscribeMsg 订阅频道，订阅确认后返回，返回的通道在ctx取消后关闭，断线时由go-redis自动重新订阅
+func SubscribeMsg(ctx context.Context, channel string) (<-chan string, error) {
+	sub := rdb.Subscribe(ctx, channel)
+	recvCtx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	_, err := sub.Receive(recvCtx)
+	if err != nil {
+		_ = sub.Close()
+		return nil, fmt.Errorf("sub.Receive failed,err:%w", err)
+	}
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				select {
+				case out <- msg.Payload:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// HeartbeatInstance 记录实例最后一次心跳的时间
+func HeartbeatInstance(ctx context.Context, instance string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := rdb.HSet(ctx, InstanceHashName, instance, at.UnixMilli()).Err()
+	if err != nil {
+		return fmt.Errorf("rdb.HSet failed,err:%w", err)
+	}
+	return nil
+}
+
+// RemoveInstance 删除实例的心跳记录
+func RemoveInstance(ctx context.Context, instance string) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := rdb.HDel(ctx, InstanceHashName, instance).Err()
+	if err != nil {
+		return fmt.Errorf("rdb.HDel failed,err:%w", err)
+	}
+	return nil
+}
+
+// ListInstances 返回所有实例最后一次心跳的时间
+func ListInstances(ctx context.Context) (map[string]time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	fields, err := rdb.HGetAll(ctx, InstanceHashName).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.HGetAll failed,err:%w", err)
+	}
+	return decodeInstances(fields), nil
+}
+
+// SetPresence 记录用户在哪个实例上在线
+func SetPresence(ctx context.Context, username string, p Presence) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed,err:%w", err)
+	}
+	err = rdb.HSet(ctx, PresenceHashName, username, data).Err()
+	if err != nil {
+		return fmt.Errorf("rdb.HSet failed,err:%w", err)
+	}
+	return nil
+}
+
+// DelPresence 删除用户的在线记录，记录已经属于其他实例时不删除
+func DelPresence(ctx context.Context, username string, instance string) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := delPresenceScript.Run(ctx, rdb, []string{PresenceHashName}, username, instance).Err()
+	if err != nil {
+		return fmt.Errorf("delPresenceScript.Run failed,err:%w", err)
+	}
+	return nil
+}
+
+// GetPresence 返回用户的在线记录，不在线时返回ErrNil
+func GetPresence(ctx context.Context, username string) (Presence, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	data, err := rdb.HGet(ctx, PresenceHashName, username).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return Presence{}, ErrNil
+		}
+		return Presence{}, fmt.Errorf("rdb.HGet failed,err:%w", err)
+	}
+	return decodePresence(data)
+}
+
+// ListPresence 返回所有用户的在线记录，其中可能有已经失联的实例留下的记录
+func ListPresence(ctx context.Context) (map[string]Presence, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	fields, err := rdb.HGetAll(ctx, PresenceHashName).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.HGetAll failed,err:%w", err)
+	}
+	return decodePresences(fields), nil
+}
+
+// SetLastSeen 记录用户最后一次下线的时间
+func SetLastSeen(ctx context.Context, username string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := rdb.HSet(ctx, LastSeenHashName, username, at.UnixMilli()).Err()
+	if err != nil {
+		return fmt.Errorf("rdb.HSet failed,err:%w", err)
+	}
+	return nil
+}
+
+// GetLastSeen 返回用户最后一次下线的时间，没有记录时返回ErrNil
+func GetLastSeen(ctx context.Context, username string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	ms, err := rdb.HGet(ctx, LastSeenHashName, username).Int64()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return time.Time{}, ErrNil
+		}
+		return time.Time{}, fmt.Errorf("rdb.HGet failed,err:%w", err)
+	}
+	return time.UnixMilli(ms), nil
+}
+
+func decodePresence(data string) (Presence, error) {
+	var p Presence
+	err := json.Unmarshal([]byte(data), &p)
+	if err != nil {
+		return Presence{}, fmt.Errorf("json.Unmarshal failed,err:%w", err)
+	}
+	return p, nil
+}
+
+// decodePresences 解码在线记录，格式错误的记录跳过
+func decodePresences(fields map[string]string) map[string]Presence {
+	res := make(map[string]Presence, len(fields))
+	for username, data := range fields {
+		if p, err := decodePresence(data); err == nil {
+			res[username] = p
+		}
+	}
+	return res
+}
+
+// decodeInstances 解码实例的心跳时间，格式错误的记录跳过
+func decodeInstances(fields map[string]string) map[string]time.Time {
+	res := make(map[string]time.Time, len(fields))
+	for instance, ms := range fields {
+		if n, err := strconv.ParseInt(ms, 10, 64); err == nil {
+			res[instance] = time.UnixMilli(n)
+		}
+	}
+	return res
+}
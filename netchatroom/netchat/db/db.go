@@ -1,55 +1,163 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"log"
+	"netchatroom/netchat/config"
+	"time"
 )
 
 var db *sqlx.DB
 
+// queryTimeout 每次查询的超时时间，来自配置
+var queryTimeout = 5 * time.Second
+
+// PasswordColumnSize password列的最小宽度，足够存放bcrypt哈希
+const PasswordColumnSize = 100
+
 //type user struct {
 //	id       int
 //	username string
 //	password string
 //}
 
-// 初始化连接数据库
-func InitDB() (err error) {
-	//go项目数据库信息
-	dsn := "root:1458963@tcp(127.0.0.1:3306)/netchat"
-	////部署docker后数据库信息
-	//dsn := "netchat:netchat@tcp(mysql:3306)/netchat"
+// 初始化连接数据库，连接串和查询超时来自配置
+func InitDB(cfg *config.MySQLConfig) (err error) {
+	queryTimeout = cfg.QueryTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
 	//连接数据库
-	db, err = sqlx.Connect("mysql", dsn)
+	db, err = sqlx.ConnectContext(ctx, "mysql", cfg.DSN)
 	if err != nil {
 		return fmt.Errorf("InitDB sqlx.Connect failed,err:%w", err)
 	}
 	fmt.Println("连接数据库成功!")
+	err = widenPasswordColumn(context.Background())
+	if err != nil {
+		return fmt.Errorf("InitDB widenPasswordColumn failed,err:%w", err)
+	}
+	err = addCreatedColumn(context.Background())
+	if err != nil {
+		return fmt.Errorf("InitDB addCreatedColumn failed,err:%w", err)
+	}
+	err = createTables(context.Background())
+	if err != nil {
+		return fmt.Errorf("InitDB createTables failed,err:%w", err)
+	}
 	return
 }
 
-// 查询username是否存在
-func QueryUsername(username string) (string, error) {
+// widenPasswordColumn 旧库的password列只有varchar(20)，放不下bcrypt哈希，启动时自动加宽
+func widenPasswordColumn(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	sqlStr := "select character_maximum_length from information_schema.columns " +
+		"where table_schema = database() and table_name = 'user' and column_name = 'password'"
+	var length int
+	err := db.GetContext(ctx, &length, sqlStr)
+	if err != nil {
+		return fmt.Errorf("Get failed,err:%w", err)
+	}
+	if length >= PasswordColumnSize {
+		return nil
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf("alter table user modify password varchar(%d) default null", PasswordColumnSize))
+	if err != nil {
+		return fmt.Errorf("Exec failed,err:%w", err)
+	}
+	return nil
+}
+
+// addCreatedColumn 旧库的user表没有注册时间，启动时自动添加，已有用户的注册时间留空
+func addCreatedColumn(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	sqlStr := "select count(*) from information_schema.columns " +
+		"where table_schema = database() and table_name = 'user' and column_name = 'created_at'"
+	var n int
+	err := db.GetContext(ctx, &n, sqlStr)
+	if err != nil {
+		return fmt.Errorf("Get failed,err:%w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	//先不带默认值添加，已有的行为null，再给新注册的用户设置默认值
+	_, err = db.ExecContext(ctx, "alter table user add column created_at datetime null")
+	if err != nil {
+		return fmt.Errorf("Exec add failed,err:%w", err)
+	}
+	_, err = db.ExecContext(ctx, "alter table user modify created_at datetime null default current_timestamp")
+	if err != nil {
+		return fmt.Errorf("Exec modify failed,err:%w", err)
+	}
+	return nil
+}
+
+// 查询username是否存在，返回存储的密码哈希（旧数据可能是明文）
+func QueryUsername(ctx context.Context, username string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
 	sqlStr := "select password from user where username = ?"
 	var password string
-	err := db.Get(&password, sqlStr, username)
+	err := db.GetContext(ctx, &password, sqlStr, username)
 	if err != nil {
 		return "", fmt.Errorf("Get failed,err:%w", err)
 	}
 	return password, nil
 }
 
-// 将user加入数据库
-func AddUser(username string, password string) error {
+// 将user加入数据库，password必须是哈希后的值，用户名重复时返回ErrUserExists
+func AddUser(ctx context.Context, username string, password string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
 	sqlStr := "insert into user(username,password) values(?,?)"
-	_, err := db.Exec(sqlStr, username, password)
+	_, err := db.ExecContext(ctx, sqlStr, username, password)
 	if err != nil {
+		//username有唯一约束，重复时添加失败
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			return ErrUserExists
+		}
 		return fmt.Errorf("Exec failed,err:%w", err)
 	}
 	return nil
 }
 
+// UpdatePassword 更新用户的密码哈希，用于旧明文密码的迁移
+func UpdatePassword(ctx context.Context, username string, password string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	sqlStr := "update user set password = ? where username = ?"
+	_, err := db.ExecContext(ctx, sqlStr, password, username)
+	if err != nil {
+		return fmt.Errorf("Exec failed,err:%w", err)
+	}
+	return nil
+}
+
+// QueryRegistered 查询用户的注册时间，旧库迁移前注册的用户没有记录，返回零值
+func QueryRegistered(ctx context.Context, username string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	//用时间戳读取，不依赖连接串的parseTime参数
+	sqlStr := "select unix_timestamp(created_at) from user where username = ?"
+	var sec sql.NullInt64
+	err := db.GetContext(ctx, &sec, sqlStr, username)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Get failed,err:%w", err)
+	}
+	if !sec.Valid {
+		return time.Time{}, nil
+	}
+	return time.Unix(sec.Int64, 0), nil
+}
+
 func CloseDB() {
 	err := db.Close()
 	if err != nil {
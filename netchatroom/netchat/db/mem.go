@@ -0,0 +1,856 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"netchatroom/netchat/message"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemStore 内存实现的全部存储，行为尽量与MySQL和redis保持一致，
+// 流支持消费者组的XADD、XREADGROUP、XACK和待确认列表，用于在go test中运行整个服务端。
+// 操作都在内存中立即完成，只有阻塞读取会检查ctx
+type MemStore struct {
+	MaxLen int64 // 每个流保留的最大消息数
+
+	mu        sync.Mutex
+	users     map[string]string
+	created   map[string]time.Time // 注册时间
+	roles     map[[2]string]int
+	flags     map[string]ScopeFlags
+	sanctions map[[3]string]time.Time // 零值表示永久
+	invites   map[[2]string]bool
+	cache     map[string]memValue
+	sets      map[string]map[string]struct{}
+	hashes    map[string]map[string]string
+	zsets     map[string]map[string]float64
+	streams   map[string]*memStream
+	notify    chan struct{} // 有新消息时关闭并替换，唤醒阻塞的读取
+	subs      map[string]map[*memSub]struct{}
+}
+
+type memValue struct {
+	value  string
+	expire time.Time
+}
+
+type memEntry struct {
+	seq int64 // 流内递增序号，用于比较先后
+	StreamEntry
+}
+
+type memStream struct {
+	entries []memEntry
+	lastMs  int64
+	lastSeq int64
+	next    int64
+	groups  map[string]*memGroup
+}
+
+type memGroup struct {
+	last    int64                 // 最后一次投递的序号
+	pending map[string]memPending // 消息ID -> 待确认信息
+}
+
+type memPending struct {
+	seq        int64
+	consumer   string
+	deliveries int64
+	delivered  time.Time
+}
+
+// NewMemStore 创建内存存储，和InitRDB一样预先创建默认房间的流和消费者组
+func NewMemStore() *MemStore {
+	m := &MemStore{
+		MaxLen:    streamMaxLen,
+		users:     make(map[string]string),
+		created:   make(map[string]time.Time),
+		roles:     make(map[[2]string]int),
+		flags:     make(map[string]ScopeFlags),
+		sanctions: make(map[[3]string]time.Time),
+		invites:   make(map[[2]string]bool),
+		cache:     make(map[string]memValue),
+		sets:      make(map[string]map[string]struct{}),
+		hashes:    make(map[string]map[string]string),
+		zsets:     make(map[string]map[string]float64),
+		streams:   make(map[string]*memStream),
+		notify:    make(chan struct{}),
+		subs:      make(map[string]map[*memSub]struct{}),
+	}
+	_ = m.XGroupCreateMkStreamMsg(context.Background(), ReceiveStreamName, GroupName)
+	_, _ = m.SAddMsg(context.Background(), DefaultRoom, RoomSetName)
+	return m
+}
+
+// Stores 把内存存储作为服务端的全部存储
+func (m *MemStore) Stores() Stores {
+	return Stores{Users: m, Cache: m, Streams: m, Ranks: m, Cluster: m}
+}
+
+// QueryUsername 查询用户的密码哈希
+func (m *MemStore) QueryUsername(_ context.Context, username string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	password, ok := m.users[username]
+	if !ok {
+		return "", fmt.Errorf("Get failed,err:%w", sql.ErrNoRows)
+	}
+	return password, nil
+}
+
+// AddUser 添加用户
+func (m *MemStore) AddUser(_ context.Context, username string, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[username]; ok {
+		return ErrUserExists
+	}
+	m.users[username] = password
+	m.created[username] = time.Now()
+	return nil
+}
+
+// UpdatePassword 更新密码哈希
+func (m *MemStore) UpdatePassword(_ context.Context, username string, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[username]; ok {
+		m.users[username] = password
+	}
+	return nil
+}
+
+// QueryRegistered 查询注册时间
+func (m *MemStore) QueryRegistered(_ context.Context, username string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[username]; !ok {
+		return time.Time{}, fmt.Errorf("Get failed,err:%w", sql.ErrNoRows)
+	}
+	return m.created[username], nil
+}
+
+// QueryRole 查询角色
+func (m *MemStore) QueryRole(_ context.Context, scope string, username string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.roles[[2]string{scope, username}], nil
+}
+
+// SetRole 设置角色
+func (m *MemStore) SetRole(_ context.Context, scope string, username string, role int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if role == RoleMember {
+		delete(m.roles, [2]string{scope, username})
+	} else {
+		m.roles[[2]string{scope, username}] = role
+	}
+	return nil
+}
+
+// QueryFlags 查询权限标志
+func (m *MemStore) QueryFlags(_ context.Context, scope string) (*ScopeFlags, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	flags, ok := m.flags[scope]
+	if !ok {
+		return &ScopeFlags{Scope: scope}, nil
+	}
+	return &flags, nil
+}
+
+// SetFlags 保存权限标志
+func (m *MemStore) SetFlags(_ context.Context, flags *ScopeFlags) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flags[flags.Scope] = *flags
+	return nil
+}
+
+// AddSanction 添加处罚
+func (m *MemStore) AddSanction(_ context.Context, scope string, username string, kind string, seconds int, operator string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var until time.Time
+	if seconds > 0 {
+		until = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	m.sanctions[[3]string{scope, username, kind}] = until
+	return nil
+}
+
+// DelSanction 解除处罚
+func (m *MemStore) DelSanction(_ context.Context, scope string, username string, kind string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [3]string{scope, username, kind}
+	_, ok := m.sanctions[key]
+	delete(m.sanctions, key)
+	return ok, nil
+}
+
+// QuerySanction 查询处罚是否生效
+func (m *MemStore) QuerySanction(_ context.Context, scope string, username string, kind string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	until, ok := m.sanctions[[3]string{scope, username, kind}]
+	return ok && (until.IsZero() || until.After(time.Now())), nil
+}
+
+// AddInvite 添加邀请
+func (m *MemStore) AddInvite(_ context.Context, scope string, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.invites[[2]string{scope, username}] = true
+	return nil
+}
+
+// QueryInvite 查询邀请
+func (m *MemStore) QueryInvite(_ context.Context, scope string, username string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.invites[[2]string{scope, username}], nil
+}
+
+// set 设置带过期时间的键，调用方需持有锁
+func (m *MemStore) set(key string, value string, ttl time.Duration) {
+	m.cache[key] = memValue{value: value, expire: time.Now().Add(ttl)}
+}
+
+// get 读取未过期的键，调用方需持有锁
+func (m *MemStore) get(key string) (string, error) {
+	v, ok := m.cache[key]
+	if !ok || !time.Now().Before(v.expire) {
+		delete(m.cache, key)
+		return "", ErrNil
+	}
+	return v.value, nil
+}
+
+// SetUser 缓存用户
+func (m *MemStore) SetUser(_ context.Context, username string, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(UserKeyPrefix+username, value, 3600*time.Second)
+	return nil
+}
+
+// GetUser 读取缓存的用户
+func (m *MemStore) GetUser(_ context.Context, username string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(UserKeyPrefix + username)
+}
+
+// DelLegacyUser 删除旧版本的明文缓存，不合法的用户名可能与系统的key重名，不删除
+func (m *MemStore) DelLegacyUser(_ context.Context, username string) error {
+	if message.ValidateUsername(username) != nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.cache, username)
+	return nil
+}
+
+// SetSession 保存会话令牌
+func (m *MemStore) SetSession(_ context.Context, token string, username string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(SessionKeyPrefix+token, username, ttl)
+	return nil
+}
+
+// GetSession 根据会话令牌查找用户名
+func (m *MemStore) GetSession(_ context.Context, token string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(SessionKeyPrefix + token)
+}
+
+// DelSession 注销会话令牌
+func (m *MemStore) DelSession(_ context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.cache, SessionKeyPrefix+token)
+	return nil
+}
+
+// SAddMsg 集合添加成员
+func (m *MemStore) SAddMsg(_ context.Context, member string, key string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set, ok := m.sets[key]
+	if !ok {
+		set = make(map[string]struct{})
+		m.sets[key] = set
+	}
+	if _, ok = set[member]; ok {
+		return 0, nil
+	}
+	set[member] = struct{}{}
+	return 1, nil
+}
+
+// SRemMsg 集合删除成员
+func (m *MemStore) SRemMsg(_ context.Context, member string, key string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sets[key][member]; !ok {
+		return 0, nil
+	}
+	delete(m.sets[key], member)
+	return 1, nil
+}
+
+// SIsMemberMsg 判断是否为集合成员
+func (m *MemStore) SIsMemberMsg(_ context.Context, member string, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.sets[key][member]
+	return ok, nil
+}
+
+// SMembersMsg 集合的全部成员
+func (m *MemStore) SMembersMsg(_ context.Context, key string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := make([]string, 0, len(m.sets[key]))
+	for member := range m.sets[key] {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// HSetMsg 设置哈希的字段
+func (m *MemStore) HSetMsg(_ context.Context, key string, field string, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash, ok := m.hashes[key]
+	if !ok {
+		hash = make(map[string]string)
+		m.hashes[key] = hash
+	}
+	hash[field] = value
+	return nil
+}
+
+// HGetMsg 返回哈希的一个字段，字段不存在时返回ErrNil
+func (m *MemStore) HGetMsg(_ context.Context, key string, field string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.hashes[key][field]
+	if !ok {
+		return "", ErrNil
+	}
+	return value, nil
+}
+
+// HGetAllMsg 哈希的全部字段，键不存在时返回空map
+func (m *MemStore) HGetAllMsg(_ context.Context, key string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.hashes[key]), nil
+}
+
+// HDelMsg 删除哈希的字段，返回删除的个数
+func (m *MemStore) HDelMsg(_ context.Context, key string, fields ...string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, field := range fields {
+		if _, ok := m.hashes[key][field]; ok {
+			delete(m.hashes[key], field)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ZAddNXMsg 有序集合添加成员，分数为1
+func (m *MemStore) ZAddNXMsg(_ context.Context, member string, key string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zset, ok := m.zsets[key]
+	if !ok {
+		zset = make(map[string]float64)
+		m.zsets[key] = zset
+	}
+	if _, ok = zset[member]; ok {
+		return 0, nil
+	}
+	zset[member] = 1
+	return 1, nil
+}
+
+// ZIncrMsg 成员分数加1
+func (m *MemStore) ZIncrMsg(_ context.Context, member string, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.zsets[key]; !ok {
+		m.zsets[key] = make(map[string]float64)
+	}
+	m.zsets[key][member]++
+	return nil
+}
+
+// ZScoreMsg 返回成员的分数，成员不存在时返回ErrNil
+func (m *MemStore) ZScoreMsg(_ context.Context, member string, key string) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	score, ok := m.zsets[key][member]
+	if !ok {
+		return 0, ErrNil
+	}
+	return score, nil
+}
+
+// ZRevRangeMsg 按分数从高到低返回，分数相同时按成员名倒序，与redis一致
+func (m *MemStore) ZRevRangeMsg(_ context.Context, key string) ([]RankItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]RankItem, 0, len(m.zsets[key]))
+	for member, score := range m.zsets[key] {
+		res = append(res, RankItem{Member: member, Score: score})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score > res[j].Score
+		}
+		return res[i].Member > res[j].Member
+	})
+	return res, nil
+}
+
+// DelKey 删除任意类型的键
+func (m *MemStore) DelKey(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.cache, key)
+	delete(m.sets, key)
+	delete(m.zsets, key)
+	delete(m.streams, key)
+	return nil
+}
+
+// stream 取出流，不存在时创建，调用方需持有锁
+func (m *MemStore) stream(name string) *memStream {
+	s, ok := m.streams[name]
+	if !ok {
+		s = &memStream{groups: make(map[string]*memGroup)}
+		m.streams[name] = s
+	}
+	return s
+}
+
+// group 取出消费者组，不存在时和redis一样返回NOGROUP错误，调用方需持有锁
+func (m *MemStore) group(stream string, group string) (*memStream, *memGroup, error) {
+	s, ok := m.streams[stream]
+	if ok {
+		if g, ok := s.groups[group]; ok {
+			return s, g, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", stream, group)
+}
+
+// XGroupCreateMkStreamMsg 创建流和从头读取的消费者组，已存在不算错误
+func (m *MemStore) XGroupCreateMkStreamMsg(_ context.Context, stream string, group string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.stream(stream)
+	if _, ok := s.groups[group]; !ok {
+		s.groups[group] = &memGroup{pending: make(map[string]memPending)}
+	}
+	return nil
+}
+
+// XGroupCreateLatestMsg 创建流和只读取之后新消息的消费者组，已存在时跳过组内还没读取的消息
+func (m *MemStore) XGroupCreateLatestMsg(_ context.Context, stream string, group string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.stream(stream)
+	g, ok := s.groups[group]
+	if !ok {
+		g = &memGroup{pending: make(map[string]memPending)}
+		s.groups[group] = g
+	}
+	g.last = s.next
+	return nil
+}
+
+// XGroupDestroyMsg 删除消费者组
+func (m *MemStore) XGroupDestroyMsg(_ context.Context, stream string, group string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.streams[stream]; ok {
+		delete(s.groups, group)
+	}
+	return nil
+}
+
+// XAddMsg 追加消息，超过MaxLen时删除最早的消息，并唤醒阻塞的读取，返回消息ID
+func (m *MemStore) XAddMsg(_ context.Context, msg string, codec string, stream string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.stream(stream)
+	ms := time.Now().UnixMilli()
+	if ms > s.lastMs {
+		s.lastMs, s.lastSeq = ms, 0
+	} else {
+		s.lastSeq++
+	}
+	s.next++
+	id := fmt.Sprintf("%d-%d", s.lastMs, s.lastSeq)
+	s.entries = append(s.entries, memEntry{
+		seq: s.next,
+		StreamEntry: StreamEntry{
+			ID:    id,
+			Data:  msg,
+			Codec: codec,
+		},
+	})
+	if m.MaxLen > 0 && int64(len(s.entries)) > m.MaxLen {
+		s.entries = slices.Clone(s.entries[int64(len(s.entries))-m.MaxLen:])
+	}
+	close(m.notify)
+	m.notify = make(chan struct{})
+	return id, nil
+}
+
+// XGetMsg 按ID读取一条消息，不存在或已被裁剪时返回ErrNil
+func (m *MemStore) XGetMsg(_ context.Context, stream string, id string) (*StreamEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.streams[stream]; ok {
+		for _, e := range s.entries {
+			if e.ID == id {
+				entry := e.StreamEntry
+				return &entry, nil
+			}
+		}
+	}
+	return nil, ErrNil
+}
+
+// XReadGroupMsg 阻塞读取组内下一条未投递的消息，并记入该消费者的待确认列表，ctx取消时返回ctx.Err()
+func (m *MemStore) XReadGroupMsg(ctx context.Context, stream, group, consumer string) (*StreamEntry, error) {
+	for {
+		m.mu.Lock()
+		s, g, err := m.group(stream, group)
+		if err != nil {
+			m.mu.Unlock()
+			return nil, err
+		}
+		for _, e := range s.entries {
+			if e.seq > g.last {
+				g.last = e.seq
+				g.pending[e.ID] = memPending{seq: e.seq, consumer: consumer, deliveries: 1, delivered: time.Now()}
+				m.mu.Unlock()
+				entry := e.StreamEntry
+				return &entry, nil
+			}
+		}
+		wait := m.notify
+		m.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// XReadGroupPendingMsg 读取该消费者已投递未确认的消息并增加投递次数，已被裁剪的消息只有ID
+func (m *MemStore) XReadGroupPendingMsg(_ context.Context, stream, group, consumer string, count int) ([]*StreamEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, g, err := m.group(stream, group)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*StreamEntry, 0, count)
+	for _, id := range g.pendingIDs() {
+		if len(res) == count {
+			break
+		}
+		p := g.pending[id]
+		if p.consumer != consumer {
+			continue
+		}
+		p.deliveries++
+		p.delivered = time.Now()
+		g.pending[id] = p
+		entry := StreamEntry{ID: id}
+		if e, ok := s.entry(p.seq); ok {
+			entry = e.StreamEntry
+		}
+		res = append(res, &entry)
+	}
+	return res, nil
+}
+
+// XAutoClaimMsg 把组内空闲超过minIdle的待确认消息认领给consumer并增加投递次数，
+// 和redis一样，已被裁剪的消息直接从待确认列表删除
+func (m *MemStore) XAutoClaimMsg(_ context.Context, stream, group, consumer string, minIdle time.Duration, count int) ([]*StreamEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, g, err := m.group(stream, group)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	res := make([]*StreamEntry, 0, count)
+	for _, id := range g.pendingIDs() {
+		if len(res) == count {
+			break
+		}
+		p := g.pending[id]
+		if now.Sub(p.delivered) < minIdle {
+			continue
+		}
+		e, ok := s.entry(p.seq)
+		if !ok {
+			delete(g.pending, id)
+			continue
+		}
+		p.consumer = consumer
+		p.deliveries++
+		p.delivered = now
+		g.pending[id] = p
+		entry := e.StreamEntry
+		entry.Deliveries = p.deliveries
+		res = append(res, &entry)
+	}
+	return res, nil
+}
+
+// pendingIDs 返回待确认消息的ID，按写入顺序
+func (g *memGroup) pendingIDs() []string {
+	ids := make([]string, 0, len(g.pending))
+	for id := range g.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return g.pending[ids[i]].seq < g.pending[ids[j]].seq })
+	return ids
+}
+
+// entry 按序号查找还没被裁剪的消息
+func (s *memStream) entry(seq int64) (memEntry, bool) {
+	for _, e := range s.entries {
+		if e.seq == seq {
+			return e, true
+		}
+	}
+	return memEntry{}, false
+}
+
+// XAckMsg 确认消息，从待确认列表中删除
+func (m *MemStore) XAckMsg(_ context.Context, msgID string, stream string, group string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, g, err := m.group(stream, group); err == nil {
+		delete(g.pending, msgID)
+	}
+	return nil
+}
+
+// XRangeMsg 返回最近的n条消息，按时间正序
+func (m *MemStore) XRangeMsg(_ context.Context, stream string, n int) ([]*StreamEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.streams[stream]
+	if !ok || n <= 0 {
+		return []*StreamEntry{}, nil
+	}
+	entries := s.entries[max(0, len(s.entries)-n):]
+	res := make([]*StreamEntry, 0, len(entries))
+	for _, e := range entries {
+		entry := e.StreamEntry
+		res = append(res, &entry)
+	}
+	return res, nil
+}
+
+// XRangeAfterMsg 按时间正序返回ID大于after的至多count条消息
+func (m *MemStore) XRangeAfterMsg(_ context.Context, stream string, after string, count int) ([]*StreamEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]*StreamEntry, 0)
+	s, ok := m.streams[stream]
+	if !ok {
+		return res, nil
+	}
+	for _, e := range s.entries {
+		if len(res) == count {
+			break
+		}
+		if CompareStreamID(e.ID, after) > 0 {
+			entry := e.StreamEntry
+			res = append(res, &entry)
+		}
+	}
+	return res, nil
+}
+
+// memSub 一个订阅者，发布时只追加到队列，不会因为订阅者处理慢而阻塞发布者
+type memSub struct {
+	mu    sync.Mutex
+	queue []string
+	wake  chan struct{}
+}
+
+func (s *memSub) push(payload string) {
+	s.mu.Lock()
+	s.queue = append(s.queue, payload)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *memSub) pop() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return "", false
+	}
+	payload := s.queue[0]
+	s.queue = s.queue[1:]
+	return payload, true
+}
+
+// PublishMsg 把消息发给频道当前的所有订阅者
+func (m *MemStore) PublishMsg(_ context.Context, channel string, payload string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for sub := range m.subs[channel] {
+		sub.push(payload)
+	}
+	return nil
+}
+
+// SubscribeMsg 订阅频道，返回后发布的消息都能收到，ctx取消后关闭返回的通道
+func (m *MemStore) SubscribeMsg(ctx context.Context, channel string) (<-chan string, error) {
+	sub := &memSub{wake: make(chan struct{}, 1)}
+	m.mu.Lock()
+	if m.subs[channel] == nil {
+		m.subs[channel] = make(map[*memSub]struct{})
+	}
+	m.subs[channel][sub] = struct{}{}
+	m.mu.Unlock()
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		defer func() {
+			m.mu.Lock()
+			delete(m.subs[channel], sub)
+			m.mu.Unlock()
+		}()
+		for {
+			payload, ok := sub.pop()
+			if !ok {
+				select {
+				case <-sub.wake:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case out <- payload:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// HeartbeatInstance 记录实例最后一次心跳的时间
+func (m *MemStore) HeartbeatInstance(ctx context.Context, instance string, at time.Time) error {
+	return m.HSetMsg(ctx, InstanceHashName, instance, strconv.FormatInt(at.UnixMilli(), 10))
+}
+
+// RemoveInstance 删除实例的心跳记录
+func (m *MemStore) RemoveInstance(_ context.Context, instance string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.hashes[InstanceHashName], instance)
+	return nil
+}
+
+// ListInstances 返回所有实例最后一次心跳的时间
+func (m *MemStore) ListInstances(ctx context.Context) (map[string]time.Time, error) {
+	fields, _ := m.HGetAllMsg(ctx, InstanceHashName)
+	return decodeInstances(fields), nil
+}
+
+// SetPresence 记录用户在哪个实例上在线
+func (m *MemStore) SetPresence(ctx context.Context, username string, p Presence) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed,err:%w", err)
+	}
+	return m.HSetMsg(ctx, PresenceHashName, username, string(data))
+}
+
+// DelPresence 删除用户的在线记录，记录已经属于其他实例时不删除
+func (m *MemStore) DelPresence(_ context.Context, username string, instance string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.hashes[PresenceHashName][username]
+	if !ok {
+		return nil
+	}
+	if p, err := decodePresence(data); err == nil && p.Instance == instance {
+		delete(m.hashes[PresenceHashName], username)
+	}
+	return nil
+}
+
+// GetPresence 返回用户的在线记录，不在线时返回ErrNil
+func (m *MemStore) GetPresence(_ context.Context, username string) (Presence, error) {
+	m.mu.Lock()
+	data, ok := m.hashes[PresenceHashName][username]
+	m.mu.Unlock()
+	if !ok {
+		return Presence{}, ErrNil
+	}
+	return decodePresence(data)
+}
+
+// ListPresence 返回所有用户的在线记录
+func (m *MemStore) ListPresence(ctx context.Context) (map[string]Presence, error) {
+	fields, _ := m.HGetAllMsg(ctx, PresenceHashName)
+	return decodePresences(fields), nil
+}
+
+// SetLastSeen 记录用户最后一次下线的时间
+func (m *MemStore) SetLastSeen(ctx context.Context, username string, at time.Time) error {
+	return m.HSetMsg(ctx, LastSeenHashName, username, strconv.FormatInt(at.UnixMilli(), 10))
+}
+
+// GetLastSeen 返回用户最后一次下线的时间，没有记录时返回ErrNil
+func (m *MemStore) GetLastSeen(_ context.Context, username string) (time.Time, error) {
+	m.mu.Lock()
+	data, ok := m.hashes[LastSeenHashName][username]
+	m.mu.Unlock()
+	if !ok {
+		return time.Time{}, ErrNil
+	}
+	ms, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("strconv.ParseInt failed,err:%w", err)
+	}
+	return time.UnixMilli(ms), nil
+}
@@ -0,0 +1,387 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemStoreStreamGroup(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	if err := m.XGroupCreateMkStreamMsg(ctx, "s", "g"); err != nil {
+		t.Fatal(err)
+	}
+	//重复创建不算错误
+	if err := m.XGroupCreateMkStreamMsg(ctx, "s", "g"); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"a", "b", "c"} {
+		if _, err := m.XAddMsg(ctx, data, "json", "s"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, err := m.XReadGroupMsg(ctx, "s", "g", "c1")
+	if err != nil || first.Data != "a" || first.Codec != "json" {
+		t.Fatalf("first = %+v, %v", first, err)
+	}
+	second, err := m.XReadGroupMsg(ctx, "s", "g", "c1")
+	if err != nil || second.Data != "b" {
+		t.Fatalf("second = %+v, %v", second, err)
+	}
+	if err = m.XAckMsg(ctx, first.ID, "s", "g"); err != nil {
+		t.Fatal(err)
+	}
+
+	//只剩第二条待确认
+	pending, err := m.XReadGroupPendingMsg(ctx, "s", "g", "c1", 10)
+	if err != nil || len(pending) != 1 || pending[0].ID != second.ID {
+		t.Fatalf("pending = %+v, %v", pending, err)
+	}
+	//其他消费者看不到
+	pending, err = m.XReadGroupPendingMsg(ctx, "s", "g", "c2", 10)
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("other consumer pending = %+v, %v", pending, err)
+	}
+
+	if _, err = m.XReadGroupMsg(ctx, "s", "missing", "c1"); err == nil {
+		t.Fatal("want NOGROUP error")
+	}
+}
+
+func TestMemStoreReadGroupBlocks(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	if err := m.XGroupCreateMkStreamMsg(ctx, "s", "g"); err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan *StreamEntry)
+	go func() {
+		entry, err := m.XReadGroupMsg(ctx, "s", "g", "c")
+		if err != nil {
+			t.Error(err)
+		}
+		got <- entry
+	}()
+	select {
+	case <-got:
+		t.Fatal("read returned before any message was added")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if _, err := m.XAddMsg(ctx, "hello", "", "s"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case entry := <-got:
+		if entry.Data != "hello" {
+			t.Fatalf("entry = %+v", entry)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read was not woken by XAddMsg")
+	}
+
+	//取消ctx时阻塞的读取返回
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := m.XReadGroupMsg(ctx, "s", "g", "c")
+		errc <- err
+	}()
+	cancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("err = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read was not cancelled")
+	}
+}
+
+func TestMemStoreRangeAndTrim(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	m.MaxLen = 3
+	for _, data := range []string{"1", "2", "3", "4", "5"} {
+		if _, err := m.XAddMsg(ctx, data, "", "s"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := m.XRangeMsg(ctx, "s", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for _, e := range entries {
+		got += e.Data
+	}
+	if got != "345" {
+		t.Fatalf("range after trim = %q, want %q", got, "345")
+	}
+	entries, err = m.XRangeMsg(ctx, "s", 2)
+	if err != nil || len(entries) != 2 || entries[0].Data != "4" {
+		t.Fatalf("range 2 = %+v, %v", entries, err)
+	}
+}
+
+func TestMemStoreUsersAndCache(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	if _, err := m.QueryUsername(ctx, "alice"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("QueryUsername err = %v, want sql.ErrNoRows", err)
+	}
+	if err := m.AddUser(ctx, "alice", "hash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddUser(ctx, "alice", "hash"); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("AddUser err = %v, want ErrUserExists", err)
+	}
+
+	if _, err := m.GetSession(ctx, "t"); !errors.Is(err, ErrNil) {
+		t.Fatalf("GetSession err = %v, want ErrNil", err)
+	}
+	if err := m.SetSession(ctx, "t", "alice", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := m.GetSession(ctx, "t"); !errors.Is(err, ErrNil) {
+		t.Fatalf("expired session err = %v, want ErrNil", err)
+	}
+
+	if err := m.AddSanction(ctx, GlobalScope, "alice", SanctionMute, 0, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if muted, _ := m.QuerySanction(ctx, GlobalScope, "alice", SanctionMute); !muted {
+		t.Fatal("permanent mute not active")
+	}
+}
+
+func TestDelLegacyUserSkipsReservedKeys(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	m.set("alice", "123456", time.Hour)
+	m.set(ZSetName, "system", time.Hour)
+	for _, username := range []string{"alice", ZSetName} {
+		if err := m.DelLegacyUser(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.get("alice"); !errors.Is(err, ErrNil) {
+		t.Fatalf("legacy user kept, err = %v", err)
+	}
+	//与用户名同名的系统key不能被当作旧缓存删掉
+	if v, err := m.get(ZSetName); err != nil || v != "system" {
+		t.Fatalf("%s = %q, %v", ZSetName, v, err)
+	}
+}
+
+func TestMemStoreRank(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	for _, member := range []string{"a", "b", "b", "c"} {
+		if _, err := m.ZAddNXMsg(ctx, member, "z"); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.ZIncrMsg(ctx, member, "z"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rank, err := m.ZRevRangeMsg(ctx, "z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rank) != 3 || rank[0].Member != "b" || rank[0].Score != 3 || rank[1].Member != "c" {
+		t.Fatalf("rank = %+v", rank)
+	}
+}
+
+func TestMemXRangeAfterAndCursor(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	for _, data := range []string{"a", "b", "c"} {
+		if _, err := m.XAddMsg(ctx, data, "", "s"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := m.XRangeAfterMsg(ctx, "s", "0", 10)
+	if err != nil || len(all) != 3 {
+		t.Fatalf("XRangeAfterMsg(0) = %v, %v", all, err)
+	}
+	after, err := m.XRangeAfterMsg(ctx, "s", all[0].ID, 1)
+	if err != nil || len(after) != 1 || after[0].Data != "b" {
+		t.Fatalf("XRangeAfterMsg(first, 1) = %v, %v", after, err)
+	}
+
+	if err = m.HSetMsg(ctx, "h", "alice", all[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	fields, err := m.HGetAllMsg(ctx, "h")
+	if err != nil || fields["alice"] != all[1].ID {
+		t.Fatalf("HGetAllMsg = %v, %v", fields, err)
+	}
+	if fields, _ = m.HGetAllMsg(ctx, "missing"); len(fields) != 0 {
+		t.Fatalf("missing hash = %v", fields)
+	}
+	if id, err := m.HGetMsg(ctx, "h", "alice"); err != nil || id != all[1].ID {
+		t.Fatalf("HGetMsg = %q, %v", id, err)
+	}
+	if _, err = m.HGetMsg(ctx, "h", "bob"); !errors.Is(err, ErrNil) {
+		t.Fatalf("missing field err = %v, want ErrNil", err)
+	}
+	if err = m.HSetMsg(ctx, "h", "bob", all[2].ID); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := m.HDelMsg(ctx, "h", "alice", "carol"); err != nil || n != 1 {
+		t.Fatalf("HDelMsg = %d, %v", n, err)
+	}
+	if fields, _ = m.HGetAllMsg(ctx, "h"); len(fields) != 1 || fields["bob"] != all[2].ID {
+		t.Fatalf("after HDelMsg = %v", fields)
+	}
+
+	entry, err := m.XGetMsg(ctx, "s", all[2].ID)
+	if err != nil || entry.Data != "c" {
+		t.Fatalf("XGetMsg = %+v, %v", entry, err)
+	}
+	if _, err = m.XGetMsg(ctx, "s", "1-0"); !errors.Is(err, ErrNil) {
+		t.Fatalf("missing entry err = %v, want ErrNil", err)
+	}
+	if StreamIDTime(all[0].ID).IsZero() {
+		t.Fatalf("StreamIDTime(%q) is zero", all[0].ID)
+	}
+}
+
+func TestCompareStreamID(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"1-0", "1-0", 0},
+		{"1-1", "1-0", 1},
+		{"2-0", "10-0", -1},
+		{"5", "5-0", 0},
+		{"0", "1700000000000-3", -1},
+	} {
+		if got := CompareStreamID(c.a, c.b); got != c.want {
+			t.Errorf("CompareStreamID(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestMemXAutoClaim(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemStore()
+	m.MaxLen = 2
+	if err := m.XGroupCreateMkStreamMsg(ctx, "s", "g"); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"a", "b"} {
+		if _, err := m.XAddMsg(ctx, data, "", "s"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.XReadGroupMsg(ctx, "s", "g", "c1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//还没空闲足够久
+	claimed, err := m.XAutoClaimMsg(ctx, "s", "g", "c2", time.Hour, 10)
+	if err != nil || len(claimed) != 0 {
+		t.Fatalf("claimed before idle = %+v, %v", claimed, err)
+	}
+	claimed, err = m.XAutoClaimMsg(ctx, "s", "g", "c2", 0, 1)
+	if err != nil || len(claimed) != 1 || claimed[0].Data != "a" || claimed[0].Deliveries != 2 {
+		t.Fatalf("claimed = %+v, %v", claimed, err)
+	}
+	//认领后归c2所有
+	pending, err := m.XReadGroupPendingMsg(ctx, "s", "g", "c2", 10)
+	if err != nil || len(pending) != 1 || pending[0].ID != claimed[0].ID {
+		t.Fatalf("c2 pending = %+v, %v", pending, err)
+	}
+
+	//被裁剪的消息直接从待确认列表删除
+	if _, err = m.XAddMsg(ctx, "c", "", "s"); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err = m.XAutoClaimMsg(ctx, "s", "g", "c2", 0, 10)
+	if err != nil || len(claimed) != 1 || claimed[0].Data != "b" {
+		t.Fatalf("claimed after trim = %+v, %v", claimed, err)
+	}
+	pending, _ = m.XReadGroupPendingMsg(ctx, "s", "g", "c2", 10)
+	if len(pending) != 1 || pending[0].Data != "b" {
+		t.Fatalf("pending after trim = %+v", pending)
+	}
+}
+
+func TestMemClusterPresence(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := NewMemStore()
+
+	events, err := m.SubscribeMsg(ctx, ClusterChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"a", "b"} {
+		if err = m.PublishMsg(ctx, ClusterChannel, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"a", "b"} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("event = %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %q not received", want)
+		}
+	}
+
+	if err = m.SetPresence(ctx, "alice", Presence{Instance: "node1"}); err != nil {
+		t.Fatal(err)
+	}
+	//已经转到node2的记录不会被node1删除
+	if err = m.SetPresence(ctx, "alice", Presence{Instance: "node2", Detached: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.DelPresence(ctx, "alice", "node1"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := m.GetPresence(ctx, "alice")
+	if err != nil || p.Instance != "node2" || !p.Detached {
+		t.Fatalf("presence = %+v, %v", p, err)
+	}
+	if err = m.DelPresence(ctx, "alice", "node2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.GetPresence(ctx, "alice"); !errors.Is(err, ErrNil) {
+		t.Fatalf("deleted presence err = %v", err)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("event after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription not closed after cancel")
+	}
+}
+
+func TestKeyNamesDoNotCollide(t *testing.T) {
+	//用户名可以包含下划线，房间的key不能与按用户名生成的key重名
+	for _, username := range []string{"room_lobby", "lobby", "room", "room_lobby_stream"} {
+		inbox := InboxStreamName(username)
+		for _, room := range []string{"lobby", "room", DefaultRoom} {
+			for _, key := range []string{RoomStreamName(room), RoomZSetName(room), RoomMembersName(room), RoomEditsName(room), RoomDeletedName(room), RoomLastMsgName(room)} {
+				if key == inbox || key == ReadCursorName(username) {
+					t.Errorf("room %q key %q collides with user %q", room, key, username)
+				}
+			}
+		}
+	}
+}
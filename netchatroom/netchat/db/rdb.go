@@ -1,21 +1,42 @@
 package db
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/redis/go-redis/v9"
+	"log"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/config"
+	"netchatroom/netchat/message"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
 var rdb *redis.Client
 
+// streamMaxLen 每个流保留的最大消息数，来自配置
+var streamMaxLen int64 = 1000
+
+// opTimeout 每次操作的超时时间，来自配置
+var opTimeout = 3 * time.Second
+
+// xReadBlock XReadGroupMsg每次阻塞读取的时长
+const xReadBlock = 2 * time.Second
+
 const (
 	ReceiveStreamName = "chat_receive_stream"
 	GroupName         = "chat_group"
-	ConsumerName      = "chat_consumer1"
 	ZSetName          = "chat_zset"
+	UserKeyPrefix     = "user:"
+	SessionKeyPrefix  = "session:"
+	RoomSetName       = "chat_rooms"
+	RoomKeyPrefix     = "room:"                   // 房间的各个key，用户名中没有冒号，不会与按用户名生成的key重名
+	DeadLetterName    = "chat_dead_letter_stream" // 多次投递仍未确认的私聊
+	DefaultRoom       = common.DefaultRoom        // 默认房间沿用最早的流和排行榜
 )
 
 type RankItem struct {
@@ -23,61 +44,241 @@ type RankItem struct {
 	Score  float64
 }
 
+// StreamEntry 流中的一条消息，Codec为写入时使用的编解码器，旧条目为空
+type StreamEntry struct {
+	ID         string
+	Data       string
+	Codec      string
+	Deliveries int64 // 投递次数，只有认领待确认消息时有值
+}
+
 // InitRDB 初始化redis
-func InitRDB() (err error) {
+func InitRDB(cfg *config.RedisConfig) (err error) {
 	rdb = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "", //没有密码
-		DB:       0,  //默认数据库0
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
 	})
-
-	////docker部署时的redis连接
-	//rdb = redis.NewClient(&redis.Options{
-	//	Addr:     "redis:6379",
-	//	Password: "", //没有密码
-	//	DB:       0,  //默认数据库0
-	//})
+	streamMaxLen = cfg.StreamMaxLen
+	opTimeout = cfg.OpTimeout
 
 	//测试一下连接
 	ctx := context.Background()
-	err = rdb.Ping(ctx).Err()
+	pingCtx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err = rdb.Ping(pingCtx).Err()
 	if err != nil {
 		err = fmt.Errorf("rdb.Ping failed,err:%w", err)
 		return
 	}
 	fmt.Println("连接redis成功!")
 
-	err = XGroupCreateMkStreamMsg(ReceiveStreamName, GroupName)
+	err = XGroupCreateMkStreamMsg(ctx, ReceiveStreamName, GroupName)
 	if err != nil {
 		err = fmt.Errorf("XGroupCreateMkStreamMsg failed,err:%w", err)
 		return
 	}
+	_, err = SAddMsg(ctx, DefaultRoom, RoomSetName)
+	if err != nil {
+		err = fmt.Errorf("SAddMsg failed,err:%w", err)
+		return
+	}
 	return
 }
 
-// SetUser 设置键值对
-func SetUser(key string, value string) error {
-	ctx := context.Background()
-	err := rdb.Set(ctx, key, value, 3600*time.Second).Err()
+// CloseRDB 关闭redis连接
+func CloseRDB() {
+	err := rdb.Close()
+	if err != nil {
+		log.Printf("rdb.Close failed,err:%v\n", err)
+	}
+}
+
+// RoomStreamName 房间的消息流，默认房间沿用chat_receive_stream
+func RoomStreamName(room string) string {
+	if room == DefaultRoom {
+		return ReceiveStreamName
+	}
+	return RoomKeyPrefix + room + ":stream"
+}
+
+// RoomZSetName 房间的活跃度排行榜，默认房间沿用chat_zset
+func RoomZSetName(room string) string {
+	if room == DefaultRoom {
+		return ZSetName
+	}
+	return RoomKeyPrefix + room + ":zset"
+}
+
+// InboxStreamName 用户的私聊收件箱流
+func InboxStreamName(username string) string {
+	return username + "_stream"
+}
+
+// InboxGroupName 私聊收件箱的消费者组
+func InboxGroupName(username string) string {
+	return username + "_group"
+}
+
+// InboxConsumerName 私聊收件箱的消费者
+func InboxConsumerName(username string) string {
+	return username + "_consumer"
+}
+
+// ReadCursorName 用户在各个私聊会话中的已读位置，哈希的字段为对方用户名，值为收件箱中最后已读的消息ID，
+// 字段ReadCursorFloor为所有会话共同的已读下限
+func ReadCursorName(username string) string {
+	return username + "_read"
+}
+
+// ReadCursorFloor 已读下限字段，旧版本用户首次登录时设为收件箱的最新消息，之前的消息不算未读
+const ReadCursorFloor = "*"
+
+// RoomMembersName 房间的成员集合
+func RoomMembersName(room string) string {
+	return RoomKeyPrefix + room + ":members"
+}
+
+// RoomEditsName 房间中被编辑或删除的消息，哈希的字段为消息ID，值为最新版本的JSON
+func RoomEditsName(room string) string {
+	return RoomKeyPrefix + room + ":edits"
+}
+
+// RoomDeletedName 房间中被删除的消息ID集合，以它为准判断消息是否已删除，
+// 与删除同时进行的编辑即使覆盖了编辑记录也不会让消息恢复
+func RoomDeletedName(room string) string {
+	return RoomKeyPrefix + room + ":deleted"
+}
+
+// RoomLastMsgName 用户在房间中发的最后一条消息，哈希的字段为用户名，值为消息ID
+func RoomLastMsgName(room string) string {
+	return RoomKeyPrefix + room + ":last"
+}
+
+// SetUser 缓存用户的非敏感信息，不允许存放密码
+func SetUser(ctx context.Context, username string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := rdb.Set(ctx, UserKeyPrefix+username, value, 3600*time.Second).Err()
 	if err != nil {
 		return fmt.Errorf("rdb.Set failed,err:%w", err)
 	}
 	return nil
 }
 
-// GetUser 得到键值
-func GetUser(key string) (string, error) {
-	ctx := context.Background()
-	value, err := rdb.Get(ctx, key).Result()
+// GetUser 得到缓存的用户信息
+func GetUser(ctx context.Context, username string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	value, err := rdb.Get(ctx, UserKeyPrefix+username).Result()
+	if err != nil {
+		return "", fmt.Errorf("rdb.Get failed,err:%w", err)
+	}
+	return value, nil
+}
+
+// DelLegacyUser 删除旧版本直接以用户名为键缓存的明文密码。
+// 不合法的用户名（如chat_zset）可能与系统的key重名，不删除
+func DelLegacyUser(ctx context.Context, username string) error {
+	if message.ValidateUsername(username) != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := rdb.Del(ctx, username).Err()
+	if err != nil {
+		return fmt.Errorf("rdb.Del failed,err:%w", err)
+	}
+	return nil
+}
+
+// SetSession 保存会话令牌对应的用户名，ttl到期后令牌失效
+func SetSession(ctx context.Context, token string, username string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := rdb.Set(ctx, SessionKeyPrefix+token, username, ttl).Err()
+	if err != nil {
+		return fmt.Errorf("rdb.Set failed,err:%w", err)
+	}
+	return nil
+}
+
+// GetSession 根据会话令牌查找用户名
+func GetSession(ctx context.Context, token string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	username, err := rdb.Get(ctx, SessionKeyPrefix+token).Result()
 	if err != nil {
 		return "", fmt.Errorf("rdb.Get failed,err:%w", err)
 	}
+	return username, nil
+}
+
+// DelSession 注销会话令牌
+func DelSession(ctx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := rdb.Del(ctx, SessionKeyPrefix+token).Err()
+	if err != nil {
+		return fmt.Errorf("rdb.Del failed,err:%w", err)
+	}
+	return nil
+}
+
+// HSetMsg 设置哈希的字段
+func HSetMsg(ctx context.Context, key string, field string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := rdb.HSet(ctx, key, field, value).Err()
+	if err != nil {
+		return fmt.Errorf("rdb.HSet failed,err:%w", err)
+	}
+	return nil
+}
+
+// HGetMsg 返回哈希的一个字段，字段不存在时返回ErrNil
+func HGetMsg(ctx context.Context, key string, field string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	value, err := rdb.HGet(ctx, key, field).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", ErrNil
+		}
+		return "", fmt.Errorf("rdb.HGet failed,err:%w", err)
+	}
 	return value, nil
 }
 
+// HGetAllMsg 返回哈希的全部字段，键不存在时返回空map
+func HGetAllMsg(ctx context.Context, key string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	fields, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.HGetAll failed,err:%w", err)
+	}
+	return fields, nil
+}
+
+// HDelMsg 删除哈希的字段，返回删除的个数
+func HDelMsg(ctx context.Context, key string, fields ...string) (int, error) {
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	n, err := rdb.HDel(ctx, key, fields...).Result()
+	if err != nil {
+		return 0, fmt.Errorf("rdb.HDel failed,err:%w", err)
+	}
+	return int(n), nil
+}
+
 // ZAddNXMsg 为有序集合添加成员，分数默认为1
-func ZAddNXMsg(member string, key string) (int, error) {
-	ctx := context.Background()
+func ZAddNXMsg(ctx context.Context, member string, key string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
 	n, err := rdb.ZAddNX(ctx, key, redis.Z{Score: 1.0, Member: member}).Result()
 	if err != nil {
 		return int(n), fmt.Errorf("rdb.ZAddNX failed:err%w", err)
@@ -86,8 +287,9 @@ func ZAddNXMsg(member string, key string) (int, error) {
 }
 
 // ZIncrMsg 为某个成员分数加1
-func ZIncrMsg(member string, key string) error {
-	ctx := context.Background()
+func ZIncrMsg(ctx context.Context, member string, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
 	err := rdb.ZIncrBy(ctx, key, 1.0, member).Err()
 	if err != nil {
 		return fmt.Errorf("rdb.ZIncrBy failed,err:%w", err)
@@ -95,9 +297,24 @@ func ZIncrMsg(member string, key string) error {
 	return nil
 }
 
+// ZScoreMsg 返回成员的分数，成员不存在时返回ErrNil
+func ZScoreMsg(ctx context.Context, member string, key string) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	score, err := rdb.ZScore(ctx, key, member).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return 0, ErrNil
+		}
+		return 0, fmt.Errorf("rdb.ZScore failed,err:%w", err)
+	}
+	return score, nil
+}
+
 // ZRevRangeMsg 遍历有序集合
-func ZRevRangeMsg(key string) ([]RankItem, error) {
-	ctx := context.Background()
+func ZRevRangeMsg(ctx context.Context, key string) ([]RankItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
 	rank, err := rdb.ZRevRangeWithScores(ctx, key, 0, -1).Result()
 	if err != nil {
 		return nil, fmt.Errorf("rdb.ZRevRangeWithScores failed,err:%w", err)
@@ -113,9 +330,65 @@ func ZRevRangeMsg(key string) ([]RankItem, error) {
 	return res, nil
 }
 
+// DelKey 删除某个键，用于重置排行榜
+func DelKey(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := rdb.Del(ctx, key).Err()
+	if err != nil {
+		return fmt.Errorf("rdb.Del failed,err:%w", err)
+	}
+	return nil
+}
+
+// SAddMsg 集合添加成员，返回新添加的个数
+func SAddMsg(ctx context.Context, member string, key string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	n, err := rdb.SAdd(ctx, key, member).Result()
+	if err != nil {
+		return int(n), fmt.Errorf("rdb.SAdd failed,err:%w", err)
+	}
+	return int(n), nil
+}
+
+// SRemMsg 集合删除成员，返回删除的个数
+func SRemMsg(ctx context.Context, member string, key string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	n, err := rdb.SRem(ctx, key, member).Result()
+	if err != nil {
+		return int(n), fmt.Errorf("rdb.SRem failed,err:%w", err)
+	}
+	return int(n), nil
+}
+
+// SIsMemberMsg 判断是否是集合成员
+func SIsMemberMsg(ctx context.Context, member string, key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	ok, err := rdb.SIsMember(ctx, key, member).Result()
+	if err != nil {
+		return false, fmt.Errorf("rdb.SIsMember failed,err:%w", err)
+	}
+	return ok, nil
+}
+
+// SMembersMsg 返回集合所有成员
+func SMembersMsg(ctx context.Context, key string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	members, err := rdb.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.SMembers failed,err:%w", err)
+	}
+	return members, nil
+}
+
 // XGroupCreateMkStreamMsg 创建消费者组和流
-func XGroupCreateMkStreamMsg(stream string, group string) (err error) {
-	ctx := context.Background()
+func XGroupCreateMkStreamMsg(ctx context.Context, stream string, group string) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
 	err = rdb.XGroupCreateMkStream(ctx, stream, group, "0").Err()
 	if err != nil {
 		//消费者组已存在不算错误
@@ -129,43 +402,174 @@ func XGroupCreateMkStreamMsg(stream string, group string) (err error) {
 	return
 }
 
-// XAddMsg 消息加入流中
-func XAddMsg(msg string, stream string) error {
-	ctx := context.Background()
-	err := rdb.XAdd(ctx, &redis.XAddArgs{
-		Stream: stream,
-		MaxLen: 1000,
-		Values: map[string]interface{}{
-			"data": msg,
-		},
-	}).Err()
+// XGroupCreateLatestMsg 创建流和只读取之后新消息的消费者组，已存在时跳过组内还没读取的消息
+func XGroupCreateLatestMsg(ctx context.Context, stream string, group string) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := rdb.XGroupCreateMkStream(ctx, stream, group, "$").Err()
+	if err == nil {
+		return nil
+	}
+	if !strings.Contains(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("rdb.XGroupCreateMkStream failed,err:%w", err)
+	}
+	err = rdb.XGroupSetID(ctx, stream, group, "$").Err()
 	if err != nil {
-		return fmt.Errorf("rdb.XAdd failed,err:%w", err)
+		return fmt.Errorf("rdb.XGroupSetID failed,err:%w", err)
 	}
 	return nil
 }
 
-// XReadGroupMsg 消费者从流中读消息
-func XReadGroupMsg(stream, group, consumer string) (string, string, error) {
-	ctx := context.Background()
+// XGroupDestroyMsg 删除消费者组，组或流不存在不算错误
+func XGroupDestroyMsg(ctx context.Context, stream string, group string) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	err := rdb.XGroupDestroy(ctx, stream, group).Err()
+	//流不存在时Redis返回"ERR The XGROUP subcommand requires the key to exist..."
+	if err != nil && !errors.Is(err, redis.Nil) && !strings.Contains(err.Error(), "requires the key to exist") &&
+		!strings.Contains(err.Error(), "no such key") {
+		return fmt.Errorf("rdb.XGroupDestroy failed,err:%w", err)
+	}
+	return nil
+}
+
+// XAddMsg 消息加入流中，codec记录消息的编码格式，纯文本条目传空串，返回消息ID
+func XAddMsg(ctx context.Context, msg string, codec string, stream string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	values := map[string]interface{}{
+		"data": msg,
+	}
+	if codec != "" {
+		values["codec"] = codec
+	}
+	id, err := rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: streamMaxLen,
+		Values: values,
+	}).Result()
+	if err != nil {
+		return "", fmt.Errorf("rdb.XAdd failed,err:%w", err)
+	}
+	return id, nil
+}
+
+// XGetMsg 按ID读取一条消息，不存在或已被裁剪时返回ErrNil
+func XGetMsg(ctx context.Context, stream string, id string) (*StreamEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	msgs, err := rdb.XRange(ctx, stream, id, id).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.XRange failed,err:%w", err)
+	}
+	if len(msgs) == 0 {
+		return nil, ErrNil
+	}
+	return toStreamEntry(msgs[0]), nil
+}
+
+// XReadGroupMsg 消费者从流中读消息，阻塞到有新消息或ctx被取消
+func XReadGroupMsg(ctx context.Context, stream, group, consumer string) (*StreamEntry, error) {
+	//分段阻塞，取消ctx后最多一个xReadBlock内返回
+	for {
+		msgs, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{stream, ">"},
+			Count:    1,
+			Block:    xReadBlock,
+		}).Result()
+		if err == nil {
+			return toStreamEntry(msgs[0].Messages[0]), nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !errors.Is(err, redis.Nil) {
+			return nil, fmt.Errorf("rdb.XReadGroup failed,err:%w", err)
+		}
+	}
+}
+
+// XReadGroupPendingMsg 读取已投递给该消费者但还未确认的消息，不阻塞
+func XReadGroupPendingMsg(ctx context.Context, stream, group, consumer string, count int) ([]*StreamEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
 	msgs, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
 		Group:    group,
 		Consumer: consumer,
-		Streams:  []string{stream, ">"},
-		Count:    1,
-		Block:    0,
+		Streams:  []string{stream, "0"},
+		Count:    int64(count),
+		Block:    -1,
 	}).Result()
 	if err != nil {
-		return "", "", fmt.Errorf("rdb.XReadGroup failed,err:%w", err)
+		return nil, fmt.Errorf("rdb.XReadGroup failed,err:%w", err)
 	}
-	msgID := msgs[0].Messages[0].ID
-	msg := msgs[0].Messages[0].Values["data"]
-	return msgID, msg.(string), nil
+	res := make([]*StreamEntry, 0, count)
+	if len(msgs) == 0 {
+		return res, nil
+	}
+	for _, msg := range msgs[0].Messages {
+		res = append(res, toStreamEntry(msg))
+	}
+	return res, nil
+}
+
+// XAutoClaimMsg 把组内空闲超过minIdle的待确认消息认领给consumer，返回的消息带上投递次数，
+// 已被裁剪的消息由redis直接从待确认列表删除，不会返回
+func XAutoClaimMsg(ctx context.Context, stream, group, consumer string, minIdle time.Duration, count int) ([]*StreamEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	msgs, _, err := rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   stream,
+		Group:    group,
+		MinIdle:  minIdle,
+		Start:    "0-0",
+		Count:    int64(count),
+		Consumer: consumer,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.XAutoClaim failed,err:%w", err)
+	}
+	res := make([]*StreamEntry, 0, len(msgs))
+	if len(msgs) == 0 {
+		return res, nil
+	}
+	//逐条按ID查询投递次数，同一区间内该消费者的其他待确认消息不会挤掉认领到的消息
+	cmds := make([]*redis.XPendingExtCmd, len(msgs))
+	_, err = rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, msg := range msgs {
+			cmds[i] = pipe.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: stream,
+				Group:  group,
+				Start:  msg.ID,
+				End:    msg.ID,
+				Count:  1,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("rdb.XPendingExt failed,err:%w", err)
+	}
+	deliveries := make(map[string]int64, len(msgs))
+	for _, cmd := range cmds {
+		for _, p := range cmd.Val() {
+			deliveries[p.ID] = p.RetryCount
+		}
+	}
+	for _, msg := range msgs {
+		entry := toStreamEntry(msg)
+		entry.Deliveries = deliveries[msg.ID]
+		res = append(res, entry)
+	}
+	return res, nil
 }
 
 // XAckMsg 确认消息，保证不被重复读
-func XAckMsg(msgID string, stream string, group string) error {
-	ctx := context.Background()
+func XAckMsg(ctx context.Context, msgID string, stream string, group string) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
 	err := rdb.XAck(ctx, stream, group, msgID).Err()
 	if err != nil {
 		return fmt.Errorf("rdb.XAck failed,err:%w", err)
@@ -173,17 +577,65 @@ func XAckMsg(msgID string, stream string, group string) error {
 	return nil
 }
 
-// XRangeMsg 遍历流返回n条消息
-func XRangeMsg(stream string, n int) ([]string, error) {
-	res := make([]string, 0, n)
-	ctx := context.Background()
+// XRangeMsg 遍历流返回最近的n条消息
+func XRangeMsg(ctx context.Context, stream string, n int) ([]*StreamEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	res := make([]*StreamEntry, 0, n)
 	msgs, err := rdb.XRevRangeN(ctx, stream, "+", "-", int64(n)).Result()
 	if err != nil {
 		return nil, fmt.Errorf("rdb.XRangeN failed,err:%w", err)
 	}
 	for _, msg := range msgs {
-		res = append(res, msg.Values["data"].(string))
+		res = append(res, toStreamEntry(msg))
 	}
 	slices.Reverse(res)
 	return res, nil
 }
+
+// XRangeAfterMsg 按时间正序返回ID大于after的至多count条消息，after为"0"时从头读取
+func XRangeAfterMsg(ctx context.Context, stream string, after string, count int) ([]*StreamEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	msgs, err := rdb.XRangeN(ctx, stream, "("+after, "+", int64(count)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.XRangeN failed,err:%w", err)
+	}
+	res := make([]*StreamEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		res = append(res, toStreamEntry(msg))
+	}
+	return res, nil
+}
+
+// CompareStreamID 比较两个流消息ID的先后，格式为毫秒时间戳-序号，省略序号时按0处理
+func CompareStreamID(a string, b string) int {
+	aMs, aSeq := parseStreamID(a)
+	bMs, bSeq := parseStreamID(b)
+	if c := cmp.Compare(aMs, bMs); c != 0 {
+		return c
+	}
+	return cmp.Compare(aSeq, bSeq)
+}
+
+// StreamIDTime 流消息ID中的毫秒时间戳，即消息写入流的时间
+func StreamIDTime(id string) time.Time {
+	ms, _ := parseStreamID(id)
+	return time.UnixMilli(int64(ms))
+}
+
+// parseStreamID 解析流消息ID，格式错误的部分按0处理
+func parseStreamID(id string) (uint64, uint64) {
+	msStr, seqStr, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseUint(msStr, 10, 64)
+	seq, _ := strconv.ParseUint(seqStr, 10, 64)
+	return ms, seq
+}
+
+// toStreamEntry 取出流条目中的数据和编码标记
+func toStreamEntry(msg redis.XMessage) *StreamEntry {
+	entry := &StreamEntry{ID: msg.ID}
+	entry.Data, _ = msg.Values["data"].(string)
+	entry.Codec, _ = msg.Values["codec"].(string)
+	return entry
+}
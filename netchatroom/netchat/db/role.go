@@ -0,0 +1,204 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// 角色，数值越大权限越高
+const (
+	RoleMember = iota
+	RoleModerator
+	RoleOwner
+)
+
+// 处罚类型
+const (
+	SanctionMute = "mute"
+	SanctionBan  = "ban"
+)
+
+// GlobalScope 全局范围，全局角色和处罚对所有房间生效
+const GlobalScope = "global"
+
+// RoomScope 房间的权限范围
+func RoomScope(room string) string {
+	return "room:" + room
+}
+
+// tableSQL 角色、权限标志、处罚和邀请表，旧库启动时自动创建
+var tableSQL = []string{
+	"create table if not exists `role` (" +
+		"`scope` varchar(64) not null," +
+		"`username` varchar(20) not null," +
+		"`role` tinyint not null default 0," +
+		"primary key (`scope`,`username`))",
+	"create table if not exists `scope_flag` (" +
+		"`scope` varchar(64) not null," +
+		"`invite_only` tinyint(1) not null default 0," +
+		"`read_only` tinyint(1) not null default 0," +
+		"`slow_mode` int not null default 0," +
+		"primary key (`scope`))",
+	"create table if not exists `sanction` (" +
+		"`scope` varchar(64) not null," +
+		"`username` varchar(20) not null," +
+		"`kind` varchar(10) not null," +
+		"`until` datetime default null," +
+		"`operator` varchar(20) default null," +
+		"primary key (`scope`,`username`,`kind`))",
+	"create table if not exists `invite` (" +
+		"`scope` varchar(64) not null," +
+		"`username` varchar(20) not null," +
+		"primary key (`scope`,`username`))",
+}
+
+// ScopeFlags 某个范围的权限标志
+type ScopeFlags struct {
+	Scope      string `db:"scope"`
+	InviteOnly bool   `db:"invite_only"` // 只能被邀请加入
+	ReadOnly   bool   `db:"read_only"`   // 公告频道，只有管理员能发言
+	SlowMode   int    `db:"slow_mode"`   // 两次发言的最小间隔秒数，0表示不限制
+}
+
+// createTables 创建权限相关的表
+func createTables(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	for _, sqlStr := range tableSQL {
+		_, err := db.ExecContext(ctx, sqlStr)
+		if err != nil {
+			return fmt.Errorf("Exec failed,err:%w", err)
+		}
+	}
+	return nil
+}
+
+// QueryRole 查询用户在某个范围内的角色，没有记录时为普通成员
+func QueryRole(ctx context.Context, scope string, username string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	sqlStr := "select role from role where scope = ? and username = ?"
+	var role int
+	err := db.GetContext(ctx, &role, sqlStr, scope, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return RoleMember, nil
+		}
+		return RoleMember, fmt.Errorf("Get failed,err:%w", err)
+	}
+	return role, nil
+}
+
+// SetRole 设置用户在某个范围内的角色，设为普通成员时删除记录
+func SetRole(ctx context.Context, scope string, username string, role int) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	var err error
+	if role == RoleMember {
+		_, err = db.ExecContext(ctx, "delete from role where scope = ? and username = ?", scope, username)
+	} else {
+		_, err = db.ExecContext(ctx, "insert into role(scope,username,role) values(?,?,?) "+
+			"on duplicate key update role = values(role)", scope, username, role)
+	}
+	if err != nil {
+		return fmt.Errorf("Exec failed,err:%w", err)
+	}
+	return nil
+}
+
+// QueryFlags 查询某个范围的权限标志，没有记录时全部为默认值
+func QueryFlags(ctx context.Context, scope string) (*ScopeFlags, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	sqlStr := "select scope,invite_only,read_only,slow_mode from scope_flag where scope = ?"
+	flags := &ScopeFlags{}
+	err := db.GetContext(ctx, flags, sqlStr, scope)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &ScopeFlags{Scope: scope}, nil
+		}
+		return nil, fmt.Errorf("Get failed,err:%w", err)
+	}
+	return flags, nil
+}
+
+// SetFlags 保存某个范围的权限标志
+func SetFlags(ctx context.Context, flags *ScopeFlags) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	sqlStr := "insert into scope_flag(scope,invite_only,read_only,slow_mode) values(?,?,?,?) " +
+		"on duplicate key update invite_only = values(invite_only),read_only = values(read_only),slow_mode = values(slow_mode)"
+	_, err := db.ExecContext(ctx, sqlStr, flags.Scope, flags.InviteOnly, flags.ReadOnly, flags.SlowMode)
+	if err != nil {
+		return fmt.Errorf("Exec failed,err:%w", err)
+	}
+	return nil
+}
+
+// AddSanction 添加处罚，seconds为0表示永久
+func AddSanction(ctx context.Context, scope string, username string, kind string, seconds int, operator string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	sqlStr := "insert into sanction(scope,username,kind,until,operator) " +
+		"values(?,?,?,if(? = 0,null,date_add(now(),interval ? second)),?) " +
+		"on duplicate key update until = values(until),operator = values(operator)"
+	_, err := db.ExecContext(ctx, sqlStr, scope, username, kind, seconds, seconds, operator)
+	if err != nil {
+		return fmt.Errorf("Exec failed,err:%w", err)
+	}
+	return nil
+}
+
+// DelSanction 解除处罚，返回是否存在该处罚
+func DelSanction(ctx context.Context, scope string, username string, kind string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	res, err := db.ExecContext(ctx, "delete from sanction where scope = ? and username = ? and kind = ?", scope, username, kind)
+	if err != nil {
+		return false, fmt.Errorf("Exec failed,err:%w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("RowsAffected failed,err:%w", err)
+	}
+	return n > 0, nil
+}
+
+// QuerySanction 查询用户当前是否处于某种处罚中
+func QuerySanction(ctx context.Context, scope string, username string, kind string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	sqlStr := "select count(*) from sanction where scope = ? and username = ? and kind = ? " +
+		"and (until is null or until > now())"
+	var n int
+	err := db.GetContext(ctx, &n, sqlStr, scope, username, kind)
+	if err != nil {
+		return false, fmt.Errorf("Get failed,err:%w", err)
+	}
+	return n > 0, nil
+}
+
+// AddInvite 邀请用户加入仅限邀请的房间
+func AddInvite(ctx context.Context, scope string, username string) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	_, err := db.ExecContext(ctx, "insert ignore into invite(scope,username) values(?,?)", scope, username)
+	if err != nil {
+		return fmt.Errorf("Exec failed,err:%w", err)
+	}
+	return nil
+}
+
+// QueryInvite 查询用户是否被邀请
+func QueryInvite(ctx context.Context, scope string, username string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	var n int
+	err := db.GetContext(ctx, &n, "select count(*) from invite where scope = ? and username = ?", scope, username)
+	if err != nil {
+		return false, fmt.Errorf("Get failed,err:%w", err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrNil 缓存中不存在该键
+	ErrNil = redis.Nil
+	// ErrUserExists 用户名已被注册
+	ErrUserExists = errors.New("user exists")
+)
+
+// UserStore 用户账号、角色和处罚，查询不到用户时返回sql.ErrNoRows
+type UserStore interface {
+	QueryUsername(ctx context.Context, username string) (string, error)
+	AddUser(ctx context.Context, username string, password string) error
+	UpdatePassword(ctx context.Context, username string, password string) error
+	QueryRegistered(ctx context.Context, username string) (time.Time, error)
+	QueryRole(ctx context.Context, scope string, username string) (int, error)
+	SetRole(ctx context.Context, scope string, username string, role int) error
+	QueryFlags(ctx context.Context, scope string) (*ScopeFlags, error)
+	SetFlags(ctx context.Context, flags *ScopeFlags) error
+	AddSanction(ctx context.Context, scope string, username string, kind string, seconds int, operator string) error
+	DelSanction(ctx context.Context, scope string, username string, kind string) (bool, error)
+	QuerySanction(ctx context.Context, scope string, username string, kind string) (bool, error)
+	AddInvite(ctx context.Context, scope string, username string) error
+	QueryInvite(ctx context.Context, scope string, username string) (bool, error)
+}
+
+// CacheStore 用户缓存、会话令牌、房间成员集合、私聊已读位置和消息的编辑记录，键不存在时返回ErrNil
+type CacheStore interface {
+	SetUser(ctx context.Context, username string, value string) error
+	GetUser(ctx context.Context, username string) (string, error)
+	DelLegacyUser(ctx context.Context, username string) error
+	SetSession(ctx context.Context, token string, username string, ttl time.Duration) error
+	GetSession(ctx context.Context, token string) (string, error)
+	DelSession(ctx context.Context, token string) error
+	SAddMsg(ctx context.Context, member string, key string) (int, error)
+	SRemMsg(ctx context.Context, member string, key string) (int, error)
+	SIsMemberMsg(ctx context.Context, member string, key string) (bool, error)
+	SMembersMsg(ctx context.Context, key string) ([]string, error)
+	HSetMsg(ctx context.Context, key string, field string, value string) error
+	HGetMsg(ctx context.Context, key string, field string) (string, error)
+	HGetAllMsg(ctx context.Context, key string) (map[string]string, error)
+	HDelMsg(ctx context.Context, key string, fields ...string) (int, error)
+}
+
+// StreamStore 消息流和消费者组
+type StreamStore interface {
+	XGroupCreateMkStreamMsg(ctx context.Context, stream string, group string) error
+	XGroupCreateLatestMsg(ctx context.Context, stream string, group string) error
+	XGroupDestroyMsg(ctx context.Context, stream string, group string) error
+	XAddMsg(ctx context.Context, msg string, codec string, stream string) (string, error)
+	XGetMsg(ctx context.Context, stream string, id string) (*StreamEntry, error)
+	XReadGroupMsg(ctx context.Context, stream, group, consumer string) (*StreamEntry, error)
+	XReadGroupPendingMsg(ctx context.Context, stream, group, consumer string, count int) ([]*StreamEntry, error)
+	XAutoClaimMsg(ctx context.Context, stream, group, consumer string, minIdle time.Duration, count int) ([]*StreamEntry, error)
+	XAckMsg(ctx context.Context, msgID string, stream string, group string) error
+	XRangeMsg(ctx context.Context, stream string, n int) ([]*StreamEntry, error)
+	XRangeAfterMsg(ctx context.Context, stream string, after string, count int) ([]*StreamEntry, error)
+}
+
+// RankStore 活跃度排行榜
+type RankStore interface {
+	ZAddNXMsg(ctx context.Context, member string, key string) (int, error)
+	ZIncrMsg(ctx context.Context, member string, key string) error
+	ZScoreMsg(ctx context.Context, member string, key string) (float64, error)
+	ZRevRangeMsg(ctx context.Context, key string) ([]RankItem, error)
+	DelKey(ctx context.Context, key string) error
+}
+
+// ClusterStore 多个服务端实例共享的事件频道、实例心跳、用户在线记录和最后下线时间
+type ClusterStore interface {
+	PublishMsg(ctx context.Context, channel string, payload string) error
+	SubscribeMsg(ctx context.Context, channel string) (<-chan string, error)
+	HeartbeatInstance(ctx context.Context, instance string, at time.Time) error
+	RemoveInstance(ctx context.Context, instance string) error
+	ListInstances(ctx context.Context) (map[string]time.Time, error)
+	SetPresence(ctx context.Context, username string, p Presence) error
+	DelPresence(ctx context.Context, username string, instance string) error
+	GetPresence(ctx context.Context, username string) (Presence, error)
+	ListPresence(ctx context.Context) (map[string]Presence, error)
+	SetLastSeen(ctx context.Context, username string, at time.Time) error
+	GetLastSeen(ctx context.Context, username string) (time.Time, error)
+}
+
+// Stores 服务端用到的全部存储，所有方法在ctx取消或超时后返回错误
+type Stores struct {
+	Users   UserStore
+	Cache   CacheStore
+	Streams StreamStore
+	Ranks   RankStore
+	Cluster ClusterStore
+}
+
+// NewStores 返回基于MySQL和redis的存储，需要先调用InitDB和InitRDB
+func NewStores() Stores {
+	return Stores{
+		Users:   MySQLStore{},
+		Cache:   RedisStore{},
+		Streams: RedisStore{},
+		Ranks:   RedisStore{},
+		Cluster: RedisStore{},
+	}
+}
+
+// MySQLStore 用包级的MySQL连接实现UserStore
+type MySQLStore struct{}
+
+func (MySQLStore) QueryUsername(ctx context.Context, username string) (string, error) {
+	return QueryUsername(ctx, username)
+}
+func (MySQLStore) AddUser(ctx context.Context, username string, password string) error {
+	return AddUser(ctx, username, password)
+}
+func (MySQLStore) UpdatePassword(ctx context.Context, username string, password string) error {
+	return UpdatePassword(ctx, username, password)
+}
+func (MySQLStore) QueryRegistered(ctx context.Context, username string) (time.Time, error) {
+	return QueryRegistered(ctx, username)
+}
+func (MySQLStore) QueryRole(ctx context.Context, scope string, username string) (int, error) {
+	return QueryRole(ctx, scope, username)
+}
+func (MySQLStore) SetRole(ctx context.Context, scope string, username string, role int) error {
+	return SetRole(ctx, scope, username, role)
+}
+func (MySQLStore) QueryFlags(ctx context.Context, scope string) (*ScopeFlags, error) {
+	return QueryFlags(ctx, scope)
+}
+func (MySQLStore) SetFlags(ctx context.Context, flags *ScopeFlags) error { return SetFlags(ctx, flags) }
+func (MySQLStore) AddSanction(ctx context.Context, scope string, username string, kind string, seconds int, operator string) error {
+	return AddSanction(ctx, scope, username, kind, seconds, operator)
+}
+func (MySQLStore) DelSanction(ctx context.Context, scope string, username string, kind string) (bool, error) {
+	return DelSanction(ctx, scope, username, kind)
+}
+func (MySQLStore) QuerySanction(ctx context.Context, scope string, username string, kind string) (bool, error) {
+	return QuerySanction(ctx, scope, username, kind)
+}
+func (MySQLStore) AddInvite(ctx context.Context, scope string, username string) error {
+	return AddInvite(ctx, scope, username)
+}
+func (MySQLStore) QueryInvite(ctx context.Context, scope string, username string) (bool, error) {
+	return QueryInvite(ctx, scope, username)
+}
+
+// RedisStore 用包级的redis连接实现CacheStore、StreamStore和RankStore
+type RedisStore struct{}
+
+func (RedisStore) SetUser(ctx context.Context, username string, value string) error {
+	return SetUser(ctx, username, value)
+}
+func (RedisStore) GetUser(ctx context.Context, username string) (string, error) {
+	return GetUser(ctx, username)
+}
+func (RedisStore) DelLegacyUser(ctx context.Context, username string) error {
+	return DelLegacyUser(ctx, username)
+}
+func (RedisStore) SetSession(ctx context.Context, token string, username string, ttl time.Duration) error {
+	return SetSession(ctx, token, username, ttl)
+}
+func (RedisStore) GetSession(ctx context.Context, token string) (string, error) {
+	return GetSession(ctx, token)
+}
+func (RedisStore) DelSession(ctx context.Context, token string) error { return DelSession(ctx, token) }
+func (RedisStore) SAddMsg(ctx context.Context, member string, key string) (int, error) {
+	return SAddMsg(ctx, member, key)
+}
+func (RedisStore) SRemMsg(ctx context.Context, member string, key string) (int, error) {
+	return SRemMsg(ctx, member, key)
+}
+func (RedisStore) SIsMemberMsg(ctx context.Context, member string, key string) (bool, error) {
+	return SIsMemberMsg(ctx, member, key)
+}
+func (RedisStore) SMembersMsg(ctx context.Context, key string) ([]string, error) {
+	return SMembersMsg(ctx, key)
+}
+func (RedisStore) HSetMsg(ctx context.Context, key string, field string, value string) error {
+	return HSetMsg(ctx, key, field, value)
+}
+func (RedisStore) HGetMsg(ctx context.Context, key string, field string) (string, error) {
+	return HGetMsg(ctx, key, field)
+}
+func (RedisStore) HGetAllMsg(ctx context.Context, key string) (map[string]string, error) {
+	return HGetAllMsg(ctx, key)
+}
+func (RedisStore) HDelMsg(ctx context.Context, key string, fields ...string) (int, error) {
+	return HDelMsg(ctx, key, fields...)
+}
+func (RedisStore) XGroupCreateMkStreamMsg(ctx context.Context, stream string, group string) error {
+	return XGroupCreateMkStreamMsg(ctx, stream, group)
+}
+func (RedisStore) XGroupCreateLatestMsg(ctx context.Context, stream string, group string) error {
+	return XGroupCreateLatestMsg(ctx, stream, group)
+}
+func (RedisStore) XGroupDestroyMsg(ctx context.Context, stream string, group string) error {
+	return XGroupDestroyMsg(ctx, stream, group)
+}
+func (RedisStore) XAddMsg(ctx context.Context, msg string, codec string, stream string) (string, error) {
+	return XAddMsg(ctx, msg, codec, stream)
+}
+func (RedisStore) XGetMsg(ctx context.Context, stream string, id string) (*StreamEntry, error) {
+	return XGetMsg(ctx, stream, id)
+}
+func (RedisStore) XReadGroupMsg(ctx context.Context, stream, group, consumer string) (*StreamEntry, error) {
+	return XReadGroupMsg(ctx, stream, group, consumer)
+}
+func (RedisStore) XReadGroupPendingMsg(ctx context.Context, stream, group, consumer string, count int) ([]*StreamEntry, error) {
+	return XReadGroupPendingMsg(ctx, stream, group, consumer, count)
+}
+func (RedisStore) XAutoClaimMsg(ctx context.Context, stream, group, consumer string, minIdle time.Duration, count int) ([]*StreamEntry, error) {
+	return XAutoClaimMsg(ctx, stream, group, consumer, minIdle, count)
+}
+func (RedisStore) XAckMsg(ctx context.Context, msgID string, stream string, group string) error {
+	return XAckMsg(ctx, msgID, stream, group)
+}
+func (RedisStore) XRangeMsg(ctx context.Context, stream string, n int) ([]*StreamEntry, error) {
+	return XRangeMsg(ctx, stream, n)
+}
+func (RedisStore) XRangeAfterMsg(ctx context.Context, stream string, after string, count int) ([]*StreamEntry, error) {
+	return XRangeAfterMsg(ctx, stream, after, count)
+}
+func (RedisStore) ZAddNXMsg(ctx context.Context, member string, key string) (int, error) {
+	return ZAddNXMsg(ctx, member, key)
+}
+func (RedisStore) ZIncrMsg(ctx context.Context, member string, key string) error {
+	return ZIncrMsg(ctx, member, key)
+}
+func (RedisStore) ZScoreMsg(ctx context.Context, member string, key string) (float64, error) {
+	return ZScoreMsg(ctx, member, key)
+}
+func (RedisStore) ZRevRangeMsg(ctx context.Context, key string) ([]RankItem, error) {
+	return ZRevRangeMsg(ctx, key)
+}
+func (RedisStore) DelKey(ctx context.Context, key string) error { return DelKey(ctx, key) }
+func (RedisStore) PublishMsg(ctx context.Context, channel string, payload string) error {
+	return PublishMsg(ctx, channel, payload)
+}
+func (RedisStore) SubscribeMsg(ctx context.Context, channel string) (<-chan string, error) {
+	return SubscribeMsg(ctx, channel)
+}
+func (RedisStore) HeartbeatInstance(ctx context.Context, instance string, at time.Time) error {
+	return HeartbeatInstance(ctx, instance, at)
+}
+func (RedisStore) RemoveInstance(ctx context.Context, instance string) error {
+	return RemoveInstance(ctx, instance)
+}
+func (RedisStore) ListInstances(ctx context.Context) (map[string]time.Time, error) {
+	return ListInstances(ctx)
+}
+func (RedisStore) SetPresence(ctx context.Context, username string, p Presence) error {
+	return SetPresence(ctx, username, p)
+}
+func (RedisStore) DelPresence(ctx context.Context, username string, instance string) error {
+	return DelPresence(ctx, username, instance)
+}
+func (RedisStore) GetPresence(ctx context.Context, username string) (Presence, error) {
+	return GetPresence(ctx, username)
+}
+func (RedisStore) ListPresence(ctx context.Context) (map[string]Presence, error) {
+	return ListPresence(ctx)
+}
+func (RedisStore) SetLastSeen(ctx context.Context, username string, at time.Time) error {
+	return SetLastSeen(ctx, username, at)
+}
+func (RedisStore) GetLastSeen(ctx context.Context, username string) (time.Time, error) {
+	return GetLastSeen(ctx, username)
+}
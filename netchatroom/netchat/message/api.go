@@ -0,0 +1,39 @@
+package message
+
+// PostRequest HTTP接口发送消息的请求，To非空时为私聊，否则发往Room，Room为空表示默认房间
+type PostRequest struct {
+	Content string
+	To      string `json:",omitempty"`
+	Room    string `json:",omitempty"`
+}
+
+// HistoryItem HTTP接口返回的一条历史消息
+type HistoryItem struct {
+	ID      string // 消息在房间流或私聊历史流中的ID
+	Time    int64  // 服务端收到消息的毫秒时间戳
+	Sender  string
+	Content string // 被编辑过时为最新版本，被删除时为DeletedText
+	Edited  bool   `json:",omitempty"`
+	Deleted bool   `json:",omitempty"`
+}
+
+// RankItem HTTP接口返回的排行榜中的一项
+type RankItem struct {
+	Rank     int
+	Username string
+	Score    float64
+}
+
+// APIResponse HTTP接口没有数据时的回复，Code与登录注册的错误码一致
+type APIResponse struct {
+	Code    string
+	Message string
+}
+
+// NewAPIResponse 按错误码生成回复，text为空时使用错误码对应的提示
+func NewAPIResponse(code string, text string) *APIResponse {
+	if text == "" {
+		text = CodeText(code)
+	}
+	return &APIResponse{Code: code, Message: text}
+}
@@ -0,0 +1,153 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"netchatroom/netchat/common"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 用户名和密码的长度限制，密码上限受bcrypt的72字节限制
+const (
+	UsernameMinLen = 3
+	UsernameMaxLen = 20
+	PasswordMinLen = 8
+	PasswordMaxLen = 72
+)
+
+// 登录注册的错误码，客户端根据错误码决定提示内容
+const (
+	CodeOK              = "OK"
+	CodeBadRequest      = "BAD_REQUEST"
+	CodeInvalidUsername = "INVALID_USERNAME"
+	CodeWeakPassword    = "WEAK_PASSWORD"
+	CodeUserExists      = "USER_EXISTS"
+	CodeUserNotFound    = "USER_NOT_FOUND"
+	CodeWrongPassword   = "WRONG_PASSWORD"
+	CodeAlreadyLoggedIn = "ALREADY_LOGGED_IN"
+	CodeInvalidToken    = "INVALID_TOKEN"
+	CodeBanned          = "BANNED"
+	CodeForbidden       = "FORBIDDEN"
+	CodeInternal        = "INTERNAL_ERROR"
+)
+
+// ReservedPrefix 系统的key以chat_开头，用户名不能以此开头，避免收件箱等按用户名生成的key与之重名
+const ReservedPrefix = "chat_"
+
+var (
+	ErrInvalidUsername = errors.New("invalid username")
+	ErrWeakPassword    = errors.New("weak password")
+)
+
+// codeTexts 错误码对应的中文提示
+var codeTexts = map[string]string{
+	CodeOK:              "成功",
+	CodeBadRequest:      "请求格式错误",
+	CodeInvalidUsername: fmt.Sprintf("用户名只能包含字母、数字、下划线，长度%d-%d位", UsernameMinLen, UsernameMaxLen),
+	CodeWeakPassword:    fmt.Sprintf("密码长度需为%d-%d位，且同时包含字母和数字", PasswordMinLen, PasswordMaxLen),
+	CodeUserExists:      "该用户名已存在，请登录",
+	CodeUserNotFound:    "该用户名不存在，请注册",
+	CodeWrongPassword:   "密码错误，请重新输入",
+	CodeAlreadyLoggedIn: "该用户名已登录...",
+	CodeInvalidToken:    "会话已过期，请重新登录",
+	CodeBanned:          "该账号已被封禁",
+	CodeForbidden:       "没有权限执行该操作",
+	CodeInternal:        "服务器繁忙，请稍后再试",
+}
+
+// RegisterRequest 注册请求
+type RegisterRequest struct {
+	Username string
+	Password string
+}
+
+// LoginRequest 登录请求
+type LoginRequest struct {
+	Username string
+	Password string
+}
+
+// ResumeRequest 断线重连后用会话令牌恢复登录状态
+type ResumeRequest struct {
+	Token string
+}
+
+// AuthResponse 登录注册的回复，Code为机器可读的错误码，登录成功时带上会话令牌和各会话的未读私聊数
+type AuthResponse struct {
+	Code    string
+	Message string        `json:",omitempty"`
+	Token   string        `json:",omitempty"`
+	Unread  []UnreadCount `json:",omitempty"`
+}
+
+// OK 判断回复是否成功
+func (r *AuthResponse) OK() bool {
+	return r.Code == CodeOK
+}
+
+// CodeText 返回错误码对应的提示，未知错误码原样返回
+func CodeText(code string) string {
+	if text, ok := codeTexts[code]; ok {
+		return text
+	}
+	return code
+}
+
+// SetPayload 把结构化载荷编码进消息的Content
+func SetPayload(msg *common.Message, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("SetPayload Marshal failed,err:%w", err)
+	}
+	msg.Content = string(data)
+	return nil
+}
+
+// GetPayload 从消息的Content中解出结构化载荷
+func GetPayload(msg *common.Message, payload any) error {
+	err := json.Unmarshal([]byte(msg.Content), payload)
+	if err != nil {
+		return fmt.Errorf("GetPayload Unmarshal failed,err:%w", err)
+	}
+	return nil
+}
+
+// ValidateUsername 校验用户名字符集和长度，允许中文等字母、数字和下划线，不能以ReservedPrefix开头
+func ValidateUsername(username string) error {
+	n := utf8.RuneCountInString(username)
+	if n < UsernameMinLen || n > UsernameMaxLen {
+		return fmt.Errorf("%w: length %d", ErrInvalidUsername, n)
+	}
+	if strings.HasPrefix(username, ReservedPrefix) {
+		return fmt.Errorf("%w: reserved prefix %q", ErrInvalidUsername, ReservedPrefix)
+	}
+	for _, r := range username {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return fmt.Errorf("%w: char %q", ErrInvalidUsername, r)
+		}
+	}
+	return nil
+}
+
+// ValidatePassword 校验密码强度，只在注册时使用
+func ValidatePassword(password string) error {
+	if len(password) < PasswordMinLen || len(password) > PasswordMaxLen {
+		return fmt.Errorf("%w: length %d", ErrWeakPassword, len(password))
+	}
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		return fmt.Errorf("%w: needs letters and digits", ErrWeakPassword)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"netchatroom/netchat/common"
+	"netchatroom/netchat/utils"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 编解码器名称，握手和流条目中的codec标记都使用这些名称
+const (
+	CodecJSON     = "json"
+	CodecMsgPack  = "msgpack"
+	CodecProtobuf = "protobuf"
+)
+
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// Codec 消息编解码器，决定common.Message在连接和redis流中的字节格式
+type Codec interface {
+	Name() string
+	Marshal(msg *common.Message) ([]byte, error)
+	Unmarshal(data []byte, msg *common.Message) error
+}
+
+var (
+	JSON     Codec = jsonCodec{}
+	MsgPack  Codec = msgpackCodec{}
+	Protobuf Codec = protobufCodec{}
+)
+
+// codecs 按名称索引的编解码器
+var codecs = map[string]Codec{
+	CodecJSON:     JSON,
+	CodecMsgPack:  MsgPack,
+	CodecProtobuf: Protobuf,
+}
+
+// CodecNames 服务端支持的编解码器，客户端按此顺序优先选择
+var CodecNames = []string{CodecMsgPack, CodecProtobuf, CodecJSON}
+
+// CodecByName 根据名称查找编解码器
+func CodecByName(name string) (Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+	}
+	return c, nil
+}
+
+// Conn 握手后的连接，记录协商出的编解码器
+type Conn struct {
+	net.Conn
+	Codec Codec
+}
+
+// ReadMsg 读取一帧并用协商出的编解码器解码
+func (c *Conn) ReadMsg() (*common.Message, error) {
+	msg, err := utils.ReadData(c.Conn)
+	if err != nil {
+		return nil, fmt.Errorf("ReadData failed ,err:%w", err)
+	}
+	codec := CodecOf(c)
+	message := &common.Message{}
+	err = codec.Unmarshal([]byte(msg), message)
+	if err != nil {
+		return nil, fmt.Errorf("%s Unmarshal failed ,err:%w", codec.Name(), err)
+	}
+	return message, nil
+}
+
+// WriteMsg 用协商出的编解码器编码并写入一帧
+func (c *Conn) WriteMsg(message *common.Message) error {
+	codec := CodecOf(c)
+	msg, err := codec.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("%s Marshal failed,err:%w", codec.Name(), err)
+	}
+	err = utils.WriteData(c.Conn, string(msg))
+	if err != nil {
+		return fmt.Errorf("WriteData failed,err:%w", err)
+	}
+	return nil
+}
+
+// CodecOf 返回连接使用的编解码器，没有协商出编解码器的连接默认使用JSON
+func CodecOf(conn common.Conn) Codec {
+	var codec Codec
+	switch c := conn.(type) {
+	case *Conn:
+		codec = c.Codec
+	case *WSConn:
+		codec = c.Codec
+	case interface{ Unwrap() common.Conn }:
+		//服务端在连接外包装的发送队列
+		return CodecOf(c.Unwrap())
+	}
+	if codec == nil {
+		return JSON
+	}
+	return codec
+}
+
+// ClientHandshake 客户端握手，按prefer顺序声明希望使用的编解码器
+func ClientHandshake(conn net.Conn, prefer []string) (*Conn, error) {
+	reply, err := utils.ClientHandshake(conn, prefer)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, reply.Codec)
+}
+
+// ServerHandshake 服务端握手，选出客户端最优先且服务端支持的编解码器
+func ServerHandshake(conn net.Conn) (*Conn, error) {
+	reply, err := utils.ServerHandshake(conn, CodecNames)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, reply.Codec)
+}
+
+func newConn(conn net.Conn, name string) (*Conn, error) {
+	if name == "" {
+		name = CodecJSON
+	}
+	codec, err := CodecByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, Codec: codec}, nil
+}
+
+// EncodeStored 用conn协商出的编解码器编码要写入流的消息，返回数据和codec标记
+func EncodeStored(conn common.Conn, msg *common.Message) (string, string, error) {
+	codec := CodecOf(conn)
+	data, err := codec.Marshal(msg)
+	if err != nil {
+		return "", "", fmt.Errorf("%s Marshal failed,err:%w", codec.Name(), err)
+	}
+	return string(data), codec.Name(), nil
+}
+
+// DecodeStored 按流条目中的codec标记解码消息，没有标记的旧条目按JSON处理
+func DecodeStored(codecName string, data string) (*common.Message, error) {
+	if codecName == "" {
+		codecName = CodecJSON
+	}
+	codec, err := CodecByName(codecName)
+	if err != nil {
+		return nil, err
+	}
+	msg := &common.Message{}
+	err = codec.Unmarshal([]byte(data), msg)
+	if err != nil {
+		return nil, fmt.Errorf("%s Unmarshal failed,err:%w", codecName, err)
+	}
+	return msg, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return CodecJSON }
+
+func (jsonCodec) Marshal(msg *common.Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, msg *common.Message) error {
+	return json.Unmarshal(data, msg)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return CodecMsgPack }
+
+func (msgpackCodec) Marshal(msg *common.Message) ([]byte, error) {
+	return msgpack.Marshal(msg)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, msg *common.Message) error {
+	return msgpack.Unmarshal(data, msg)
+}
+
+// protobufCodec 手写的protobuf线格式编解码，对应的schema:
+//
+//	message Sender  { string user_name = 1; }
+//	message Message {
+//	  Sender sender  = 1;
+//	  string content = 2;
+//	  int32  type    = 3;
+//	  string to      = 4;
+//	  string room    = 5;
+//	  string id      = 6;
+//	  int64  time    = 7;
+//	}
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string { return CodecProtobuf }
+
+func (protobufCodec) Marshal(msg *common.Message) ([]byte, error) {
+	var b []byte
+	if msg.Sender != nil {
+		var sender []byte
+		if msg.Sender.UserName != "" {
+			sender = protowire.AppendTag(sender, 1, protowire.BytesType)
+			sender = protowire.AppendString(sender, msg.Sender.UserName)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, sender)
+	}
+	if msg.Content != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, msg.Content)
+	}
+	if msg.Type != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(int64(msg.Type)))
+	}
+	if msg.To != "" {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendString(b, msg.To)
+	}
+	if msg.Room != "" {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendString(b, msg.Room)
+	}
+	if msg.ID != "" {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendString(b, msg.ID)
+	}
+	if msg.Time != 0 {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(msg.Time))
+	}
+	return b, nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, msg *common.Message) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			msg.Sender = &common.Client{}
+			return n, consumeFields(v, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+				if num == 1 && typ == protowire.BytesType {
+					s, n := protowire.ConsumeString(b)
+					msg.Sender.UserName = s
+					return n, nil
+				}
+				return protowire.ConsumeFieldValue(num, typ, b), nil
+			})
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			msg.Content = v
+			return n, nil
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			msg.Type = int(int64(v))
+			return n, nil
+		case num == 4 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			msg.To = v
+			return n, nil
+		case num == 5 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			msg.Room = v
+			return n, nil
+		case num == 6 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			msg.ID = v
+			return n, nil
+		case num == 7 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			msg.Time = int64(v)
+			return n, nil
+		}
+		//未知字段直接跳过，保证新旧版本兼容
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// consumeFields 依次解析每个字段，field返回该字段值占用的字节数
+func consumeFields(b []byte, field func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
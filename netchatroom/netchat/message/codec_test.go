@@ -0,0 +1,179 @@
+package message
+
+import (
+	"errors"
+	"netchatroom/netchat/common"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// sampleMsgs 覆盖空消息、缺省字段和所有字段都有值的情况
+func sampleMsgs() []*common.Message {
+	return []*common.Message{
+		{},
+		{Content: "只有内容"},
+		{Sender: &common.Client{}, Type: PublicMsg},
+		{Sender: &common.Client{UserName: "alice"}, Content: "你好", Type: PrivateMsg, To: "bob"},
+		{
+			Sender:  &common.Client{UserName: "alice"},
+			Content: "hello",
+			Type:    PublicMsg,
+			Room:    "golang",
+			ID:      "1700000000000-0",
+			Time:    1700000000000,
+		},
+		//负数类型按int64编码，解码后保持不变
+		{Content: "x", Type: -1, Time: -5},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, name := range CodecNames {
+		codec, err := CodecByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codec.Name() != name {
+			t.Fatalf("%s: Name = %q", name, codec.Name())
+		}
+		for _, want := range sampleMsgs() {
+			data, err := codec.Marshal(want)
+			if err != nil {
+				t.Fatalf("%s: Marshal %+v: %v", name, want, err)
+			}
+			got := &common.Message{}
+			if err = codec.Unmarshal(data, got); err != nil {
+				t.Fatalf("%s: Unmarshal %+v: %v", name, want, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: got %+v (sender %+v), want %+v (sender %+v)", name, got, got.Sender, want, want.Sender)
+			}
+		}
+	}
+}
+
+func TestCodecByNameUnknown(t *testing.T) {
+	if _, err := CodecByName("xml"); !errors.Is(err, ErrUnknownCodec) {
+		t.Fatalf("err = %v, want ErrUnknownCodec", err)
+	}
+}
+
+func TestProtobufWireFormat(t *testing.T) {
+	msg := &common.Message{Sender: &common.Client{UserName: "alice"}, Content: "hi", Type: PublicMsg, ID: "1-0", Time: 42}
+	data, err := Protobuf.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//按schema手工拼出同样的字节
+	var sender, want []byte
+	sender = protowire.AppendTag(sender, 1, protowire.BytesType)
+	sender = protowire.AppendString(sender, "alice")
+	want = protowire.AppendTag(want, 1, protowire.BytesType)
+	want = protowire.AppendBytes(want, sender)
+	want = protowire.AppendTag(want, 2, protowire.BytesType)
+	want = protowire.AppendString(want, "hi")
+	want = protowire.AppendTag(want, 3, protowire.VarintType)
+	want = protowire.AppendVarint(want, uint64(PublicMsg))
+	want = protowire.AppendTag(want, 6, protowire.BytesType)
+	want = protowire.AppendString(want, "1-0")
+	want = protowire.AppendTag(want, 7, protowire.VarintType)
+	want = protowire.AppendVarint(want, 42)
+	if !reflect.DeepEqual(data, want) {
+		t.Fatalf("Marshal = %x, want %x", data, want)
+	}
+}
+
+func TestProtobufSkipsUnknownFields(t *testing.T) {
+	data, err := Protobuf.Marshal(&common.Message{Sender: &common.Client{UserName: "alice"}, Content: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//新版本可能增加的各类字段，包括发送者内部的字段
+	var sender []byte
+	sender = protowire.AppendTag(sender, 1, protowire.BytesType)
+	sender = protowire.AppendString(sender, "bob")
+	sender = protowire.AppendTag(sender, 9, protowire.VarintType)
+	sender = protowire.AppendVarint(sender, 1)
+	data = protowire.AppendTag(data, 20, protowire.BytesType)
+	data = protowire.AppendString(data, "future")
+	data = protowire.AppendTag(data, 21, protowire.Fixed64Type)
+	data = protowire.AppendFixed64(data, 7)
+	data = protowire.AppendTag(data, 22, protowire.Fixed32Type)
+	data = protowire.AppendFixed32(data, 7)
+	//重复出现的字段以最后一次为准
+	data = protowire.AppendTag(data, 1, protowire.BytesType)
+	data = protowire.AppendBytes(data, sender)
+
+	got := &common.Message{}
+	if err = Protobuf.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != "hi" || got.Sender == nil || got.Sender.UserName != "bob" {
+		t.Fatalf("got %+v (sender %+v)", got, got.Sender)
+	}
+}
+
+func TestProtobufRejectsTruncated(t *testing.T) {
+	data, err := Protobuf.Marshal(&common.Message{Sender: &common.Client{UserName: "alice"}, Content: "hello", Time: 1700000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//字段边界处截断仍是合法消息，字段中间截断应报错而不是panic或静默成功
+	boundaries := map[int]bool{9: true, 16: true}
+	for i := 1; i < len(data); i++ {
+		err = Protobuf.Unmarshal(data[:i], &common.Message{})
+		if boundaries[i] != (err == nil) {
+			t.Fatalf("Unmarshal of %d/%d bytes: err = %v", i, len(data), err)
+		}
+	}
+}
+
+func TestStoredRoundTrip(t *testing.T) {
+	want := &common.Message{Sender: &common.Client{UserName: "alice"}, Content: "hello", Type: PublicMsg, Room: "golang"}
+	for _, name := range CodecNames {
+		codec, _ := CodecByName(name)
+		data, tag, err := EncodeStored(&Conn{Codec: codec}, want)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if tag != name {
+			t.Fatalf("tag = %q, want %q", tag, name)
+		}
+		got, err := DecodeStored(tag, data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+
+	//没有协商编解码器的连接按JSON存储
+	_, tag, err := EncodeStored(&Conn{}, want)
+	if err != nil || tag != CodecJSON {
+		t.Fatalf("default tag = %q, %v", tag, err)
+	}
+}
+
+func TestDecodeStoredLegacyEntry(t *testing.T) {
+	//增加codec标记、ID和Time之前写入流的条目
+	legacy := `{"Sender":{"UserName":"alice"},"Content":"老消息","Type":3,"To":"","Room":""}`
+	got, err := DecodeStored("", legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &common.Message{Sender: &common.Client{UserName: "alice"}, Content: "老消息", Type: 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	if _, err = DecodeStored("xml", legacy); !errors.Is(err, ErrUnknownCodec) {
+		t.Fatalf("unknown codec err = %v", err)
+	}
+	//标记和数据不匹配时报错
+	if _, err = DecodeStored(CodecJSON, "\x0a\x00"); err == nil {
+		t.Fatal("DecodeStored of protobuf data as json succeeded")
+	}
+}
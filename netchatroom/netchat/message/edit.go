@@ -0,0 +1,37 @@
+package message
+
+import (
+	"strconv"
+	"strings"
+)
+
+// EditedMark 历史消息中被编辑过的标记
+const EditedMark = "(已编辑)"
+
+// DeletedText 被删除的消息在历史中显示的内容
+const DeletedText = "[该消息已删除]"
+
+// MsgUpdate 房间消息被编辑或删除后广播的更新事件，同时作为消息的最新版本保存
+type MsgUpdate struct {
+	ID      string
+	Room    string
+	Author  string
+	Editor  string // 执行编辑或删除的用户，管理员操作他人消息时与Author不同
+	Content string `json:",omitempty"` // 编辑后的内容
+	Deleted bool   `json:",omitempty"`
+	Time    int64  // 编辑或删除的时间，毫秒时间戳
+}
+
+// IsMsgID 判断是否为房间流的消息ID，格式为"毫秒时间戳-序号"
+func IsMsgID(s string) bool {
+	ms, seq, ok := strings.Cut(s, "-")
+	if !ok {
+		return false
+	}
+	_, err := strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return false
+	}
+	_, err = strconv.ParseUint(seq, 10, 64)
+	return err == nil
+}
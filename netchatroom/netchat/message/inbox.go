@@ -0,0 +1,32 @@
+package message
+
+// UnreadCount 来自某个用户的未读私聊数
+type UnreadCount struct {
+	From  string
+	Count int
+}
+
+// UnreadMessage 一条未读私聊，ID为收件箱中的消息ID
+type UnreadMessage struct {
+	ID      string
+	From    string
+	Content string
+}
+
+// UnreadResponse 拉取未读私聊的回复，按时间正序，More表示还有更多未读没有返回
+type UnreadResponse struct {
+	Messages []UnreadMessage
+	More     bool `json:",omitempty"`
+}
+
+// ReadRequest 已读回执，把与Peer的会话标记为已读到ID，ID为空时标记到最新一条
+type ReadRequest struct {
+	Peer string
+	ID   string `json:",omitempty"`
+}
+
+// ReadNotice 通知发送者对方已读了Count条私聊
+type ReadNotice struct {
+	Reader string
+	Count  int
+}
@@ -3,9 +3,8 @@ package message
 import (
 	"encoding/json"
 	"fmt"
-	"net"
 	"netchatroom/netchat/common"
-	"netchatroom/netchat/utils"
+	"time"
 )
 
 const (
@@ -20,8 +19,39 @@ const (
 	HeartMsg
 	PublicHistory
 	PrivateHistory
+	Resume
+	CreateRoom
+	JoinRoom
+	LeaveRoom
+	ListRooms
+	Moderate
+	Kicked
+	Shutdown
+	FetchUnread
+	ReadReceipt
+	SetStatus
+	Whois
+	EditMsg
+	DeleteMsg
 )
 
+// EphemeralBase 临时事件的编号从这里开始，临时事件不进消息流也不保存，服务端收到后直接转发给在线用户
+const EphemeralBase = 1000
+
+const (
+	Typing = EphemeralBase + iota // 正在输入，Room为输入所在的房间，To非空时为私聊对象
+)
+
+const (
+	TypingInterval = 3 * time.Second // 客户端持续输入时建议的发送间隔，也是服务端typing_interval的默认值
+	TypingTTL      = 6 * time.Second // 客户端超过这个时间没有收到新的输入事件就不再显示
+)
+
+// IsEphemeral 判断消息类型是否为临时事件
+func IsEphemeral(typ int) bool {
+	return typ >= EphemeralBase
+}
+
 func MsgToJson(message *common.Message) (string, error) {
 	msg, err := json.Marshal(message)
 	if err != nil {
@@ -39,27 +69,21 @@ func JsonToMsg(msg string) (*common.Message, error) {
 	return message, nil
 }
 
-func SendMsg(conn net.Conn, message *common.Message) error {
-	msg, err := MsgToJson(message)
-	if err != nil {
-		return fmt.Errorf("MsgToJson failed,err:%w", err)
-	}
-	err = utils.WriteData(conn, msg)
-	if err != nil {
-		return fmt.Errorf("WriteData failed,err:%w", err)
-	}
-	return nil
+// SendMsg 用连接协商出的编解码器发送消息
+func SendMsg(conn common.Conn, message *common.Message) error {
+	return conn.WriteMsg(message)
 }
 
-func ReciveMsg(conn net.Conn) (*common.Message, error) {
-	msg, err := utils.ReadData(conn)
-	if err != nil {
-		return nil, fmt.Errorf("ReadData failed ,err:%w", err)
-	}
-	message, err := JsonToMsg(msg)
+// ReciveMsg 用连接协商出的编解码器接收消息
+func ReciveMsg(conn common.Conn) (*common.Message, error) {
+	return conn.ReadMsg()
+}
+
+// ValidateRoomName 校验房间名，规则与用户名相同
+func ValidateRoomName(room string) error {
+	err := ValidateUsername(room)
 	if err != nil {
-		return nil, fmt.Errorf("JsonToMsg failed ,err:%w", err)
+		return fmt.Errorf("invalid room name %q", room)
 	}
-	return message, nil
-
+	return nil
 }
@@ -0,0 +1,28 @@
+package message
+
+// 管理操作
+const (
+	ActionKick   = "kick"
+	ActionMute   = "mute"
+	ActionUnmute = "unmute"
+	ActionBan    = "ban"
+	ActionUnban  = "unban"
+	ActionRole   = "role"
+	ActionFlag   = "flag"
+	ActionInvite = "invite"
+)
+
+// 房间权限标志的名称
+const (
+	FlagInviteOnly = "invite"
+	FlagReadOnly   = "readonly"
+	FlagSlowMode   = "slow"
+)
+
+// ModerateRequest 管理请求，作用于消息的Room，Arg的含义由Action决定：
+// mute为禁言分钟数，role为角色名，flag为"标志名 值"
+type ModerateRequest struct {
+	Action string
+	Target string `json:",omitempty"`
+	Arg    string `json:",omitempty"`
+}
@@ -0,0 +1,44 @@
+package message
+
+import "unicode/utf8"
+
+// 用户可以设置的在线状态
+const (
+	StatusOnline    = "online"
+	StatusAway      = "away"
+	StatusBusy      = "busy"
+	StatusInvisible = "invisible" // 对其他用户显示为离线
+)
+
+// StatusTextMaxLen 状态说明的最大字数
+const StatusTextMaxLen = 30
+
+// statusTexts 在线状态对应的中文名称
+var statusTexts = map[string]string{
+	StatusOnline:    "在线",
+	StatusAway:      "离开",
+	StatusBusy:      "忙碌",
+	StatusInvisible: "隐身",
+}
+
+// StatusRequest 设置在线状态，Text为可选的状态说明
+type StatusRequest struct {
+	Status string
+	Text   string `json:",omitempty"`
+}
+
+// ValidateStatus 校验状态和状态说明
+func ValidateStatus(req *StatusRequest) bool {
+	if _, ok := statusTexts[req.Status]; !ok {
+		return false
+	}
+	return utf8.RuneCountInString(req.Text) <= StatusTextMaxLen
+}
+
+// StatusText 返回在线状态的中文名称，未知状态原样返回
+func StatusText(status string) string {
+	if text, ok := statusTexts[status]; ok {
+		return text
+	}
+	return status
+}
@@ -0,0 +1,85 @@
+package message
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"netchatroom/netchat/common"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSConn WebSocket连接，每个文本帧或二进制帧是一条消息。
+// 文本帧总是JSON，二进制帧使用建立连接时通过子协议协商出的编解码器
+type WSConn struct {
+	ws    *websocket.Conn
+	Codec Codec
+	mu    sync.Mutex // 同一时刻只能有一个协程写WebSocket连接，服务端的发送队列已经保证了这一点，客户端直接使用时仍需要
+}
+
+// NewWSConn 包装已经完成升级的WebSocket连接，codec为nil时使用JSON
+func NewWSConn(ws *websocket.Conn, codec Codec) *WSConn {
+	if codec == nil {
+		codec = JSON
+	}
+	return &WSConn{ws: ws, Codec: codec}
+}
+
+// ReadMsg 读取一帧并解码
+func (c *WSConn) ReadMsg() (*common.Message, error) {
+	typ, data, err := c.ws.ReadMessage()
+	//浏览器正常关闭按连接断开处理，与TCP的EOF一致
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+		err = io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ReadMessage failed ,err:%w", err)
+	}
+	codec := c.Codec
+	if typ == websocket.TextMessage {
+		codec = JSON
+	}
+	message := &common.Message{}
+	err = codec.Unmarshal(data, message)
+	if err != nil {
+		return nil, fmt.Errorf("%s Unmarshal failed ,err:%w", codec.Name(), err)
+	}
+	return message, nil
+}
+
+// WriteMsg 编码并写入一帧，JSON用文本帧，其他编解码器用二进制帧
+func (c *WSConn) WriteMsg(message *common.Message) error {
+	data, err := c.Codec.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("%s Marshal failed,err:%w", c.Codec.Name(), err)
+	}
+	typ := websocket.BinaryMessage
+	if c.Codec == JSON {
+		typ = websocket.TextMessage
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err = c.ws.WriteMessage(typ, data)
+	if err != nil {
+		return fmt.Errorf("WriteMessage failed,err:%w", err)
+	}
+	return nil
+}
+
+func (c *WSConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *WSConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *WSConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *WSConn) Close() error {
+	return c.ws.Close()
+}
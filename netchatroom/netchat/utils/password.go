@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordCost bcrypt的计算代价
+const PasswordCost = bcrypt.DefaultCost
+
+// HashPassword 生成带随机盐的bcrypt密码哈希，盐保存在哈希串中
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
+	if err != nil {
+		return "", fmt.Errorf("bcrypt.GenerateFromPassword failed,err:%w", err)
+	}
+	return string(hash), nil
+}
+
+// CheckPassword 以常量时间校验密码。
+// legacy为true表示库中存的是旧版本的明文密码，校验通过后应重新哈希保存
+func CheckPassword(stored string, password string) (ok bool, legacy bool) {
+	if IsPasswordHash(stored) {
+		err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+		return err == nil, false
+	}
+	ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	return ok, true
+}
+
+// IsPasswordHash 判断存储的密码是否已经是bcrypt哈希
+func IsPasswordHash(stored string) bool {
+	return len(stored) == 60 && (strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$"))
+}
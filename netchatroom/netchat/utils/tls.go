@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 开发证书的文件名
+const (
+	CACertFile     = "ca.pem"
+	CAKeyFile      = "ca-key.pem"
+	ServerCertFile = "server.pem"
+	ServerKeyFile  = "server-key.pem"
+	ClientCertFile = "client.pem"
+	ClientKeyFile  = "client-key.pem"
+)
+
+// ServerTLS 加载服务端证书，clientCA非空时要求并校验客户端证书（mTLS）
+func ServerTLS(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("LoadX509KeyPair failed,err:%w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		pool, err := loadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientTLS 客户端TLS配置，caFile为空时使用系统根证书，certFile和keyFile用于mTLS
+func ClientTLS(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("LoadX509KeyPair failed,err:%w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// loadCertPool 读取PEM格式的CA证书
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile failed,err:%w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// GenerateDevCerts 在dir下生成自签名CA以及由它签发的服务端和客户端证书，只用于开发和测试，
+// hosts为服务端证书中的域名或IP
+func GenerateDevCerts(dir string, hosts []string, validFor time.Duration) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("MkdirAll failed,err:%w", err)
+	}
+	//允许一小时的时钟偏差
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := time.Now().Add(validFor)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("GenerateKey failed,err:%w", err)
+	}
+	caTmpl := &x509.Certificate{
+		Subject:               pkix.Name{Organization: []string{"netchat dev"}, CommonName: "netchat dev CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := issue(caTmpl, caTmpl, caKey, caKey, dir, CACertFile, CAKeyFile)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return fmt.Errorf("ParseCertificate failed,err:%w", err)
+	}
+
+	serverTmpl := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"netchat dev"}, CommonName: "netchat server"},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			serverTmpl.IPAddresses = append(serverTmpl.IPAddresses, ip)
+		} else {
+			serverTmpl.DNSNames = append(serverTmpl.DNSNames, h)
+		}
+	}
+	err = issueWithNewKey(serverTmpl, caCert, caKey, dir, ServerCertFile, ServerKeyFile)
+	if err != nil {
+		return err
+	}
+
+	clientTmpl := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"netchat dev"}, CommonName: "netchat client"},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	return issueWithNewKey(clientTmpl, caCert, caKey, dir, ClientCertFile, ClientKeyFile)
+}
+
+// issueWithNewKey 生成新密钥并用CA签发证书
+func issueWithNewKey(tmpl, ca *x509.Certificate, caKey *ecdsa.PrivateKey, dir, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("GenerateKey failed,err:%w", err)
+	}
+	_, err = issue(tmpl, ca, key, caKey, dir, certFile, keyFile)
+	return err
+}
+
+// issue 签发证书并把证书和私钥写成PEM文件，私钥文件只有所有者可读
+func issue(tmpl, parent *x509.Certificate, key, signer *ecdsa.PrivateKey, dir, certFile, keyFile string) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("rand.Int failed,err:%w", err)
+	}
+	tmpl.SerialNumber = serial
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("CreateCertificate failed,err:%w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("MarshalECPrivateKey failed,err:%w", err)
+	}
+	err = writePEM(filepath.Join(dir, certFile), "CERTIFICATE", der, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = writePEM(filepath.Join(dir, keyFile), "EC PRIVATE KEY", keyDER, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return der, nil
+}
+
+// writePEM 写PEM文件
+func writePEM(path, typ string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	err := os.WriteFile(path, data, perm)
+	if err != nil {
+		return fmt.Errorf("WriteFile failed,err:%w", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDevCertsMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	if err := GenerateDevCerts(dir, []string{"localhost", "127.0.0.1"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	serverCfg, err := ServerTLS(path(ServerCertFile), path(ServerKeyFile), path(CACertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	withCert, err := ClientTLS(path(CACertFile), path(ClientCertFile), path(ClientKeyFile), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", listen.Addr().String(), withCert)
+	if err != nil {
+		t.Fatalf("mTLS dial failed,err:%v", err)
+	}
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+	_ = conn.Close()
+
+	//没有客户端证书时握手失败，TLS1.3下错误在第一次读时才返回
+	noCert, err := ClientTLS(path(CACertFile), "", "", "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", listen.Addr().String(), noCert)
+	if err == nil {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(buf)
+		_ = conn.Close()
+	}
+	if err == nil {
+		t.Fatal("connection without client certificate was accepted")
+	}
+}
@@ -1,12 +1,146 @@
 package utils
 
 import (
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"slices"
+	"sync/atomic"
 )
 
+// 帧头格式（共9字节，大端序）:
+//
+//	| magic(2) | version(1) | type(1) | flags(1) | length(4) | payload(length) |
+const (
+	Magic      uint16 = 0x4E43 // "NC"
+	Version    uint8  = 1      // 当前协议版本
+	MinVersion uint8  = 1      // 能兼容的最低协议版本
+	HeaderSize        = 9
+
+	DefaultMaxFrameSize uint32 = 1 << 20 // 默认单帧最大1MB
+)
+
+// 帧类型
+const (
+	FrameData      uint8 = iota + 1 // 普通数据帧，载荷为编码后的消息
+	FrameHandshake                  // 握手帧，登录前协商协议版本和编解码器
+)
+
+// 帧标志位
+const (
+	FlagCompressed  uint8 = 1 << iota // 载荷经过deflate压缩
+	FlagEncrypted                     // 载荷已加密，由上层负责解密
+	FlagAckRequired                   // 对端需要回复确认
+)
+
+var (
+	ErrBadMagic           = errors.New("bad frame magic")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrFrameTooLarge      = errors.New("frame too large")
+	ErrUnexpectedFrame    = errors.New("unexpected frame type")
+	ErrUnsupportedCodec   = errors.New("no common codec")
+	ErrHandshakeFailed    = errors.New("handshake failed")
+)
+
+// maxFrameSize ReadFrame在分配内存前检查的帧长度上限，0表示默认值，由服务端和客户端启动时按配置设置
+var maxFrameSize atomic.Uint32
+
+// SetMaxFrameSize 设置单帧最大长度，0表示恢复默认值
+func SetMaxFrameSize(n uint32) {
+	maxFrameSize.Store(n)
+}
+
+// MaxFrameSize 返回当前单帧最大长度
+func MaxFrameSize() uint32 {
+	if n := maxFrameSize.Load(); n != 0 {
+		return n
+	}
+	return DefaultMaxFrameSize
+}
+
+// Frame 一个完整的协议帧
+type Frame struct {
+	Version uint8
+	Type    uint8
+	Flags   uint8
+	Payload []byte
+}
+
+// ReadFrame 读取并校验一个帧，长度超限时不会分配内存
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var header [HeaderSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(header[0:2]) != Magic {
+		return nil, ErrBadMagic
+	}
+	f := &Frame{
+		Version: header[2],
+		Type:    header[3],
+		Flags:   header[4],
+	}
+	if f.Version < MinVersion || f.Version > Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, f.Version)
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if limit := MaxFrameSize(); length > limit {
+		return nil, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, length, limit)
+	}
+
+	f.Payload = make([]byte, length)
+	_, err = io.ReadFull(r, f.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFrame io.ReadFull failed,err:%w", err)
+	}
+	if f.Flags&FlagCompressed != 0 {
+		f.Payload, err = inflate(f.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("ReadFrame inflate failed,err:%w", err)
+		}
+		f.Flags &^= FlagCompressed
+	}
+	return f, nil
+}
+
+// WriteFrame 写出一个帧，帧头和载荷合并为一次Write
+func WriteFrame(w io.Writer, f *Frame) error {
+	payload := f.Payload
+	if f.Flags&FlagCompressed != 0 {
+		var err error
+		payload, err = deflate(payload)
+		if err != nil {
+			return fmt.Errorf("WriteFrame deflate failed,err:%w", err)
+		}
+	}
+	if limit := MaxFrameSize(); uint64(len(payload)) > uint64(limit) {
+		return fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, len(payload), limit)
+	}
+	version := f.Version
+	if version == 0 {
+		version = Version
+	}
+
+	buf := make([]byte, HeaderSize+len(payload))
+	binary.BigEndian.PutUint16(buf[0:2], Magic)
+	buf[2] = version
+	buf[3] = f.Type
+	buf[4] = f.Flags
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(payload)))
+	copy(buf[HeaderSize:], payload)
+	_, err := w.Write(buf)
+	if err != nil {
+		return fmt.Errorf("WriteFrame Write failed,err:%w", err)
+	}
+	return nil
+}
+
 // 客户端和服务端之间的数据读取
 func ReadData(conn net.Conn) (string, error) {
 	////设置读超时（每次读前重置）
@@ -15,25 +149,19 @@ func ReadData(conn net.Conn) (string, error) {
 	//	return "", err
 	//}
 
-	var length uint32
-	//读取消息长度
-	err := binary.Read(conn, binary.BigEndian, &length)
-	if err != nil {
-		return "", err
-	}
-
-	message := make([]byte, length)
-	_, err = io.ReadFull(conn, message)
+	f, err := ReadFrame(conn)
 	if err != nil {
 		////net.Timeout()返回一个bool值，其判断该错误是否为超时错误
 		////将错误类型断言为net.Error调用其下的net.Timeout函数
 		//if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 		//	return "", errors.New("读数据超时")
 		//}
-		return "", fmt.Errorf("ReadData io.ReadFull failed,err:%w", err)
+		return "", err
+	}
+	if f.Type != FrameData {
+		return "", fmt.Errorf("%w: %d", ErrUnexpectedFrame, f.Type)
 	}
-	//fmt.Println("读到了", message)
-	return string(message), nil
+	return string(f.Payload), nil
 }
 
 func WriteData(conn net.Conn, message string) error {
@@ -41,21 +169,152 @@ func WriteData(conn net.Conn, message string) error {
 	//if err != nil {
 	//	return err
 	//}
-	//设置读取消息的长度
-	length := uint32(len(message))
-
-	//以二进制形式将长度写入conn
-	err := binary.Write(conn, binary.BigEndian, length)
-	if err != nil {
-		return fmt.Errorf("WriteData binary.Write failed,err:%w", err)
-	}
-
-	_, err = conn.Write([]byte(message))
+	err := WriteFrame(conn, &Frame{
+		Type:    FrameData,
+		Payload: []byte(message),
+	})
 	if err != nil {
 		//if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 		//	return errors.New("写数据超时")
 		//}
-		return fmt.Errorf("WriteData Write failed,err:%w", err)
+		return fmt.Errorf("WriteData failed,err:%w", err)
 	}
 	return nil
 }
+
+// Hello 握手帧的载荷，双方各自声明支持的协议版本区间和编解码器
+type Hello struct {
+	MinVersion uint8
+	MaxVersion uint8
+	Codecs     []string `json:",omitempty"` // 客户端按优先级列出的编解码器
+	Version    uint8    `json:",omitempty"` // 服务端选定的版本
+	Codec      string   `json:",omitempty"` // 服务端选定的编解码器
+	Error      string   `json:",omitempty"` // 协商失败的原因
+}
+
+// ClientHandshake 客户端发送握手帧并等待服务端选定版本和编解码器
+func ClientHandshake(conn net.Conn, codecs []string) (*Hello, error) {
+	hello, err := json.Marshal(&Hello{MinVersion: MinVersion, MaxVersion: Version, Codecs: codecs})
+	if err != nil {
+		return nil, fmt.Errorf("ClientHandshake Marshal failed,err:%w", err)
+	}
+	err = WriteFrame(conn, &Frame{Version: MinVersion, Type: FrameHandshake, Payload: hello})
+	if err != nil {
+		return nil, fmt.Errorf("ClientHandshake WriteFrame failed,err:%w", err)
+	}
+	f, err := ReadFrame(conn)
+	if err != nil {
+		return nil, fmt.Errorf("ClientHandshake ReadFrame failed,err:%w", err)
+	}
+	if f.Type != FrameHandshake {
+		return nil, fmt.Errorf("%w: %d", ErrUnexpectedFrame, f.Type)
+	}
+	reply := &Hello{}
+	err = json.Unmarshal(f.Payload, reply)
+	if err != nil {
+		return nil, fmt.Errorf("ClientHandshake Unmarshal failed,err:%w", err)
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("%w: %s", ErrHandshakeFailed, reply.Error)
+	}
+	return reply, nil
+}
+
+// ServerHandshake 服务端读取客户端的握手帧，选出双方都支持的最高版本和
+// 客户端最优先的编解码器并回复。supported为服务端支持的编解码器
+func ServerHandshake(conn net.Conn, supported []string) (*Hello, error) {
+	f, err := ReadFrame(conn)
+	if err != nil {
+		return nil, fmt.Errorf("ServerHandshake ReadFrame failed,err:%w", err)
+	}
+	if f.Type != FrameHandshake {
+		return nil, fmt.Errorf("%w: %d", ErrUnexpectedFrame, f.Type)
+	}
+	hello := &Hello{}
+	err = json.Unmarshal(f.Payload, hello)
+	if err != nil {
+		return nil, fmt.Errorf("ServerHandshake Unmarshal failed,err:%w", err)
+	}
+
+	reply := &Hello{MinVersion: MinVersion, MaxVersion: Version}
+	reply.Version, err = NegotiateVersion(hello.MinVersion, hello.MaxVersion)
+	if err == nil {
+		reply.Codec, err = negotiateCodec(hello.Codecs, supported)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	data, er := json.Marshal(reply)
+	if er != nil {
+		return nil, fmt.Errorf("ServerHandshake Marshal failed,err:%w", er)
+	}
+	er = WriteFrame(conn, &Frame{Version: MinVersion, Type: FrameHandshake, Payload: data})
+	if er != nil {
+		return nil, fmt.Errorf("ServerHandshake WriteFrame failed,err:%w", er)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHandshakeFailed, err)
+	}
+	return reply, nil
+}
+
+// NegotiateVersion 在对端版本区间[min,max]与本端区间的交集中选择最高版本
+func NegotiateVersion(min, max uint8) (uint8, error) {
+	if max > Version {
+		max = Version
+	}
+	if min < MinVersion {
+		min = MinVersion
+	}
+	if min > max {
+		return 0, ErrUnsupportedVersion
+	}
+	return max, nil
+}
+
+// negotiateCodec 选出客户端列表中第一个服务端也支持的编解码器，
+// 客户端没有声明时返回空串，由上层使用默认编解码器
+func negotiateCodec(offered []string, supported []string) (string, error) {
+	if len(offered) == 0 {
+		return "", nil
+	}
+	for _, name := range offered {
+		if slices.Contains(supported, name) {
+			return name, nil
+		}
+	}
+	return "", ErrUnsupportedCodec
+}
+
+// inflate 解压载荷，解压后的长度同样受maxFrameSize限制
+func inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	limit := MaxFrameSize()
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(out)) > uint64(limit) {
+		return nil, ErrFrameTooLarge
+	}
+	return out, nil
+}
+
+// deflate 压缩载荷
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
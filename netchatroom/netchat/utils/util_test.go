@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// header 构造一个帧头
+func header(magic uint16, version uint8, typ uint8, flags uint8, length uint32) []byte {
+	buf := make([]byte, HeaderSize)
+	binary.BigEndian.PutUint16(buf[0:2], magic)
+	buf[2], buf[3], buf[4] = version, typ, flags
+	binary.BigEndian.PutUint32(buf[5:9], length)
+	return buf
+}
+
+// countingReader 记录被读取的字节数
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat("你好netchat", 200))
+	for _, flags := range []uint8{0, FlagCompressed} {
+		var buf bytes.Buffer
+		if err := WriteFrame(&buf, &Frame{Type: FrameData, Flags: flags, Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+		if flags&FlagCompressed != 0 && buf.Len() >= HeaderSize+len(payload) {
+			t.Fatalf("compressed frame is %d bytes, payload %d", buf.Len(), len(payload))
+		}
+		f, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("flags %d: %v", flags, err)
+		}
+		//版本为0时写入当前版本，读出后压缩标志被清除
+		if f.Version != Version || f.Type != FrameData || f.Flags != 0 || !bytes.Equal(f.Payload, payload) {
+			t.Fatalf("flags %d: frame = %+v", flags, f)
+		}
+	}
+}
+
+func TestReadFrameRejectsBadHeader(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"magic", header(0x1234, Version, FrameData, 0, 0), ErrBadMagic},
+		{"old version", header(Magic, MinVersion-1, FrameData, 0, 0), ErrUnsupportedVersion},
+		{"new version", header(Magic, Version+1, FrameData, 0, 0), ErrUnsupportedVersion},
+	} {
+		if _, err := ReadFrame(bytes.NewReader(c.data)); !errors.Is(err, c.want) {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	//长度超限时只读帧头，不分配内存也不继续读载荷
+	r := &countingReader{r: bytes.NewReader(append(header(Magic, Version, FrameData, 0, 1<<32-1), 'x'))}
+	if _, err := ReadFrame(r); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("err = %v, want ErrFrameTooLarge", err)
+	}
+	if r.n != HeaderSize {
+		t.Fatalf("read %d bytes, want only the %d byte header", r.n, HeaderSize)
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		_, _ = ReadFrame(bytes.NewReader(header(Magic, Version, FrameData, 0, 1<<31)))
+	})
+	if allocs > 10 {
+		t.Fatalf("allocs = %v", allocs)
+	}
+}
+
+func TestSetMaxFrameSize(t *testing.T) {
+	t.Cleanup(func() { SetMaxFrameSize(0) })
+	SetMaxFrameSize(16)
+	if MaxFrameSize() != 16 {
+		t.Fatalf("MaxFrameSize = %d", MaxFrameSize())
+	}
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, &Frame{Type: FrameData, Payload: make([]byte, 17)}); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("write err = %v, want ErrFrameTooLarge", err)
+	}
+	if _, err := ReadFrame(bytes.NewReader(header(Magic, Version, FrameData, 0, 17))); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("read err = %v, want ErrFrameTooLarge", err)
+	}
+
+	//压缩后很小的帧解压后同样受限制
+	SetMaxFrameSize(0)
+	buf.Reset()
+	if err := WriteFrame(&buf, &Frame{Type: FrameData, Flags: FlagCompressed, Payload: make([]byte, 1024)}); err != nil {
+		t.Fatal(err)
+	}
+	SetMaxFrameSize(512)
+	if _, err := ReadFrame(&buf); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("inflated err = %v, want ErrFrameTooLarge", err)
+	}
+
+	SetMaxFrameSize(0)
+	if MaxFrameSize() != DefaultMaxFrameSize {
+		t.Fatalf("MaxFrameSize after reset = %d", MaxFrameSize())
+	}
+}
+
+func TestReadDataRejectsHandshakeFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		_ = WriteFrame(client, &Frame{Type: FrameHandshake, Payload: []byte("{}")})
+		_ = WriteData(client, "hello")
+	}()
+	if _, err := ReadData(server); !errors.Is(err, ErrUnexpectedFrame) {
+		t.Fatalf("err = %v, want ErrUnexpectedFrame", err)
+	}
+	if data, err := ReadData(server); err != nil || data != "hello" {
+		t.Fatalf("ReadData = %q, %v", data, err)
+	}
+}
+
+// handshake 在内存连接上完成一次握手，返回双方的结果
+func handshake(t *testing.T, offered []string, supported []string) (*Hello, *Hello, error, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	type result struct {
+		hello *Hello
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		hello, err := ServerHandshake(server, supported)
+		done <- result{hello, err}
+	}()
+	hello, err := ClientHandshake(client, offered)
+	r := <-done
+	return hello, r.hello, err, r.err
+}
+
+func TestHandshake(t *testing.T) {
+	//选客户端最优先且服务端支持的编解码器
+	hello, reply, err, serverErr := handshake(t, []string{"protobuf", "msgpack", "json"}, []string{"json", "msgpack"})
+	if err != nil || serverErr != nil {
+		t.Fatalf("handshake err = %v, %v", err, serverErr)
+	}
+	if hello.Codec != "msgpack" || hello.Version != Version || reply.Codec != "msgpack" {
+		t.Fatalf("client = %+v, server = %+v", hello, reply)
+	}
+
+	//客户端没有声明时由上层使用默认编解码器
+	hello, _, err, _ = handshake(t, nil, []string{"json"})
+	if err != nil || hello.Codec != "" {
+		t.Fatalf("default codec = %+v, %v", hello, err)
+	}
+
+	//没有共同的编解码器时双方都失败，客户端能看到原因
+	_, _, err, serverErr = handshake(t, []string{"xml"}, []string{"json"})
+	if !errors.Is(err, ErrHandshakeFailed) || !strings.Contains(err.Error(), ErrUnsupportedCodec.Error()) {
+		t.Fatalf("client err = %v", err)
+	}
+	if !errors.Is(serverErr, ErrHandshakeFailed) {
+		t.Fatalf("server err = %v", serverErr)
+	}
+}
+
+func TestHandshakeVersionMismatch(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ServerHandshake(server, []string{"json"})
+		errc <- err
+	}()
+	//只支持更高版本的客户端
+	hello, _ := json.Marshal(&Hello{MinVersion: Version + 1, MaxVersion: Version + 2})
+	if err := WriteFrame(client, &Frame{Version: MinVersion, Type: FrameHandshake, Payload: hello}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ReadFrame(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := &Hello{}
+	if err = json.Unmarshal(f.Payload, reply); err != nil || reply.Error == "" {
+		t.Fatalf("reply = %+v, %v", reply, err)
+	}
+	if err = <-errc; !errors.Is(err, ErrHandshakeFailed) {
+		t.Fatalf("server err = %v", err)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	if v, err := NegotiateVersion(MinVersion, Version+5); err != nil || v != Version {
+		t.Fatalf("NegotiateVersion = %d, %v", v, err)
+	}
+	if _, err := NegotiateVersion(Version+1, Version+2); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("err = %v, want ErrUnsupportedVersion", err)
+	}
+}